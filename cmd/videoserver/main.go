@@ -0,0 +1,36 @@
+// Command videoserver runs the video streaming server configured from the
+// environment, the server itself is the server package
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/appu900/A_siimple_video_streaming_server/server"
+)
+
+func main() {
+	// "doctor" checks the setup and exits instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(server.RunDoctor(os.Stdout))
+	}
+
+	srv, err := server.New(server.Config{})
+	if err != nil {
+		log.Fatal("failed to set up server: ", err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		log.Fatal("failed to set up ingest: ", err)
+	}
+
+	listeners, err := server.ListenFromEnv()
+	if err != nil {
+		log.Fatal("failed to listen: ", err)
+	}
+	for _, listener := range listeners {
+		fmt.Printf("Starting Streaming server on %s\n", listener)
+	}
+	log.Fatal(srv.Serve(listeners))
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the audio of an abr package is one stream all the video renditions share
+const abrAudioName = "audio"
+
+// a stream of an abr package as the master playlist and the dash manifest
+// advertise it
+type abrStream struct {
+	name   string
+	codecs string
+	// peak and average bits per second of the segments
+	bandwidth, average int64
+	width, height      int
+	frameRate          float64
+	segments           []hlsSegment
+}
+
+// a segment of a media playlist
+type hlsSegment struct {
+	uri      string
+	duration float64
+}
+
+// packageABR will encode a video only stream of every target rendition and
+// one audio stream into tmp, with the master playlist as index.m3u8 and a
+// dash manifest of the same segments when they are fmp4 in the clear.
+// keyframes are forced on the segment boundaries so players can switch
+// between renditions at any segment
+func (sm *StreamManager) packageABR(ctx context.Context, video VideoRecord, profile TranscodeProfile, targets []Rendition, source, tmp string, mark *watermarkFilter, keyArgs []string) error {
+	keyframes := []string{"-force_key_frames", "expr:gte(t,n_forced*" + strconv.Itoa(profile.SegmentSeconds) + ")"}
+	fmp4 := profile.SegmentFormat != "ts"
+
+	var streams []abrStream
+	for _, rendition := range targets {
+		args := []string{"-i", source, "-map", "0:v:0", "-an"}
+		args = append(args, profile.encodeArgs(rendition, video, mark, true)...)
+		args = append(args, keyframes...)
+		// apple players only take hevc in fmp4 tagged like this
+		if rendition.VideoCodec == "hevc" && fmp4 {
+			args = append(args, "-tag:v", "hvc1")
+		}
+		if _, err := runFFmpeg(ctx, append(args, profile.hlsArgs(tmp, rendition.Name, rendition.Name+"_", keyArgs)...)); err != nil {
+			return fmt.Errorf("rendition %s: %w", rendition.Name, err)
+		}
+		stream, err := measureABRStream(tmp, rendition.Name)
+		if err != nil {
+			return err
+		}
+		stream.width, stream.height = scaledWidth(video, rendition.Height), rendition.Height
+		stream.frameRate = profile.outputFrameRate(video)
+		stream.codecs = videoCodecString(rendition.VideoCodec, stream.width, stream.height, stream.frameRate)
+		streams = append(streams, stream)
+	}
+
+	// the audio is encoded like the top rendition's, a silent video has none
+	top := targets[0]
+	for _, rendition := range targets[1:] {
+		if rendition.Height > top.Height {
+			top = rendition
+		}
+	}
+	var audio *abrStream
+	args := append([]string{"-i", source, "-map", "0:a:0", "-vn"}, top.audioArgs()...)
+	out, err := runFFmpeg(ctx, append(args, profile.hlsArgs(tmp, abrAudioName, abrAudioName+"_", keyArgs)...))
+	switch {
+	case err == nil:
+		stream, err := measureABRStream(tmp, abrAudioName)
+		if err != nil {
+			return err
+		}
+		stream.codecs = audioCodecStrings[top.AudioCodec]
+		audio = &stream
+	case !bytes.Contains(out, []byte("matches no streams")):
+		return fmt.Errorf("audio: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, "index.m3u8"), masterPlaylist(streams, audio), 0644); err != nil {
+		return err
+	}
+	if fmp4 && len(keyArgs) == 0 {
+		return os.WriteFile(filepath.Join(tmp, "manifest.mpd"), dashManifest(streams, audio), 0644)
+	}
+	return nil
+}
+
+// measureABRStream will read the segments of a stream's playlist and the
+// bitrate they come to, from their sizes on disk
+func measureABRStream(dir, name string) (abrStream, error) {
+	playlist, err := os.ReadFile(filepath.Join(dir, name+".m3u8"))
+	if err != nil {
+		return abrStream{}, err
+	}
+	stream := abrStream{name: name, segments: parseHLSSegments(playlist)}
+	if len(stream.segments) == 0 {
+		return abrStream{}, fmt.Errorf("%s has no segments", name)
+	}
+	var total int64
+	var seconds float64
+	for _, segment := range stream.segments {
+		info, err := os.Stat(filepath.Join(dir, segment.uri))
+		if err != nil {
+			return abrStream{}, err
+		}
+		total += info.Size()
+		seconds += segment.duration
+		if segment.duration > 0 {
+			stream.bandwidth = max(stream.bandwidth, int64(math.Ceil(float64(info.Size())*8/segment.duration)))
+		}
+	}
+	if seconds > 0 {
+		stream.average = int64(math.Ceil(float64(total) * 8 / seconds))
+	}
+	return stream, nil
+}
+
+// parseHLSSegments will read the segment uris and durations of a media playlist
+func parseHLSSegments(playlist []byte) []hlsSegment {
+	var segments []hlsSegment
+	duration := 0.0
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, _ = strconv.ParseFloat(value, 64)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			segments = append(segments, hlsSegment{uri: line, duration: duration})
+			duration = 0
+		}
+	}
+	return segments
+}
+
+// scaledWidth is the width ffmpeg's scale=-2:height gives source, rounded to
+// the nearest even width like it does. 0 when the source's size isn't known
+func scaledWidth(source VideoRecord, height int) int {
+	if source.Width <= 0 || source.Height <= 0 {
+		return 0
+	}
+	return int(math.Round(float64(height)*float64(source.Width)/float64(source.Height*2))) * 2
+}
+
+// outputFrameRate is the frame rate the profile encodes source at, 0 when
+// it isn't known
+func (p TranscodeProfile) outputFrameRate(source VideoRecord) float64 {
+	switch p.FrameRate {
+	case "":
+		return source.FrameRate
+	case "auto":
+		if rate, odd := nearestFrameRate(source.FrameRate); odd {
+			return parseFrameRate(rate)
+		}
+		return source.FrameRate
+	}
+	return parseFrameRate(p.FrameRate)
+}
+
+// a level of a video codec, the largest picture and the most luma samples a
+// second it allows
+type codecLevel struct {
+	id              string
+	picture, sample float64
+}
+
+// the levels of the codecs from the specs, lowest first. encoders pick the
+// lowest one a stream fits in, the codec strings say the same
+var codecLevels = map[string][]codecLevel{
+	// high profile like libx264's default, the level in hex
+	"h264": {{"1e", 414720, 10368000}, {"1f", 921600, 27648000}, {"20", 1310720, 55296000},
+		{"28", 2097152, 62914560}, {"2a", 2228224, 133693440}, {"32", 5652480, 150994944},
+		{"33", 9437184, 251658240}, {"34", 9437184, 530841600}, {"3c", 35651584, 1069547520},
+		{"3d", 35651584, 2139095040}, {"3e", 35651584, 4278190080}},
+	// level times 30
+	"hevc": {{"90", 552960, 16588800}, {"93", 983040, 33177600}, {"120", 2228224, 66846720},
+		{"123", 2228224, 133693440}, {"150", 8912896, 267386880}, {"153", 8912896, 534773760},
+		{"156", 8912896, 1069547520}, {"180", 35651584, 1069547520}, {"183", 35651584, 2139095040},
+		{"186", 35651584, 4278190080}},
+	// level times 10
+	"vp9": {{"30", 552960, 20736000}, {"31", 983040, 36864000}, {"40", 2228224, 83558400},
+		{"41", 2228224, 160432128}, {"50", 8912896, 311951360}, {"51", 8912896, 588251136},
+		{"52", 8912896, 1176502272}, {"60", 35651584, 1176502272}, {"61", 35651584, 2353004544},
+		{"62", 35651584, 4706009088}},
+	// seq_level_idx
+	"av1": {{"04", 665856, 19975680}, {"05", 1065024, 31950720}, {"08", 2359296, 70778880},
+		{"09", 2359296, 141557760}, {"12", 8912896, 267386880}, {"13", 8912896, 534773760},
+		{"14", 8912896, 1069547520}, {"15", 8912896, 1069547520}, {"16", 35651584, 1069547520},
+		{"17", 35651584, 2139095040}, {"18", 35651584, 4278190080}},
+}
+
+// videoCodecString will return the rfc 6381 codec string of a video stream
+// of codec, width by height at rate frames a second
+func videoCodecString(codec string, width, height int, rate float64) string {
+	if width <= 0 {
+		width = height * 16 / 9
+	}
+	if rate <= 0 {
+		rate = 30
+	}
+	// h264 counts whole macroblocks
+	if codec == "h264" {
+		width, height = (width+15)/16*16, (height+15)/16*16
+	}
+	picture := float64(width * height)
+	levels := codecLevels[codec]
+	level := levels[len(levels)-1].id
+	for _, candidate := range levels {
+		if picture <= candidate.picture && picture*rate <= candidate.sample {
+			level = candidate.id
+			break
+		}
+	}
+	switch codec {
+	case "hevc":
+		return "hvc1.1.6.L" + level + ".90"
+	case "vp9":
+		return "vp09.00." + level + ".08"
+	case "av1":
+		return "av01.0." + level + "M.08"
+	}
+	return "avc1.6400" + level
+}
+
+var audioCodecStrings = map[string]string{
+	"aac":  "mp4a.40.2",
+	"opus": "Opus",
+	"mp3":  "mp4a.40.34",
+}
+
+// masterPlaylist will list every rendition with what players need to pick
+// between them, the audio is a group they all play
+func masterPlaylist(streams []abrStream, audio *abrStream) []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if audio != nil {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"default\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s.m3u8\"\n", audio.name)
+	}
+	for _, stream := range streams {
+		bandwidth, average, codecs := stream.bandwidth, stream.average, stream.codecs
+		if audio != nil {
+			bandwidth, average, codecs = bandwidth+audio.bandwidth, average+audio.average, codecs+","+audio.codecs
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=\"%s\"", bandwidth, average, codecs)
+		if stream.width > 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", stream.width, stream.height)
+		}
+		if stream.frameRate > 0 {
+			fmt.Fprintf(&b, ",FRAME-RATE=%.3f", stream.frameRate)
+		}
+		if audio != nil {
+			b.WriteString(",AUDIO=\"audio\"")
+		}
+		fmt.Fprintf(&b, "\n%s.m3u8\n", stream.name)
+	}
+	return []byte(b.String())
+}
+
+// dashManifest will describe the same segments as a static mpd, a video
+// adaptation set of the renditions and an audio one
+func dashManifest(streams []abrStream, audio *abrStream) []byte {
+	duration := 0.0
+	for _, segment := range streams[0].segments {
+		duration += segment.duration
+	}
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-main:2011" type="static" mediaPresentationDuration="PT%.3fS" minBufferTime="PT%dS">`+"\n",
+		duration, int(math.Ceil(streams[0].segments[0].duration)))
+	b.WriteString(`<Period id="0" start="PT0S">` + "\n")
+	b.WriteString(`<AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">` + "\n")
+	for _, stream := range streams {
+		fmt.Fprintf(&b, `<Representation id="%s" bandwidth="%d" codecs="%s" height="%d"`, html.EscapeString(stream.name), stream.bandwidth, stream.codecs, stream.height)
+		if stream.width > 0 {
+			fmt.Fprintf(&b, ` width="%d"`, stream.width)
+		}
+		if stream.frameRate > 0 {
+			fmt.Fprintf(&b, ` frameRate="%s"`, dashFrameRate(stream.frameRate))
+		}
+		b.WriteString(">\n")
+		writeDASHSegments(&b, stream)
+		b.WriteString("</Representation>\n")
+	}
+	b.WriteString("</AdaptationSet>\n")
+	if audio != nil {
+		b.WriteString(`<AdaptationSet id="1" contentType="audio" mimeType="audio/mp4" lang="und" segmentAlignment="true" startWithSAP="1">` + "\n")
+		fmt.Fprintf(&b, `<Representation id="%s" bandwidth="%d" codecs="%s">`+"\n", audio.name, audio.bandwidth, html.EscapeString(audio.codecs))
+		writeDASHSegments(&b, *audio)
+		b.WriteString("</Representation>\n</AdaptationSet>\n")
+	}
+	b.WriteString("</Period>\n</MPD>\n")
+	return []byte(b.String())
+}
+
+// writeDASHSegments will write a representation's segment list, in
+// milliseconds from the durations of its hls playlist
+func writeDASHSegments(b *strings.Builder, stream abrStream) {
+	fmt.Fprintf(b, `<SegmentList timescale="1000"><Initialization sourceURL="%s_init.mp4"/>`+"\n<SegmentTimeline>", html.EscapeString(stream.name))
+	for _, segment := range stream.segments {
+		fmt.Fprintf(b, `<S d="%d"/>`, int64(math.Round(segment.duration*1000)))
+	}
+	b.WriteString("</SegmentTimeline>\n")
+	for _, segment := range stream.segments {
+		fmt.Fprintf(b, `<SegmentURL media="%s"/>`+"\n", html.EscapeString(segment.uri))
+	}
+	b.WriteString("</SegmentList>\n")
+}
+
+// dashFrameRate will write a rate like 29.97 as 30000/1001, the way the
+// standard rates are
+func dashFrameRate(rate float64) string {
+	for _, standard := range standardFrameRates {
+		if math.Abs(parseFrameRate(standard)-rate) < 0.001 {
+			return standard
+		}
+	}
+	return strconv.FormatFloat(rate, 'f', 3, 64)
+}
+
+var dashURLAttr = regexp.MustCompile(`(sourceURL|media)="([^"]*)"`)
+
+// handleDASHManifest will serve a video's dash manifest, packaging it on
+// the first request like the hls playlist. its segments are the hls ones,
+// with the same session token in their urls
+func (sm *StreamManager) handleDASHManifest(w http.ResponseWriter, r *http.Request) {
+	rawID := r.PathValue("id")
+	fileID := tenantFrom(r).VideoID(rawID)
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if !video.IsVideo() {
+		writeError(w, http.StatusNotFound, "only videos have dash")
+		return
+	}
+	if !sm.hasDASH(video) {
+		writeError(w, http.StatusNotFound, "video has no dash manifest, its profile doesn't make fmp4 abr packages")
+		return
+	}
+
+	ctx, cancel := renditionContext(r.Context())
+	defer cancel()
+	if err := sm.packageHLS(ctx, fileID, PriorityViewer); err != nil {
+		switch {
+		case stillProcessing(r, err):
+			writeProcessing(w, r)
+		case errors.Is(err, exec.ErrNotFound):
+			writeError(w, http.StatusServiceUnavailable, "dash packaging needs ffmpeg")
+		case r.Context().Err() != nil:
+		default:
+			log.Println("failed to package dash", fileID, err)
+			writeError(w, http.StatusInternalServerError, "failed to package dash")
+		}
+		return
+	}
+	manifest, err := sm.readHLSFile(fileID, "manifest.mpd")
+	if err != nil {
+		// a package made before the profile had abr
+		writeError(w, http.StatusNotFound, "video has no dash manifest yet")
+		return
+	}
+
+	query, err := sm.hlsQuery(r, rawID)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	suffix := ""
+	if encoded := query.Encode(); encoded != "" {
+		suffix = html.EscapeString("?" + encoded)
+	}
+	manifest = dashURLAttr.ReplaceAll(manifest, []byte(`${1}="${2}`+strings.ReplaceAll(suffix, "$", "$$")+`"`))
+	// the segments are served with the hls ones, the manifest is two
+	// levels down from the api root like the playlist
+	base := "<BaseURL>../../hls/" + html.EscapeString(url.PathEscape(rawID)) + "/</BaseURL>\n"
+	manifest = bytes.Replace(manifest, []byte("<Period "), []byte(base+"<Period "), 1)
+
+	sm.recordPlay(r, video.ID)
+	sm.demand.Record(fileID, "hls")
+	if len(query) > 0 {
+		setCachePolicy(w, r, CacheNoStore, "")
+	} else {
+		setCachePolicy(w, r, CacheManifest, "")
+	}
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Write(manifest)
+}
+
+// hasDASH reports whether a video's packages get a dash manifest
+func (sm *StreamManager) hasDASH(video VideoRecord) bool {
+	profile := sm.profileFor(video)
+	return profile.ABR && profile.SegmentFormat != "ts" && !HLSEncrypt
+}
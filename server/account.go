@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the signed in user of an account request
+type accountUser struct {
+	identity Identity
+	tenant   *Tenant
+}
+
+// key is how the user is stored, subjects are only unique within a tenant
+func (u accountUser) key() string {
+	return scopeID(u.tenant.ID, u.identity.Subject)
+}
+
+// currentUser will verify the request's token, account endpoints need one
+// with a subject since that is who the account belongs to. a token for one
+// video is a link to it, not the account. scope is what the endpoint needs
+// on top, "" for reading the account
+func (sm *StreamManager) currentUser(w http.ResponseWriter, r *http.Request, scope string) (accountUser, bool) {
+	identity, err := sm.tokens.Authenticate(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return accountUser{}, false
+	}
+	tenant := tenantFrom(r)
+	if identity.Subject == "" || identity.VideoID != "" || !inTenant(identity.Tenant, tenant.ID) {
+		writeError(w, http.StatusForbidden, "token does not belong to a user")
+		return accountUser{}, false
+	}
+	if scope != "" && !identity.HasScope(scope) {
+		writeError(w, http.StatusForbidden, "token lacks the "+scope+" scope")
+		return accountUser{}, false
+	}
+	return accountUser{identity: identity, tenant: tenant}, true
+}
+
+// ownedVideos will return the videos uploaded by the user
+func (sm *StreamManager) ownedVideos(user accountUser) []VideoRecord {
+	owned := []VideoRecord{}
+	for _, video := range sm.metadata.ListVideos(user.tenant.ID) {
+		if video.Owner == user.identity.Subject {
+			owned = append(owned, video)
+		}
+	}
+	return owned
+}
+
+// handleAccount will describe the signed in user and their storage usage
+func (sm *StreamManager) handleAccount(w http.ResponseWriter, r *http.Request) {
+	user, ok := sm.currentUser(w, r, "")
+	if !ok {
+		return
+	}
+
+	videos := sm.ownedVideos(user)
+	var bytes int64
+	for _, video := range videos {
+		bytes += video.Size
+	}
+	account := map[string]interface{}{
+		"sub":      user.identity.Subject,
+		"tenant":   user.tenant.ID,
+		"scope":    strings.Join(user.identity.Scopes, " "),
+		"provider": user.identity.Provider,
+		"usage": map[string]interface{}{
+			"videos": len(videos),
+			"bytes":  bytes,
+		},
+	}
+	if !user.identity.ExpiresAt.IsZero() {
+		account["expires_at"] = user.identity.ExpiresAt.UTC()
+	}
+	writeJSON(w, http.StatusOK, account)
+}
+
+// handleAccountVideos will list the user's own uploads
+func (sm *StreamManager) handleAccountVideos(w http.ResponseWriter, r *http.Request) {
+	user, ok := sm.currentUser(w, r, "")
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.ownedVideos(user))
+}
+
+// handleAccountDeleteVideo will delete one of the user's own videos
+func (sm *StreamManager) handleAccountDeleteVideo(w http.ResponseWriter, r *http.Request) {
+	user, ok := sm.currentUser(w, r, ScopeUpload)
+	if !ok {
+		return
+	}
+	fileID := user.tenant.VideoID(r.PathValue("id"))
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || video.Owner != user.identity.Subject {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if video.Locked() {
+		lockedError(w, video)
+		return
+	}
+	if err := sm.deleteVideo(r.Context(), fileID); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete video")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAccountTokens will list the user's outstanding tokens
+func (sm *StreamManager) handleAccountTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := sm.currentUser(w, r, ScopeUpload)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.accountTokens(user))
+}
+
+func (sm *StreamManager) accountTokens(user accountUser) []TokenClaims {
+	tokens := []TokenClaims{}
+	for _, claims := range sm.tokens.Outstanding("", user.identity.Subject) {
+		if inTenant(claims.Tenant, user.tenant.ID) {
+			tokens = append(tokens, claims)
+		}
+	}
+	return tokens
+}
+
+// handleAccountIssueToken will mint a token for the user, eg a playback link
+// for one video. it can't outlive or have a wider scope than the token used
+func (sm *StreamManager) handleAccountIssueToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := sm.currentUser(w, r, ScopeUpload)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Scope   string `json:"scope"`
+		VideoID string `json:"video_id"`
+		TTL     string `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = ScopePlayback
+	}
+	// upload tokens may hand out playback and download, nothing else wider
+	// than the token's own scopes
+	if !user.identity.HasScope(req.Scope) && req.Scope != ScopePlayback && req.Scope != ScopeDownload {
+		writeError(w, http.StatusForbidden, "scope must be playback, download or a scope of your token")
+		return
+	}
+
+	// credentials that don't expire hand out tokens of up to a day
+	remaining := 24 * time.Hour
+	if !user.identity.ExpiresAt.IsZero() {
+		remaining = time.Until(user.identity.ExpiresAt)
+	}
+	ttl := remaining
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		ttl = min(parsed, remaining)
+	}
+
+	token, claims, err := sm.tokens.Issue(TokenClaims{
+		Scope:   req.Scope,
+		VideoID: req.VideoID,
+		Subject: user.identity.Subject,
+		Tenant:  user.identity.Tenant,
+	}, ttl)
+	if errors.Is(err, ErrTokenUnsigned) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to issue token")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"token": token, "claims": claims})
+}
+
+// handleAccountRevokeToken will revoke one of the user's own tokens
+func (sm *StreamManager) handleAccountRevokeToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := sm.currentUser(w, r, ScopeUpload)
+	if !ok {
+		return
+	}
+	for _, claims := range sm.accountTokens(user) {
+		if claims.ID != r.PathValue("jti") {
+			continue
+		}
+		if err := sm.tokens.RevokeID(claims.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save revocation")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, http.StatusNotFound, "token not found")
+}
+
+// handleAccountHistory will list (GET) or clear (DELETE) the user's playback history
+func (sm *StreamManager) handleAccountHistory(w http.ResponseWriter, r *http.Request) {
+	user, ok := sm.currentUser(w, r, "")
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		sm.history.Clear(user.key())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// titles are looked up now, deleted videos drop out of the history
+	type historyItem struct {
+		HistoryEntry
+		Title string `json:"title"`
+	}
+	items := []historyItem{}
+	for _, entry := range sm.history.List(user.key()) {
+		if video, ok := sm.metadata.GetVideo(user.tenant.VideoID(entry.VideoID)); ok {
+			items = append(items, historyItem{HistoryEntry: entry, Title: video.Title})
+		}
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// recordPlay will count a playback start and add it to the viewer's history
+func (sm *StreamManager) recordPlay(r *http.Request, videoID string) {
+	if !isPlaybackStart(r) {
+		return
+	}
+	sm.metadata.AddView(tenantFrom(r).VideoID(videoID))
+	if subject := sm.tokens.Subject(r); subject != "" {
+		sm.history.Record(scopeID(tenantFrom(r).ID, subject), videoID)
+	}
+}
+
+// deleteVideo will remove a video's files, tokens and record
+func (sm *StreamManager) deleteVideo(ctx context.Context, fileID string) error {
+	// the storage refuses while the video is write once locked, so this goes first
+	if err := sm.storage.Delete(ctx, videoKey(fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(filepath.Join(VideoStoragePath, videoKey(fileID))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// an upload waiting for validation would bring it back
+	os.Remove(pendingUploadPath(fileID))
+	os.Remove(pendingUploadPath(fileID) + ".json")
+	tracks, _ := filepath.Glob(filepath.Join(VideoStoragePath, fileID+".*.vtt"))
+	for _, track := range tracks {
+		os.Remove(track)
+	}
+	removeAudio(fileID)
+	removeHLS(fileID)
+	removePreviews(fileID)
+	sm.demand.Delete(fileID)
+	sm.unpin(fileID)
+	sm.removeLinks(fileID)
+	sm.analytics.Delete(fileID)
+
+	if err := sm.metadata.DeleteVideo(fileID); err != nil && err != ErrNotFound {
+		return err
+	}
+	sm.tokens.RevokeVideo(fileID)
+	sm.cache.Invalidate(fileID)
+	sm.invalidateEdges(fileID)
+	sm.events.Emit(EventVideoDeleted, fileID, nil)
+	return nil
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the heatmap splits a video into this many equal parts, at most 128
+	heatmapBuckets = 100
+	// a playback session is added to the totals once idle this long
+	analyticsSessionIdle = 10 * time.Minute
+	// distinct viewers remembered per video, past it the count stops growing
+	maxAnalyticsViewers = 100000
+)
+
+var hlsSegmentNumber = regexp.MustCompile(`^seg([0-9]+)\.`)
+
+// videoAnalytics are the totals of a video's finished playback sessions
+type videoAnalytics struct {
+	Sessions    int64 `json:"sessions"`
+	Completions int64 `json:"completions"`
+	// heatmap buckets played summed over sessions, watch time is worked out
+	// from it with the video's duration when asked
+	Watched     int64           `json:"watched"`
+	BytesServed int64           `json:"bytes_served"`
+	Heatmap     []int64         `json:"heatmap"`
+	Viewers     map[string]bool `json:"viewers"`
+}
+
+func newVideoAnalytics() *videoAnalytics {
+	return &videoAnalytics{Heatmap: make([]int64, heatmapBuckets), Viewers: make(map[string]bool)}
+}
+
+// add will count a finished session
+func (va *videoAnalytics) add(ls *liveSession) {
+	va.Sessions++
+	va.BytesServed += ls.bytes
+	for bucket := range heatmapBuckets {
+		if ls.played(bucket) {
+			va.Heatmap[bucket]++
+			va.Watched++
+		}
+	}
+	if ls.played(heatmapBuckets - 1) {
+		va.Completions++
+	}
+}
+
+// liveSession is a playback session still being watched, which parts of the
+// video it fetched so seeking around isn't counted twice
+type liveSession struct {
+	fileID   string
+	covered  [2]uint64
+	bytes    int64
+	lastSeen time.Time
+}
+
+func (ls *liveSession) played(bucket int) bool {
+	return ls.covered[bucket/64]&(1<<(bucket%64)) != 0
+}
+
+// Analytics will keep per video playback analytics. sessions being watched
+// are kept in memory and added to the totals once idle, the totals are saved
+// in the background like the history
+type Analytics struct {
+	path string
+
+	mu     sync.Mutex
+	videos map[string]*videoAnalytics
+	live   map[string]*liveSession
+	dirty  bool
+}
+
+// NewAnalytics will load the totals from path, a missing file is empty
+func NewAnalytics(path string) (*Analytics, error) {
+	a := &Analytics{path: path, videos: make(map[string]*videoAnalytics), live: make(map[string]*liveSession)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &a.videos); err != nil {
+			return nil, err
+		}
+	}
+	supervisor.Go(context.Background(), "analytics-flush", RestartAlways, a.flushRoutine)
+	return a, nil
+}
+
+// Observe will record a response of a playback session, from and to are the
+// part of the video it carried as fractions of the whole, equal when it
+// carried none (a playlist, the init segment)
+func (a *Analytics) Observe(sessionID, fileID, viewer string, from, to float64, bytes int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ls, ok := a.live[sessionID]
+	if !ok {
+		ls = &liveSession{fileID: fileID}
+		a.live[sessionID] = ls
+		va := a.videoLocked(fileID)
+		if len(va.Viewers) < maxAnalyticsViewers {
+			va.Viewers[viewer] = true
+		}
+		a.dirty = true
+	}
+	ls.lastSeen = time.Now()
+	ls.bytes += bytes
+	if to > from {
+		first := int(from * heatmapBuckets)
+		last := min(int(math.Ceil(to*heatmapBuckets)), heatmapBuckets) - 1
+		for bucket := max(first, 0); bucket <= last; bucket++ {
+			ls.covered[bucket/64] |= 1 << (bucket % 64)
+		}
+	}
+}
+
+func (a *Analytics) videoLocked(fileID string) *videoAnalytics {
+	va, ok := a.videos[fileID]
+	if !ok {
+		va = newVideoAnalytics()
+		a.videos[fileID] = va
+	}
+	return va
+}
+
+// AnalyticsReport is what GET /api/videos/{id}/analytics returns
+type AnalyticsReport struct {
+	VideoID string `json:"video_id"`
+	// playback starts, the same count the video list sorts by
+	Views          int64   `json:"views"`
+	Sessions       int64   `json:"sessions"`
+	UniqueViewers  int     `json:"unique_viewers"`
+	Completions    int64   `json:"completions"`
+	CompletionRate float64 `json:"completion_rate"`
+	// share of the video an average session played, and how long that is
+	// when the duration is known
+	AverageWatched      float64  `json:"average_watched"`
+	AverageWatchSeconds *float64 `json:"average_watch_seconds,omitempty"`
+	BytesServed         int64    `json:"bytes_served"`
+	// sessions that played each part of the video, where it falls is where
+	// viewers drop off
+	Heatmap       []int64  `json:"heatmap"`
+	BucketSeconds *float64 `json:"bucket_seconds,omitempty"`
+}
+
+// Report will add up a video's totals and the sessions still being watched
+func (a *Analytics) Report(video VideoRecord) AnalyticsReport {
+	a.mu.Lock()
+	totals := newVideoAnalytics()
+	if va, ok := a.videos[video.Key()]; ok {
+		*totals = *va
+		totals.Heatmap = append([]int64{}, va.Heatmap...)
+	}
+	for _, ls := range a.live {
+		if ls.fileID == video.Key() {
+			totals.add(ls)
+		}
+	}
+	viewers := len(totals.Viewers)
+	a.mu.Unlock()
+
+	report := AnalyticsReport{
+		VideoID:       video.ID,
+		Views:         video.Views,
+		Sessions:      totals.Sessions,
+		UniqueViewers: viewers,
+		Completions:   totals.Completions,
+		BytesServed:   totals.BytesServed,
+		Heatmap:       totals.Heatmap,
+	}
+	if totals.Sessions > 0 {
+		report.CompletionRate = float64(totals.Completions) / float64(totals.Sessions)
+		report.AverageWatched = float64(totals.Watched) / float64(totals.Sessions) / heatmapBuckets
+	}
+	if video.Duration > 0 {
+		seconds := math.Round(report.AverageWatched*video.Duration*10) / 10
+		bucket := video.Duration / heatmapBuckets
+		report.AverageWatchSeconds, report.BucketSeconds = &seconds, &bucket
+	}
+	return report
+}
+
+// Delete will forget a video's analytics
+func (a *Analytics) Delete(fileID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.videos, fileID)
+	for id, ls := range a.live {
+		if ls.fileID == fileID {
+			delete(a.live, id)
+		}
+	}
+	a.dirty = true
+}
+
+// flushRoutine will add idle sessions to the totals and save them
+func (a *Analytics) flushRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		a.mu.Lock()
+		for id, ls := range a.live {
+			if time.Since(ls.lastSeen) > analyticsSessionIdle {
+				a.videoLocked(ls.fileID).add(ls)
+				delete(a.live, id)
+				a.dirty = true
+			}
+		}
+		if !a.dirty {
+			a.mu.Unlock()
+			continue
+		}
+		data, err := json.Marshal(a.videos)
+		a.dirty = false
+		a.mu.Unlock()
+
+		if err == nil {
+			err = writeFileAtomic(a.path, data)
+		}
+		if err != nil {
+			log.Println("failed to save analytics", err)
+		}
+	}
+}
+
+// analyticsPath is where the analytics totals are persisted
+func analyticsPath() string {
+	return filepath.Join(VideoStoragePath, ".analytics.json")
+}
+
+// trackAnalytics will wrap a playback handler (inside diagnostics.Track, which
+// finds the playback session) and record what each response carried
+func (sm *StreamManager) trackAnalytics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := playbackSessionOf(r.Context())
+		if !ok {
+			next(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		if rec.status != http.StatusOK && rec.status != http.StatusPartialContent {
+			return
+		}
+
+		fileID := scopeID(session.Tenant, session.VideoID)
+		video, ok := sm.metadata.GetVideo(fileID)
+		if !ok {
+			return
+		}
+		from, to, media := sm.playedPart(r, video, rec.bytes)
+		bytes := rec.bytes
+		if !media {
+			bytes = 0
+		}
+		sm.analytics.Observe(session.ID, fileID, viewerKey(r, sm.tokens.Subject(r)), from, to, bytes)
+	}
+}
+
+// playedPart will work out which part of the video a response carried, byte
+// ranges of the file assume a steady bitrate and hls segments are placed by
+// their number. media is false for playlists, init segments and keys
+func (sm *StreamManager) playedPart(r *http.Request, video VideoRecord, sent int64) (float64, float64, bool) {
+	if name := r.PathValue("file"); name != "" {
+		match := hlsSegmentNumber.FindStringSubmatch(name)
+		if match == nil {
+			return 0, 0, false
+		}
+		if video.Duration <= 0 {
+			return 0, 0, true
+		}
+		number, _ := strconv.Atoi(match[1])
+		seconds := float64(sm.profileFor(video).SegmentSeconds)
+		return float64(number) * seconds / video.Duration, float64(number+1) * seconds / video.Duration, true
+	}
+	if strings.HasSuffix(r.URL.Path, ".m3u8") {
+		return 0, 0, false
+	}
+	if video.Size <= 0 {
+		return 0, 0, true
+	}
+	var start int64
+	if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+		first, _, _ := strings.Cut(spec, "-")
+		start, _ = strconv.ParseInt(first, 10, 64)
+	}
+	return float64(start) / float64(video.Size), float64(start+sent) / float64(video.Size), true
+}
+
+// viewerKey tells viewers apart without keeping who they are, the token's
+// user when there is one or else the address and browser
+func viewerKey(r *http.Request, subject string) string {
+	key := "sub:" + subject
+	if subject == "" {
+		key = "ip:" + clientIP(r) + "|" + r.UserAgent()
+	}
+	sum := sha256.Sum256([]byte(tenantFrom(r).ID + "|" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// handleVideoAnalytics will return a video's views, viewers, watch time and heatmap
+func (sm *StreamManager) handleVideoAnalytics(w http.ResponseWriter, r *http.Request) {
+	video, ok := sm.metadata.GetVideo(tenantFrom(r).VideoID(r.PathValue("id")))
+	if !ok {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.analytics.Report(video))
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// extract the aac rendition as soon as an upload is ready instead of on the
+// first audio request
+var AudioEager = envBool("AUDIO_EAGER", false)
+
+// how long extracting audio from a single video may take
+const audioTimeout = 30 * time.Minute
+
+// an audio only rendition
+type audioFormat struct {
+	ext         string
+	contentType string
+	// ffmpeg output args, copy is tried first when the source codec fits
+	copyArgs   []string
+	encodeArgs []string
+}
+
+var audioFormats = map[string]audioFormat{
+	"aac": {
+		ext:         "m4a",
+		contentType: "audio/mp4",
+		copyArgs:    []string{"-c:a", "copy", "-movflags", "+faststart", "-f", "ipod"},
+		encodeArgs:  []string{"-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart", "-f", "ipod"},
+	},
+	"mp3": {
+		ext:         "mp3",
+		contentType: "audio/mpeg",
+		encodeArgs:  []string{"-c:a", "libmp3lame", "-b:a", "128k", "-f", "mp3"},
+	},
+}
+
+// audioPath is where a video's audio rendition is kept, next to the video
+func audioPath(fileID string, format audioFormat) string {
+	return filepath.Join(VideoStoragePath, fileID+".audio."+format.ext)
+}
+
+// handleAudio will serve a video's audio only rendition (?format=aac|mp3),
+// it is extracted on the first request
+func (sm *StreamManager) handleAudio(w http.ResponseWriter, r *http.Request) {
+	sm.serveAudio(w, r, tenantFrom(r).VideoID(requestedVideoID(r)))
+}
+
+func (sm *StreamManager) serveAudio(w http.ResponseWriter, r *http.Request, fileID string) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "aac"
+	}
+	format, ok := audioFormats[name]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "format must be aac or mp3")
+		return
+	}
+
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if video.Kind == MediaImage {
+		writeError(w, http.StatusNotFound, "an image has no audio")
+		return
+	}
+	if video.NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	ctx, cancel := renditionContext(r.Context())
+	defer cancel()
+	if err := sm.extractAudio(ctx, fileID, format, PriorityViewer); err != nil {
+		switch {
+		case stillProcessing(r, err):
+			writeProcessing(w, r)
+		case errors.Is(err, exec.ErrNotFound):
+			writeError(w, http.StatusServiceUnavailable, "audio extraction needs ffmpeg")
+		case errors.Is(err, errNoAudio):
+			writeError(w, http.StatusNotFound, "video has no audio")
+		case r.Context().Err() != nil:
+		default:
+			log.Println("failed to extract audio", fileID, err)
+			writeError(w, http.StatusInternalServerError, "failed to extract audio")
+		}
+		return
+	}
+
+	plain, err := os.Open(audioPath(fileID, format))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to open audio")
+		return
+	}
+	file, err := sm.keys.Open(plain)
+	if err != nil {
+		plain.Close()
+		log.Println("failed to decrypt audio", fileID, err)
+		writeError(w, http.StatusInternalServerError, "failed to open audio")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to open audio")
+		return
+	}
+
+	sm.recordPlay(r, video.ID)
+	sm.demand.Record(fileID, name)
+	setCachePolicy(w, r, CacheContent, strongETag(info))
+	w.Header().Set("ETag", strongETag(info))
+	w.Header().Set("Content-Type", format.contentType)
+	strictIfRange(r)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+var errNoAudio = errors.New("video has no audio")
+
+// extractAudio will make sure the rendition exists, waiting for it when it
+// is being extracted already. it runs as a transcode job of priority
+func (sm *StreamManager) extractAudio(ctx context.Context, fileID string, format audioFormat, priority int) error {
+	path := audioPath(fileID, format)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	video, _ := sm.metadata.GetVideo(fileID)
+	job := &TranscodeJob{Kind: "audio", VideoID: fileID, Priority: priority, Duration: video.Duration}
+	return sm.buildOnce(ctx, path, job, func(ctx context.Context) error {
+		return sm.runAudioExtraction(ctx, fileID, format, path)
+	})
+}
+
+func (sm *StreamManager) runAudioExtraction(ctx context.Context, fileID string, format audioFormat, path string) error {
+	if _, err := exec.LookPath(FFmpegPath); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, audioTimeout)
+	defer cancel()
+
+	source, cleanup, err := sm.localVideoPath(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	output := filepath.Join(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	defer os.Remove(output)
+
+	// stream copy keeps the original quality and takes seconds, it fails
+	// when the source codec doesn't fit the container
+	if format.copyArgs != nil {
+		err = ffmpegAudio(ctx, source, output, format.copyArgs)
+	}
+	if format.copyArgs == nil || (err != nil && !errors.Is(err, errNoAudio)) {
+		err = ffmpegAudio(ctx, source, output, format.encodeArgs)
+	}
+	if err != nil {
+		return err
+	}
+	if err := sm.keys.EncryptFile(output); err != nil {
+		return err
+	}
+	return os.Rename(output, path)
+}
+
+// ffmpegAudio will write the first audio stream of input to output
+func ffmpegAudio(ctx context.Context, input, output string, args []string) error {
+	args = append([]string{"-hide_banner", "-nostats", "-y", "-i", input, "-vn", "-sn", "-dn", "-map", "0:a:0"}, args...)
+	args = append(args, output)
+	if out, err := exec.CommandContext(ctx, FFmpegPath, args...).CombinedOutput(); err != nil {
+		text := strings.TrimSpace(string(out))
+		if strings.Contains(text, "matches no streams") {
+			return errNoAudio
+		}
+		lines := strings.Split(text, "\n")
+		return fmt.Errorf("ffmpeg failed: %s", lines[len(lines)-1])
+	}
+	return nil
+}
+
+// removeAudio will delete a video's audio renditions
+func removeAudio(fileID string) {
+	for _, format := range audioFormats {
+		os.Remove(audioPath(fileID, format))
+	}
+}
@@ -0,0 +1,419 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file the audit trail is appended to, next to the videos when empty. it is
+// only ever appended to, rotating or archiving it is up to the operator
+var AuditLogPath = envString("AUDIT_LOG", "")
+
+// how an audited action went
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	// refused for missing or wrong credentials or scope
+	AuditDenied = "denied"
+)
+
+// the most entries /admin/audit returns at once, the jsonl export has all
+const maxAuditLimit = 1000
+
+// AuditEntry is one security relevant action, who did it from where and how
+// it went
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Outcome string    `json:"outcome"`
+	// http status, 0 for what the server did by itself
+	Status int `json:"status,omitempty"`
+	// the token's subject, "admin" for the admin key, "tenant:<id>" for a
+	// tenant key and "system" for the server's own work. "" is anonymous
+	Actor  string `json:"actor,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	// the video, token, collection... acted on
+	Target string `json:"target,omitempty"`
+	// without the query, it can carry tokens
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// routes whose every request is audited, the other /admin/ routes that
+// change something are "admin". any route's 401s and 403s are audited too
+var auditedRoutes = map[string]string{
+	"POST /api/upload/from-url":     "video.upload",
+	"PATCH /api/videos/{id}":        "video.update",
+	"POST /api/videos/{id}/clip":    "video.clip",
+	"DELETE /api/me/videos/{id}":    "video.delete",
+	"DELETE /api/me/tokens/{jti}":   "token.revoke",
+	"DELETE /api/collections/{id}":  "collection.delete",
+	"DELETE /api/playlists/{id}":    "playlist.delete",
+	"POST /api/links":               "link.create",
+	"DELETE /api/links/{code}":      "link.delete",
+	"POST /admin/tokens":            "token.issue",
+	"POST /admin/tokens/revoke":     "token.revoke",
+	"PUT /admin/profiles/{name}":    "profile.update",
+	"POST /admin/profiles":          "profile.update",
+	"DELETE /admin/profiles/{name}": "profile.delete",
+	"POST /admin/jobs/{id}/retry":   "job.retry",
+	"DELETE /admin/jobs/{id}":       "job.delete",
+	"POST /admin/storage/migrate":   "storage.migrate",
+	"DELETE /admin/storage/migrate": "storage.migrate.cancel",
+	"GET /admin/audit":              "audit.read",
+}
+
+// AuditLog will append entries to a jsonl file as they happen, synced to
+// disk in the background
+type AuditLog struct {
+	path    string
+	tenants *Tenants
+
+	mu    sync.Mutex
+	file  *os.File
+	dirty bool
+}
+
+// NewAuditLog will open the trail at path for appending
+func NewAuditLog(path string, tenants *Tenants) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	al := &AuditLog{path: path, tenants: tenants, file: file}
+	supervisor.Go(context.Background(), "audit-sync", RestartAlways, al.syncRoutine)
+	return al, nil
+}
+
+// Record will append an entry, its time is now when it has none
+func (al *AuditLog) Record(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("failed to encode audit entry", err)
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	// one write per line, appends of a line don't interleave
+	if _, err := al.file.Write(append(line, '\n')); err != nil {
+		log.Println("failed to write audit entry", entry.Action, err)
+		return
+	}
+	al.dirty = true
+}
+
+// syncRoutine will fsync what was appended every second, a sync per entry
+// would let failed logins slow the disk down
+func (al *AuditLog) syncRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			al.sync()
+			return nil
+		case <-ticker.C:
+			al.sync()
+		}
+	}
+}
+
+func (al *AuditLog) sync() {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if !al.dirty {
+		return
+	}
+	if err := al.file.Sync(); err != nil {
+		log.Println("failed to sync the audit log", err)
+		return
+	}
+	al.dirty = false
+}
+
+// the audit of the request being served, routes and handlers fill it in and
+// the middleware records it once the response is written
+type auditRecord struct {
+	log    *AuditLog
+	action string
+	// worked out while the request is served, its credentials may be
+	// revoked by it
+	actor  *string
+	tenant string
+	target string
+	detail string
+}
+
+// who will work out the actor of the request, once
+func (record *auditRecord) who(r *http.Request) {
+	if record.actor == nil {
+		actor := record.log.actor(r)
+		record.actor = &actor
+	}
+}
+
+type auditContextKey struct{}
+
+// auditAs will say what a request did, for a handler whose route isn't
+// audited as a whole or that knows better what it acted on
+func auditAs(r *http.Request, action, target, detail string) {
+	record, ok := r.Context().Value(auditContextKey{}).(*auditRecord)
+	if !ok {
+		return
+	}
+	if action != "" {
+		record.action = action
+	}
+	record.who(r)
+	record.tenant = tenantFrom(r).ID
+	if target != "" {
+		record.target = target
+	}
+	record.detail = detail
+}
+
+// Middleware will record the audited requests and every request refused
+// for its credentials, the tenant check included. it goes before tenant
+// resolution so it sees those refusals
+func (al *AuditLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &auditRecord{log: al}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+
+		action := record.action
+		switch {
+		case action != "":
+		case rec.status == http.StatusUnauthorized:
+			action = "auth.failed"
+		case rec.status == http.StatusForbidden:
+			action = "auth.denied"
+		default:
+			return
+		}
+		record.who(r)
+		outcome := AuditSuccess
+		switch {
+		case rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden:
+			outcome = AuditDenied
+		case rec.status >= 400:
+			outcome = AuditFailure
+		}
+		al.Record(AuditEntry{
+			Action:  action,
+			Outcome: outcome,
+			Status:  rec.status,
+			Actor:   *record.actor,
+			IP:      clientIP(r),
+			Tenant:  record.tenant,
+			Target:  record.target,
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Detail:  record.detail,
+		})
+	})
+}
+
+// route will mark the requests of an audited route, with their tenant and
+// what they are for
+func (al *AuditLog) route(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	action, ok := auditedRoutes[pattern]
+	if method, path, _ := strings.Cut(pattern, " "); !ok && strings.HasPrefix(path, "/admin/") && method != http.MethodGet {
+		action, ok = "admin", true
+	}
+	if !ok {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if record, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+			record.action = action
+			record.who(r)
+			record.tenant = tenantFrom(r).ID
+			record.target = requestedVideoID(r)
+			for _, name := range []string{"code", "name", "jti"} {
+				if record.target == "" {
+					record.target = r.PathValue(name)
+				}
+			}
+		}
+		next(w, r)
+	}
+}
+
+// actor is who made a request, by the credentials it carries
+func (al *AuditLog) actor(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key != "" && AdminAPIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(AdminAPIKey)) == 1 {
+		return "admin"
+	}
+	if tenant, ok := al.tenants.byKey[key]; ok && key != "" {
+		return "tenant:" + tenant.ID
+	}
+	if al.tenants.tokens.Enabled() {
+		if id, err := al.tenants.tokens.Authenticate(r); err == nil {
+			return id.Subject
+		}
+	}
+	return ""
+}
+
+// recordRPC will record a grpc call that said what it did or was refused
+// for its credentials, like Middleware does for http
+func (al *AuditLog) recordRPC(c *grpcCall, code int, msg string) {
+	action, outcome := c.audit, AuditSuccess
+	switch code {
+	case grpcOK:
+	case grpcUnauthenticated, grpcPermissionDenied:
+		outcome = AuditDenied
+		if action == "" {
+			action = map[int]string{grpcUnauthenticated: "auth.failed", grpcPermissionDenied: "auth.denied"}[code]
+		}
+	default:
+		outcome = AuditFailure
+	}
+	if action == "" {
+		return
+	}
+	al.Record(AuditEntry{
+		Action:  action,
+		Outcome: outcome,
+		Actor:   al.actor(c.r),
+		IP:      clientIP(c.r),
+		Tenant:  tenantFrom(c.r).ID,
+		Target:  c.target,
+		Method:  "grpc",
+		Path:    c.r.URL.Path,
+		Detail:  msg,
+	})
+}
+
+// auditFilter picks entries out of the trail, empty fields match anything
+type auditFilter struct {
+	action, actor, tenant, target, outcome string
+	since, until                           time.Time
+}
+
+func (f auditFilter) match(entry AuditEntry) bool {
+	return (f.action == "" || entry.Action == f.action || strings.HasSuffix(f.action, ".") && strings.HasPrefix(entry.Action, f.action)) &&
+		(f.actor == "" || entry.Actor == f.actor) &&
+		(f.tenant == "" || entry.Tenant == f.tenant) &&
+		(f.target == "" || entry.Target == f.target) &&
+		(f.outcome == "" || entry.Outcome == f.outcome) &&
+		(f.since.IsZero() || !entry.Time.Before(f.since)) &&
+		(f.until.IsZero() || entry.Time.Before(f.until))
+}
+
+// Scan will call fn with the entries matching filter, oldest first, until
+// it returns false
+func (al *AuditLog) Scan(filter auditFilter, fn func(entry AuditEntry) bool) error {
+	file, err := os.Open(al.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		// a line cut short by a crash is skipped, the ones after it are fine
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.match(entry) && !fn(entry) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// handleAudit will return the newest entries of the audit trail, filtered by
+// ?action= (video. for all video actions), actor, tenant, target, outcome,
+// since and until (rfc3339) and up to ?limit=. ?format=jsonl exports all of
+// the matching ones, oldest first
+func (sm *StreamManager) handleAudit(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	filter := auditFilter{
+		action: params.Get("action"), actor: params.Get("actor"), tenant: params.Get("tenant"),
+		target: params.Get("target"), outcome: params.Get("outcome"),
+	}
+	for name, at := range map[string]*time.Time{"since": &filter.since, "until": &filter.until} {
+		if raw := params.Get(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, name+" must be an rfc3339 time")
+				return
+			}
+			*at = parsed
+		}
+	}
+
+	if params.Get("format") == "jsonl" {
+		setCachePolicy(w, r, CacheNoStore, "")
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		encoder := json.NewEncoder(w)
+		if err := sm.audit.Scan(filter, func(entry AuditEntry) bool {
+			return encoder.Encode(entry) == nil
+		}); err != nil {
+			log.Println("failed to export the audit log", err)
+		}
+		return
+	}
+
+	limit := 100
+	if raw := params.Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxAuditLimit {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditLimit))
+			return
+		}
+	}
+	// the last limit matches, kept in a ring while the file is read
+	ring := make([]AuditEntry, 0, limit)
+	next := 0
+	err := sm.audit.Scan(filter, func(entry AuditEntry) bool {
+		if len(ring) < limit {
+			ring = append(ring, entry)
+		} else {
+			ring[next] = entry
+		}
+		next = (next + 1) % limit
+		return true
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to read the audit log")
+		return
+	}
+	entries := make([]AuditEntry, 0, len(ring))
+	for i := range ring {
+		entries = append(entries, ring[(next-1-i+2*len(ring))%len(ring)])
+	}
+	setCachePolicy(w, r, CacheNoStore, "")
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// auditLogPath is where the audit trail is appended
+func auditLogPath() string {
+	if AuditLogPath != "" {
+		return AuditLogPath
+	}
+	return filepath.Join(VideoStoragePath, ".audit.jsonl")
+}
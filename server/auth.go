@@ -0,0 +1,480 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// shared secret of HS256 jwts from another service
+	AuthJWTSecret = envString("AUTH_JWT_SECRET", "")
+	// openid connect issuer, its jwks verifies RS256 and ES256 jwts
+	AuthOIDCIssuer = strings.TrimSuffix(envString("AUTH_OIDC_ISSUER", ""), "/")
+	// jwts need this iss and aud when set, iss is the oidc issuer by default
+	AuthJWTIssuer   = envString("AUTH_JWT_ISSUER", AuthOIDCIssuer)
+	AuthJWTAudience = envString("AUTH_JWT_AUDIENCE", "")
+	// claim of a jwt naming the tenant it belongs to
+	AuthJWTTenantClaim = envString("AUTH_JWT_TENANT_CLAIM", "tenant")
+	// json file of api keys, [{"key_sha256": "...", "sub": "...", "tenant": "...", "scopes": ["upload"]}]
+	AuthAPIKeysFile = envString("AUTH_API_KEYS_FILE", "")
+)
+
+const (
+	// clocks of the issuer and this server may be this far apart
+	jwtLeeway = time.Minute
+	// an unknown key id fetches the jwks again at most this often
+	jwksRefresh = time.Minute
+)
+
+// Identity is who a request is, as the authenticator that recognised its
+// credentials sees it
+type Identity struct {
+	// name of the authenticator, "token" for the server's own signed tokens
+	Provider string   `json:"provider"`
+	Subject  string   `json:"sub,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"`
+	Scopes   []string `json:"scopes"`
+	// the one video the credentials are for, any video when empty
+	VideoID string `json:"video_id,omitempty"`
+	// zero when the credentials don't expire
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	// the signed token's claims, only for the token provider
+	claims TokenClaims
+}
+
+// HasScope reports whether the identity may do what scope allows
+func (id Identity) HasScope(scope string) bool {
+	return slices.Contains(id.Scopes, scope)
+}
+
+// allows reports whether the identity may use scope on videoID of tenantID
+func (id Identity) allows(scope, videoID, tenantID string) bool {
+	return id.HasScope(scope) && (id.VideoID == "" || id.VideoID == videoID) && inTenant(id.Tenant, tenantID)
+}
+
+// Authenticator checks a request's credentials. it returns ErrTokenMissing
+// when the request has none it understands, so the next one gets a go
+type Authenticator interface {
+	Validate(r *http.Request) (Identity, error)
+}
+
+// AddAuthenticator will accept another kind of credentials next to the built
+// in ones, for programs with their own auth. add them before serving
+func (ts *TokenStore) AddAuthenticator(a Authenticator) {
+	ts.authenticators = append(ts.authenticators, a)
+}
+
+// Authenticate will find who a request is, asking the signed tokens first
+// and then every authenticator in the order they were added
+func (ts *TokenStore) Authenticate(r *http.Request) (Identity, error) {
+	if ts.Signs() {
+		if id, err := ts.Validate(r); err != ErrTokenMissing {
+			return id, err
+		}
+	}
+	for _, a := range ts.authenticators {
+		if id, err := a.Validate(r); err != ErrTokenMissing {
+			return id, err
+		}
+	}
+	// credentials none of them knew
+	if tokenFromRequest(r) != "" {
+		return Identity{}, ErrTokenInvalid
+	}
+	return Identity{}, ErrTokenMissing
+}
+
+// Validate makes the signed tokens an Authenticator, a token of another
+// shape isn't one of them
+func (ts *TokenStore) Validate(r *http.Request) (Identity, error) {
+	token := tokenFromRequest(r)
+	if strings.Count(token, ".") != 1 {
+		return Identity{}, ErrTokenMissing
+	}
+	claims, err := ts.Verify(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	return claimsIdentity(claims), nil
+}
+
+func claimsIdentity(claims TokenClaims) Identity {
+	return Identity{
+		Provider:  "token",
+		Subject:   claims.Subject,
+		Tenant:    claims.Tenant,
+		Scopes:    []string{claims.Scope},
+		VideoID:   claims.VideoID,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		claims:    claims,
+	}
+}
+
+// NewAuthenticatorsFromEnv will set up the jwt, oidc and api key
+// authenticators that are configured
+func NewAuthenticatorsFromEnv() ([]Authenticator, error) {
+	var authenticators []Authenticator
+	if AuthAPIKeysFile != "" {
+		keys, err := LoadAPIKeys(AuthAPIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, keys)
+	}
+	if AuthJWTSecret != "" || AuthOIDCIssuer != "" {
+		jwt := &JWTAuthenticator{
+			Issuer:      AuthJWTIssuer,
+			Audience:    AuthJWTAudience,
+			TenantClaim: AuthJWTTenantClaim,
+			Secret:      []byte(AuthJWTSecret),
+		}
+		if AuthOIDCIssuer != "" {
+			client, err := newOutboundClient(10 * time.Second)
+			if err != nil {
+				return nil, err
+			}
+			jwt.Keys = &JWKS{Issuer: AuthOIDCIssuer, client: client}
+		}
+		authenticators = append(authenticators, jwt)
+	}
+	return authenticators, nil
+}
+
+// APIKeys are long lived keys for services, sent as "Authorization: ApiKey
+// <key>" or as a bearer token. only their sha256 is kept
+type APIKeys struct {
+	byHash map[string]Identity
+}
+
+type apiKey struct {
+	KeySHA256 string   `json:"key_sha256"`
+	Subject   string   `json:"sub"`
+	Tenant    string   `json:"tenant"`
+	Scopes    []string `json:"scopes"`
+	VideoID   string   `json:"video_id"`
+}
+
+// LoadAPIKeys will read an AUTH_API_KEYS_FILE
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	ak := &APIKeys{byHash: make(map[string]Identity)}
+	for _, key := range keys {
+		sum, err := hex.DecodeString(key.KeySHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("%s: key_sha256 of %q must be a hex sha256", path, key.Subject)
+		}
+		if len(key.Scopes) == 0 {
+			return nil, fmt.Errorf("%s: key of %q has no scopes", path, key.Subject)
+		}
+		ak.byHash[hex.EncodeToString(sum)] = Identity{
+			Provider: "apikey",
+			Subject:  key.Subject,
+			Tenant:   key.Tenant,
+			Scopes:   key.Scopes,
+			VideoID:  key.VideoID,
+		}
+	}
+	return ak, nil
+}
+
+func (ak *APIKeys) Validate(r *http.Request) (Identity, error) {
+	key, scheme := tokenFromRequest(r), "Bearer"
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "ApiKey ") {
+		key, scheme = strings.TrimPrefix(auth, "ApiKey "), "ApiKey"
+	}
+	if key == "" {
+		return Identity{}, ErrTokenMissing
+	}
+	sum := sha256.Sum256([]byte(key))
+	id, ok := ak.byHash[hex.EncodeToString(sum[:])]
+	if !ok {
+		// a bearer token may be for another authenticator
+		if scheme == "ApiKey" {
+			return Identity{}, ErrTokenInvalid
+		}
+		return Identity{}, ErrTokenMissing
+	}
+	return id, nil
+}
+
+// JWTAuthenticator accepts jwts of another service, HS256 with a shared
+// secret or RS256 and ES256 with the keys of an oidc issuer
+type JWTAuthenticator struct {
+	Issuer   string
+	Audience string
+	// claim with the tenant, the scopes are in "scope" (space separated) or
+	// "scp", the video in "video_id"
+	TenantClaim string
+	Secret      []byte
+	Keys        *JWKS
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (ja *JWTAuthenticator) Validate(r *http.Request) (Identity, error) {
+	token := tokenFromRequest(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrTokenMissing
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Identity{}, ErrTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, ErrTokenInvalid
+	}
+	if err := ja.verify(r.Context(), header, parts[0]+"."+parts[1], signature); err != nil {
+		return Identity{}, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Identity{}, ErrTokenInvalid
+	}
+	return ja.identity(claims)
+}
+
+func (ja *JWTAuthenticator) verify(ctx context.Context, header jwtHeader, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch header.Alg {
+	case "HS256":
+		if len(ja.Secret) == 0 {
+			return ErrTokenInvalid
+		}
+		mac := hmac.New(sha256.New, ja.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return ErrTokenInvalid
+		}
+		return nil
+	case "RS256", "ES256":
+		if ja.Keys == nil {
+			return ErrTokenInvalid
+		}
+		key, err := ja.Keys.Key(ctx, header.Kid)
+		if err != nil {
+			return err
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			// r and s, 32 bytes each
+			if header.Alg == "ES256" && len(signature) == 64 &&
+				ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+				return nil
+			}
+		}
+		return ErrTokenInvalid
+	}
+	// none and everything else
+	return ErrTokenInvalid
+}
+
+// identity will check the registered claims and map the rest
+func (ja *JWTAuthenticator) identity(claims map[string]interface{}) (Identity, error) {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return Identity{}, ErrTokenInvalid
+	}
+	expiresAt := time.Unix(int64(exp), 0)
+	if now.After(expiresAt.Add(jwtLeeway)) {
+		return Identity{}, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return Identity{}, ErrTokenInvalid
+	}
+	if ja.Issuer != "" && claims["iss"] != ja.Issuer {
+		return Identity{}, ErrTokenInvalid
+	}
+	if ja.Audience != "" {
+		var audiences []string
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []string{aud}
+		case []interface{}:
+			for _, a := range aud {
+				if a, ok := a.(string); ok {
+					audiences = append(audiences, a)
+				}
+			}
+		}
+		if !slices.Contains(audiences, ja.Audience) {
+			return Identity{}, ErrTokenInvalid
+		}
+	}
+
+	id := Identity{Provider: "jwt", ExpiresAt: expiresAt}
+	id.Subject, _ = claims["sub"].(string)
+	id.Tenant, _ = claims[ja.TenantClaim].(string)
+	id.VideoID, _ = claims["video_id"].(string)
+	if scope, ok := claims["scope"].(string); ok {
+		id.Scopes = strings.Fields(scope)
+	}
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				id.Scopes = append(id.Scopes, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// JWKS are the signing keys of an oidc issuer, found through its discovery
+// document and fetched again when a token names a key they don't have
+type JWKS struct {
+	Issuer string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// Key is the public key kid, any key when kid is empty and there is one
+func (j *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if key, ok := j.lookupLocked(kid); ok {
+		return key, nil
+	}
+	// keys rotate, but a made up kid mustn't make a request each time
+	if time.Since(j.fetched) < jwksRefresh {
+		return nil, ErrTokenInvalid
+	}
+	j.fetched = time.Now()
+	keys, err := j.fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	j.keys = keys
+	if key, ok := j.lookupLocked(kid); ok {
+		return key, nil
+	}
+	return nil, ErrTokenInvalid
+}
+
+func (j *JWKS) lookupLocked(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+func (j *JWKS) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := j.getJSON(ctx, j.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := j.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	number := func(raw string) *big.Int {
+		data, _ := base64.RawURLEncoding.DecodeString(raw)
+		return new(big.Int).SetBytes(data)
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			keys[k.Kid] = &rsa.PublicKey{N: number(k.N), E: int(number(k.E).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			// the coordinates are exactly 32 bytes, a key that isn't is skipped
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+				continue
+			}
+			// ecdh checks the point is on the curve
+			if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func (j *JWKS) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// what kind of response we are sending decides how long it may be cached
+type CacheClass int
+
+const (
+	// video bytes, renditions and segments
+	CacheContent CacheClass = iota
+	// manifests and text tracks that change when the video is reprocessed
+	CacheManifest
+	// html pages
+	CachePage
+	// key delivery and anything else that must never be stored
+	CacheNoStore
+)
+
+var (
+	// max-age for content addressed urls (?v=<etag>), they never change
+	CacheImmutableMaxAge = envDuration("CACHE_IMMUTABLE_MAX_AGE", 365*24*time.Hour)
+	// max-age for content fetched by a plain url
+	CacheContentMaxAge = envDuration("CACHE_CONTENT_MAX_AGE", 24*time.Hour)
+	// max-age for manifests
+	CacheManifestMaxAge = envDuration("CACHE_MANIFEST_MAX_AGE", 10*time.Second)
+)
+
+// setCachePolicy will emit Cache-Control for a response. etag is the current
+// validator of the content, when the url pins that exact version with ?v= the
+// response can be cached forever
+func setCachePolicy(w http.ResponseWriter, r *http.Request, class CacheClass, etag string) {
+	var value string
+	switch class {
+	case CacheContent:
+		if version := r.URL.Query().Get("v"); version != "" && version == strings.Trim(etag, `"`) {
+			value = fmt.Sprintf("public, max-age=%d, immutable", int(CacheImmutableMaxAge.Seconds()))
+		} else {
+			value = fmt.Sprintf("public, max-age=%d, must-revalidate", int(CacheContentMaxAge.Seconds()))
+		}
+	case CacheManifest:
+		value = fmt.Sprintf("public, max-age=%d", int(CacheManifestMaxAge.Seconds()))
+	case CachePage:
+		value = "no-cache"
+	default:
+		value = "no-store"
+	}
+
+	// tokenized urls and what a playback policy let through are per
+	// viewer, shared caches must not keep them
+	if isTokenized(r) || r.Context().Value(restrictedKey{}) != nil {
+		value = strings.Replace(value, "public", "private", 1)
+	}
+	// a shared cache that ignores private still mustn't hand it to a viewer
+	// without the same credentials
+	w.Header().Add("Vary", "Authorization, X-API-Key")
+	w.Header().Set("Cache-Control", value)
+}
+
+// restrictedKey marks a request that passed a playback policy
+type restrictedKey struct{}
+
+// isTokenized reports whether a request carries credentials, in a header or the url
+func isTokenized(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" ||
+		r.URL.Query().Get("token") != "" || r.URL.Query().Get("st") != ""
+}
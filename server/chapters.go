@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chapters kept per video
+const maxVideoChapters = 200
+
+// Chapter is a named section of a video. players get them as json or as a
+// webvtt chapters track, the player page lists them
+type Chapter struct {
+	Name string `json:"name"`
+	// seconds from the start of the video
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	// image url shown for the chapter, absolute or relative to this server
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// normalizeChapters will sort and check chapters, a chapter without an end
+// runs to the next one or to the end of the video
+func normalizeChapters(chapters []Chapter, video VideoRecord) ([]Chapter, error) {
+	if len(chapters) > maxVideoChapters {
+		return nil, errors.New("at most " + strconv.Itoa(maxVideoChapters) + " chapters")
+	}
+	chapters = append([]Chapter{}, chapters...)
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	for i := range chapters {
+		chapter := &chapters[i]
+		chapter.Name = strings.TrimSpace(chapter.Name)
+		if chapter.Name == "" || len(chapter.Name) > 200 {
+			return nil, errors.New("chapters need a name of at most 200 bytes")
+		}
+		// the name is a webvtt cue's text
+		if strings.ContainsAny(chapter.Name, "\r\n") || strings.Contains(chapter.Name, "-->") {
+			return nil, errors.New("chapter names can't have line breaks or -->")
+		}
+		if chapter.Start < 0 || chapter.End < 0 {
+			return nil, errors.New("start and end can't be negative")
+		}
+		if chapter.End == 0 {
+			switch {
+			case i+1 < len(chapters):
+				chapter.End = chapters[i+1].Start
+			case video.Duration > 0:
+				chapter.End = video.Duration
+			default:
+				return nil, fmt.Errorf("chapter %q needs an end", chapter.Name)
+			}
+		}
+		if chapter.End <= chapter.Start {
+			return nil, fmt.Errorf("chapter %q ends before it starts", chapter.Name)
+		}
+		if video.Duration > 0 && chapter.End > video.Duration {
+			return nil, fmt.Errorf("chapter %q is past the end of the video", chapter.Name)
+		}
+		if i > 0 && chapter.Start < chapters[i-1].End {
+			return nil, fmt.Errorf("chapter %q overlaps the one before it", chapter.Name)
+		}
+		if chapter.Thumbnail != "" {
+			thumbnail, err := url.Parse(chapter.Thumbnail)
+			if err != nil || len(chapter.Thumbnail) > 2048 ||
+				!(thumbnail.Scheme == "https" || thumbnail.Scheme == "http" || (thumbnail.Scheme == "" && strings.HasPrefix(thumbnail.Path, "/"))) {
+				return nil, fmt.Errorf("chapter %q has an invalid thumbnail url", chapter.Name)
+			}
+		}
+	}
+	return chapters, nil
+}
+
+// handleGetChapters will return a video's chapters in time order
+func (sm *StreamManager) handleGetChapters(w http.ResponseWriter, r *http.Request) {
+	video, ok := sm.metadata.GetVideo(tenantFrom(r).VideoID(r.PathValue("id")))
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	chapters := video.Chapters
+	if chapters == nil {
+		chapters = []Chapter{}
+	}
+	writeJSON(w, http.StatusOK, chapters)
+}
+
+// handleChaptersVTT will return a video's chapters as a webvtt chapters track
+func (sm *StreamManager) handleChaptersVTT(w http.ResponseWriter, r *http.Request) {
+	video, ok := sm.metadata.GetVideo(tenantFrom(r).VideoID(r.PathValue("id")))
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	cues := make([]SubtitleCue, 0, len(video.Chapters))
+	for _, chapter := range video.Chapters {
+		cues = append(cues, SubtitleCue{
+			Start: time.Duration(chapter.Start * float64(time.Second)),
+			End:   time.Duration(chapter.End * float64(time.Second)),
+			Text:  chapter.Name,
+		})
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Write(renderWebVTT(cues))
+}
+
+// handlePutChapters will replace a video's chapters, an empty list removes them
+func (sm *StreamManager) handlePutChapters(w http.ResponseWriter, r *http.Request) {
+	var chapters []Chapter
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(&chapters); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body, want a list of chapters")
+		return
+	}
+
+	fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+	if video, ok := sm.metadata.GetVideo(fileID); ok && video.Locked() {
+		lockedError(w, video)
+		return
+	}
+	var invalid error
+	err := sm.metadata.UpdateVideo(fileID, func(video *VideoRecord) {
+		normalized, err := normalizeChapters(chapters, *video)
+		if err != nil {
+			invalid = err
+			return
+		}
+		if len(normalized) == 0 {
+			normalized = nil
+		}
+		video.Chapters = normalized
+		chapters = normalized
+	})
+	if err == ErrNotFound {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if invalid != nil {
+		writeError(w, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save chapters")
+		return
+	}
+
+	if chapters == nil {
+		chapters = []Chapter{}
+	}
+	writeJSON(w, http.StatusOK, chapters)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// clip re-encodes are done in parts this long, a restarted job only
+	// redoes the part it was in
+	clipPartLength = 2 * time.Minute
+	// a job whose checkpoint wasn't touched for this long was running on a
+	// replica that went away, the leader restarts it
+	clipJobStale = 2 * time.Minute
+)
+
+// clipJob is the checkpoint of a clip being cut, kept next to the clip until
+// it is done
+type clipJob struct {
+	SourceID string        `json:"source_id"`
+	ClipID   string        `json:"clip_id"`
+	Start    time.Duration `json:"start"`
+	End      time.Duration `json:"end"`
+	Accurate bool          `json:"accurate"`
+	Priority int           `json:"priority,omitempty"`
+	// re-encoded parts that are finished, the next one starts after them
+	Parts int `json:"parts"`
+
+	clipPath string
+}
+
+// clipJobPath is where the checkpoint of a clip to clipPath is kept
+func clipJobPath(clipPath string) string {
+	return clipPath + ".clip.json"
+}
+
+// clipPartPath is where a finished part of a clip re-encode is kept
+func clipPartPath(clipPath string, part int) string {
+	return fmt.Sprintf("%s.part%04d", clipPath, part)
+}
+
+// save will write the checkpoint, which also marks the job as alive
+func (job *clipJob) save() error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(clipJobPath(job.clipPath), data)
+}
+
+// heartbeat will keep the checkpoint fresh until ctx is done, so a job that
+// is slow on one part isn't taken for a dead one
+func (job *clipJob) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(clipJobStale / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			os.Chtimes(clipJobPath(job.clipPath), now, now)
+		}
+	}
+}
+
+// remove will drop the checkpoint and the parts
+func (job *clipJob) remove() {
+	parts, _ := filepath.Glob(job.clipPath + ".part*")
+	for _, part := range parts {
+		os.Remove(part)
+	}
+	os.Remove(clipJobPath(job.clipPath))
+}
+
+func loadClipJob(path string) (*clipJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var job clipJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	job.clipPath = strings.TrimSuffix(path, ".clip.json")
+	return &job, nil
+}
+
+// encodeClipParts will re-encode the clip a part at a time, checkpointing
+// after each, and join the parts into output. parts finished before a
+// restart are kept
+func (sm *StreamManager) encodeClipParts(ctx context.Context, job *clipJob, sourcePath, output string, encodeArgs []string) error {
+	length := job.End - job.Start
+	count := int((length + clipPartLength - 1) / clipPartLength)
+	if count <= 1 {
+		return ffmpegClip(ctx, sourcePath, output, job.Start, job.End, encodeArgs)
+	}
+
+	// a part that went missing is redone with everything after it
+	for part := range job.Parts {
+		if _, err := os.Stat(clipPartPath(job.clipPath, part)); err != nil {
+			job.Parts = part
+			break
+		}
+	}
+	if job.Parts > 0 {
+		log.Println("resuming clip", job.ClipID, "at part", job.Parts+1, "of", count)
+	}
+	for part := job.Parts; part < count; part++ {
+		from := job.Start + time.Duration(part)*clipPartLength
+		to := min(from+clipPartLength, job.End)
+		if err := ffmpegClip(ctx, sourcePath, clipPartPath(job.clipPath, part), from, to, encodeArgs); err != nil {
+			return err
+		}
+		job.Parts = part + 1
+		if err := job.save(); err != nil {
+			log.Println("failed to save clip checkpoint", job.ClipID, err)
+		}
+	}
+
+	// the parts have the same encoding, they are joined without re-encoding
+	var list strings.Builder
+	for part := range count {
+		path, err := filepath.Abs(clipPartPath(job.clipPath, part))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+	}
+	listPath := job.clipPath + ".parts.txt"
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(listPath)
+	return ffmpegConcat(ctx, listPath, output)
+}
+
+// resumeClipJobs will restart clips whose replica went away in the middle of
+// cutting them, from their checkpoint. it runs on the leader
+func (sm *StreamManager) resumeClipJobs(ctx context.Context) {
+	top, _ := filepath.Glob(filepath.Join(VideoStoragePath, "*.clip.json"))
+	nested, _ := filepath.Glob(filepath.Join(VideoStoragePath, "*", "*.clip.json"))
+	for _, path := range append(top, nested...) {
+		if ctx.Err() != nil {
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < clipJobStale {
+			continue
+		}
+		job, err := loadClipJob(path)
+		if err != nil {
+			log.Println("failed to load clip checkpoint", path, err)
+			continue
+		}
+		// deleted or given up on in the meantime
+		if clip, ok := sm.metadata.GetVideo(job.ClipID); !ok || clip.Status != VideoStatusProcessing {
+			job.remove()
+			continue
+		}
+		log.Println("restarting interrupted clip", job.ClipID)
+		// claim it before the next run looks at it again
+		job.save()
+		go sm.cutClip(job)
+	}
+}
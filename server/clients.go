@@ -0,0 +1,604 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// the parts of the openapi document the clients are generated from, it is
+// read back from its json so the clients see exactly what is published
+type specDocument struct {
+	Paths      map[string]map[string]specOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]*specSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type specOperation struct {
+	OperationID string `json:"operationId"`
+	Summary     string `json:"summary"`
+	Parameters  []struct {
+		Name string `json:"name"`
+		In   string `json:"in"`
+	} `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]json.RawMessage `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema *specSchema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+}
+
+type specSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Format               string                 `json:"format"`
+	Items                *specSchema            `json:"items"`
+	Properties           map[string]*specSchema `json:"properties"`
+	AdditionalProperties *specSchema            `json:"additionalProperties"`
+	Required             []string               `json:"required"`
+}
+
+// clientOperation is an operation as the clients call it
+type clientOperation struct {
+	Name    string
+	Summary string
+	Method  string
+	Path    string
+	// path parameters in the order they appear
+	Params []string
+	// content type of the request body, "" for none
+	BodyType string
+	// schema of a json success response, nil when it isn't json
+	Response *specSchema
+	// whether the success response has a body at all
+	HasBody bool
+}
+
+// clientOperations are the operations of the document sorted by path and
+// method, with names that are unique
+func (doc specDocument) clientOperations() []clientOperation {
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	seen := map[string]int{}
+	var operations []clientOperation
+	for _, path := range paths {
+		methods := make([]string, 0, len(doc.Paths[path]))
+		for method := range doc.Paths[path] {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			spec := doc.Paths[path][method]
+			operation := clientOperation{Summary: spec.Summary, Method: strings.ToUpper(method), Path: path}
+			operation.Name = spec.OperationID
+			if operation.Name == "" {
+				operation.Name = operationID(method, path)
+			}
+			if seen[operation.Name]++; seen[operation.Name] > 1 {
+				operation.Name += fmt.Sprint(seen[operation.Name])
+			}
+			for _, param := range spec.Parameters {
+				if param.In == "path" {
+					operation.Params = append(operation.Params, param.Name)
+				}
+			}
+			if spec.RequestBody != nil {
+				for contentType := range spec.RequestBody.Content {
+					operation.BodyType = contentType
+				}
+			}
+			for status, response := range spec.Responses {
+				if status == "default" {
+					continue
+				}
+				operation.HasBody = status != "204" && len(response.Content) > 0
+				if content, ok := response.Content["application/json"]; ok {
+					operation.Response = content.Schema
+					if operation.Response == nil {
+						operation.Response = &specSchema{}
+					}
+				}
+			}
+			operations = append(operations, operation)
+		}
+	}
+	return operations
+}
+
+var clientPathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// exportedName turns a json or operation name into a go one, created_at is
+// CreatedAt
+func exportedName(name string) string {
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	if b.Len() == 0 || unicode.IsDigit(rune(b.String()[0])) {
+		return "X" + b.String()
+	}
+	return b.String()
+}
+
+// paramName is a path parameter as a go or typescript argument
+func paramName(name string) string {
+	name = exportedName(name)
+	name = strings.ToLower(name[:1]) + name[1:]
+	switch name {
+	case "ctx", "query", "body", "type", "func", "var", "default", "range", "map", "package", "import", "new", "delete":
+		return name + "Param"
+	}
+	return name
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// goType is the go type of a schema
+func goType(schema *specSchema) string {
+	if schema == nil {
+		return "json.RawMessage"
+	}
+	if schema.Ref != "" {
+		return refName(schema.Ref)
+	}
+	switch schema.Type {
+	case "boolean":
+		return "bool"
+	case "integer":
+		return "int64"
+	case "number":
+		return "float64"
+	case "string":
+		switch schema.Format {
+		case "date-time":
+			return "time.Time"
+		case "byte":
+			return "[]byte"
+		}
+		return "string"
+	case "array":
+		return "[]" + goType(schema.Items)
+	case "object":
+		if schema.Properties == nil {
+			return "map[string]" + goType(schema.AdditionalProperties)
+		}
+		return "struct {\n" + goFields(schema) + "}"
+	}
+	return "json.RawMessage"
+}
+
+// goFields are the fields of an object schema, sorted like the json
+func goFields(schema *specSchema) string {
+	names := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	required := map[string]bool{}
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+	var b strings.Builder
+	fields := map[string]int{}
+	for _, name := range names {
+		field := exportedName(name)
+		if fields[field]++; fields[field] > 1 {
+			field += fmt.Sprint(fields[field])
+		}
+		tag := name
+		if !required[name] {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(&b, "%s %s `json:%q`\n", field, goType(schema.Properties[name]), tag)
+	}
+	return b.String()
+}
+
+// goZero is what a generated method returns with an error
+func goZero(goType string) string {
+	switch {
+	case goType == "bool":
+		return "false"
+	case goType == "string":
+		return `""`
+	case goType == "int64", goType == "float64":
+		return "0"
+	}
+	return "nil"
+}
+
+// generateGoClient will write a go client package for the document
+func generateGoClient(doc specDocument) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(`// Code generated from the video streaming server's /api/openapi.json. DO NOT EDIT.
+
+// Package videoclient calls the video streaming server's api.
+package videoclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var _ = time.Time{}
+
+// Client calls the api at BaseURL
+type Client struct {
+	BaseURL string
+	// a token for the routes that need one, sent as a bearer token
+	Token string
+	// the admin key, sent as X-API-Key
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// New is a client of the server at baseURL, like http://localhost:8080
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+// Error is an error response of the api
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func escapePath(value string) string {
+	parts := strings.Split(value, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// do will send a request, a response that isn't a success is returned as an *Error
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var body struct {
+			Error APIError ` + "`json:\"error\"`" + `
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return nil, &Error{Status: resp.StatusCode, Code: body.Error.Code, Message: body.Error.Message}
+	}
+	return resp, nil
+}
+
+func jsonBody(body interface{}) (io.Reader, error) {
+	if body == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func decode(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+`)
+
+	names := make([]string, 0, len(doc.Components.Schemas))
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		schema := doc.Components.Schemas[name]
+		if schema == nil || schema.Properties == nil {
+			fmt.Fprintf(&b, "\ntype %s %s\n", name, goType(schema))
+			continue
+		}
+		fmt.Fprintf(&b, "\ntype %s struct {\n%s}\n", name, goFields(schema))
+	}
+
+	for _, operation := range doc.clientOperations() {
+		name := exportedName(operation.Name)
+		args := []string{"ctx context.Context"}
+		path := clientPathParam.ReplaceAllStringFunc(operation.Path, func(match string) string {
+			param := paramName(match[1 : len(match)-1])
+			args = append(args, param+" string")
+			return `" + escapePath(` + param + `) + "`
+		})
+		path = strings.ReplaceAll(`"`+path+`"`, ` + ""`, "")
+		args = append(args, "query url.Values")
+
+		body, contentType := "nil", `""`
+		prepare := ""
+		if operation.BodyType != "" {
+			contentType = fmt.Sprintf("%q", operation.BodyType)
+			if operation.BodyType == "application/json" {
+				args = append(args, "body interface{}")
+				prepare = "reader, err := jsonBody(body)\nif err != nil {\nreturn %s\n}\n"
+				body = "reader"
+			} else {
+				args = append(args, "body io.Reader")
+				body = "body"
+			}
+		}
+
+		b.WriteString("\n")
+		if operation.Summary != "" {
+			fmt.Fprintf(&b, "// %s: %s\n", name, strings.ReplaceAll(operation.Summary, "\n", " "))
+		}
+		call := fmt.Sprintf("c.do(ctx, %q, %s, query, %s, %s)", operation.Method, path, body, contentType)
+		switch {
+		case operation.Response != nil:
+			result := goType(operation.Response)
+			returned, zero := "out", goZero(result)
+			if operation.Response.Ref != "" || strings.HasPrefix(result, "struct") {
+				returned = "&out"
+				result = "*" + result
+			}
+			fmt.Fprintf(&b, "func (c *Client) %s(%s) (%s, error) {\n", name, strings.Join(args, ", "), result)
+			if prepare != "" {
+				fmt.Fprintf(&b, prepare, zero+", err")
+			}
+			fmt.Fprintf(&b, "resp, err := %s\nif err != nil {\nreturn %s, err\n}\n", call, zero)
+			fmt.Fprintf(&b, "var out %s\nif err := decode(resp, &out); err != nil {\nreturn %s, err\n}\nreturn %s, nil\n}\n",
+				strings.TrimPrefix(result, "*"), zero, returned)
+		case operation.HasBody:
+			b.WriteString("// the caller closes the response body\n")
+			fmt.Fprintf(&b, "func (c *Client) %s(%s) (*http.Response, error) {\n", name, strings.Join(args, ", "))
+			if prepare != "" {
+				fmt.Fprintf(&b, prepare, "nil, err")
+			}
+			fmt.Fprintf(&b, "return %s\n}\n", call)
+		default:
+			fmt.Fprintf(&b, "func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+			if prepare != "" {
+				fmt.Fprintf(&b, prepare, "err")
+			}
+			fmt.Fprintf(&b, "resp, err := %s\nif err != nil {\nreturn err\n}\nreturn resp.Body.Close()\n}\n", call)
+		}
+	}
+	return format.Source(b.Bytes())
+}
+
+var tsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// tsType is the typescript type of a schema
+func tsType(schema *specSchema) string {
+	if schema == nil {
+		return "unknown"
+	}
+	if schema.Ref != "" {
+		return refName(schema.Ref)
+	}
+	switch schema.Type {
+	case "boolean":
+		return "boolean"
+	case "integer", "number":
+		return "number"
+	case "string":
+		return "string"
+	case "array":
+		return "Array<" + tsType(schema.Items) + ">"
+	case "object":
+		if schema.Properties == nil {
+			return "Record<string, " + tsType(schema.AdditionalProperties) + ">"
+		}
+		return "{\n" + tsFields(schema, "  ") + "}"
+	}
+	return "unknown"
+}
+
+func tsFields(schema *specSchema, indent string) string {
+	names := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	required := map[string]bool{}
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+	var b strings.Builder
+	for _, name := range names {
+		key := name
+		if !tsIdentifier.MatchString(key) {
+			key = fmt.Sprintf("%q", key)
+		}
+		if !required[name] {
+			key += "?"
+		}
+		fmt.Fprintf(&b, "%s%s: %s;\n", indent, key, tsType(schema.Properties[name]))
+	}
+	return b.String()
+}
+
+// generateTSClient will write a typescript client module for the document,
+// it uses fetch so it runs in browsers, node 18 and deno
+func generateTSClient(doc specDocument) []byte {
+	var b bytes.Buffer
+	b.WriteString(`// generated from the video streaming server's /api/openapi.json, don't edit
+
+export interface ClientOptions {
+  // a token for the routes that need one, sent as a bearer token
+  token?: string;
+  // the admin key, sent as X-API-Key
+  apiKey?: string;
+  fetch?: typeof fetch;
+}
+
+// an error response of the api
+export class APIResponseError extends Error {
+  constructor(public status: number, public code: string, message: string) {
+    super(status + " " + code + ": " + message);
+  }
+}
+
+const escapePath = (value: string) => value.split("/").map(encodeURIComponent).join("/");
+`)
+
+	names := make([]string, 0, len(doc.Components.Schemas))
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		schema := doc.Components.Schemas[name]
+		if schema == nil || schema.Properties == nil {
+			fmt.Fprintf(&b, "\nexport type %s = %s;\n", name, tsType(schema))
+			continue
+		}
+		fmt.Fprintf(&b, "\nexport interface %s {\n%s}\n", name, tsFields(schema, "  "))
+	}
+
+	b.WriteString(`
+export class Client {
+  constructor(public baseURL: string, public options: ClientOptions = {}) {
+    this.baseURL = baseURL.replace(/\/+$/, "");
+  }
+
+  // request will send a request, a response that isn't a success is thrown
+  // as an APIResponseError
+  async request(method: string, path: string, query?: Record<string, string>, body?: BodyInit, contentType?: string): Promise<Response> {
+    let url = this.baseURL + path;
+    if (query && Object.keys(query).length > 0) {
+      url += "?" + new URLSearchParams(query).toString();
+    }
+    const headers: Record<string, string> = {};
+    if (contentType) headers["Content-Type"] = contentType;
+    if (this.options.token) headers["Authorization"] = "Bearer " + this.options.token;
+    if (this.options.apiKey) headers["X-API-Key"] = this.options.apiKey;
+    const resp = await (this.options.fetch ?? fetch)(url, { method, headers, body });
+    if (resp.status >= 300) {
+      const data = await resp.json().catch(() => ({}));
+      throw new APIResponseError(resp.status, data?.error?.code ?? "", data?.error?.message ?? resp.statusText);
+    }
+    return resp;
+  }
+`)
+	for _, operation := range doc.clientOperations() {
+		name := paramName(operation.Name)
+		var args []string
+		path := clientPathParam.ReplaceAllStringFunc(operation.Path, func(match string) string {
+			param := paramName(match[1 : len(match)-1])
+			args = append(args, param+": string")
+			return "${escapePath(" + param + ")}"
+		})
+		args = append(args, "query?: Record<string, string>")
+
+		body, contentType := "undefined", "undefined"
+		if operation.BodyType != "" {
+			contentType = fmt.Sprintf("%q", operation.BodyType)
+			if operation.BodyType == "application/json" {
+				args = append(args, "body?: unknown")
+				body = "body === undefined ? undefined : JSON.stringify(body)"
+			} else {
+				args = append(args, "body?: BodyInit")
+				body = "body"
+			}
+		}
+		call := fmt.Sprintf("this.request(%q, `%s`, query, %s, %s)", operation.Method, path, body, contentType)
+
+		b.WriteString("\n")
+		if operation.Summary != "" {
+			fmt.Fprintf(&b, "  // %s\n", strings.ReplaceAll(operation.Summary, "\n", " "))
+		}
+		switch {
+		case operation.Response != nil:
+			fmt.Fprintf(&b, "  async %s(%s): Promise<%s> {\n    return (await %s).json();\n  }\n",
+				name, strings.Join(args, ", "), tsType(operation.Response), call)
+		case operation.HasBody:
+			fmt.Fprintf(&b, "  %s(%s): Promise<Response> {\n    return %s;\n  }\n", name, strings.Join(args, ", "), call)
+		default:
+			fmt.Fprintf(&b, "  async %s(%s): Promise<void> {\n    await %s;\n  }\n", name, strings.Join(args, ", "), call)
+		}
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// handleAPIClient will serve a client of the api generated from the openapi
+// document, /api/clients/go is a go package and /api/clients/ts a
+// typescript module
+func (s *Server) handleAPIClient(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(s.openAPI(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to build the openapi document")
+		return
+	}
+	var doc specDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to read the openapi document")
+		return
+	}
+
+	switch r.PathValue("lang") {
+	case "go":
+		source, err := generateGoClient(doc)
+		if err != nil {
+			log.Println("generated go client doesn't build", err)
+			writeError(w, http.StatusInternalServerError, "failed to generate the go client")
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-go; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="videoclient.go"`)
+		w.Write(source)
+	case "ts":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="videoclient.ts"`)
+		w.Write(generateTSClient(doc))
+	default:
+		writeError(w, http.StatusNotFound, "no client for "+r.PathValue("lang")+", there are go and ts")
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long cutting a single clip may take
+const clipTimeout = 30 * time.Minute
+
+// handleCreateClip will cut start..end out of a video into a new video. the
+// clip is registered right away as processing and becomes ready like an upload
+func (sm *StreamManager) handleCreateClip(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+		Start string `json:"start"`
+		End   string `json:"end"`
+		// re-encode for frame accurate cuts, stream copy cuts on keyframes
+		Accurate bool `json:"accurate"`
+		// place of the re-encode in the transcode queue, -10 to 10
+		Priority int `json:"priority"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	start, err := parseClipTime(req.Start)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid start")
+		return
+	}
+	end, err := parseClipTime(req.End)
+	if err != nil || end <= start {
+		writeError(w, http.StatusBadRequest, "end must be after start")
+		return
+	}
+	if req.Priority < PriorityBackground || req.Priority > PriorityViewer {
+		writeError(w, http.StatusBadRequest, "priority must be between -10 and 10")
+		return
+	}
+	if req.ID == "" {
+		req.ID = newID()
+	}
+	if !isSafeName(req.ID) {
+		writeError(w, http.StatusBadRequest, "invalid clip id")
+		return
+	}
+	if _, err := exec.LookPath(FFmpegPath); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "clipping needs ffmpeg")
+		return
+	}
+
+	tenant := tenantFrom(r)
+	sourceID := tenant.VideoID(r.PathValue("id"))
+	source, ok := sm.metadata.GetVideo(sourceID)
+	if !ok || !source.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if !source.IsVideo() {
+		writeError(w, http.StatusBadRequest, "only videos can be clipped")
+		return
+	}
+	if source.Duration > 0 && end.Seconds() > source.Duration {
+		writeError(w, http.StatusBadRequest, "end is past the end of the video")
+		return
+	}
+
+	clipID := tenant.VideoID(req.ID)
+	if _, exists := sm.metadata.GetVideo(clipID); exists || sm.hasUploadSession(clipID) {
+		writeError(w, http.StatusConflict, "a video with this id already exists")
+		return
+	}
+	if err := sm.checkTenantQuota(tenant, 0); err != nil {
+		writeError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	}
+
+	if req.Title == "" {
+		req.Title = source.Title + " (clip)"
+	}
+	clip := VideoRecord{
+		ID:        req.ID,
+		Tenant:    tenant.ID,
+		Title:     req.Title,
+		Status:    VideoStatusProcessing,
+		ClipOf:    source.ID,
+		Profile:   source.Profile,
+		Owner:     sm.tokens.Subject(r),
+		CreatedAt: time.Now(),
+	}
+	if err := sm.metadata.PutVideo(clip); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save video")
+		return
+	}
+
+	job := &clipJob{
+		SourceID: sourceID,
+		ClipID:   clipID,
+		Start:    start,
+		End:      end,
+		Accurate: req.Accurate,
+		Priority: req.Priority,
+		clipPath: filepath.Join(VideoStoragePath, videoKey(clipID)),
+	}
+	go sm.cutClip(job)
+	writeJSON(w, http.StatusAccepted, clip)
+}
+
+// cutClip will run ffmpeg and queue the result for the upload validation, a
+// failed cut marks the clip rejected. the job is checkpointed while it runs,
+// if the replica goes away the leader restarts it from there
+func (sm *StreamManager) cutClip(job *clipJob) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sourceID, clipID := job.SourceID, job.ClipID
+	if err := os.MkdirAll(filepath.Dir(job.clipPath), 0755); err == nil {
+		if err := job.save(); err != nil {
+			log.Println("failed to save clip checkpoint", clipID, err)
+		}
+	}
+	go job.heartbeat(ctx)
+	defer job.remove()
+
+	if err := sm.runClip(ctx, job); err != nil {
+		log.Println("failed to cut clip", clipID, "of", sourceID, err)
+		sm.metadata.UpdateVideo(clipID, func(video *VideoRecord) {
+			video.Status = VideoStatusRejected
+			video.Reason = err.Error()
+		})
+		sm.events.Emit(EventVideoRejected, clipID, map[string]string{"reason": err.Error()})
+		return
+	}
+	if err := sm.jobs.Enqueue(JobFinalizeUpload, clipID, nil); err != nil {
+		log.Println("failed to queue clip validation", clipID, err)
+	}
+}
+
+func (sm *StreamManager) runClip(ctx context.Context, job *clipJob) error {
+	sourceID, clipID, start, end := job.SourceID, job.ClipID, job.Start, job.End
+	sourcePath, cleanup, err := sm.localVideoPath(ctx, sourceID)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	clipPath := job.clipPath
+	if err := os.MkdirAll(filepath.Dir(clipPath), 0755); err != nil {
+		return err
+	}
+
+	output := filepath.Join(filepath.Dir(clipPath), ".tmp-clip-"+filepath.Base(clipPath))
+	defer os.Remove(output)
+
+	// re-encodes use the top rendition of the clip's profile and take a
+	// transcode worker, the estimator counts them
+	clip, _ := sm.metadata.GetVideo(clipID)
+	source, _ := sm.metadata.GetVideo(sourceID)
+	profile := sm.profileFor(clip)
+	cut := func(reencode bool) error {
+		if !reencode {
+			ctx, cancel := context.WithTimeout(ctx, clipTimeout)
+			defer cancel()
+			return ffmpegClip(ctx, sourcePath, output, start, end, nil)
+		}
+		transcode := &TranscodeJob{
+			Kind:     "clip",
+			VideoID:  clipID,
+			Priority: job.Priority,
+			Duration: (end - start).Seconds(),
+			estimate: clipEncodeEstimate(end-start, profile.Top()),
+		}
+		// the time waiting for a worker doesn't count against the timeout
+		return sm.transcodes.Run(ctx, transcode, func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, clipTimeout)
+			defer cancel()
+			return sm.encodeClipParts(ctx, job, sourcePath, output, profile.encodeArgs(profile.Top(), source, nil, false))
+		})
+	}
+
+	// stream copy is fast and lossless but can only cut on keyframes, fall
+	// back to re-encoding when it fails or an accurate cut was asked for. a
+	// restarted job with finished parts was re-encoding already
+	accurate := job.Accurate || job.Parts > 0
+	err = cut(accurate)
+	if err != nil && !accurate {
+		err = cut(true)
+	}
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	checksum, err := fileSHA256(output)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(output, clipPath); err != nil {
+		return err
+	}
+	return sm.metadata.UpdateVideo(clipID, func(video *VideoRecord) {
+		video.Size = info.Size()
+		video.SHA256 = checksum
+	})
+}
+
+// ffmpegClip will write start..end of input to output as mp4, re-encoding
+// with encodeArgs or stream copying when there are none
+func ffmpegClip(ctx context.Context, input, output string, start, end time.Duration, encodeArgs []string) error {
+	args := []string{
+		"-hide_banner", "-nostats", "-y",
+		"-ss", strconv.FormatFloat(start.Seconds(), 'f', 3, 64),
+		"-to", strconv.FormatFloat(end.Seconds(), 'f', 3, 64),
+		"-i", input,
+		"-map", "0:v?", "-map", "0:a?",
+	}
+	if encodeArgs != nil {
+		args = append(args, encodeArgs...)
+	} else {
+		args = append(args, "-c", "copy", "-avoid_negative_ts", "make_zero")
+	}
+	args = append(args, "-movflags", "+faststart", "-f", "mp4", output)
+
+	if output, err := exec.CommandContext(ctx, FFmpegPath, args...).CombinedOutput(); err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return fmt.Errorf("ffmpeg failed: %s", lines[len(lines)-1])
+	}
+	return nil
+}
+
+// ffmpegConcat will join the mp4s listed in listPath into output without
+// re-encoding
+func ffmpegConcat(ctx context.Context, listPath, output string) error {
+	args := []string{
+		"-hide_banner", "-nostats", "-y",
+		"-f", "concat", "-safe", "0", "-i", listPath,
+		"-c", "copy", "-movflags", "+faststart", "-f", "mp4", output,
+	}
+	if output, err := exec.CommandContext(ctx, FFmpegPath, args...).CombinedOutput(); err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return fmt.Errorf("ffmpeg failed: %s", lines[len(lines)-1])
+	}
+	return nil
+}
+
+// parseClipTime will parse seconds ("90.5") or a timestamp ("1:30", "00:01:30.500")
+func parseClipTime(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, ":") {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return parseCueTimestamp(value)
+}
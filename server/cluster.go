@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// "edge" makes this instance a caching proxy in front of ORIGIN_URL, it
+	// keeps no videos of its own. anything else is a normal (origin) instance
+	ClusterRole = envString("CLUSTER_ROLE", "")
+	// the instance edges proxy to, it has the storage and the metadata
+	OriginURL = strings.TrimSuffix(envString("ORIGIN_URL", ""), "/")
+	// base urls of all edges, comma separated. videos are spread over them
+	// by consistent hashing so each one is cached on one edge, and the
+	// origin tells them all when a video goes away
+	EdgePeers = envString("EDGE_PEERS", "")
+	// this edge's own url as it appears in EDGE_PEERS
+	EdgeSelf = strings.TrimSuffix(envString("EDGE_SELF", ""), "/")
+	// shared between origin and edges for the invalidation requests
+	ClusterSecret = envString("CLUSTER_SECRET", "")
+)
+
+// edgeHopHeader marks a request one edge passed to another, it is answered
+// without passing it on again
+const edgeHopHeader = "X-Edge-Hop"
+
+// hls segments and init segments, with or without a tenant. playlists carry
+// per viewer tokens and the aes key must never sit in a cache, those two are
+// proxied like everything else
+var edgeSegmentPath = regexp.MustCompile(`^/api/(?:[^/]+/)?hls/[^/]+/[^/]+$`)
+
+// edgePeerList will parse EDGE_PEERS
+func edgePeerList() []string {
+	var peers []string
+	for _, peer := range strings.Split(EdgePeers, ",") {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// hashRing maps video ids to peers, adding or removing one peer only moves
+// the videos of that peer
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// points each peer gets on the ring, more spread the videos more evenly
+const hashRingReplicas = 128
+
+func newHashRing(peers []string) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string)}
+	for _, peer := range peers {
+		for i := range hashRingReplicas {
+			point := crc32.ChecksumIEEE([]byte(peer + "#" + strconv.Itoa(i)))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = peer
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Owner is the peer a video belongs to, "" when there are no peers
+func (hr *hashRing) Owner(fileID string) string {
+	if len(hr.points) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(fileID))
+	i := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= hash })
+	if i == len(hr.points) {
+		i = 0
+	}
+	return hr.owners[hr.points[i]]
+}
+
+// Edge is the handler of an edge instance. segments are served from the
+// block cache, fetched from the origin on a miss by the edge owning the
+// video, everything else goes to the origin as is. tokens are checked with
+// the shared AUTH_SECRET, revocations only reach the origin
+type Edge struct {
+	sm     *StreamManager
+	origin *url.URL
+	ring   *hashRing
+	client *http.Client
+	// segments and the invalidation hook, behind the tenant resolution
+	local http.Handler
+}
+
+// NewEdge will create the edge handler for sm
+func NewEdge(sm *StreamManager) (*Edge, error) {
+	origin, err := url.Parse(OriginURL)
+	if err != nil || origin.Host == "" || (origin.Scheme != "http" && origin.Scheme != "https") {
+		return nil, errors.New("CLUSTER_ROLE=edge needs ORIGIN_URL, like http://origin:8080")
+	}
+	peers := edgePeerList()
+	if len(peers) > 0 && !slices.Contains(peers, EdgeSelf) {
+		return nil, errors.New("EDGE_SELF must be one of EDGE_PEERS")
+	}
+	if !sm.cache.Enabled() {
+		log.Println("SEGMENT_CACHE_BYTES is 0, the edge will only proxy")
+	}
+	e := &Edge{
+		sm:     sm,
+		origin: origin,
+		ring:   newHashRing(peers),
+		client: &http.Client{Timeout: time.Minute},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/hls/{id}/{file}", sm.tokens.RequireSession(e.handleSegment))
+	mux.HandleFunc("POST /internal/edge/invalidate", e.handleInvalidate)
+	mux.HandleFunc("POST /internal/edge/pin", e.handlePin)
+	mux.HandleFunc("GET /admin/cache", requireAdmin(sm.cache.handleCache))
+	mux.HandleFunc("DELETE /admin/cache", requireAdmin(sm.cache.handleCache))
+	e.local = Chain(mux, JSONErrors, sm.tenants.Resolve)
+	return e, nil
+}
+
+func (e *Edge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/healthz" || r.URL.Path == "/readyz":
+		handleHealthz(w, r)
+	case r.Method == http.MethodGet && edgeSegmentPath.MatchString(r.URL.Path) && !isEdgeUncached(r.URL.Path):
+		// the tenant resolution strips the tenant off the path, peers and
+		// the origin need it
+		e.local.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), edgeRequestKey{}, r)))
+	case strings.HasPrefix(r.URL.Path, "/internal/edge/") || r.URL.Path == "/admin/cache":
+		e.local.ServeHTTP(w, r)
+	default:
+		e.proxy(e.origin).ServeHTTP(w, r)
+	}
+}
+
+type edgeRequestKey struct{}
+
+// edgeRequest is r as it reached the edge
+func edgeRequest(r *http.Request) *http.Request {
+	if original, ok := r.Context().Value(edgeRequestKey{}).(*http.Request); ok {
+		return original.WithContext(r.Context())
+	}
+	return r
+}
+
+// isEdgeUncached reports whether an hls or dash path is a playlist, the
+// manifest or the key, they carry tokens
+func isEdgeUncached(path string) bool {
+	return strings.HasSuffix(path, ".m3u8") || strings.HasSuffix(path, ".mpd") || strings.HasSuffix(path, "/key")
+}
+
+// proxy will pass a request on to target unchanged, the host is kept so the
+// urls the origin puts in responses point back at the edge
+func (e *Edge) proxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Host = pr.In.Host
+			injectTrace(pr.In.Context(), pr.Out.Header)
+		},
+		// server sent events have to get through as they come
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println("edge proxy to", target.Host, "failed", err)
+			writeError(w, http.StatusBadGateway, "origin unavailable")
+		},
+	}
+}
+
+// handleSegment will serve a segment from the cache. a video is cached on
+// the edge owning it, the others pass its segments there
+func (e *Edge) handleSegment(w http.ResponseWriter, r *http.Request) {
+	fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+	owner := e.ring.Owner(fileID)
+	if owner != "" && owner != EdgeSelf && r.Header.Get(edgeHopHeader) == "" {
+		peer, err := url.Parse(owner)
+		if err == nil {
+			proxy := e.proxy(peer)
+			// a peer that is down is skipped, the origin has everything
+			proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+				log.Println("edge peer", owner, "failed, going to the origin", err)
+				e.serveSegment(w, r, fileID)
+			}
+			forward := edgeRequest(r).Clone(r.Context())
+			forward.Header.Set(edgeHopHeader, EdgeSelf)
+			proxy.ServeHTTP(w, forward)
+			return
+		}
+	}
+	e.serveSegment(w, r, fileID)
+}
+
+// edgeFetchError is an answer of the origin that isn't a segment, it is
+// passed on to the client as it is
+type edgeFetchError struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+func (err *edgeFetchError) Error() string {
+	return fmt.Sprintf("origin answered %d", err.status)
+}
+
+func (e *Edge) serveSegment(w http.ResponseWriter, r *http.Request, fileID string) {
+	name := r.PathValue("file")
+	key := segmentKey{object: fileID + "@hls/" + name}
+	data, err := e.sm.cache.Get(key, func() ([]byte, error) {
+		return e.fetchSegment(r)
+	})
+	var fetchErr *edgeFetchError
+	switch {
+	case errors.As(err, &fetchErr):
+		w.Header().Set("Content-Type", fetchErr.contentType)
+		w.WriteHeader(fetchErr.status)
+		w.Write(fetchErr.body)
+		return
+	case err != nil:
+		log.Println("edge failed to fetch segment", fileID, name, err)
+		writeError(w, http.StatusBadGateway, "origin unavailable")
+		return
+	}
+
+	contentType := "video/mp4"
+	if strings.HasSuffix(name, ".ts") {
+		contentType = "video/mp2t"
+	}
+	setCachePolicy(w, r, CacheContent, "")
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// fetchSegment will get a whole segment from the origin with the client's
+// credentials, the origin does the checks that need the metadata
+func (e *Edge) fetchSegment(r *http.Request) ([]byte, error) {
+	req, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), http.MethodGet, OriginURL+edgeRequest(r).URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range []string{"Authorization", "X-API-Key"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+	injectTrace(r.Context(), req.Header)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &edgeFetchError{status: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body}
+	}
+	return body, nil
+}
+
+// handleInvalidate will drop a video's segments, the origin calls it when
+// the video is deleted or replaced
+func (e *Edge) handleInvalidate(w http.ResponseWriter, r *http.Request) {
+	if !validClusterSecret(r) {
+		writeError(w, http.StatusUnauthorized, "cluster secret required")
+		return
+	}
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.ID == "" {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	e.sm.cache.Invalidate(req.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validClusterSecret reports whether a request carries CLUSTER_SECRET, there
+// is no way in without one configured
+func validClusterSecret(r *http.Request) bool {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ClusterSecret != "" && ok && subtle.ConstantTimeCompare([]byte(secret), []byte(ClusterSecret)) == 1
+}
+
+// invalidateEdges will tell every edge to drop a video's segments, in the
+// background with a few retries. nothing happens without EDGE_PEERS
+func (sm *StreamManager) invalidateEdges(fileID string) {
+	body, _ := json.Marshal(map[string]string{"id": fileID})
+	tellEdges("/internal/edge/invalidate", "invalidate "+fileID, body)
+}
+
+// tellEdges will post body to path on every edge, in the background with a
+// few retries. what is only for the failure log
+func tellEdges(path, what string, body []byte) {
+	peers := edgePeerList()
+	if len(peers) == 0 || ClusterRole == "edge" {
+		return
+	}
+	for _, peer := range peers {
+		go func(peer string) {
+			for attempt := range 3 {
+				time.Sleep(time.Duration(attempt) * 5 * time.Second)
+				err := postEdge(peer, path, body)
+				if err == nil {
+					return
+				}
+				log.Println("failed to", what, "on edge", peer, err)
+			}
+		}(peer)
+	}
+}
+
+func postEdge(peer, path string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+ClusterSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("edge answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Collection is a folder of videos, collections nest inside each other. a
+// video is filed in one collection at most
+type Collection struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant,omitempty"`
+	Name   string `json:"name"`
+	// the collection it is in, "" at the top
+	Parent string `json:"parent,omitempty"`
+	// who made it. the owner and the editors of a collection, or of one it
+	// is in, may change it and what's in it. a collection nobody owns all
+	// the way up is open to any upload token
+	Owner     string    `json:"owner,omitempty"`
+	Editors   []string  `json:"editors,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	ErrCollectionExists   = errors.New("a collection with this name is already there")
+	ErrCollectionNotEmpty = errors.New("collection is not empty")
+	ErrCollectionCycle    = errors.New("a collection can't be moved into itself or one of its own")
+)
+
+// collections can't nest deeper than this
+const maxCollectionDepth = 32
+
+func copyCollection(collection *Collection) Collection {
+	cp := *collection
+	cp.Editors = append([]string(nil), collection.Editors...)
+	return cp
+}
+
+// sameTenant reports whether two records' tenants are the same, records from
+// before tenants existed belong to the default one
+func sameTenant(a, b string) bool {
+	if b == "" {
+		b = DefaultTenantID
+	}
+	return inTenant(a, b)
+}
+
+// checkCollectionLocked will make sure a new or changed collection is in a
+// collection of its tenant, isn't inside itself and has a name of its own
+// among its siblings
+func (ms *MetadataStore) checkCollectionLocked(collection *Collection) error {
+	depth := 0
+	for parent := collection.Parent; parent != ""; depth++ {
+		if parent == collection.ID {
+			return ErrCollectionCycle
+		}
+		if depth >= maxCollectionDepth {
+			return errors.New("collections nest too deep")
+		}
+		above, ok := ms.collections[parent]
+		if !ok || !sameTenant(above.Tenant, collection.Tenant) {
+			return ErrNotFound
+		}
+		parent = above.Parent
+	}
+	for _, other := range ms.collections {
+		if other.ID != collection.ID && other.Parent == collection.Parent &&
+			sameTenant(other.Tenant, collection.Tenant) && strings.EqualFold(other.Name, collection.Name) {
+			return ErrCollectionExists
+		}
+	}
+	return nil
+}
+
+// CreateCollection will store a new collection, ErrNotFound when its parent
+// doesn't exist
+func (ms *MetadataStore) CreateCollection(collection Collection) (Collection, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.checkCollectionLocked(&collection); err != nil {
+		return Collection{}, err
+	}
+	ms.collections[collection.ID] = &collection
+	return copyCollection(&collection), ms.saveLocked()
+}
+
+// GetCollection will return a copy of a collection
+func (ms *MetadataStore) GetCollection(id string) (Collection, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	collection, ok := ms.collections[id]
+	if !ok {
+		return Collection{}, ErrNotFound
+	}
+	return copyCollection(collection), nil
+}
+
+// ListCollections will return the tenant's collections in parent ("" for the
+// top), by name
+func (ms *MetadataStore) ListCollections(tenantID, parent string) []Collection {
+	ms.mu.RLock()
+	collections := []Collection{}
+	for _, collection := range ms.collections {
+		if collection.Parent == parent && inTenant(collection.Tenant, tenantID) {
+			collections = append(collections, copyCollection(collection))
+		}
+	}
+	ms.mu.RUnlock()
+	sort.Slice(collections, func(i, j int) bool {
+		return strings.ToLower(collections[i].Name) < strings.ToLower(collections[j].Name)
+	})
+	return collections
+}
+
+// CollectionPath will return a collection and the ones it is in, the top
+// one first
+func (ms *MetadataStore) CollectionPath(id string) []Collection {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var path []Collection
+	for id != "" && len(path) <= maxCollectionDepth {
+		collection, ok := ms.collections[id]
+		if !ok {
+			break
+		}
+		path = append([]Collection{copyCollection(collection)}, path...)
+		id = collection.Parent
+	}
+	return path
+}
+
+// CollectionTree will return the ids of a collection and every collection
+// inside it, the deepest last
+func (ms *MetadataStore) CollectionTree(id string) []string {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	children := make(map[string][]string)
+	for _, collection := range ms.collections {
+		children[collection.Parent] = append(children[collection.Parent], collection.ID)
+	}
+	tree := []string{id}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+// UpdateCollection will apply update to a collection under the store lock and
+// save it, a move into another collection is checked like a new one
+func (ms *MetadataStore) UpdateCollection(id string, update func(collection *Collection) error) (Collection, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	current, ok := ms.collections[id]
+	if !ok {
+		return Collection{}, ErrNotFound
+	}
+	// work on a copy so a failed update leaves the collection untouched
+	updated := copyCollection(current)
+	if err := update(&updated); err != nil {
+		return Collection{}, err
+	}
+	if err := ms.checkCollectionLocked(&updated); err != nil {
+		return Collection{}, err
+	}
+	updated.UpdatedAt = time.Now()
+	ms.collections[id] = &updated
+	return copyCollection(&updated), ms.saveLocked()
+}
+
+// DeleteCollection will remove an empty collection
+func (ms *MetadataStore) DeleteCollection(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.collections[id]; !ok {
+		return ErrNotFound
+	}
+	for _, collection := range ms.collections {
+		if collection.Parent == id {
+			return ErrCollectionNotEmpty
+		}
+	}
+	for _, video := range ms.videos {
+		if video.Collection == id {
+			return ErrCollectionNotEmpty
+		}
+	}
+	delete(ms.collections, id)
+	return ms.saveLocked()
+}
+
+// tenantCollection will return a collection of the request's tenant, other
+// tenants' collections are not found
+func (sm *StreamManager) tenantCollection(r *http.Request, id string) (Collection, error) {
+	collection, err := sm.metadata.GetCollection(id)
+	if err != nil {
+		return Collection{}, err
+	}
+	if !inTenant(collection.Tenant, tenantFrom(r).ID) {
+		return Collection{}, ErrNotFound
+	}
+	return collection, nil
+}
+
+// canEditCollection reports whether the request may change a collection and
+// what's in it, "" is the top where anyone may file videos
+func (sm *StreamManager) canEditCollection(r *http.Request, id string) bool {
+	if id == "" || !sm.tokens.Enabled() {
+		return true
+	}
+	subject := sm.tokens.Subject(r)
+	restricted := false
+	for _, collection := range sm.metadata.CollectionPath(id) {
+		if collection.Owner == "" && len(collection.Editors) == 0 {
+			continue
+		}
+		restricted = true
+		if subject != "" && (collection.Owner == subject || slices.Contains(collection.Editors, subject)) {
+			return true
+		}
+	}
+	return !restricted
+}
+
+// checkCollection will write the error for a collection a video or another
+// collection can't be filed in, false when it did
+func (sm *StreamManager) checkCollection(w http.ResponseWriter, r *http.Request, id string) bool {
+	if id == "" {
+		return true
+	}
+	if _, err := sm.tenantCollection(r, id); err != nil {
+		writeError(w, http.StatusBadRequest, "collection not found")
+		return false
+	}
+	if !sm.canEditCollection(r, id) {
+		writeError(w, http.StatusForbidden, "not an editor of the collection")
+		return false
+	}
+	return true
+}
+
+// writeCollectionError will write the error of a failed collection change
+func writeCollectionError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNotFound:
+		writeError(w, http.StatusNotFound, "collection not found")
+	case ErrCollectionExists, ErrCollectionNotEmpty, ErrCollectionCycle:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, "failed to save collection")
+	}
+}
+
+// validCollectionName will trim a name, false when it can't be used. it is a
+// directory name in the storage tree so it can't have slashes
+func validCollectionName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, name != "" && len(name) <= 200 && !strings.ContainsAny(name, "/\\\x00") && name != "." && name != ".."
+}
+
+// handleListCollections will list the collections in ?parent=, the top ones
+// when it is missing
+func (sm *StreamManager) handleListCollections(w http.ResponseWriter, r *http.Request) {
+	parent := r.URL.Query().Get("parent")
+	if parent != "" {
+		if _, err := sm.tenantCollection(r, parent); err != nil {
+			writeError(w, http.StatusNotFound, "collection not found")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, sm.metadata.ListCollections(tenantFrom(r).ID, parent))
+}
+
+// handleCreateCollection will create a collection, in parent when given. the
+// token's user owns it
+func (sm *StreamManager) handleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string   `json:"name"`
+		Parent  string   `json:"parent"`
+		Editors []string `json:"editors"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	name, ok := validCollectionName(req.Name)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "name is required and can't have slashes")
+		return
+	}
+	if !sm.checkCollection(w, r, req.Parent) {
+		return
+	}
+
+	now := time.Now()
+	collection, err := sm.metadata.CreateCollection(Collection{
+		ID:        newID(),
+		Tenant:    tenantFrom(r).ID,
+		Name:      name,
+		Parent:    req.Parent,
+		Owner:     sm.tokens.Subject(r),
+		Editors:   req.Editors,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	if err != nil {
+		writeCollectionError(w, err)
+		return
+	}
+	sm.collectionsChanged()
+	writeJSON(w, http.StatusCreated, collection)
+}
+
+// CollectionListing is a collection with where it is and what's in it
+type CollectionListing struct {
+	Collection
+	// the collections it is in, the top one first
+	Path        []Collection  `json:"path"`
+	Collections []Collection  `json:"collections"`
+	Videos      []VideoRecord `json:"videos"`
+}
+
+// handleGetCollection will return a collection, the collections it is in and
+// the collections and videos in it
+func (sm *StreamManager) handleGetCollection(w http.ResponseWriter, r *http.Request) {
+	collection, err := sm.tenantCollection(r, r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "collection not found")
+		return
+	}
+	tenantID := tenantFrom(r).ID
+	path := sm.metadata.CollectionPath(collection.ID)
+	videos, _ := sm.metadata.SearchVideos(tenantID, VideoQuery{Sort: "created", Collections: map[string]bool{collection.ID: true}})
+	writeJSON(w, http.StatusOK, CollectionListing{
+		Collection:  collection,
+		Path:        path[:len(path)-1],
+		Collections: sm.metadata.ListCollections(tenantID, collection.ID),
+		Videos:      videos,
+	})
+}
+
+// handleUpdateCollection will rename a collection, move it into another one
+// ("" moves it to the top) or change its editors, which only its owner may
+func (sm *StreamManager) handleUpdateCollection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    *string   `json:"name"`
+		Parent  *string   `json:"parent"`
+		Editors *[]string `json:"editors"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var name string
+	if req.Name != nil {
+		var ok bool
+		if name, ok = validCollectionName(*req.Name); !ok {
+			writeError(w, http.StatusBadRequest, "name can't be empty or have slashes")
+			return
+		}
+	}
+	collection, err := sm.tenantCollection(r, r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "collection not found")
+		return
+	}
+	if !sm.canEditCollection(r, collection.ID) {
+		writeError(w, http.StatusForbidden, "not an editor of the collection")
+		return
+	}
+	if req.Parent != nil && *req.Parent != collection.Parent && !sm.checkCollection(w, r, *req.Parent) {
+		return
+	}
+	if req.Editors != nil && collection.Owner != "" && sm.tokens.Subject(r) != collection.Owner {
+		writeError(w, http.StatusForbidden, "only the owner can change the editors")
+		return
+	}
+
+	collection, err = sm.metadata.UpdateCollection(collection.ID, func(collection *Collection) error {
+		if req.Name != nil {
+			collection.Name = name
+		}
+		if req.Parent != nil {
+			collection.Parent = *req.Parent
+		}
+		if req.Editors != nil {
+			collection.Editors = *req.Editors
+		}
+		return nil
+	})
+	if err != nil {
+		writeCollectionError(w, err)
+		return
+	}
+	sm.collectionsChanged()
+	writeJSON(w, http.StatusOK, collection)
+}
+
+// handleDeleteCollection will delete an empty collection, with ?recursive=1
+// the collections and videos in it go too. nothing is deleted when one of
+// the videos is write once locked
+func (sm *StreamManager) handleDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	collection, err := sm.tenantCollection(r, r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "collection not found")
+		return
+	}
+	if !sm.canEditCollection(r, collection.ID) {
+		writeError(w, http.StatusForbidden, "not an editor of the collection")
+		return
+	}
+
+	tree := []string{collection.ID}
+	if r.URL.Query().Get("recursive") == "1" {
+		tree = sm.metadata.CollectionTree(collection.ID)
+		in := make(map[string]bool, len(tree))
+		for _, id := range tree {
+			in[id] = true
+		}
+		videos, _ := sm.metadata.SearchVideos(tenantFrom(r).ID, VideoQuery{Collections: in})
+		for _, video := range videos {
+			if video.Locked() {
+				lockedError(w, video)
+				return
+			}
+		}
+		for _, video := range videos {
+			if err := sm.deleteVideo(r.Context(), video.Key()); err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to delete video "+video.ID)
+				return
+			}
+		}
+	}
+	// the deepest first, so each is empty by the time it goes
+	for i := len(tree) - 1; i >= 0; i-- {
+		if err := sm.metadata.DeleteCollection(tree[i]); err != nil && err != ErrNotFound {
+			sm.collectionsChanged()
+			writeCollectionError(w, err)
+			return
+		}
+	}
+	sm.collectionsChanged()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMoveToCollection will file videos in the collection, taking them out
+// of the one they were in
+func (sm *StreamManager) handleMoveToCollection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		VideoIDs []string `json:"video_ids"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || len(req.VideoIDs) == 0 {
+		writeError(w, http.StatusBadRequest, "video_ids is required")
+		return
+	}
+	collection, err := sm.tenantCollection(r, r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "collection not found")
+		return
+	}
+	if !sm.canEditCollection(r, collection.ID) {
+		writeError(w, http.StatusForbidden, "not an editor of the collection")
+		return
+	}
+	// every video is checked before any is moved
+	tenant := tenantFrom(r)
+	for _, id := range req.VideoIDs {
+		// an id with a slash would name another tenant's video
+		if !isSafeName(id) {
+			writeError(w, http.StatusBadRequest, "invalid video id "+strconv.Quote(id))
+			return
+		}
+		video, ok := sm.metadata.GetVideo(tenant.VideoID(id))
+		if !ok || !inTenant(video.Tenant, tenant.ID) {
+			writeError(w, http.StatusBadRequest, "video "+id+" not found")
+			return
+		}
+		if video.Locked() {
+			lockedError(w, video)
+			return
+		}
+		if !sm.canEditCollection(r, video.Collection) {
+			writeError(w, http.StatusForbidden, "not an editor of the collection video "+id+" is in")
+			return
+		}
+	}
+	for _, id := range req.VideoIDs {
+		if err := sm.metadata.UpdateVideo(tenant.VideoID(id), func(video *VideoRecord) {
+			video.Collection = collection.ID
+		}); err != nil && err != ErrNotFound {
+			writeError(w, http.StatusInternalServerError, "failed to save video")
+			return
+		}
+	}
+	sm.collectionsChanged()
+	sm.handleGetCollection(w, r)
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a caller can't file another tenant's video by sending its namespaced id
+func TestMoveToCollectionRejectsOtherTenantsVideos(t *testing.T) {
+	dir := t.TempDir()
+	metadata, err := NewMetadataStore(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &StreamManager{
+		metadata:       metadata,
+		tokens:         NewTokenStore("", filepath.Join(dir, "tokens.json")),
+		collectionTree: make(chan struct{}, 1),
+	}
+	if err := metadata.PutVideo(VideoRecord{ID: "x", Tenant: "acme", Status: VideoStatusReady}); err != nil {
+		t.Fatal(err)
+	}
+	collection, err := metadata.CreateCollection(Collection{ID: "c1", Tenant: DefaultTenantID, Name: "mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"acme/x", "../acme/x"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/collections/c1/videos", strings.NewReader(`{"video_ids":["`+id+`"]}`))
+		r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, &Tenant{ID: DefaultTenantID}))
+		r.SetPathValue("id", collection.ID)
+		w := httptest.NewRecorder()
+		sm.handleMoveToCollection(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("moving %q: got %d, want %d", id, w.Code, http.StatusBadRequest)
+		}
+	}
+	if video, _ := metadata.GetVideo("acme/x"); video.Collection != "" {
+		t.Errorf("acme's video was filed in %q", video.Collection)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// a directory the collections are mirrored to as folders of symlinks to the
+// stored videos, named by their titles, for browsing the library on disk.
+// the videos themselves stay where they are. only videos with a local file
+// show up. "" keeps no tree
+var CollectionTreePath = envString("COLLECTION_TREE_PATH", "")
+
+// the tree is built again this often anyway, uploads and deletes don't tell it
+const collectionTreeRefresh = 5 * time.Minute
+
+// AllCollections will return every tenant's collections
+func (ms *MetadataStore) AllCollections() []Collection {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	collections := make([]Collection, 0, len(ms.collections))
+	for _, collection := range ms.collections {
+		collections = append(collections, copyCollection(collection))
+	}
+	return collections
+}
+
+// collectionsChanged will have the tree built again soon, changes coming in
+// together build it once
+func (sm *StreamManager) collectionsChanged() {
+	select {
+	case sm.collectionTree <- struct{}{}:
+	default:
+	}
+}
+
+func (sm *StreamManager) collectionTreeRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(collectionTreeRefresh)
+	defer ticker.Stop()
+	for {
+		if err := sm.buildCollectionTree(); err != nil {
+			log.Println("failed to build the collection tree", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-sm.collectionTree:
+		}
+	}
+}
+
+// buildCollectionTree will build the tree next to the old one and swap it in,
+// a reader never sees half of one
+func (sm *StreamManager) buildCollectionTree() error {
+	root, err := filepath.Abs(CollectionTreePath)
+	if err != nil {
+		return err
+	}
+	videosDir, err := filepath.Abs(VideoStoragePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(root), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(root), ".tmp-tree-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	collections := make(map[string]Collection)
+	for _, collection := range sm.metadata.AllCollections() {
+		collections[collection.ID] = collection
+	}
+	dirs := make(map[string]string)
+	var dirOf func(tenantID, id string, depth int) string
+	dirOf = func(tenantID, id string, depth int) string {
+		collection, ok := collections[id]
+		if id == "" || !ok || depth > maxCollectionDepth {
+			return filepath.Join(tmp, treeName(tenantID, DefaultTenantID))
+		}
+		if dir, ok := dirs[id]; ok {
+			return dir
+		}
+		dir := filepath.Join(dirOf(tenantID, collection.Parent, depth+1), treeName(collection.Name, collection.ID))
+		dirs[id] = dir
+		return dir
+	}
+	// empty collections are folders too
+	for _, collection := range collections {
+		tenantID := collection.Tenant
+		if tenantID == "" {
+			tenantID = DefaultTenantID
+		}
+		if err := os.MkdirAll(dirOf(tenantID, collection.ID, 0), 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, video := range sm.metadata.AllVideos() {
+		target := filepath.Join(videosDir, videoKey(video.Key()))
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		dir := dirOf(tenantOf(video.Key()), video.Collection, 0)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		// titles aren't unique, the id tells apart the ones that aren't
+		ext := video.mediaFormat().ext
+		link := filepath.Join(dir, treeName(video.Title, video.ID)+ext)
+		if err := os.Symlink(target, link); os.IsExist(err) {
+			err = os.Symlink(target, filepath.Join(dir, treeName(video.Title, video.ID)+" ("+video.ID+")"+ext))
+		}
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	old := root + ".old"
+	os.RemoveAll(old)
+	if err := os.Rename(root, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, root); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// treeName will make a title or name usable as a file name, fallback when
+// nothing of it is
+func treeName(name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		return fallback
+	}
+	return name
+}
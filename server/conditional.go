@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// strongETag will build a validator from size and mtime, any rewrite of the file changes it
+func strongETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// videoETag will build the validator of a video's file from its content hash
+// when the record has one for this size, a re-encode that keeps the size and
+// mtime (copies that preserve it, second granular storage) still changes it
+func videoETag(video VideoRecord, info os.FileInfo) string {
+	if len(video.SHA256) >= 32 && video.Size == info.Size() {
+		return `"` + video.SHA256[:32] + `"`
+	}
+	return strongETag(info)
+}
+
+// strictIfRange will only let a strong etag in If-Range resume a range. a
+// date or weak etag can't tell two versions apart, so the whole file is sent
+// instead of bytes that might be spliced onto another version
+func strictIfRange(r *http.Request) {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange != "" && !strings.HasPrefix(ifRange, `"`) {
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+	}
+}
+
+// fileSHA256 will hash a file, hex encoded
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
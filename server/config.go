@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// config values that were set but didn't parse, they fell back to their
+// default. the doctor command lists them
+var invalidConfig []string
+
+// parsed will note a value of key that didn't parse, an unset one is fine
+func parsed(key string, err error) bool {
+	if err != nil && os.Getenv(key) != "" {
+		invalidConfig = append(invalidConfig, fmt.Sprintf("%s=%q", key, os.Getenv(key)))
+	}
+	return err == nil
+}
+
+// envString will read a config value from the environment with a default
+func envString(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// envBool will read a boolean config value, anything unparsable is the default
+func envBool(key string, def bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if !parsed(key, err) {
+		return def
+	}
+	return value
+}
+
+// only trust X-Forwarded-For when running behind a known reverse proxy
+var TrustProxyHeaders = envBool("TRUST_PROXY_HEADERS", false)
+
+// the proxies in front of the one we are behind, like a cdn in front of a
+// load balancer, comma separated ips or cidrs. the client is the rightmost
+// X-Forwarded-For entry that isn't one of them, what's left of it the client
+// could have sent itself
+var TrustedProxies = envString("TRUSTED_PROXIES", "")
+
+// secret used to sign playback and upload tokens, empty disables auth
+var AuthSecret = envString("AUTH_SECRET", "")
+
+// key for the /admin endpoints, empty disables them
+var AdminAPIKey = envString("ADMIN_API_KEY", "")
+
+// envInt64 will read an integer config value, anything unparsable is the default
+func envInt64(key string, def int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if !parsed(key, err) {
+		return def
+	}
+	return value
+}
+
+// envFloat64 will read a decimal config value, anything unparsable is the default
+func envFloat64(key string, def float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if !parsed(key, err) {
+		return def
+	}
+	return value
+}
+
+// envDuration will read a duration like "10s" or "24h" from the environment
+func envDuration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if !parsed(key, err) {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// derived renditions (the hls package and the audio files) that weren't
+// requested for this long are deleted, they are made again from the source
+// on the next request. 0 keeps them forever
+var RenditionPruneAfter = envDuration("RENDITION_PRUNE_AFTER", 0)
+
+// a rendition's last request is only updated this often, every segment
+// request would keep the store dirty
+const demandResolution = time.Hour
+
+// DemandStore will keep when each derived rendition of a video was last
+// requested, by video key and rendition ("hls", "aac", "mp3")
+type DemandStore struct {
+	path string
+
+	mu    sync.Mutex
+	last  map[string]map[string]time.Time
+	dirty bool
+}
+
+// NewDemandStore will load the demand from path, a missing file is empty
+func NewDemandStore(path string) (*DemandStore, error) {
+	ds := &DemandStore{path: path, last: make(map[string]map[string]time.Time)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &ds.last); err != nil {
+			return nil, err
+		}
+	}
+	supervisor.Go(context.Background(), "demand-flush", RestartAlways, ds.flushRoutine)
+	return ds, nil
+}
+
+// Record will note a request for a rendition of a video
+func (ds *DemandStore) Record(fileID, rendition string) {
+	now := time.Now()
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if now.Sub(ds.last[fileID][rendition]) < demandResolution {
+		return
+	}
+	if ds.last[fileID] == nil {
+		ds.last[fileID] = make(map[string]time.Time)
+	}
+	ds.last[fileID][rendition] = now.UTC()
+	ds.dirty = true
+}
+
+// LastRequested is when a rendition of a video was last requested, zero
+// when it never was
+func (ds *DemandStore) LastRequested(fileID, rendition string) time.Time {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.last[fileID][rendition]
+}
+
+// Delete will forget a video's demand
+func (ds *DemandStore) Delete(fileID string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.last[fileID]; ok {
+		delete(ds.last, fileID)
+		ds.dirty = true
+	}
+}
+
+func (ds *DemandStore) flushRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		ds.mu.Lock()
+		if !ds.dirty {
+			ds.mu.Unlock()
+			continue
+		}
+		data, err := json.Marshal(ds.last)
+		ds.dirty = false
+		ds.mu.Unlock()
+
+		if err == nil {
+			err = writeFileAtomic(ds.path, data)
+		}
+		if err != nil {
+			log.Println("failed to save rendition demand", err)
+		}
+	}
+}
+
+// demandPath is where rendition demand is persisted
+func demandPath() string {
+	return filepath.Join(VideoStoragePath, ".demand.json")
+}
+
+// pruneRenditions will delete the derived renditions nobody asked for in
+// RenditionPruneAfter. one that was never requested counts from when it was
+// made, so eager audio goes too when nobody listens to it
+func (sm *StreamManager) pruneRenditions(ctx context.Context) {
+	if RenditionPruneAfter <= 0 {
+		return
+	}
+	now := time.Now()
+	for _, video := range sm.metadata.AllVideos() {
+		if ctx.Err() != nil {
+			return
+		}
+		fileID := video.Key()
+		// a launch is coming, nobody has watched it yet
+		if sm.pins.Pinned(fileID) {
+			continue
+		}
+		paths := map[string]string{"hls": hlsDir(fileID)}
+		for name, format := range audioFormats {
+			paths[name] = audioPath(fileID, format)
+		}
+		for rendition, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			used := sm.demand.LastRequested(fileID, rendition)
+			if info.ModTime().After(used) {
+				used = info.ModTime()
+			}
+			if now.Sub(used) < RenditionPruneAfter {
+				continue
+			}
+			log.Println("pruning unwatched", rendition, "rendition of", fileID)
+			if err := os.RemoveAll(path); err != nil {
+				log.Println("failed to prune rendition", path, err)
+			}
+		}
+	}
+}
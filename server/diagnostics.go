@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// server events kept per playback session
+	MaxSessionEvents = 50
+	// diagnostic records kept for the admin api
+	MaxDiagnosticRecords = 500
+	// playback sessions are forgotten after this long without requests
+	SessionLogTTL = 1 * time.Hour
+)
+
+// a single request the server handled for a playback session
+type SessionEvent struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Range    string    `json:"range,omitempty"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration string    `json:"duration"`
+	// instance that served the request
+	Instance string `json:"instance,omitempty"`
+}
+
+// what the player reports when it hits a fatal error
+type PlayerError struct {
+	SessionID   string  `json:"session_id"`
+	VideoID     string  `json:"video_id"`
+	Code        int     `json:"code"`
+	Message     string  `json:"message"`
+	CurrentTime float64 `json:"current_time"`
+	Range       string  `json:"range,omitempty"`
+	Buffered    string  `json:"buffered,omitempty"`
+	UserAgent   string  `json:"user_agent,omitempty"`
+}
+
+// the player error combined with the server side view of the same session
+type DiagnosticRecord struct {
+	ID           string         `json:"id"`
+	CreatedAt    time.Time      `json:"created_at"`
+	ClientIP     string         `json:"client_ip"`
+	Error        PlayerError    `json:"error"`
+	ServerEvents []SessionEvent `json:"server_events"`
+}
+
+type sessionLog struct {
+	events   []SessionEvent
+	lastSeen time.Time
+}
+
+// Diagnostics will keep recent per session request logs and the error reports correlated with them
+type Diagnostics struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionLog
+	records  []*DiagnosticRecord
+
+	playback *PlaybackSessions
+	// where playback request events go, set once the bus is up
+	events *EventBus
+}
+
+// NewDiagnostics will create the diagnostics store
+func NewDiagnostics() *Diagnostics {
+	d := &Diagnostics{sessions: make(map[string]*sessionLog), playback: NewPlaybackSessions()}
+	supervisor.Go(context.Background(), "diagnostics-cleanup", RestartAlways, d.cleanupRoutine)
+	return d
+}
+
+// Record will append a server event to a playback session log
+func (d *Diagnostics) Record(sessionID string, event SessionEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sl, ok := d.sessions[sessionID]
+	if !ok {
+		sl = &sessionLog{}
+		d.sessions[sessionID] = sl
+	}
+	sl.events = append(sl.events, event)
+	if len(sl.events) > MaxSessionEvents {
+		sl.events = sl.events[len(sl.events)-MaxSessionEvents:]
+	}
+	sl.lastSeen = event.Time
+}
+
+// Track will wrap a handler and log each request of a playback session. a
+// signed session token (X-Playback-Session) is started with the first request
+// and sent back, later range and segment requests carry it to any instance.
+// a player's own ?sid= wins for the log so its beacons still match
+func (d *Diagnostics) Track(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, session, ok := d.playback.FromRequest(r)
+		if !ok && isPlaybackStart(r) && requestedVideoID(r) != "" {
+			token, session = d.playback.Issue(requestedVideoID(r), tenantFrom(r).ID)
+			ok = true
+		}
+		if ok {
+			w.Header().Set("X-Playback-Session", token)
+			r = r.WithContext(context.WithValue(r.Context(), playbackSessionKey{}, playbackContext{token: token, session: session}))
+		}
+		sessionID := r.URL.Query().Get("sid")
+		if sessionID == "" && ok {
+			sessionID = session.ID
+		}
+		if sessionID == "" {
+			next(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		event := SessionEvent{
+			Time:     start,
+			Path:     r.URL.Path,
+			Range:    r.Header.Get("Range"),
+			Status:   rec.status,
+			Bytes:    rec.bytes,
+			Duration: time.Since(start).String(),
+			Instance: d.playback.instance,
+		}
+		d.Record(sessionID, event)
+		if ok && PlaybackRequestEvents && d.events != nil {
+			d.events.Emit(EventPlaybackRequest, scopeID(session.Tenant, session.VideoID), map[string]interface{}{
+				"session":    session.ID,
+				"origin":     session.Origin,
+				"started_at": time.Unix(session.StartedAt, 0).UTC(),
+				"request":    event,
+			})
+		}
+	}
+}
+
+// Correlate will store a player error together with the server log for its session
+func (d *Diagnostics) Correlate(report PlayerError, clientIP string) *DiagnosticRecord {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	record := &DiagnosticRecord{
+		ID:        hex.EncodeToString(id),
+		CreatedAt: time.Now(),
+		ClientIP:  clientIP,
+		Error:     report,
+	}
+	if sl, ok := d.sessions[report.SessionID]; ok {
+		record.ServerEvents = append([]SessionEvent(nil), sl.events...)
+	}
+
+	d.records = append(d.records, record)
+	if len(d.records) > MaxDiagnosticRecords {
+		d.records = d.records[len(d.records)-MaxDiagnosticRecords:]
+	}
+	return record
+}
+
+// Records will return stored records newest first, filtered by video or session when set
+func (d *Diagnostics) Records(videoID, sessionID string) []*DiagnosticRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	records := make([]*DiagnosticRecord, 0)
+	for i := len(d.records) - 1; i >= 0; i-- {
+		record := d.records[i]
+		if videoID != "" && record.Error.VideoID != videoID {
+			continue
+		}
+		if sessionID != "" && record.Error.SessionID != sessionID {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func (d *Diagnostics) cleanupRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(15 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		for id, sl := range d.sessions {
+			if time.Since(sl.lastSeen) > SessionLogTTL {
+				delete(d.sessions, id)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// handleBeacon will accept a fatal error report from the player
+func (d *Diagnostics) handleBeacon(w http.ResponseWriter, r *http.Request) {
+	var report PlayerError
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&report); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid beacon")
+		return
+	}
+	if report.SessionID == "" {
+		writeError(w, http.StatusBadRequest, "session_id is missing")
+		return
+	}
+	if report.UserAgent == "" {
+		report.UserAgent = r.UserAgent()
+	}
+
+	record := d.Correlate(report, clientIP(r))
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": record.ID})
+}
+
+// handleListDiagnostics will list diagnostic records, ?video= and ?session= filter
+func (d *Diagnostics) handleListDiagnostics(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	writeJSON(w, http.StatusOK, d.Records(query.Get("video"), query.Get("session")))
+}
+
+// statusRecorder will remember the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile path of the real writer working when wrapped
+func (rec *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(rec.ResponseWriter, src)
+	}
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the real writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
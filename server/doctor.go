@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// clocks further apart than this break s3 signatures and token expiry
+const maxClockSkew = 5 * time.Minute
+
+// doctor will check what the server needs before it is started, run with
+// "doctor" as the first argument. every check runs even when one fails
+type doctor struct {
+	out      io.Writer
+	failures int
+	warnings int
+}
+
+func (d *doctor) ok(check, format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "  ok    %-10s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(check, format string, args ...interface{}) {
+	d.warnings++
+	fmt.Fprintf(d.out, "  warn  %-10s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(check, format string, args ...interface{}) {
+	d.failures++
+	fmt.Fprintf(d.out, "  FAIL  %-10s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// RunDoctor will print a report of every check to out, the exit code is 1
+// when any failed
+func RunDoctor(out io.Writer) int {
+	d := &doctor{out: out}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	fmt.Fprintln(out, "config")
+	d.checkConfig()
+	fmt.Fprintln(out, "storage")
+	storage := d.checkStorage(ctx)
+	fmt.Fprintln(out, "tools")
+	d.checkTool(ctx, "ffmpeg", FFmpegPath, "transcodes, renditions and previews won't work")
+	if _, err := exec.LookPath(FFprobePath); err != nil && ProbeUploads {
+		// the server won't start without it, see checkProbeAvailable
+		d.fail("ffprobe", "not found, the server won't start without it unless PROBE_UPLOADS=false")
+	} else {
+		d.checkTool(ctx, "ffprobe", FFprobePath, "uploads won't be validated")
+	}
+	fmt.Fprintln(out, "stores")
+	d.checkStores(ctx)
+	fmt.Fprintln(out, "ports")
+	if specs, err := parseListenSpecs(ListenAddrs); err != nil {
+		d.fail("listen", "%v", err)
+	} else {
+		for _, spec := range specs {
+			d.checkListen(spec)
+		}
+	}
+	if GRPCAddr != "" {
+		d.checkPort("grpc", GRPCAddr)
+	}
+	fmt.Fprintln(out, "clock")
+	d.checkClock(ctx, storage)
+
+	fmt.Fprintf(out, "\n%d failed, %d warnings\n", d.failures, d.warnings)
+	if d.failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (d *doctor) checkConfig() {
+	for _, value := range invalidConfig {
+		d.fail("env", "%s doesn't parse, the default is used", value)
+	}
+
+	tokens := NewTokenStore(AuthSecret, tokenStatePath())
+	authenticators, err := NewAuthenticatorsFromEnv()
+	switch {
+	case err != nil:
+		d.fail("auth", "%v", err)
+	case !tokens.Enabled() && len(authenticators) == 0:
+		d.warn("auth", "AUTH_SECRET not set, playback and upload are not authenticated")
+	default:
+		d.ok("auth", "signed tokens %t, %d other authenticators", tokens.Signs(), len(authenticators))
+	}
+	if tenants, err := NewTenants(TenantsFile, tokens); err != nil {
+		d.fail("tenants", "%v", err)
+	} else {
+		d.ok("tenants", "%d configured", len(tenants.byID))
+	}
+
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"worm", func() error { _, err := parseWORMTags(WORMTags); return err }},
+		{"keys", func() error { _, err := NewKeyringFromEnv(); return err }},
+		{"scanner", func() error { _, err := NewUploadScanner(UploadScannerURL); return err }},
+		{"events", func() error { _, err := NewEventBusFromEnv(nil); return err }},
+		{"ingest", func() error { _, err := NewIngestSourcesFromEnv(); return err }},
+		{"leader", func() error { _, err := NewElectorFromEnv(); return err }},
+		{"geoip", func() error { _, err := LoadGeoIP(GeoIPDatabase); return err }},
+		{"cluster", checkClusterConfig},
+	}
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			d.fail(c.name, "%v", err)
+		} else {
+			d.ok(c.name, "valid")
+		}
+	}
+}
+
+// checkClusterConfig is what NewEdge checks, without a stream manager
+func checkClusterConfig() error {
+	switch ClusterRole {
+	case "", "origin":
+		return nil
+	case "edge":
+		origin, err := url.Parse(OriginURL)
+		if err != nil || origin.Host == "" || (origin.Scheme != "http" && origin.Scheme != "https") {
+			return fmt.Errorf("CLUSTER_ROLE=edge needs ORIGIN_URL, like http://origin:8080")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown CLUSTER_ROLE %q", ClusterRole)
+	}
+}
+
+// checkStorage will write, read back and delete a file through the storage
+// driver, like an upload being published and played would
+func (d *doctor) checkStorage(ctx context.Context) Storage {
+	if err := os.MkdirAll(VideoStoragePath, 0755); err != nil {
+		d.fail("videos", "%v", err)
+	} else if err := checkWritable(VideoStoragePath); err != nil {
+		d.fail("videos", "%s is not writable: %v", VideoStoragePath, err)
+	} else {
+		d.ok("videos", "%s is writable", VideoStoragePath)
+	}
+
+	storage, err := storageFromEnv()
+	if err != nil {
+		d.fail("driver", "%v", err)
+		return nil
+	}
+	driver := envString("STORAGE_DRIVER", "local")
+	if err := roundTripStorage(ctx, storage); err != nil {
+		d.fail("driver", "%s: %v", driver, err)
+	} else {
+		d.ok("driver", "%s: write, read and delete work", driver)
+	}
+	return storage
+}
+
+func roundTripStorage(ctx context.Context, storage Storage) error {
+	key := ".doctor-" + newID()
+	data := []byte("doctor " + time.Now().UTC().Format(time.RFC3339Nano))
+	if err := storage.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	// the file is removed whatever goes wrong reading it
+	defer storage.Delete(context.WithoutCancel(ctx), key)
+
+	object, err := storage.Open(ctx, key)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	read, err := io.ReadAll(object)
+	object.Close()
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if !bytes.Equal(read, data) {
+		return fmt.Errorf("read back %d bytes that don't match the %d written", len(read), len(data))
+	}
+	if err := storage.Delete(ctx, key); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	if _, err := storage.Stat(ctx, key); err == nil {
+		return fmt.Errorf("deleted file is still there")
+	}
+	return nil
+}
+
+// checkTool will run a tool with -version, missing tools only turn features off
+func (d *doctor) checkTool(ctx context.Context, name, path, without string) {
+	if _, err := exec.LookPath(path); err != nil {
+		d.warn(name, "not found, %s", without)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		d.fail(name, "%s -version: %v", path, err)
+		return
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	d.ok(name, "%s", version)
+}
+
+// checkStores will load the json stores the server keeps its state in, and
+// reach the brokers events are published to
+func (d *doctor) checkStores(ctx context.Context) {
+	stores := []struct {
+		name string
+		path string
+		load func(path string) error
+	}{
+		{"metadata", metadataPath(), func(path string) error { _, err := NewMetadataStore(path); return err }},
+		{"history", historyPath(), func(path string) error { _, err := NewHistoryStore(path); return err }},
+		{"demand", demandPath(), func(path string) error { _, err := NewDemandStore(path); return err }},
+		{"pins", pinsPath(), func(path string) error { _, err := NewPinStore(path); return err }},
+		{"profiles", profilesPath(), func(path string) error { _, err := NewProfileStore(path); return err }},
+		{"links", linksPath(), func(path string) error { _, err := NewLinkStore(path); return err }},
+		{"analytics", analyticsPath(), func(path string) error { _, err := NewAnalytics(path); return err }},
+	}
+	for _, store := range stores {
+		if err := store.load(store.path); err != nil {
+			d.fail(store.name, "%s: %v", store.path, err)
+		} else {
+			d.ok(store.name, "%s loads", store.path)
+		}
+	}
+
+	if NATSURL != "" {
+		if u, err := url.Parse(NATSURL); err == nil && u.Host != "" {
+			d.checkReachable(ctx, "nats", u.Host, "4222")
+		}
+	}
+	if KafkaRESTURL != "" {
+		if u, err := url.Parse(KafkaRESTURL); err == nil && u.Host != "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			d.checkReachable(ctx, "kafka", u.Host, port)
+		}
+	}
+	if tracer != nil {
+		if u, err := url.Parse(tracer.url); err == nil && u.Host != "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			d.checkReachable(ctx, "otlp", u.Host, port)
+		} else {
+			d.fail("otlp", "%q isn't a url", tracer.url)
+		}
+	}
+}
+
+// checkReachable will open a tcp connection to host, with defaultPort when
+// it has none
+func (d *doctor) checkReachable(ctx context.Context, name, host, defaultPort string) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, defaultPort)
+	}
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		d.fail(name, "%v", err)
+		return
+	}
+	conn.Close()
+	d.ok(name, "%s is reachable", host)
+}
+
+// checkPort will bind addr and let it go, another process on it fails here
+func (d *doctor) checkPort(name, addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		d.fail(name, "%v", err)
+		return
+	}
+	listener.Close()
+	d.ok(name, "%s is free", addr)
+}
+
+// checkClock will compare the clock with the Date of the s3 endpoint or the
+// origin, the servers a skew breaks
+func (d *doctor) checkClock(ctx context.Context, storage Storage) {
+	now := time.Now()
+	if now.Year() < 2020 {
+		d.fail("clock", "it is %s here, the clock isn't set", now.UTC().Format(time.RFC3339))
+		return
+	}
+
+	var remote string
+	for s := storage; s != nil; {
+		if s3, ok := s.(*S3Storage); ok {
+			remote = s3.endpoint.String()
+			break
+		}
+		wrapped, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			break
+		}
+		s = wrapped.Unwrap()
+	}
+	if remote == "" && ClusterRole == "edge" {
+		remote = OriginURL
+	}
+	if remote == "" {
+		d.ok("clock", "%s, nothing to compare with", now.UTC().Format(time.RFC3339))
+		return
+	}
+
+	skew, err := clockSkew(ctx, remote)
+	if err != nil {
+		d.warn("clock", "couldn't ask %s the time: %v", remote, err)
+		return
+	}
+	if skew.Abs() > maxClockSkew {
+		d.fail("clock", "%s off from %s", skew.Round(time.Second), remote)
+		return
+	}
+	d.ok("clock", "%s off from %s", skew.Round(time.Second), remote)
+}
+
+// clockSkew is how far ahead the local clock is of the Date remote answers
+// with, any status will do
+func clockSkew(ctx context.Context, remote string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, remote, nil)
+	if err != nil {
+		return 0, err
+	}
+	before := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	// the middle of the round trip, Date has a second's precision anyway
+	local := before.Add(time.Since(before) / 2)
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no Date header")
+	}
+	return local.Sub(date), nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// handleDownload will serve a video's original file as an attachment, ranges
+// let an interrupted download resume. ?filename= overrides the saved name
+func (sm *StreamManager) handleDownload(w http.ResponseWriter, r *http.Request) {
+	fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+
+	file, err := sm.openVideo(r.Context(), fileID)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to open video file")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get file info")
+		return
+	}
+
+	name := r.URL.Query().Get("filename")
+	if name == "" {
+		name = video.Title
+	}
+	// If-Range needs the etag, a resumed download must not splice two versions
+	w.Header().Set("ETag", videoETag(video, info))
+	w.Header().Set("Content-Type", video.ContentType())
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": downloadName(name, video.ID, video.mediaFormat().ext)}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	setCachePolicy(w, r, CacheNoStore, "")
+	strictIfRange(r)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// downloadName will make a safe file name ending in ext, without path parts
+// or control characters, falling back to the video id
+func downloadName(name, id, ext string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(`"/:*?<>|`, c) {
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.Trim(strings.TrimSpace(name), ".")
+	if runes := []rune(name); len(runes) > 200 {
+		name = string(runes[:200])
+	}
+	if name == "" {
+		name = id
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ext) {
+		name += ext
+	}
+	return name
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bytes per second all responses serving media may send together, for
+// constrained uplinks. 0 doesn't limit
+var EgressLimit = envInt64("EGRESS_LIMIT", 0)
+
+// EgressClass is how urgent a response's bytes are, higher classes always
+// send first and a lower class only gets what they leave over
+type EgressClass int
+
+const (
+	// downloads and exports, nobody is watching them
+	EgressBulk EgressClass = iota
+	// on demand playback, a player has a buffer to fall back on
+	EgressInteractive
+	// live viewers, the edge of the stream has no buffer behind it
+	EgressLive
+	egressClasses
+)
+
+var egressClassNames = [egressClasses]string{"bulk", "interactive", "live"}
+
+const (
+	// bytes a response waits for at a time
+	egressChunk = 32 << 10
+	// never less than this can be saved up, or a chunk would never fit
+	minEgressBurst = 2 * egressChunk
+)
+
+// EgressLimiter is a token bucket shared by every media response, with
+// strict priority between the classes
+type EgressLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	waiting [egressClasses]int
+
+	sent    [egressClasses]atomic.Int64
+	delayed [egressClasses]atomic.Int64
+}
+
+// NewEgressLimiter will create a limiter of rate bytes per second, nil when
+// rate is 0
+func NewEgressLimiter(rate int64) *EgressLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	// a twentieth of a second of sending saved up smooths out the chunks
+	burst := max(float64(rate)/20, minEgressBurst)
+	return &EgressLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Limit will send the response of next at class
+func (el *EgressLimiter) Limit(class EgressClass, next http.HandlerFunc) http.HandlerFunc {
+	if el == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&egressWriter{ResponseWriter: w, limiter: el, class: class, ctx: r.Context()}, r)
+	}
+}
+
+// take will wait until n bytes of class may be sent. a class waits while a
+// higher one is waiting, so bulk bytes never go ahead of a viewer's
+func (el *EgressLimiter) take(ctx context.Context, class EgressClass, n int) error {
+	el.mu.Lock()
+	el.waiting[class]++
+	delayed := false
+	for {
+		now := time.Now()
+		el.tokens = min(el.tokens+now.Sub(el.last).Seconds()*el.rate, el.burst)
+		el.last = now
+
+		higher := false
+		for above := class + 1; above < egressClasses; above++ {
+			higher = higher || el.waiting[above] > 0
+		}
+		if !higher && el.tokens >= float64(n) {
+			el.tokens -= float64(n)
+			el.waiting[class]--
+			el.mu.Unlock()
+			el.sent[class].Add(int64(n))
+			if delayed {
+				el.delayed[class].Add(1)
+			}
+			return nil
+		}
+
+		// a higher class takes the next chunk's worth first
+		need := float64(n) - el.tokens
+		if higher {
+			need = max(need, 0) + egressChunk
+		}
+		wait := time.Duration(need / el.rate * float64(time.Second))
+		el.mu.Unlock()
+
+		delayed = true
+		timer := time.NewTimer(max(wait, time.Millisecond))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			el.mu.Lock()
+			el.waiting[class]--
+			el.mu.Unlock()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		el.mu.Lock()
+	}
+}
+
+// handleEgress will report the limit and what each class sent
+func (el *EgressLimiter) handleEgress(w http.ResponseWriter, r *http.Request) {
+	if el == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	classes := map[string]interface{}{}
+	el.mu.Lock()
+	for class, name := range egressClassNames {
+		classes[name] = map[string]int64{
+			"bytes_sent": el.sent[class].Load(),
+			// chunks that had to wait for the limit
+			"delayed": el.delayed[class].Load(),
+			"waiting": int64(el.waiting[class]),
+		}
+	}
+	el.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":          true,
+		"bytes_per_second": int64(el.rate),
+		"classes":          classes,
+	})
+}
+
+// egressWriter will send a response through the limiter in chunks. it has no
+// ReadFrom so file bodies are copied through Write instead of sendfile
+type egressWriter struct {
+	http.ResponseWriter
+	limiter *EgressLimiter
+	class   EgressClass
+	ctx     context.Context
+}
+
+func (ew *egressWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), egressChunk)]
+		if err := ew.limiter.take(ew.ctx, ew.class, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := ew.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the real writer
+func (ew *egressWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
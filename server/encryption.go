@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// base64 aes-256 keys, comma separated. the first encrypts new files, the
+	// others are only used to read files written before a key rotation
+	EncryptionKeys = envString("ENCRYPTION_KEYS", "")
+	// command printing the keys in the same format, for fetching them from a
+	// kms or secret manager at startup instead of keeping them in the env
+	EncryptionKeyCommand = envString("ENCRYPTION_KEY_COMMAND", "")
+)
+
+// encrypted files start with a header: magic, key id, nonce and the plaintext
+// size, then the plaintext sealed with aes-gcm in chunks so any range can be
+// decrypted without reading the file from the start
+const (
+	encryptionMagic      = "VSENC1\x00\x00"
+	encryptionHeaderSize = 8 + 8 + 12 + 8
+	encryptionChunkSize  = 64 * 1024
+	encryptionTagSize    = 16
+)
+
+// Keyring holds the keys videos are encrypted with, a nil keyring means
+// encryption at rest is off and files are stored and served as they are
+type Keyring struct {
+	current []byte
+	keys    map[[8]byte]cipher.AEAD
+}
+
+// NewKeyringFromEnv will load the keys from ENCRYPTION_KEYS or run
+// ENCRYPTION_KEY_COMMAND, nil when neither is set
+func NewKeyringFromEnv() (*Keyring, error) {
+	raw := EncryptionKeys
+	if EncryptionKeyCommand != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, EncryptionKeyCommand).Output()
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEY_COMMAND: %w", err)
+		}
+		raw = string(output)
+	}
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	kr := &Keyring{keys: make(map[[8]byte]cipher.AEAD)}
+	for _, encoded := range strings.FieldsFunc(raw, func(c rune) bool { return c == ',' || c == '\n' || c == ' ' }) {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("encryption keys must be base64 encoded 32 byte keys")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		if kr.current == nil {
+			kr.current = id[:]
+		}
+		kr.keys[id] = aead
+	}
+	return kr, nil
+}
+
+// keyID names a key in file headers without revealing it
+func keyID(key []byte) [8]byte {
+	sum := sha256.Sum256(append([]byte("video-key-id:"), key...))
+	return [8]byte(sum[:8])
+}
+
+// chunkNonce is the file nonce with the chunk index mixed into its tail, so
+// chunks can't be reordered
+func chunkNonce(base []byte, index int64) []byte {
+	nonce := bytes.Clone(base)
+	tail := binary.BigEndian.Uint64(nonce[4:]) ^ uint64(index)
+	binary.BigEndian.PutUint64(nonce[4:], tail)
+	return nonce
+}
+
+// EncryptFile will replace the file at path with its encrypted form, files
+// that are encrypted already are left alone
+func (kr *Keyring) EncryptFile(path string) error {
+	if kr == nil {
+		return nil
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, len(encryptionMagic))
+	if n, _ := io.ReadFull(source, magic); n == len(magic) && string(magic) == encryptionMagic {
+		return nil
+	}
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := make([]byte, encryptionHeaderSize)
+	copy(header, encryptionMagic)
+	copy(header[8:16], kr.current)
+	if _, err := rand.Read(header[16:28]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(header[28:], uint64(info.Size()))
+	aead := kr.keys[[8]byte(kr.current)]
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(header); err != nil {
+		tmp.Close()
+		return err
+	}
+	chunk := make([]byte, encryptionChunkSize)
+	sealed := make([]byte, 0, encryptionChunkSize+encryptionTagSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(source, chunk)
+		if n > 0 {
+			sealed = aead.Seal(sealed[:0], chunkNonce(header[16:28], index), chunk[:n], header)
+			if _, err := tmp.Write(sealed); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Open will decrypt an opened file as it is read, files without the header
+// (stored before encryption was turned on) are returned as they are
+func (kr *Keyring) Open(obj Object) (Object, error) {
+	if kr == nil {
+		return obj, nil
+	}
+	header := make([]byte, encryptionHeaderSize)
+	n, err := io.ReadFull(obj, header)
+	if n < len(encryptionMagic) || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		if _, err := obj.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("truncated encryption header: %w", err)
+	}
+	aead, ok := kr.keys[[8]byte(header[8:16])]
+	if !ok {
+		return nil, fmt.Errorf("file is encrypted with unknown key %x", header[8:16])
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint64(header[28:]))
+	return &encryptedObject{
+		obj:      obj,
+		aead:     aead,
+		header:   header,
+		info:     plainFileInfo{FileInfo: info, size: size},
+		size:     size,
+		position: encryptionHeaderSize,
+		current:  -1,
+	}, nil
+}
+
+// encryptedObject decrypts a file chunk by chunk as it is read
+type encryptedObject struct {
+	obj    Object
+	aead   cipher.AEAD
+	header []byte
+	info   os.FileInfo
+	size   int64
+	offset int64
+
+	// where obj is positioned, sequential reads don't seek it
+	position int64
+	// the decrypted chunk being read
+	chunk   []byte
+	current int64
+	sealed  []byte
+}
+
+func (o *encryptedObject) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	index := o.offset / encryptionChunkSize
+	if index != o.current {
+		if err := o.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.chunk[o.offset-index*encryptionChunkSize:])
+	o.offset += int64(n)
+	return n, nil
+}
+
+// load will read and open one chunk, a chunk that fails authentication is an
+// error instead of bytes handed to the player
+func (o *encryptedObject) load(index int64) error {
+	start := encryptionHeaderSize + index*(encryptionChunkSize+encryptionTagSize)
+	if start != o.position {
+		if _, err := o.obj.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		o.position = start
+	}
+	length := min(encryptionChunkSize, o.size-index*encryptionChunkSize) + encryptionTagSize
+	if cap(o.sealed) < int(length) {
+		o.sealed = make([]byte, encryptionChunkSize+encryptionTagSize)
+	}
+	sealed := o.sealed[:length]
+	n, err := io.ReadFull(o.obj, sealed)
+	o.position += int64(n)
+	if err != nil {
+		return fmt.Errorf("reading encrypted chunk %d: %w", index, err)
+	}
+	o.chunk, err = o.aead.Open(o.chunk[:0], chunkNonce(o.header[16:28], index), sealed, o.header)
+	if err != nil {
+		o.current = -1
+		return fmt.Errorf("encrypted chunk %d failed authentication", index)
+	}
+	o.current = index
+	return nil
+}
+
+func (o *encryptedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *encryptedObject) Close() error {
+	return o.obj.Close()
+}
+
+func (o *encryptedObject) Stat() (os.FileInfo, error) {
+	return o.info, nil
+}
+
+// plainFileInfo reports the decrypted size of an encrypted file
+type plainFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi plainFileInfo) Size() int64 { return fi.size }
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// APIError is the body of every error response, {"error": {...}}. code is
+// the status as a word (not_found, method_not_allowed) unless a handler
+// has a more specific one
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorCode is the code of a status, its text in snake case
+func errorCode(status int) string {
+	text := strings.ToLower(http.StatusText(status))
+	if text == "" {
+		return "error"
+	}
+	return strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text)
+}
+
+// writeError will send an error response with the status's code
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorCode(w, status, errorCode(status), message)
+}
+
+// writeErrorCode will send an error response with a code of its own
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, map[string]APIError{"error": {Code: code, Message: message}})
+}
+
+// storageErrorStatus is the status for a failed write, 507 when the disk is full
+func storageErrorStatus(err error) int {
+	if errors.Is(err, syscall.ENOSPC) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// JSONErrors will turn the plain text errors we don't write ourselves (the
+// mux's 404 and 405, ServeContent's 412 and 416) into json ones
+func JSONErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.status != 0 {
+			writeError(w, ew.status, strings.TrimSpace(ew.body.String()))
+		}
+	})
+}
+
+// errorWriter will hold back a plain text error response so it can be sent
+// as json, everything else goes straight through
+type errorWriter struct {
+	http.ResponseWriter
+	// set while holding back an error
+	status int
+	body   bytes.Buffer
+}
+
+func (ew *errorWriter) WriteHeader(status int) {
+	if status >= 400 && strings.HasPrefix(ew.Header().Get("Content-Type"), "text/plain") && ew.status == 0 {
+		ew.status = status
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorWriter) Write(p []byte) (int, error) {
+	if ew.status != 0 {
+		return ew.body.Write(p)
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps the sendfile path of the real writer working when wrapped
+func (ew *errorWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := ew.ResponseWriter.(io.ReaderFrom); ok && ew.status == 0 {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{ew}, src)
+}
+
+// Unwrap lets http.ResponseController reach the real writer
+func (ew *errorWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// writerOnly hides ReadFrom so io.Copy doesn't call back into it
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// seconds of 1080p h264 one worker encodes per second, measure it on the
+	// real hardware for good estimates
+	TranscodeSpeed = envFloat64("TRANSCODE_SPEED", 1.5)
+	// encodes that run at the same time
+	TranscodeWorkers = envInt64("TRANSCODE_WORKERS", 2)
+)
+
+// how much harder a codec is than h264 to encode and to decode
+type codecCost struct {
+	encode float64
+	decode float64
+}
+
+var codecCosts = map[string]codecCost{
+	"h264": {encode: 1, decode: 0.1},
+	"hevc": {encode: 2.5, decode: 0.15},
+	"vp9":  {encode: 3, decode: 0.15},
+	"av1":  {encode: 6, decode: 0.2},
+}
+
+// codecName will map the names ffprobe and people use to the ones above
+func codecName(name string) string {
+	switch name = strings.ToLower(name); name {
+	case "avc", "x264", "libx264":
+		return "h264"
+	case "h265", "x265", "libx265":
+		return "hevc"
+	case "libvpx-vp9":
+		return "vp9"
+	case "libaom-av1", "libsvtav1", "svtav1":
+		return "av1"
+	}
+	return name
+}
+
+// a video to estimate for
+type EstimateSource struct {
+	Duration float64 `json:"duration"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Codec    string  `json:"codec"`
+	// resolution or codec weren't known and 1080p h264 was assumed
+	Assumed bool `json:"assumed,omitempty"`
+}
+
+// one rendition of the estimate
+type RenditionEstimate struct {
+	Rendition string  `json:"rendition"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Codec     string  `json:"codec"`
+	Seconds   float64 `json:"seconds"`
+}
+
+// estimateTranscode will guess how long encoding source to a rendition takes
+// on one worker. cost grows with output pixels and codec, plus decoding the
+// source once per rendition. sources are never upscaled
+func estimateTranscode(source EstimateSource, rendition Rendition) RenditionEstimate {
+	codec := rendition.VideoCodec
+	height := min(rendition.Height, source.Height)
+	width := source.Width * height / source.Height
+	width += width % 2
+
+	const pixels1080p = 1920 * 1080
+	outScale := float64(width*height) / pixels1080p
+	srcScale := float64(source.Width*source.Height) / pixels1080p
+	seconds := source.Duration * (outScale*codecCosts[codec].encode + srcScale*codecCosts[source.Codec].decode) / TranscodeSpeed
+	return RenditionEstimate{Rendition: rendition.Name, Width: width, Height: height, Codec: codec, Seconds: math.Ceil(seconds)}
+}
+
+// clipEncodeEstimate is how long re-encoding a clip takes, assuming a 1080p source
+func clipEncodeEstimate(length time.Duration, rendition Rendition) time.Duration {
+	source := EstimateSource{Duration: length.Seconds(), Width: 1920, Height: 1080, Codec: "h264"}
+	return time.Duration(estimateTranscode(source, rendition).Seconds) * time.Second
+}
+
+// handleEstimate will estimate when a video would be ready, from a stored
+// video (video_id) or a described source, encoded with a transcode profile
+// (the video's or the tenant's when not named)
+func (sm *StreamManager) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		VideoID string         `json:"video_id"`
+		Source  EstimateSource `json:"source"`
+		Profile string         `json:"profile"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	source := req.Source
+	video := VideoRecord{Tenant: tenantFrom(r).ID}
+	if req.VideoID != "" {
+		fileID := tenantFrom(r).VideoID(req.VideoID)
+		var ok bool
+		video, ok = sm.metadata.GetVideo(fileID)
+		if !ok || !isSafeName(req.VideoID) {
+			writeError(w, http.StatusNotFound, "video not found")
+			return
+		}
+		if source.Duration == 0 {
+			source.Duration = video.Duration
+		}
+		if source.Height == 0 && video.Height > 0 {
+			source.Width, source.Height = video.Width, video.Height
+		}
+		if source.Codec == "" {
+			source.Codec = video.Codec
+		}
+		if (source.Duration == 0 || source.Height == 0 || source.Codec == "") && ProbeUploads {
+			probeSource(r.Context(), fileID, &source)
+		}
+	}
+	if source.Duration <= 0 {
+		writeError(w, http.StatusBadRequest, "source duration is required")
+		return
+	}
+	if source.Width <= 0 || source.Height <= 0 {
+		source.Width, source.Height, source.Assumed = 1920, 1080, true
+	}
+	source.Codec = codecName(source.Codec)
+	if _, ok := codecCosts[source.Codec]; !ok {
+		source.Codec, source.Assumed = "h264", true
+	}
+
+	profile := sm.profileFor(video)
+	if req.Profile != "" {
+		var ok bool
+		if profile, ok = sm.profiles.Get(req.Profile); !ok {
+			writeError(w, http.StatusBadRequest, "unknown profile")
+			return
+		}
+	}
+
+	// renditions above the source aren't made, a small source gets one at its size
+	renditions := []RenditionEstimate{}
+	processing := 0.0
+	for _, rendition := range profile.Targets(source.Height) {
+		estimate := estimateTranscode(source, rendition)
+		renditions = append(renditions, estimate)
+		processing += estimate.Seconds
+	}
+
+	wait, running := sm.transcodes.Wait()
+	queue := math.Ceil(wait.Seconds())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"source":             source,
+		"profile":            profile.Name,
+		"renditions":         renditions,
+		"processing_seconds": processing,
+		"queue_seconds":      queue,
+		"running":            running,
+		"ready_in_seconds":   processing + queue,
+		"ready_at":           time.Now().Add(time.Duration(processing+queue) * time.Second).UTC().Truncate(time.Second),
+	})
+}
+
+// probeSource will fill in what the request left out from the video's local copy
+func probeSource(ctx context.Context, fileID string, source *EstimateSource) {
+	probe, err := probeMedia(ctx, filepath.Join(VideoStoragePath, videoKey(fileID)))
+	if err != nil {
+		return
+	}
+	if source.Duration == 0 {
+		source.Duration = probe.Duration()
+	}
+	if stream, ok := probe.VideoStream(); ok {
+		if source.Height == 0 {
+			source.Width, source.Height = stream.Width, stream.Height
+		}
+		if source.Codec == "" {
+			source.Codec = stream.CodecName
+		}
+	}
+}
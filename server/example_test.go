@@ -0,0 +1,50 @@
+package server_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/appu900/A_siimple_video_streaming_server/server"
+)
+
+// a program serving the api next to a route of its own
+func ExampleNew() {
+	dir, err := os.MkdirTemp("", "videos")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := server.New(server.Config{StoragePath: dir, AdminAPIKey: "secret", DisableProbe: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv.Handle("GET /hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from the program")
+	}))
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/hello")
+	if err != nil {
+		log.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	fmt.Println(string(body))
+
+	resp, err = http.Get(ts.URL + "/api/videos")
+	if err != nil {
+		log.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	fmt.Println(resp.StatusCode, string(body))
+	// Output:
+	// hello from the program
+	// 200 []
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// address of the grpc api (h2c, put tls in front), empty disables it
+var GRPCAddr = envString("GRPC_ADDR", "")
+
+// biggest single grpc message we accept, upload chunks included
+const grpcMaxMessage = 4 << 20
+
+// grpc status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is a failed call, sent to the client as grpc-status/grpc-message
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcCall is one rpc, messages are length prefixed frames on the http/2 stream
+type grpcCall struct {
+	w  http.ResponseWriter
+	r  *http.Request
+	rc *http.ResponseController
+	sm *StreamManager
+	// what the rpc did for the audit log, see auditAs
+	audit, target string
+
+	header [5]byte
+}
+
+// Recv will read the next message, io.EOF once the client is done sending
+func (c *grpcCall) Recv() ([]byte, error) {
+	if _, err := io.ReadFull(c.r.Body, c.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, grpcErrorf(grpcInternal, "truncated message")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(c.header[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message is larger than %d bytes", grpcMaxMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(c.r.Body, msg); err != nil {
+		return nil, grpcErrorf(grpcInternal, "truncated message")
+	}
+	if c.header[0] == 0 {
+		return msg, nil
+	}
+
+	if c.r.Header.Get("Grpc-Encoding") != "gzip" {
+		return nil, grpcErrorf(grpcUnimplemented, "unsupported message encoding")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, grpcErrorf(grpcInternal, "bad compressed message")
+	}
+	msg, err = io.ReadAll(io.LimitReader(zr, grpcMaxMessage+1))
+	if err != nil {
+		return nil, grpcErrorf(grpcInternal, "bad compressed message")
+	}
+	if len(msg) > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message is larger than %d bytes", grpcMaxMessage)
+	}
+	return msg, nil
+}
+
+// RecvOne will read the single request message of a unary or server streaming call
+func (c *grpcCall) RecvOne() ([]byte, error) {
+	msg, err := c.Recv()
+	if err == io.EOF {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	return msg, err
+}
+
+// Send will write a message and flush it to the client
+func (c *grpcCall) Send(msg []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(msg); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+// authorize will check the call's token like Require does, the video a token
+// may be bound to comes from the request message instead of the url
+func (c *grpcCall) authorize(scope, videoID string) error {
+	if !c.sm.tokens.Enabled() {
+		return nil
+	}
+	id, err := c.sm.tokens.Authenticate(c.r)
+	if err != nil {
+		return grpcErrorf(grpcUnauthenticated, "%s", err)
+	}
+	if !id.allows(scope, videoID, tenantFrom(c.r).ID) {
+		return grpcErrorf(grpcPermissionDenied, "%s", ErrTokenScope)
+	}
+	return nil
+}
+
+// grpcMethod will adapt an rpc to a http handler, errors become the
+// grpc-status trailer
+func (sm *StreamManager) grpcMethod(method func(c *grpcCall) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			writeError(w, http.StatusUnsupportedMediaType, "grpc requests only")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Grpc-Accept-Encoding", "gzip")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+
+		c := &grpcCall{w: w, r: r, rc: http.NewResponseController(w), sm: sm}
+		err := method(c)
+
+		code, msg := grpcOK, ""
+		var gerr *grpcError
+		switch {
+		case err == nil:
+		case errors.As(err, &gerr):
+			code, msg = gerr.code, gerr.msg
+		default:
+			log.Println("grpc", r.URL.Path, "failed", err)
+			code, msg = grpcInternal, "internal error"
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		w.Header().Set("Grpc-Message", grpcEscape(msg))
+		sm.audit.recordRPC(c, code, msg)
+	}
+}
+
+// grpcEscape will percent encode a status message as the protocol asks
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcUploadVideo is a client streaming UploadVideo, the first message names
+// the video and every message may carry a chunk. an upload cut short resumes
+// by sending the offset it was at
+func (sm *StreamManager) grpcUploadVideo(c *grpcCall) error {
+	var req pbUploadVideoRequest
+	msg, err := c.RecvOne()
+	if err != nil {
+		return err
+	}
+	if err := req.unmarshal(msg); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	if err := c.authorize(ScopeUpload, req.ID); err != nil {
+		return err
+	}
+	if req.ID == "" || !isSafeName(req.ID) {
+		return grpcErrorf(grpcInvalidArgument, "invalid video id")
+	}
+	if req.Size <= 0 {
+		return grpcErrorf(grpcInvalidArgument, "size is required")
+	}
+	if MaxUploadSize > 0 && req.Size > MaxUploadSize {
+		return grpcErrorf(grpcInvalidArgument, "upload is too large")
+	}
+
+	id, title := req.ID, req.Title
+	tenant := tenantFrom(c.r)
+	fileID := tenant.VideoID(id)
+	if _, exists := sm.metadata.GetVideo(fileID); exists {
+		return grpcErrorf(grpcAlreadyExists, "a video with this id already exists")
+	}
+	if !sm.hasUploadSession(fileID) {
+		if err := sm.checkTenantQuota(tenant, req.Size); err != nil {
+			return grpcErrorf(grpcResourceExhausted, "%s", err)
+		}
+	}
+
+	session, err := sm.uploadSession(fileID, req.Size)
+	if err != nil {
+		return err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.paused() {
+		return grpcErrorf(grpcFailedPrecondition, "upload is paused, resume it first")
+	}
+	if req.Offset != session.UploadedSize {
+		return grpcErrorf(grpcFailedPrecondition, "upload is at offset %d", session.UploadedSize)
+	}
+	if err := session.open(); err != nil {
+		return err
+	}
+
+	complete := false
+	defer func() {
+		if !complete {
+			if err := session.commit(); err != nil {
+				log.Println("failed to save upload state", fileID, err)
+			}
+		}
+	}()
+
+	for {
+		if len(req.Chunk) > 0 {
+			if session.UploadedSize+int64(len(req.Chunk)) > session.FileSize {
+				return grpcErrorf(grpcInvalidArgument, "upload is larger than its size")
+			}
+			if err := session.write(req.Chunk); err != nil {
+				return err
+			}
+			sm.uploadWritten(session, len(req.Chunk))
+			tenant.stats.uploadedBytes.Add(int64(len(req.Chunk)))
+		}
+		if session.paused() && session.UploadedSize < session.FileSize {
+			session.LastUpdated = time.Now()
+			return grpcErrorf(grpcFailedPrecondition, "upload was paused at offset %d", session.UploadedSize)
+		}
+
+		msg, err := c.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		req = pbUploadVideoRequest{}
+		if err := req.unmarshal(msg); err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%s", err)
+		}
+	}
+	session.LastUpdated = time.Now()
+
+	if session.UploadedSize < session.FileSize {
+		return c.Send(marshalUploadResponse(nil, session.UploadedSize))
+	}
+	complete = true
+	c.audit, c.target = "video.upload", id
+	video, err := sm.completeUpload(session, VideoRecord{ID: id, Tenant: tenant.ID, Title: title, Owner: sm.tokens.Subject(c.r)})
+	if err != nil {
+		return err
+	}
+	return c.Send(marshalUploadResponse(&video, session.UploadedSize))
+}
+
+// grpcGetVideo is GetVideo
+func (sm *StreamManager) grpcGetVideo(c *grpcCall) error {
+	var req pbVideoRequest
+	msg, err := c.RecvOne()
+	if err != nil {
+		return err
+	}
+	if err := req.unmarshal(msg); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	video, ok := sm.metadata.GetVideo(tenantFrom(c.r).VideoID(req.ID))
+	if !ok || !isSafeName(req.ID) {
+		return grpcErrorf(grpcNotFound, "video not found")
+	}
+	return c.Send(marshalVideo(video))
+}
+
+// grpcListVideos is ListVideos, every video of the tenant
+func (sm *StreamManager) grpcListVideos(c *grpcCall) error {
+	if _, err := c.RecvOne(); err != nil {
+		return err
+	}
+	return c.Send(marshalVideoList(sm.metadata.ListVideos(tenantFrom(c.r).ID)))
+}
+
+// grpcDeleteVideo is DeleteVideo
+func (sm *StreamManager) grpcDeleteVideo(c *grpcCall) error {
+	var req pbVideoRequest
+	msg, err := c.RecvOne()
+	if err != nil {
+		return err
+	}
+	if err := req.unmarshal(msg); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	if err := c.authorize(ScopeUpload, req.ID); err != nil {
+		return err
+	}
+	fileID := tenantFrom(c.r).VideoID(req.ID)
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || !isSafeName(req.ID) {
+		return grpcErrorf(grpcNotFound, "video not found")
+	}
+	c.audit, c.target = "video.delete", req.ID
+	if video.Locked() {
+		return grpcErrorf(grpcFailedPrecondition, "video is write once locked")
+	}
+	if err := sm.deleteVideo(c.r.Context(), fileID); err != nil {
+		return err
+	}
+	return c.Send(nil)
+}
+
+// grpcWatchStats is a server streaming WatchStats, it sends a video's live
+// viewer and watch party counts whenever they change
+func (sm *StreamManager) grpcWatchStats(c *grpcCall) error {
+	var req pbVideoRequest
+	msg, err := c.RecvOne()
+	if err != nil {
+		return err
+	}
+	if err := req.unmarshal(msg); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	if err := c.authorize(ScopePlayback, req.ID); err != nil {
+		return err
+	}
+	fileID := tenantFrom(c.r).VideoID(req.ID)
+	if _, ok := sm.metadata.GetVideo(fileID); !ok || !isSafeName(req.ID) {
+		return grpcErrorf(grpcNotFound, "video not found")
+	}
+
+	interval := 5 * time.Second
+	if req.IntervalSeconds > 0 {
+		interval = time.Duration(req.IntervalSeconds) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastViewers, lastParties := -1, -1
+	for {
+		// peek at the session, subscribing would count us as a viewer
+		viewers, parties := 0, 0
+		if value, ok := sm.activeStreams.Load(fileID); ok {
+			session := value.(*StreamSession)
+			session.mu.Lock()
+			viewers, parties = session.ViewerCount, len(session.parties)
+			session.mu.Unlock()
+		}
+		if viewers != lastViewers || parties != lastParties {
+			if err := c.Send(marshalVideoStats(req.ID, viewers, parties, time.Now().Unix())); err != nil {
+				return nil
+			}
+			lastViewers, lastParties = viewers, parties
+		}
+
+		select {
+		case <-c.r.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveGRPC will run the VideoService of video.proto over h2c on addr
+func (sm *StreamManager) serveGRPC(addr string, limits *RateLimits) error {
+	const service = "/videoserver.v1.VideoService/"
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+service+"UploadVideo", limits.Upload.Limit(nil, sm.grpcMethod(sm.grpcUploadVideo)))
+	mux.HandleFunc("POST "+service+"GetVideo", limits.Metadata.Limit(nil, sm.grpcMethod(sm.grpcGetVideo)))
+	mux.HandleFunc("POST "+service+"ListVideos", limits.Metadata.Limit(nil, sm.grpcMethod(sm.grpcListVideos)))
+	mux.HandleFunc("POST "+service+"DeleteVideo", limits.Metadata.Limit(nil, sm.grpcMethod(sm.grpcDeleteVideo)))
+	mux.HandleFunc("POST "+service+"WatchStats", limits.Metadata.Limit(nil, sm.grpcMethod(sm.grpcWatchStats)))
+
+	server := newHTTPServer(addr, sm.tenants.Resolve(mux))
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	log.Println("Starting grpc api on", addr)
+	return server.ListenAndServe()
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// the protobuf messages of video.proto, encoded by hand since they are few
+// and small. only the wire types they use are supported
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errBadProto = errors.New("malformed protobuf message")
+
+func appendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// proto3 leaves out fields that have their zero value
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendProtoBytes(b []byte, field int, p []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+func appendProtoInt64(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, uint64(v))
+}
+
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, 1)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+// protoField is one decoded field, varint and fixed values are in num and
+// length delimited ones in data
+type protoField struct {
+	num      int
+	wireType int
+	num64    uint64
+	data     []byte
+}
+
+// parseProto will call fn for every field of a message, unknown fields are
+// for the caller to ignore
+func parseProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBadProto
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3), wireType: int(tag & 7)}
+		switch f.wireType {
+		case wireVarint:
+			f.num64, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errBadProto
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errBadProto
+			}
+			f.num64, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errBadProto
+			}
+			f.num64, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errBadProto
+			}
+			f.data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return errBadProto
+		}
+		if f.num == 0 {
+			return errBadProto
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UploadVideoRequest, the first message names the video and the rest carry chunks
+type pbUploadVideoRequest struct {
+	ID     string
+	Title  string
+	Size   int64
+	Offset int64
+	Chunk  []byte
+}
+
+func (m *pbUploadVideoRequest) unmarshal(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.ID = string(f.data)
+		case 2:
+			m.Title = string(f.data)
+		case 3:
+			m.Size = int64(f.num64)
+		case 4:
+			m.Chunk = f.data
+		case 5:
+			m.Offset = int64(f.num64)
+		}
+		return nil
+	})
+}
+
+// a request that only names a video (GetVideo, DeleteVideo, WatchStats)
+type pbVideoRequest struct {
+	ID              string
+	IntervalSeconds int64
+}
+
+func (m *pbVideoRequest) unmarshal(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.ID = string(f.data)
+		case 2:
+			m.IntervalSeconds = int64(f.num64)
+		}
+		return nil
+	})
+}
+
+// Video
+func marshalVideo(video VideoRecord) []byte {
+	var b []byte
+	b = appendProtoString(b, 1, video.ID)
+	b = appendProtoString(b, 2, video.Title)
+	b = appendProtoInt64(b, 3, video.Size)
+	b = appendProtoDouble(b, 4, video.Duration)
+	b = appendProtoString(b, 5, video.SHA256)
+	b = appendProtoString(b, 6, video.Status)
+	b = appendProtoString(b, 7, video.Reason)
+	b = appendProtoString(b, 8, video.ClipOf)
+	b = appendProtoString(b, 9, video.Owner)
+	b = appendProtoInt64(b, 10, video.CreatedAt.Unix())
+	b = appendProtoBool(b, 11, video.NoIndex)
+	b = appendProtoBool(b, 12, video.NoUnfurl)
+	return b
+}
+
+// UploadVideoResponse
+func marshalUploadResponse(video *VideoRecord, offset int64) []byte {
+	var b []byte
+	if video != nil {
+		b = appendProtoBytes(b, 1, marshalVideo(*video))
+	}
+	b = appendProtoInt64(b, 2, offset)
+	return appendProtoBool(b, 3, video != nil)
+}
+
+// ListVideosResponse
+func marshalVideoList(videos []VideoRecord) []byte {
+	var b []byte
+	for _, video := range videos {
+		b = appendProtoBytes(b, 1, marshalVideo(video))
+	}
+	return b
+}
+
+// VideoStats
+func marshalVideoStats(id string, viewers, parties int, at int64) []byte {
+	var b []byte
+	b = appendProtoString(b, 1, id)
+	b = appendProtoInt64(b, 2, int64(viewers))
+	b = appendProtoInt64(b, 3, int64(parties))
+	return appendProtoInt64(b, 4, at)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// ffmpeg missing makes the instance not ready, turn off for deployments that
+// don't clip or extract audio
+var ReadyNeedsFFmpeg = envBool("READY_NEEDS_FFMPEG", true)
+
+// how long all readiness checks together may take
+const readyTimeout = 3 * time.Second
+
+// handleHealthz will answer as long as the process serves requests, for liveness probes
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	setCachePolicy(w, r, CacheNoStore, "")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// a readiness check, a nil error means it passed
+type readyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type readyResult struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// handleReadyz will run the readiness checks and answer 503 when one fails,
+// so load balancers stop sending traffic until the instance recovers
+func (sm *StreamManager) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := []readyCheck{
+		{"storage", sm.checkStorage},
+		{"metadata", func(ctx context.Context) error { return checkWritable(filepath.Dir(metadataPath())) }},
+		{"capacity", sm.checkCapacity},
+	}
+	if ReadyNeedsFFmpeg {
+		checks = append(checks, readyCheck{"transcoder", func(ctx context.Context) error {
+			_, err := exec.LookPath(FFmpegPath)
+			return err
+		}})
+	}
+
+	status, ready := http.StatusOK, "ready"
+	results := make(map[string]readyResult, len(checks))
+	for _, c := range checks {
+		start := time.Now()
+		err := c.check(ctx)
+		result := readyResult{OK: err == nil, Duration: time.Since(start).String()}
+		if err != nil {
+			result.Error = err.Error()
+			status, ready = http.StatusServiceUnavailable, "not ready"
+		}
+		results[c.name] = result
+	}
+	setCachePolicy(w, r, CacheNoStore, "")
+	writeJSON(w, status, map[string]interface{}{
+		"status":  ready,
+		"streams": sm.streams.Load(),
+		"checks":  results,
+	})
+}
+
+// checkStorage will make sure videos can be written, remote storage only has
+// to answer since probing it with writes costs requests
+func (sm *StreamManager) checkStorage(ctx context.Context) error {
+	if err := checkWritable(VideoStoragePath); err != nil {
+		return err
+	}
+	if isLocalStorage(sm.storage) {
+		return nil
+	}
+	if _, err := sm.storage.Stat(ctx, ".readyz"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (sm *StreamManager) checkCapacity(ctx context.Context) error {
+	if streams := sm.streams.Load(); streams >= MaxConcurrentSteams {
+		return fmt.Errorf("%d of %d streams in use", streams, MaxConcurrentSteams)
+	}
+	return nil
+}
+
+// checkWritable will create and remove a file in dir, a read only mount or
+// wrong owner shows up here instead of on the first upload
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".tmp-ready-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// countStream will count the requests serving video bytes while they run.
+// the streams pinned videos reserve are kept free of other videos
+func (sm *StreamManager) countStream(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		streams := sm.streams.Add(1)
+		defer sm.streams.Add(-1)
+		if reserved := sm.pins.Reserved(); reserved > 0 && streams > MaxConcurrentSteams-reserved {
+			if !sm.pins.Pinned(tenantFrom(r).VideoID(requestedVideoID(r))) {
+				w.Header().Set("Retry-After", "5")
+				writeError(w, http.StatusServiceUnavailable, "streams are reserved for a launch, try again later")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
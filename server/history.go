@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how many plays are remembered per user
+const historyLimit = 200
+
+// a video a user started watching
+type HistoryEntry struct {
+	VideoID   string    `json:"video_id"`
+	WatchedAt time.Time `json:"watched_at"`
+}
+
+// HistoryStore will keep each user's recent plays, newest first. it is saved
+// in the background since plays are far more frequent than other writes
+type HistoryStore struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string][]HistoryEntry
+	dirty   bool
+}
+
+// NewHistoryStore will load the history from path, a missing file is empty
+func NewHistoryStore(path string) (*HistoryStore, error) {
+	hs := &HistoryStore{path: path, entries: make(map[string][]HistoryEntry)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &hs.entries); err != nil {
+			return nil, err
+		}
+	}
+	supervisor.Go(context.Background(), "history-flush", RestartAlways, hs.flushRoutine)
+	return hs, nil
+}
+
+// Record will add a play, watching the same video again moves it to the top
+func (hs *HistoryStore) Record(user, videoID string) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	entries := []HistoryEntry{{VideoID: videoID, WatchedAt: time.Now()}}
+	for _, entry := range hs.entries[user] {
+		if entry.VideoID != videoID && len(entries) < historyLimit {
+			entries = append(entries, entry)
+		}
+	}
+	hs.entries[user] = entries
+	hs.dirty = true
+}
+
+// List will return a user's plays, newest first
+func (hs *HistoryStore) List(user string) []HistoryEntry {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return append([]HistoryEntry{}, hs.entries[user]...)
+}
+
+// Clear will forget a user's plays
+func (hs *HistoryStore) Clear(user string) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	delete(hs.entries, user)
+	hs.dirty = true
+}
+
+func (hs *HistoryStore) flushRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		hs.mu.Lock()
+		if !hs.dirty {
+			hs.mu.Unlock()
+			continue
+		}
+		data, err := json.Marshal(hs.entries)
+		hs.dirty = false
+		hs.mu.Unlock()
+
+		if err == nil {
+			err = writeFileAtomic(hs.path, data)
+		}
+		if err != nil {
+			log.Println("failed to save playback history", err)
+		}
+	}
+}
+
+// historyPath is where playback history is persisted
+func historyPath() string {
+	return filepath.Join(VideoStoragePath, ".history.json")
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// encrypt hls segments with aes-128, players fetch the key from /key
+	HLSEncrypt = envBool("HLS_AES128", false)
+	// how long the session token in a playlist's urls is valid, never longer
+	// than the playback token the playlist was fetched with
+	HLSSessionTTL = envDuration("HLS_SESSION_TTL", 2*time.Hour)
+)
+
+// how long packaging a single video may take
+const hlsTimeout = 30 * time.Minute
+
+// the files of a package that are served, the playlists are rewritten per
+// request. an abr package has a playlist and segments per rendition
+var hlsFileName = regexp.MustCompile(`^(([\w-]+_)?init\.mp4|([\w-]+_)?seg[0-9]+\.(m4s|ts)|key|[\w-]+\.m3u8)$`)
+
+// hlsDir is where a video's hls package is kept, next to the video
+func hlsDir(fileID string) string {
+	return filepath.Join(VideoStoragePath, fileID+".hls")
+}
+
+// handleHLSPlaylist will serve a video's hls playlist, packaging it on the
+// first request. with auth on every segment and key url carries a session token
+func (sm *StreamManager) handleHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	rawID := r.PathValue("id")
+	fileID := tenantFrom(r).VideoID(rawID)
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if !video.IsVideo() {
+		writeError(w, http.StatusNotFound, "only videos have hls")
+		return
+	}
+	if video.NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	ctx, cancel := renditionContext(r.Context())
+	defer cancel()
+	if err := sm.packageHLS(ctx, fileID, PriorityViewer); err != nil {
+		switch {
+		case stillProcessing(r, err):
+			writeProcessing(w, r)
+		case errors.Is(err, exec.ErrNotFound):
+			writeError(w, http.StatusServiceUnavailable, "hls packaging needs ffmpeg")
+		case r.Context().Err() != nil:
+		default:
+			log.Println("failed to package hls", fileID, err)
+			writeError(w, http.StatusInternalServerError, "failed to package hls")
+		}
+		return
+	}
+	playlist, err := sm.readHLSFile(fileID, "index.m3u8")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to open playlist")
+		return
+	}
+
+	query, err := sm.hlsQuery(r, rawID)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	sm.recordPlay(r, video.ID)
+	sm.demand.Record(fileID, "hls")
+	if len(query) > 0 {
+		setCachePolicy(w, r, CacheNoStore, "")
+	} else {
+		setCachePolicy(w, r, CacheManifest, "")
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write(rewriteHLSPlaylist(addHLSMarkers(playlist, video), query.Encode()))
+}
+
+// hlsQuery is what the urls in a video's playlists carry, a session token
+// or the playback token and the playback session
+func (sm *StreamManager) hlsQuery(r *http.Request, rawID string) (url.Values, error) {
+	query := url.Values{}
+	switch {
+	case sm.tokens.Signs():
+		session, err := sm.tokens.SessionToken(r, rawID, HLSSessionTTL)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("st", session)
+	case sm.tokens.Enabled() && r.URL.Query().Get("token") != "":
+		// without AUTH_SECRET there are no sessions, the segments need the
+		// credentials the playlist was asked for with
+		query.Set("token", r.URL.Query().Get("token"))
+	}
+	if session := playbackSessionFrom(r.Context()); session != "" {
+		query.Set("ps", session)
+	}
+	return query, nil
+}
+
+var hlsURIAttr = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewriteHLSPlaylist will append query to the segment, init and key uris
+func rewriteHLSPlaylist(playlist []byte, query string) []byte {
+	if query == "" {
+		return playlist
+	}
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-KEY") || strings.HasPrefix(line, "#EXT-X-MAP"):
+			line = hlsURIAttr.ReplaceAllString(line, `URI="${1}?`+query+`"`)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			line += "?" + query
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// handleHLSFile will serve a segment, the init segment or the aes key of a
+// packaged video, the key is never cached
+func (sm *StreamManager) handleHLSFile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || !video.Available() || !hlsFileName.MatchString(name) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if strings.HasSuffix(name, ".m3u8") {
+		sm.serveHLSVariant(w, r, video, name)
+		return
+	}
+
+	plain, err := os.Open(filepath.Join(hlsDir(fileID), name))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	file, err := sm.keys.Open(plain)
+	if err != nil {
+		plain.Close()
+		log.Println("failed to decrypt hls file", fileID, name, err)
+		writeError(w, http.StatusInternalServerError, "failed to open file")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to open file")
+		return
+	}
+	// a cached playlist means only segments reach us
+	sm.demand.Record(fileID, "hls")
+
+	if name == "key" {
+		setCachePolicy(w, r, CacheNoStore, "")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		io.Copy(w, file)
+		return
+	}
+	if video.NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+	contentType := "video/mp4"
+	if strings.HasSuffix(name, ".ts") {
+		contentType = "video/mp2t"
+	}
+	setCachePolicy(w, r, CacheContent, strongETag(info))
+	w.Header().Set("ETag", strongETag(info))
+	w.Header().Set("Content-Type", contentType)
+	strictIfRange(r)
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// serveHLSVariant will serve the playlist of a rendition of an abr package,
+// its urls carry what the master playlist's url for it did
+func (sm *StreamManager) serveHLSVariant(w http.ResponseWriter, r *http.Request, video VideoRecord, name string) {
+	playlist, err := sm.readHLSFile(video.Key(), name)
+	if err != nil || name == "index.m3u8" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	query := url.Values{}
+	for _, key := range []string{"st", "token", "ps"} {
+		if value := r.URL.Query().Get(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	sm.demand.Record(video.Key(), "hls")
+	if len(query) > 0 {
+		setCachePolicy(w, r, CacheNoStore, "")
+	} else {
+		setCachePolicy(w, r, CacheManifest, "")
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write(rewriteHLSPlaylist(addHLSMarkers(playlist, video), query.Encode()))
+}
+
+// readHLSFile will read a whole file of a package
+func (sm *StreamManager) readHLSFile(fileID, name string) ([]byte, error) {
+	plain, err := os.Open(filepath.Join(hlsDir(fileID), name))
+	if err != nil {
+		return nil, err
+	}
+	file, err := sm.keys.Open(plain)
+	if err != nil {
+		plain.Close()
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// packageHLS will make sure the video's hls package exists, waiting for it
+// when it is being packaged already. it runs as a transcode job of priority
+func (sm *StreamManager) packageHLS(ctx context.Context, fileID string, priority int) error {
+	dir := hlsDir(fileID)
+	if _, err := os.Stat(filepath.Join(dir, "index.m3u8")); err == nil {
+		return nil
+	}
+	video, _ := sm.metadata.GetVideo(fileID)
+	job := &TranscodeJob{Kind: "hls", VideoID: fileID, Priority: priority, Duration: video.Duration}
+	return sm.buildOnce(ctx, dir, job, func(ctx context.Context) error {
+		return sm.runHLSPackaging(ctx, fileID, dir)
+	})
+}
+
+// runHLSPackaging will cut the video into segments of its profile's length
+// and format without re-encoding, into a temp dir that replaces dir when done.
+// a watermark has to be burned in, that is encoded like the top rendition.
+// a profile with abr encodes every rendition instead, see abr.go
+func (sm *StreamManager) runHLSPackaging(ctx context.Context, fileID, dir string) error {
+	if _, err := exec.LookPath(FFmpegPath); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hlsTimeout)
+	defer cancel()
+
+	source, cleanup, err := sm.localVideoPath(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-hls-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	video, _ := sm.metadata.GetVideo(fileID)
+	profile := sm.profileFor(video)
+	mark, cleanupMark, err := sm.watermarkFilter(ctx, video, sm.watermarkFor(video))
+	if err != nil {
+		return err
+	}
+	defer cleanupMark()
+
+	// the key uri is relative, a session token is added when serving
+	var keyArgs []string
+	if HLSEncrypt {
+		key := make([]byte, 16)
+		iv := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if _, err := rand.Read(iv); err != nil {
+			return err
+		}
+		keyPath := filepath.Join(tmp, "key")
+		if err := os.WriteFile(keyPath, key, 0600); err != nil {
+			return err
+		}
+		keyInfo := filepath.Join(tmp, ".keyinfo")
+		if err := os.WriteFile(keyInfo, []byte("key\n"+keyPath+"\n"+hex.EncodeToString(iv)+"\n"), 0600); err != nil {
+			return err
+		}
+		keyArgs = []string{"-hls_key_info_file", keyInfo}
+	}
+
+	if targets := profile.Targets(video.Height); profile.ABR && len(targets) > 1 {
+		err = sm.packageABR(ctx, video, profile, targets, source, tmp, mark, keyArgs)
+	} else {
+		args := []string{"-i", source, "-map", "0:v:0", "-map", "0:a:0?"}
+		args = append(args, profile.packageArgs(video, mark)...)
+		_, err = runFFmpeg(ctx, append(args, profile.hlsArgs(tmp, "index", "", keyArgs)...))
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(tmp, ".keyinfo"))
+
+	files, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := sm.keys.EncryptFile(filepath.Join(tmp, file.Name())); err != nil {
+			return err
+		}
+	}
+	os.RemoveAll(dir)
+	return os.Rename(tmp, dir)
+}
+
+// codecs the segments can carry as they are, hevc only in fmp4
+var (
+	hlsCopyVideo = map[string]map[string]bool{
+		"ts":   {"h264": true},
+		"fmp4": {"h264": true, "hevc": true},
+	}
+	hlsCopyAudio = map[string]bool{"aac": true, "mp3": true, "ac3": true, "eac3": true}
+)
+
+// packageArgs will return the codec args of a package with a single
+// rendition. the source's streams are copied when the segments can carry
+// them and only what can't is encoded, sources that weren't probed are
+// copied as they are
+func (p TranscodeProfile) packageArgs(video VideoRecord, mark *watermarkFilter) []string {
+	top := p.Top()
+	switch {
+	case mark != nil, video.Codec != "" && !hlsCopyVideo[p.SegmentFormat][video.Codec]:
+		return p.encodeArgs(top, video, mark, false)
+	case video.AudioCodec != "" && !hlsCopyAudio[video.AudioCodec]:
+		return append([]string{"-c:v", "copy"}, top.audioArgs()...)
+	}
+	return []string{"-c", "copy"}
+}
+
+// hlsArgs will return the ffmpeg args of an hls output of the profile's
+// segments into dir, the playlist is named name.m3u8 and the segments and
+// init segment start with prefix
+func (p TranscodeProfile) hlsArgs(dir, name, prefix string, keyArgs []string) []string {
+	segmentType, ext := "fmp4", "m4s"
+	if p.SegmentFormat == "ts" {
+		segmentType, ext = "mpegts", "ts"
+	}
+	args := []string{"-f", "hls", "-hls_time", strconv.Itoa(p.SegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_type", segmentType, "-hls_fmp4_init_filename", prefix + "init.mp4",
+		"-hls_segment_filename", filepath.Join(dir, prefix+"seg%05d."+ext)}
+	args = append(args, keyArgs...)
+	return append(args, filepath.Join(dir, name+".m3u8"))
+}
+
+// runFFmpeg will run ffmpeg with args, its last line of output is the error
+func runFFmpeg(ctx context.Context, args []string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, FFmpegPath, append([]string{"-hide_banner", "-nostats", "-y"}, args...)...).CombinedOutput()
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		return out, fmt.Errorf("ffmpeg failed: %s", lines[len(lines)-1])
+	}
+	return out, nil
+}
+
+// removeHLS will delete a video's hls package
+func removeHLS(fileID string) {
+	os.RemoveAll(hlsDir(fileID))
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// nats subject ingest jobs are consumed from (on NATS_URL), empty disables
+	IngestNATSSubject = envString("INGEST_NATS_SUBJECT", "")
+	// kafka topic ingest jobs are consumed from (through KAFKA_REST_URL), empty disables
+	IngestKafkaTopic = envString("INGEST_KAFKA_TOPIC", "")
+	// replicas in the same group share the jobs, each job goes to one of them
+	IngestGroup = envString("INGEST_GROUP", "videoserver-ingest")
+)
+
+// IngestJob asks the server to fetch a video and register it, the url is
+// http(s):// or s3://bucket/key (read with the S3_* credentials)
+type IngestJob struct {
+	VideoID string `json:"video_id"`
+	Tenant  string `json:"tenant"`
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+}
+
+// IngestSource is a queue ingest jobs are consumed from
+type IngestSource interface {
+	Name() string
+	// Run will consume jobs until ctx is done, handle is called for one job at a time
+	Run(ctx context.Context, handle func(ctx context.Context, job IngestJob) error) error
+}
+
+// NewIngestSourcesFromEnv will set up the configured queues
+func NewIngestSourcesFromEnv() ([]IngestSource, error) {
+	var sources []IngestSource
+	if IngestNATSSubject != "" {
+		u, err := url.Parse(NATSURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("INGEST_NATS_SUBJECT needs a valid NATS_URL")
+		}
+		sources = append(sources, &NATSIngestSource{URL: u, Subject: IngestNATSSubject, Queue: IngestGroup})
+	}
+	if IngestKafkaTopic != "" {
+		if KafkaRESTURL == "" {
+			return nil, errors.New("INGEST_KAFKA_TOPIC needs KAFKA_REST_URL")
+		}
+		client, err := newOutboundClient(time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, &KafkaRESTIngestSource{
+			URL:    strings.TrimRight(KafkaRESTURL, "/"),
+			Topic:  IngestKafkaTopic,
+			Group:  IngestGroup,
+			client: client,
+		})
+	}
+	return sources, nil
+}
+
+// runIngest will consume every source until ctx is done, reconnecting after errors
+func (sm *StreamManager) runIngest(ctx context.Context, sources []IngestSource) {
+	for _, source := range sources {
+		log.Println("consuming ingest jobs from", source.Name())
+		// a source that fails is reconnected by the supervisor
+		supervisor.Go(ctx, "ingest "+source.Name(), RestartAlways, func(ctx context.Context) error {
+			return source.Run(ctx, sm.ingest)
+		})
+	}
+}
+
+// ingest will fetch a job's video into storage and register it like a
+// finished upload. jobs for videos that already exist are skipped so
+// redelivered jobs are harmless
+func (sm *StreamManager) ingest(ctx context.Context, job IngestJob) error {
+	if !isSafeName(job.VideoID) {
+		return fmt.Errorf("invalid video id %q", job.VideoID)
+	}
+	tenant := sm.tenants.def
+	if job.Tenant != "" && job.Tenant != DefaultTenantID {
+		var ok bool
+		if tenant, ok = sm.tenants.byID[job.Tenant]; !ok {
+			return fmt.Errorf("unknown tenant %q", job.Tenant)
+		}
+	}
+	fileID := tenant.VideoID(job.VideoID)
+	if _, exists := sm.metadata.GetVideo(fileID); exists || sm.hasUploadSession(fileID) {
+		log.Println("ingest: video already exists, skipping", fileID)
+		return nil
+	}
+
+	body, size, err := openIngestURL(ctx, job.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if MaxUploadSize > 0 && size > MaxUploadSize {
+		return fmt.Errorf("%s is larger than %d bytes", job.URL, MaxUploadSize)
+	}
+	if err := sm.checkTenantQuota(tenant, size); err != nil {
+		return err
+	}
+
+	// download next to the destination and move it in place once complete
+	path := filepath.Join(VideoStoragePath, videoKey(fileID))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	reader := io.Reader(body)
+	if MaxUploadSize > 0 {
+		reader = io.LimitReader(body, MaxUploadSize+1)
+	}
+	written, err := io.Copy(io.MultiWriter(tmp, hash), reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", job.URL, err)
+	}
+	if MaxUploadSize > 0 && written > MaxUploadSize {
+		return fmt.Errorf("%s is larger than %d bytes", job.URL, MaxUploadSize)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	tenant.stats.uploadedBytes.Add(written)
+
+	title := job.Title
+	if title == "" {
+		title = job.VideoID
+	}
+	if err := sm.metadata.PutVideo(VideoRecord{
+		ID:        job.VideoID,
+		Tenant:    tenant.ID,
+		Title:     title,
+		Size:      written,
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+		Status:    VideoStatusProcessing,
+		CreatedAt: time.Now(),
+	}); err != nil {
+		os.Remove(path)
+		return err
+	}
+	log.Println("ingested", fileID, "from", job.URL)
+	return sm.jobs.Enqueue(JobFinalizeUpload, fileID, nil)
+}
+
+// openIngestURL will open the source of a job, size is -1 when unknown
+func openIngestURL(ctx context.Context, raw string) (io.ReadCloser, int64, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		client, err := newOutboundClient(0)
+		if err != nil {
+			return nil, 0, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("fetching %s returned %s", raw, resp.Status)
+		}
+		return resp.Body, resp.ContentLength, nil
+
+	case "s3":
+		cfg := S3ConfigFromEnv()
+		cfg.Bucket = u.Host
+		cfg.Prefix = ""
+		s3, err := NewS3Storage(cfg)
+		if err != nil {
+			return nil, 0, err
+		}
+		key := strings.TrimPrefix(u.Path, "/")
+		info, err := s3.Stat(ctx, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		object, err := s3.Open(ctx, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		return object, info.Size(), nil
+
+	default:
+		return nil, 0, fmt.Errorf("unsupported ingest url %q", raw)
+	}
+}
+
+// NATSIngestSource will subscribe to a subject in a queue group. core nats
+// delivers at most once, a job lost while no replica is connected is gone
+type NATSIngestSource struct {
+	URL     *url.URL
+	Subject string
+	Queue   string
+}
+
+func (ns *NATSIngestSource) Name() string { return "nats " + ns.Subject }
+
+func (ns *NATSIngestSource) Run(ctx context.Context, handle func(ctx context.Context, job IngestJob) error) error {
+	conn, reader, err := dialNATS(ctx, ns.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if _, err := fmt.Fprintf(conn, "SUB %s %s 1\r\n", ns.Subject, ns.Queue); err != nil {
+		return err
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "PING":
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + line)
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <size>
+			fields := strings.Fields(line)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("nats: bad MSG line %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return err
+			}
+
+			var job IngestJob
+			if err := json.Unmarshal(payload[:size], &job); err != nil {
+				log.Println("ingest: invalid job on", fields[1], err)
+				continue
+			}
+			if err := handle(ctx, job); err != nil {
+				log.Println("ingest: job for", job.VideoID, "failed:", err)
+			}
+		}
+	}
+}
+
+// KafkaRESTIngestSource will consume a topic through a kafka REST proxy (v2 api),
+// offsets are committed after a job is handled so jobs survive a crash
+type KafkaRESTIngestSource struct {
+	URL    string
+	Topic  string
+	Group  string
+	client *http.Client
+}
+
+func (ks *KafkaRESTIngestSource) Name() string { return "kafka " + ks.Topic }
+
+type kafkaRecord struct {
+	Topic     string          `json:"topic"`
+	Value     json.RawMessage `json:"value"`
+	Partition int             `json:"partition"`
+	Offset    int64           `json:"offset"`
+}
+
+func (ks *KafkaRESTIngestSource) Run(ctx context.Context, handle func(ctx context.Context, job IngestJob) error) error {
+	var consumer struct {
+		InstanceID string `json:"instance_id"`
+		BaseURI    string `json:"base_uri"`
+	}
+	if err := ks.call(ctx, http.MethodPost, ks.URL+"/consumers/"+url.PathEscape(ks.Group), map[string]string{
+		"name":               leaderIdentity(),
+		"format":             "json",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}, &consumer); err != nil {
+		return err
+	}
+	// the proxy forgets idle consumers, removing ours lets the group rebalance right away
+	defer func() {
+		removeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ks.call(removeCtx, http.MethodDelete, consumer.BaseURI, nil, nil)
+		cancel()
+	}()
+
+	if err := ks.call(ctx, http.MethodPost, consumer.BaseURI+"/subscription", map[string][]string{"topics": {ks.Topic}}, nil); err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		var records []kafkaRecord
+		if err := ks.call(ctx, http.MethodGet, consumer.BaseURI+"/records?timeout=5000", nil, &records); err != nil {
+			return err
+		}
+		for _, record := range records {
+			var job IngestJob
+			if err := json.Unmarshal(record.Value, &job); err != nil {
+				log.Println("ingest: invalid job at", record.Topic, record.Partition, record.Offset, err)
+			} else if err := handle(ctx, job); err != nil {
+				log.Println("ingest: job for", job.VideoID, "failed:", err)
+			}
+
+			commit := map[string]interface{}{"offsets": []map[string]interface{}{{
+				"topic": record.Topic, "partition": record.Partition, "offset": record.Offset,
+			}}}
+			if err := ks.call(ctx, http.MethodPost, consumer.BaseURI+"/offsets", commit, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// call will make a REST proxy request and decode the json reply into out
+func (ks *KafkaRESTIngestSource) call(ctx context.Context, method, endpoint string, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.json.v2+json")
+
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("kafka rest proxy returned %s", resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
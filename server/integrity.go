@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// uploadChecksum is the sha256 the client says the whole upload has, as hex,
+// from X-Content-SHA256 (hex) or Digest: sha-256=<base64>. empty when it
+// sent neither
+func uploadChecksum(r *http.Request) (string, error) {
+	if raw := strings.TrimSpace(r.Header.Get("X-Content-SHA256")); raw != "" {
+		sum, err := hex.DecodeString(raw)
+		if err != nil || len(sum) != sha256.Size {
+			return "", errors.New("X-Content-SHA256 must be a hex sha256")
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	for _, digest := range strings.Split(r.Header.Get("Digest"), ",") {
+		algorithm, value, ok := strings.Cut(strings.TrimSpace(digest), "=")
+		if !ok || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != sha256.Size {
+			return "", errors.New("Digest sha-256 must be a base64 sha256")
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	return "", nil
+}
+
+// setChecksumHeaders will tell the client the checksum the server computed,
+// both ways it may have sent its own
+func setChecksumHeaders(w http.ResponseWriter, checksum string) {
+	sum, err := hex.DecodeString(checksum)
+	if err != nil {
+		return
+	}
+	w.Header().Set("X-Content-SHA256", checksum)
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+}
+
+// verifyStoredUpload will hash the stored file again and compare it with the
+// bytes that were received (checksum), an append that went wrong on disk
+// shows up here
+func verifyStoredUpload(path, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	stored, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if stored != checksum {
+		return fmt.Errorf("stored file has sha256 %s, the upload had %s", stored, checksum)
+	}
+	return nil
+}
+
+// markCorrupt will stop a video from being served, its file is kept to look at
+func (sm *StreamManager) markCorrupt(fileID, reason string) {
+	log.Println("corrupt upload", fileID, reason)
+	sm.metadata.UpdateVideo(fileID, func(video *VideoRecord) {
+		video.Status = VideoStatusCorrupt
+		video.Reason = reason
+	})
+	sm.events.Emit(EventVideoCorrupt, fileID, map[string]string{"reason": reason})
+}
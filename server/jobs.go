@@ -0,0 +1,520 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// jobs run at once on this instance, the transcodes among them still
+	// wait for one of the TRANSCODE_WORKERS
+	JobWorkers = envInt64("JOB_WORKERS", 4)
+	// tries before a job is given up on, it is kept as dead for /admin/jobs
+	JobMaxAttempts = envInt64("JOB_MAX_ATTEMPTS", 5)
+	// wait before the first retry of a failed job, doubling up to JOB_RETRY_MAX
+	JobRetryBackoff = envDuration("JOB_RETRY_BACKOFF", 10*time.Second)
+	JobRetryMax     = envDuration("JOB_RETRY_MAX", time.Hour)
+)
+
+const (
+	// a running job's lock that wasn't touched for this long was held by an
+	// instance that went away, the leader queues the job again
+	jobStale = 2 * time.Minute
+	// how often idle workers look for due jobs, a job queued on this
+	// instance wakes them right away
+	jobPoll = 5 * time.Second
+)
+
+// job states
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	// out of attempts, it stays until it is retried or deleted
+	JobDead = "dead"
+)
+
+// job kinds
+const (
+	JobFinalizeUpload = "upload.finalize"
+	JobPackageHLS     = "hls.package"
+	JobExtractAudio   = "audio.extract"
+	JobMakePreview    = "preview.make"
+	JobDeliverEvent   = "event.deliver"
+	JobExpireVideo    = "video.expire"
+	JobMigrateStorage = "storage.migrate"
+)
+
+// Job is background work that has to get done even when the process
+// restarts, kept as a file in the jobs dir until it is
+type Job struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// what it is for, a video mostly. a kind is queued once per key
+	Key      string          `json:"key,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Status   string          `json:"status"`
+	Attempts int             `json:"attempts"`
+	// not run before then, a failed attempt pushes it out
+	RunAt     time.Time `json:"run_at"`
+	LastError string    `json:"last_error,omitempty"`
+	// the instance running it
+	Worker string `json:"worker,omitempty"`
+	// queued again while it ran, it runs once more
+	Again     bool      `json:"again,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// JobHandler does a job, an error has it tried again later
+type JobHandler func(ctx context.Context, job *Job) error
+
+// JobQueue keeps jobs as files in a directory. every instance sharing the
+// directory works on the due ones, a lock file next to a job says which
+// instance has it
+type JobQueue struct {
+	dir      string
+	identity string
+	handlers map[string]JobHandler
+	wake     chan struct{}
+
+	// job files are read and written under it, other instances keep off the
+	// ones this one has locked
+	mu sync.Mutex
+}
+
+// jobsDir is where the jobs are kept
+func jobsDir() string {
+	return filepath.Join(VideoStoragePath, ".jobs")
+}
+
+// NewJobQueue will use dir for the jobs, handlers has one for every kind
+func NewJobQueue(dir string, handlers map[string]JobHandler) (*JobQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &JobQueue{dir: dir, identity: leaderIdentity(), handlers: handlers, wake: make(chan struct{}, 1)}, nil
+}
+
+func (jq *JobQueue) path(id string) string {
+	return filepath.Join(jq.dir, id+".json")
+}
+
+func (jq *JobQueue) lockPath(id string) string {
+	return filepath.Join(jq.dir, id+".lock")
+}
+
+// Start will run the workers until ctx is done
+func (jq *JobQueue) Start(ctx context.Context) {
+	for i := range max(JobWorkers, 1) {
+		supervisor.Go(ctx, "jobs-"+strconv.FormatInt(i+1, 10), RestartAlways, jq.work)
+	}
+}
+
+// Enqueue will queue a job of kind for key, "" when every job is its own. a
+// job for the key that is waiting already is left as it is, one that is
+// running runs once more after and a dead one starts over
+func (jq *JobQueue) Enqueue(kind, key string, payload interface{}) error {
+	if jq.handlers[kind] == nil {
+		return fmt.Errorf("unknown job kind %q", kind)
+	}
+	id := newID()
+	if key != "" {
+		sum := sha256.Sum256([]byte(kind + "\n" + key))
+		id = hex.EncodeToString(sum[:8])
+	}
+	var raw json.RawMessage
+	if payload != nil {
+		var err error
+		if raw, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	now := time.Now().UTC()
+	if job, err := jq.load(id); err == nil {
+		switch job.Status {
+		case JobQueued:
+			return nil
+		case JobRunning:
+			job.Again, job.Payload, job.UpdatedAt = true, raw, now
+			return jq.save(job)
+		}
+	}
+	job := &Job{ID: id, Kind: kind, Key: key, Payload: raw, Status: JobQueued, RunAt: now, CreatedAt: now, UpdatedAt: now}
+	if err := jq.save(job); err != nil {
+		return err
+	}
+	jq.notify()
+	return nil
+}
+
+// notify will wake a worker
+func (jq *JobQueue) notify() {
+	select {
+	case jq.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (jq *JobQueue) load(id string) (*Job, error) {
+	data, err := os.ReadFile(jq.path(id))
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (jq *JobQueue) save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(jq.path(job.ID), data)
+}
+
+// List will return every job, oldest first
+func (jq *JobQueue) List() []Job {
+	paths, _ := filepath.Glob(filepath.Join(jq.dir, "*.json"))
+	jobs := make([]Job, 0, len(paths))
+	for _, path := range paths {
+		if job, err := jq.load(strings.TrimSuffix(filepath.Base(path), ".json")); err == nil {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// work is a worker, it runs due jobs until there are none and waits for more
+func (jq *JobQueue) work(ctx context.Context) error {
+	ticker := time.NewTicker(jobPoll)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			job := jq.claim()
+			if job == nil {
+				break
+			}
+			// there may be more, another worker can look while this one is busy
+			jq.notify()
+			jq.run(ctx, job)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-jq.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim will lock the job that has waited longest and mark it running, nil
+// when nothing is due
+func (jq *JobQueue) claim() *Job {
+	now := time.Now()
+	var due []Job
+	for _, job := range jq.List() {
+		if job.Status == JobQueued && !job.RunAt.After(now) && jq.handlers[job.Kind] != nil {
+			due = append(due, job)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].RunAt.Before(due[j].RunAt) })
+
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	for _, candidate := range due {
+		lock, err := os.OpenFile(jq.lockPath(candidate.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			continue
+		}
+		lock.WriteString(jq.identity)
+		lock.Close()
+		// it may have been taken and finished since it was listed
+		job, err := jq.load(candidate.ID)
+		if err != nil || job.Status != JobQueued {
+			os.Remove(jq.lockPath(candidate.ID))
+			continue
+		}
+		job.Status, job.Worker, job.UpdatedAt = JobRunning, jq.identity, time.Now().UTC()
+		job.Attempts++
+		if err := jq.save(job); err != nil {
+			log.Println("failed to claim job", job.ID, err)
+			os.Remove(jq.lockPath(job.ID))
+			continue
+		}
+		return job
+	}
+	return nil
+}
+
+// run will do a claimed job and queue it again, give up on it or drop it
+func (jq *JobQueue) run(ctx context.Context, job *Job) {
+	runCtx, cancel := context.WithCancel(ctx)
+	go jq.heartbeat(runCtx, job.ID)
+	runCtx, span := startSpan(runCtx, "job "+job.Kind, SpanInternal)
+	span.Set("job.id", job.ID)
+	span.Set("job.key", job.Key)
+	span.Set("job.attempt", job.Attempts)
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		return jq.handlers[job.Kind](runCtx, job)
+	}()
+	span.End(err)
+	cancel()
+
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	defer os.Remove(jq.lockPath(job.ID))
+	current, loadErr := jq.load(job.ID)
+	if loadErr != nil {
+		// deleted while it ran
+		return
+	}
+	now := time.Now().UTC()
+	job.Again, job.Payload, job.UpdatedAt, job.Worker = current.Again, current.Payload, now, ""
+	switch {
+	case job.Again:
+		job.Status, job.Again, job.Attempts, job.RunAt, job.LastError = JobQueued, false, 0, now, ""
+		jq.notify()
+	case err == nil:
+		os.Remove(jq.path(job.ID))
+		return
+	case ctx.Err() != nil:
+		// stopped with the process, that doesn't count as a try
+		job.Status, job.RunAt = JobQueued, now
+		job.Attempts--
+	case int64(job.Attempts) >= JobMaxAttempts:
+		log.Println("job", job.Kind, job.ID, "failed for good:", err)
+		job.Status, job.LastError = JobDead, err.Error()
+	default:
+		log.Println("job", job.Kind, job.ID, "failed, retrying:", err)
+		job.Status, job.LastError, job.RunAt = JobQueued, err.Error(), now.Add(jobBackoff(job.Attempts))
+	}
+	if err := jq.save(job); err != nil {
+		log.Println("failed to save job", job.ID, err)
+	}
+}
+
+// jobBackoff is how long a job waits after its attempt-th try failed
+func jobBackoff(attempt int) time.Duration {
+	backoff := JobRetryBackoff
+	for i := 1; i < attempt && backoff < JobRetryMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, JobRetryMax)
+}
+
+// heartbeat will keep a job's lock fresh while it runs, so a long transcode
+// isn't taken for one whose instance went away
+func (jq *JobQueue) heartbeat(ctx context.Context, id string) {
+	ticker := time.NewTicker(jobStale / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			os.Chtimes(jq.lockPath(id), now, now)
+		}
+	}
+}
+
+// sweepJobs will queue the jobs of instances that went away while running
+// them again, they count as a try. it runs on the leader
+func (jq *JobQueue) sweepJobs(ctx context.Context) {
+	locks, _ := filepath.Glob(filepath.Join(jq.dir, "*.lock"))
+	for _, lock := range locks {
+		if ctx.Err() != nil {
+			return
+		}
+		info, err := os.Stat(lock)
+		if err != nil || time.Since(info.ModTime()) < jobStale {
+			continue
+		}
+		id := strings.TrimSuffix(filepath.Base(lock), ".lock")
+		jq.mu.Lock()
+		if job, err := jq.load(id); err == nil && job.Status == JobRunning {
+			log.Println("job", job.Kind, job.ID, "was left running by", job.Worker)
+			job.Status, job.Worker, job.LastError, job.UpdatedAt = JobQueued, "", "the instance running it went away", time.Now().UTC()
+			job.RunAt = job.UpdatedAt
+			if int64(job.Attempts) >= JobMaxAttempts {
+				job.Status = JobDead
+			}
+			if err := jq.save(job); err != nil {
+				log.Println("failed to save job", job.ID, err)
+			}
+		}
+		os.Remove(lock)
+		jq.mu.Unlock()
+	}
+	jq.notify()
+}
+
+// handleListJobs will list the jobs, ?status=dead for the ones given up on
+// and ?kind= for one kind
+func (jq *JobQueue) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	status, kind := params.Get("status"), params.Get("kind")
+	if status != "" && status != JobQueued && status != JobRunning && status != JobDead {
+		writeError(w, http.StatusBadRequest, "status must be queued, running or dead")
+		return
+	}
+	limit := 100
+	if raw := params.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+	jobs := []Job{}
+	for _, job := range jq.List() {
+		if (status == "" || job.Status == status) && (kind == "" || job.Kind == kind) && len(jobs) < limit {
+			jobs = append(jobs, job)
+		}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleJob will show a job, DELETE drops one that isn't running
+func (jq *JobQueue) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !isSafeName(id) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	job, err := jq.load(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+	if job.Status == JobRunning {
+		writeError(w, http.StatusConflict, "job is running")
+		return
+	}
+	if err := os.Remove(jq.path(id)); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete job")
+		return
+	}
+	auditAs(r, "", job.Kind+" "+job.Key, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRetryJob will run a dead or waiting job now, with all its tries
+func (jq *JobQueue) handleRetryJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !isSafeName(id) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	job, err := jq.load(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if job.Status == JobRunning {
+		writeError(w, http.StatusConflict, "job is running")
+		return
+	}
+	job.Status, job.Attempts, job.LastError = JobQueued, 0, ""
+	job.RunAt, job.UpdatedAt = time.Now().UTC(), time.Now().UTC()
+	if err := jq.save(job); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to retry job")
+		return
+	}
+	auditAs(r, "", job.Kind+" "+job.Key, "")
+	jq.notify()
+	writeJSON(w, http.StatusOK, job)
+}
+
+// jobHandlers is the background work that goes through the job queue
+func (sm *StreamManager) jobHandlers() map[string]JobHandler {
+	return map[string]JobHandler{
+		JobFinalizeUpload: func(ctx context.Context, job *Job) error {
+			return sm.finalizeUpload(ctx, job.Key)
+		},
+		JobPackageHLS: func(ctx context.Context, job *Job) error {
+			return sm.ifAvailable(job.Key, func() error {
+				return sm.packageHLS(ctx, job.Key, PriorityBackground)
+			})
+		},
+		JobExtractAudio: func(ctx context.Context, job *Job) error {
+			return sm.ifAvailable(job.Key, func() error {
+				err := sm.extractAudio(ctx, job.Key, audioFormats["aac"], PriorityBackground)
+				if errors.Is(err, errNoAudio) {
+					return nil
+				}
+				return err
+			})
+		},
+		JobMakePreview: func(ctx context.Context, job *Job) error {
+			video, ok := sm.metadata.GetVideo(job.Key)
+			if !ok || !video.Available() || !video.IsVideo() {
+				return nil
+			}
+			for _, name := range []string{"poster", "preview"} {
+				if err := sm.makePreview(ctx, video, name, previewFormats[name], PriorityBackground); err != nil {
+					return noFFmpeg(err)
+				}
+			}
+			return nil
+		},
+		JobDeliverEvent: func(ctx context.Context, job *Job) error {
+			return sm.events.deliver(ctx, job)
+		},
+		JobExpireVideo: func(ctx context.Context, job *Job) error {
+			return sm.expireVideo(ctx, job.Key)
+		},
+		JobMigrateStorage: sm.migrateStorage,
+	}
+}
+
+// ifAvailable will run build for a video that is still there to build for
+func (sm *StreamManager) ifAvailable(fileID string, build func() error) error {
+	if video, ok := sm.metadata.GetVideo(fileID); !ok || !video.Available() || !video.IsVideo() {
+		return nil
+	}
+	return noFFmpeg(build())
+}
+
+// noFFmpeg will drop the error of work that needs ffmpeg when there is
+// none, trying again wouldn't help
+func noFFmpeg(err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSON will send v as a json response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// package hls when an upload becomes ready, so the source and the hls
+	// package exist from the start. the audio renditions are made on their
+	// first request either way unless AUDIO_EAGER is on
+	HLSEager = envBool("HLS_EAGER", false)
+	// how long a request for a rendition that isn't made yet waits for it
+	// before it gets a 202 to come back later. 0 waits as long as it takes
+	RenditionWait = envDuration("RENDITION_WAIT", 0)
+)
+
+// renditionContext will limit how long a request waits for a rendition
+func renditionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if RenditionWait <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, RenditionWait)
+}
+
+// stillProcessing reports whether err is the request giving up on a build
+// that goes on, which is answered with writeProcessing
+func stillProcessing(r *http.Request, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil
+}
+
+// writeProcessing will tell the client the rendition is being made and when
+// to ask again
+func writeProcessing(w http.ResponseWriter, r *http.Request) {
+	retry := max(RenditionWait, 5*time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	setCachePolicy(w, r, CacheNoStore, "")
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": VideoStatusProcessing})
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// none (every replica runs singleton jobs), kubernetes or file
+	LeaderElectionMode = envString("LEADER_ELECTION", "none")
+	// name of the lease / lock
+	LeaderElectionName = envString("LEADER_ELECTION_NAME", "video-streaming-server")
+	// how long a lease is valid without renewal
+	LeaderLeaseDuration = envDuration("LEADER_LEASE_DURATION", 15*time.Second)
+	// how often the lease is renewed / acquisition retried
+	LeaderRetryPeriod = envDuration("LEADER_RETRY_PERIOD", 5*time.Second)
+)
+
+// Elector is a lease that only one replica can hold at a time
+type Elector interface {
+	// TryAcquire will take or renew the lease, it reports whether we hold it
+	TryAcquire(ctx context.Context) (bool, error)
+	// Release will give the lease up so another replica can take over quickly
+	Release(ctx context.Context) error
+}
+
+// NewElectorFromEnv will build the elector selected by LEADER_ELECTION, nil means
+// this instance is always the leader
+func NewElectorFromEnv() (Elector, error) {
+	identity := leaderIdentity()
+	switch LeaderElectionMode {
+	case "none", "":
+		return nil, nil
+	case "kubernetes":
+		return NewKubernetesLease(LeaderElectionName, identity, LeaderLeaseDuration)
+	case "file":
+		path := envString("LEADER_LOCK_FILE", filepath.Join(VideoStoragePath, ".leader-"+LeaderElectionName))
+		return &FileLease{Path: path, Identity: identity, Duration: LeaderLeaseDuration}, nil
+	default:
+		return nil, fmt.Errorf("unknown LEADER_ELECTION %q", LeaderElectionMode)
+	}
+}
+
+// leaderIdentity is the pod name in kubernetes, host and pid elsewhere
+func leaderIdentity() string {
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		return pod
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// LeaderElection will keep trying to hold the lease and run onElected while it does
+type LeaderElection struct {
+	elector Elector
+	leader  atomic.Bool
+}
+
+// IsLeader reports whether this instance currently holds the lease
+func (le *LeaderElection) IsLeader() bool {
+	return le.leader.Load()
+}
+
+// Run will block until ctx is done. onElected gets a context that is cancelled
+// as soon as the lease is lost
+func (le *LeaderElection) Run(ctx context.Context, onElected func(ctx context.Context)) {
+	if le.elector == nil {
+		le.leader.Store(true)
+		onElected(ctx)
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(LeaderRetryPeriod)
+	defer ticker.Stop()
+
+	var cancelLeader context.CancelFunc
+	for {
+		held, err := le.elector.TryAcquire(ctx)
+		if err != nil {
+			log.Println("leader election:", err)
+		}
+
+		switch {
+		case held && cancelLeader == nil:
+			log.Println("leader election: became leader")
+			le.leader.Store(true)
+			var leaderCtx context.Context
+			leaderCtx, cancelLeader = context.WithCancel(ctx)
+			go onElected(leaderCtx)
+		case !held && cancelLeader != nil:
+			log.Println("leader election: lost leadership")
+			le.leader.Store(false)
+			cancelLeader()
+			cancelLeader = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if cancelLeader != nil {
+				cancelLeader()
+				le.leader.Store(false)
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				le.elector.Release(releaseCtx)
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleLeaderStatus will report who this instance is and whether it leads
+func (le *LeaderElection) handleLeaderStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"identity": leaderIdentity(),
+		"mode":     LeaderElectionMode,
+		"leader":   le.IsLeader(),
+	})
+}
+
+// FileLease is a lease kept in a file on storage shared by all replicas
+type FileLease struct {
+	Path     string
+	Identity string
+	Duration time.Duration
+}
+
+type fileLeaseState struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (fl *FileLease) TryAcquire(ctx context.Context) (bool, error) {
+	data, err := os.ReadFile(fl.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	lease, _ := json.Marshal(fileLeaseState{Holder: fl.Identity, ExpiresAt: time.Now().Add(fl.Duration)})
+
+	if err == nil {
+		var state fileLeaseState
+		json.Unmarshal(data, &state)
+		if state.Holder == fl.Identity {
+			return true, writeFileAtomic(fl.Path, lease)
+		}
+		if time.Now().Before(state.ExpiresAt) {
+			return false, nil
+		}
+		// expired, clear it and race the others to create it
+		if err := os.Remove(fl.Path); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	// O_EXCL makes sure only one replica creates the lease. a replica that
+	// loses a race after removing an expired lease notices on its next renew
+	file, err := os.OpenFile(fl.Path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+	if _, err := file.Write(lease); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (fl *FileLease) Release(ctx context.Context) error {
+	data, err := os.ReadFile(fl.Path)
+	if err != nil {
+		return nil
+	}
+	var state fileLeaseState
+	if json.Unmarshal(data, &state) == nil && state.Holder == fl.Identity {
+		return os.Remove(fl.Path)
+	}
+	return nil
+}
+
+// KubernetesLease is a coordination.k8s.io/v1 Lease, talked to with the pod's
+// service account
+type KubernetesLease struct {
+	name      string
+	namespace string
+	identity  string
+	duration  time.Duration
+	apiURL    string
+	client    *http.Client
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// NewKubernetesLease will set up an in cluster lease client
+func NewKubernetesLease(name, identity string, duration time.Duration) (*KubernetesLease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside kubernetes")
+	}
+
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	return &KubernetesLease{
+		name:      name,
+		namespace: strings.TrimSpace(string(namespace)),
+		identity:  identity,
+		duration:  duration,
+		apiURL:    "https://" + host + ":" + port,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// kubernetes MicroTime format
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (kl *KubernetesLease) TryAcquire(ctx context.Context) (bool, error) {
+	var lease kubeLease
+	status, err := kl.request(ctx, http.MethodGet, kl.leaseURL(), nil, &lease)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	if status == http.StatusNotFound {
+		lease.APIVersion = "coordination.k8s.io/v1"
+		lease.Kind = "Lease"
+		lease.Metadata.Name = kl.name
+		lease.Metadata.Namespace = kl.namespace
+		lease.Spec.HolderIdentity = kl.identity
+		lease.Spec.LeaseDurationSeconds = int(kl.duration.Seconds())
+		lease.Spec.AcquireTime = now.Format(kubeMicroTime)
+		lease.Spec.RenewTime = now.Format(kubeMicroTime)
+
+		collectionURL := kl.apiURL + "/apis/coordination.k8s.io/v1/namespaces/" + kl.namespace + "/leases"
+		status, err = kl.request(ctx, http.MethodPost, collectionURL, lease, nil)
+		if err != nil {
+			return false, err
+		}
+		// 409 means someone else created it first
+		return status == http.StatusCreated, nil
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("get lease: unexpected status %d", status)
+	}
+
+	if lease.Spec.HolderIdentity != kl.identity {
+		renewed, _ := time.Parse(kubeMicroTime, lease.Spec.RenewTime)
+		expires := renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if lease.Spec.HolderIdentity != "" && now.Before(expires) {
+			return false, nil
+		}
+		lease.Spec.HolderIdentity = kl.identity
+		lease.Spec.AcquireTime = now.Format(kubeMicroTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(kl.duration.Seconds())
+	lease.Spec.RenewTime = now.Format(kubeMicroTime)
+
+	// the resourceVersion makes this a compare and swap, 409 means we lost the race
+	status, err = kl.request(ctx, http.MethodPut, kl.leaseURL(), lease, nil)
+	if err != nil {
+		return false, err
+	}
+	return status == http.StatusOK, nil
+}
+
+func (kl *KubernetesLease) Release(ctx context.Context) error {
+	var lease kubeLease
+	status, err := kl.request(ctx, http.MethodGet, kl.leaseURL(), nil, &lease)
+	if err != nil || status != http.StatusOK || lease.Spec.HolderIdentity != kl.identity {
+		return err
+	}
+	lease.Spec.HolderIdentity = ""
+	_, err = kl.request(ctx, http.MethodPut, kl.leaseURL(), lease, nil)
+	return err
+}
+
+func (kl *KubernetesLease) leaseURL() string {
+	return kl.apiURL + "/apis/coordination.k8s.io/v1/namespaces/" + kl.namespace + "/leases/" + kl.name
+}
+
+// request will call the api server, the token is re-read since it is rotated
+func (kl *KubernetesLease) request(ctx context.Context, method, url string, body, out interface{}) (int, error) {
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return 0, err
+	}
+
+	var payload []byte
+	if body != nil {
+		if payload, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := kl.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return 0, err
+		}
+	}
+	return resp.StatusCode, nil
+}
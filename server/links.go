@@ -0,0 +1,431 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what a short link opens
+const (
+	LinkTargetPage     = "page"
+	LinkTargetPlayback = "playback"
+)
+
+const (
+	linkCodeLength   = 7
+	linkCodeAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	// days of daily click counts kept per link
+	linkClickDays = 90
+	// playback links mint a token this long lived when the link doesn't say
+	defaultLinkTokenTTL = 6 * time.Hour
+)
+
+var ErrLinkNotFound = errors.New("link not found")
+
+// ShortLink is a /s/{code} link to a video
+type ShortLink struct {
+	Code    string `json:"code"`
+	Tenant  string `json:"tenant,omitempty"`
+	VideoID string `json:"video_id"`
+	Target  string `json:"target"`
+	// lifetime of the playback token a playback link hands out, in seconds
+	TokenTTL  int64      `json:"token_ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy string     `json:"created_by,omitempty"`
+
+	Clicks      int64            `json:"clicks"`
+	LastClickAt *time.Time       `json:"last_click_at,omitempty"`
+	Daily       map[string]int64 `json:"daily,omitempty"`
+}
+
+// Expired will tell if the link can't be followed anymore
+func (l *ShortLink) Expired() bool {
+	return l.ExpiresAt != nil && time.Now().After(*l.ExpiresAt)
+}
+
+// LinkStore will keep the short links and their clicks. it is saved in the
+// background like the history since clicks come far more often than new links
+type LinkStore struct {
+	path string
+
+	mu    sync.Mutex
+	links map[string]*ShortLink
+	dirty bool
+}
+
+// NewLinkStore will load the links from path, a missing file is empty
+func NewLinkStore(path string) (*LinkStore, error) {
+	ls := &LinkStore{path: path, links: make(map[string]*ShortLink)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &ls.links); err != nil {
+			return nil, err
+		}
+	}
+	supervisor.Go(context.Background(), "links-flush", RestartAlways, ls.flushRoutine)
+	return ls, nil
+}
+
+// Create will give the link a fresh code and store it
+func (ls *LinkStore) Create(link ShortLink) (ShortLink, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for {
+		code, err := newLinkCode()
+		if err != nil {
+			return link, err
+		}
+		if _, taken := ls.links[code]; !taken {
+			link.Code = code
+			break
+		}
+	}
+	ls.links[link.Code] = &link
+	return link, ls.saveLocked()
+}
+
+// Get will return a copy of a link
+func (ls *LinkStore) Get(code string) (ShortLink, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	link, ok := ls.links[code]
+	if !ok {
+		return ShortLink{}, false
+	}
+	return link.copy(), true
+}
+
+// List will return a tenant's links, of one video when videoID isn't empty, newest first
+func (ls *LinkStore) List(tenantID, videoID string) []ShortLink {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	links := []ShortLink{}
+	for _, link := range ls.links {
+		if inTenant(link.Tenant, tenantID) && (videoID == "" || link.VideoID == videoID) {
+			links = append(links, link.copy())
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.After(links[j].CreatedAt) })
+	return links
+}
+
+// Click will count a visit of a link
+func (ls *LinkStore) Click(code string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	link, ok := ls.links[code]
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	link.Clicks++
+	link.LastClickAt = &now
+	if link.Daily == nil {
+		link.Daily = make(map[string]int64)
+	}
+	link.Daily[now.Format(time.DateOnly)]++
+	oldest := now.AddDate(0, 0, -linkClickDays).Format(time.DateOnly)
+	for day := range link.Daily {
+		if day < oldest {
+			delete(link.Daily, day)
+		}
+	}
+	ls.dirty = true
+}
+
+// Delete will remove a link
+func (ls *LinkStore) Delete(code string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.links[code]; !ok {
+		return ErrLinkNotFound
+	}
+	delete(ls.links, code)
+	return ls.saveLocked()
+}
+
+// DeleteVideo will remove every link to a video, returning their codes
+func (ls *LinkStore) DeleteVideo(tenantID, videoID string) []string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var codes []string
+	for code, link := range ls.links {
+		if inTenant(link.Tenant, tenantID) && link.VideoID == videoID {
+			delete(ls.links, code)
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) > 0 {
+		if err := ls.saveLocked(); err != nil {
+			log.Println("failed to save links", err)
+		}
+	}
+	return codes
+}
+
+func (l *ShortLink) copy() ShortLink {
+	link := *l
+	link.Daily = make(map[string]int64, len(l.Daily))
+	for day, clicks := range l.Daily {
+		link.Daily[day] = clicks
+	}
+	return link
+}
+
+// saveLocked will write the links now, caller holds mu
+func (ls *LinkStore) saveLocked() error {
+	data, err := json.Marshal(ls.links)
+	if err != nil {
+		return err
+	}
+	ls.dirty = false
+	return writeFileAtomic(ls.path, data)
+}
+
+func (ls *LinkStore) flushRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		ls.mu.Lock()
+		if !ls.dirty {
+			ls.mu.Unlock()
+			continue
+		}
+		data, err := json.Marshal(ls.links)
+		ls.dirty = false
+		ls.mu.Unlock()
+
+		if err == nil {
+			err = writeFileAtomic(ls.path, data)
+		}
+		if err != nil {
+			log.Println("failed to save links", err)
+		}
+	}
+}
+
+// linksPath is where the short links are persisted
+func linksPath() string {
+	return filepath.Join(VideoStoragePath, ".links.json")
+}
+
+// newLinkCode is short enough to type and random enough not to be guessed
+func newLinkCode() (string, error) {
+	code := make([]byte, linkCodeLength)
+	limit := big.NewInt(int64(len(linkCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		code[i] = linkCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// linkSubject is the token subject of the tokens a link hands out, so
+// revoking the link revokes them too
+func linkSubject(code string) string {
+	return "link:" + code
+}
+
+// handleShortLink will redirect a short link to the watch page or to the
+// stream with a freshly minted playback token
+func (sm *StreamManager) handleShortLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := sm.links.Get(r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "link not found")
+		return
+	}
+	if link.Expired() {
+		writeError(w, http.StatusGone, "link expired")
+		return
+	}
+	video, ok := sm.metadata.GetVideo(scopeID(link.Tenant, link.VideoID))
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+
+	tenant := &Tenant{ID: DefaultTenantID}
+	if link.Tenant != "" {
+		tenant.ID = link.Tenant
+	}
+	target := tenant.Path("/watch/" + url.PathEscape(link.VideoID))
+	if link.Target == LinkTargetPlayback {
+		query := url.Values{"id": {link.VideoID}}
+		if sm.tokens.Signs() {
+			ttl := time.Duration(link.TokenTTL) * time.Second
+			if ttl <= 0 {
+				ttl = defaultLinkTokenTTL
+			}
+			if link.ExpiresAt != nil {
+				ttl = min(ttl, time.Until(*link.ExpiresAt))
+			}
+			token, _, err := sm.tokens.Issue(TokenClaims{
+				Scope:   ScopePlayback,
+				VideoID: link.VideoID,
+				Subject: linkSubject(link.Code),
+				Tenant:  link.Tenant,
+			}, ttl)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to issue token")
+				return
+			}
+			query.Set("token", token)
+		}
+		target = tenant.Path("/api/watch") + "?" + query.Encode()
+	}
+
+	// link previews aren't clicks
+	if r.Method == http.MethodGet && !isUnfurlBot(r.UserAgent()) {
+		sm.links.Click(link.Code)
+	}
+	setCachePolicy(w, r, CacheNoStore, "")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// linkResponse is a link with its full short url
+type linkResponse struct {
+	ShortLink
+	URL string `json:"url"`
+}
+
+func newLinkResponse(r *http.Request, link ShortLink) linkResponse {
+	return linkResponse{ShortLink: link, URL: baseURL(r) + "/s/" + link.Code}
+}
+
+// handleCreateLink will create a short link to one of the tenant's videos
+func (sm *StreamManager) handleCreateLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		VideoID string `json:"video_id"`
+		Target  string `json:"target"`
+		// seconds until the link stops working, forever when 0
+		ExpiresIn int64 `json:"expires_in"`
+		TokenTTL  int64 `json:"token_ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Target == "" {
+		req.Target = LinkTargetPage
+	}
+	if req.Target != LinkTargetPage && req.Target != LinkTargetPlayback {
+		writeError(w, http.StatusBadRequest, "target must be page or playback")
+		return
+	}
+	if req.ExpiresIn < 0 || req.TokenTTL < 0 {
+		writeError(w, http.StatusBadRequest, "expires_in and token_ttl can't be negative")
+		return
+	}
+	tenant := tenantFrom(r)
+	if video, ok := sm.metadata.GetVideo(tenant.VideoID(req.VideoID)); !ok || !isSafeName(req.VideoID) || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+
+	link := ShortLink{
+		Tenant:    tenant.ID,
+		VideoID:   req.VideoID,
+		Target:    req.Target,
+		TokenTTL:  req.TokenTTL,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: sm.tokens.Subject(r),
+	}
+	if link.Tenant == DefaultTenantID {
+		link.Tenant = ""
+	}
+	if req.ExpiresIn > 0 {
+		expires := link.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		link.ExpiresAt = &expires
+	}
+	link, err := sm.links.Create(link)
+	if err != nil {
+		log.Println("failed to save link", err)
+		writeError(w, http.StatusInternalServerError, "failed to save link")
+		return
+	}
+	writeJSON(w, http.StatusCreated, newLinkResponse(r, link))
+}
+
+// handleListLinks will list the tenant's links, ?video_id= narrows it to one video
+func (sm *StreamManager) handleListLinks(w http.ResponseWriter, r *http.Request) {
+	links := []linkResponse{}
+	for _, link := range sm.links.List(tenantFrom(r).ID, r.URL.Query().Get("video_id")) {
+		links = append(links, newLinkResponse(r, link))
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+// handleGetLink will return a link with its click stats
+func (sm *StreamManager) handleGetLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := sm.tenantLink(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, "link not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, newLinkResponse(r, link))
+}
+
+// handleDeleteLink will revoke a link and the playback tokens it handed out
+func (sm *StreamManager) handleDeleteLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := sm.tenantLink(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, "link not found")
+		return
+	}
+	if err := sm.links.Delete(link.Code); err != nil && err != ErrLinkNotFound {
+		writeError(w, http.StatusInternalServerError, "failed to delete link")
+		return
+	}
+	if link.Target == LinkTargetPlayback && sm.tokens.Signs() {
+		if err := sm.tokens.RevokeSubject(linkSubject(link.Code)); err != nil {
+			log.Println("failed to revoke link tokens", link.Code, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tenantLink will find the {code} link, links of other tenants aren't found
+func (sm *StreamManager) tenantLink(r *http.Request) (ShortLink, bool) {
+	link, ok := sm.links.Get(r.PathValue("code"))
+	if !ok || !inTenant(link.Tenant, tenantFrom(r).ID) {
+		return ShortLink{}, false
+	}
+	return link, true
+}
+
+// removeLinks will delete the links to a deleted video
+func (sm *StreamManager) removeLinks(fileID string) {
+	videoID := fileID
+	if _, id, ok := strings.Cut(fileID, "/"); ok {
+		videoID = id
+	}
+	for _, code := range sm.links.DeleteVideo(tenantOf(fileID), videoID) {
+		if sm.tokens.Signs() {
+			sm.tokens.RevokeSubject(linkSubject(code))
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// where the api listens, a comma separated list of any of
+	//   :8080, host:8080 or http://host:8080
+	//   https://host:8443
+	//   unix:/run/videoserver.sock, for nginx or caddy on the same host
+	//   systemd, every socket systemd passed by socket activation, or
+	//   systemd:name for the ones of FileDescriptorName=name
+	// https+unix: and https+systemd: serve those with tls. behind a proxy
+	// set TRUST_PROXY_HEADERS, clients on a unix socket have no address
+	ListenAddrs = envString("LISTEN", ":8080")
+	// certificate and key of the https listeners
+	TLSCertFile = envString("TLS_CERT_FILE", "")
+	TLSKeyFile  = envString("TLS_KEY_FILE", "")
+	// permissions of the unix sockets we make, so the proxy's user can connect
+	ListenSocketMode = envString("LISTEN_SOCKET_MODE", "0660")
+)
+
+// a listener of LISTEN
+type listenSpec struct {
+	raw string
+	// tcp, unix or systemd, where addr is the socket name ("" for all)
+	network, addr string
+	tls           bool
+}
+
+func (spec listenSpec) String() string {
+	return spec.raw
+}
+
+// parseListenSpecs will parse a LISTEN value
+func parseListenSpecs(raw string) ([]listenSpec, error) {
+	var specs []listenSpec
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		spec, err := parseListenSpec(part)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("LISTEN has no listeners")
+	}
+	return specs, nil
+}
+
+func parseListenSpec(raw string) (listenSpec, error) {
+	spec := listenSpec{raw: raw, network: "tcp"}
+	rest, secure := strings.CutPrefix(raw, "https+")
+	if after, ok := strings.CutPrefix(rest, "https://"); ok {
+		spec.addr, spec.tls = after, true
+	} else if after, ok := strings.CutPrefix(rest, "http://"); ok {
+		spec.addr = after
+	} else if after, ok := strings.CutPrefix(rest, "unix:"); ok {
+		spec.network, spec.addr = "unix", strings.TrimPrefix(after, "//")
+		if spec.addr == "" {
+			return spec, fmt.Errorf("listener %q has no socket path", raw)
+		}
+	} else if rest == "systemd" || strings.HasPrefix(rest, "systemd:") {
+		spec.network, spec.addr = "systemd", strings.TrimPrefix(rest, "systemd:")
+		if rest == "systemd" {
+			spec.addr = ""
+		}
+	} else {
+		spec.addr = rest
+	}
+	if secure {
+		if spec.network == "tcp" {
+			return spec, fmt.Errorf("listener %q: https+ is for unix and systemd listeners, use https://", raw)
+		}
+		spec.tls = true
+	}
+	if spec.network == "tcp" {
+		if _, port, err := net.SplitHostPort(spec.addr); err != nil || port == "" {
+			return spec, fmt.Errorf("listener %q isn't host:port", raw)
+		}
+	}
+	return spec, nil
+}
+
+// Listener is an open listener of LISTEN and what it is for
+type Listener struct {
+	net.Listener
+	spec listenSpec
+}
+
+func (l Listener) String() string {
+	if l.spec.network == "systemd" {
+		return l.spec.raw + " (" + l.Addr().String() + ")"
+	}
+	return l.spec.raw
+}
+
+// ListenFromEnv will open every listener of LISTEN, on an error the ones
+// already open are closed
+func ListenFromEnv() ([]Listener, error) {
+	specs, err := parseListenSpecs(ListenAddrs)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []Listener
+	fail := func(err error) ([]Listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+
+	var activated []systemdSocket
+	named := make(map[string]bool)
+	for _, spec := range specs {
+		if spec.network == "systemd" {
+			named[spec.addr] = true
+		}
+	}
+	if len(named) > 0 {
+		if activated, err = systemdSockets(); err != nil {
+			return fail(err)
+		}
+	}
+	claimed := make([]bool, len(activated))
+
+	for _, spec := range specs {
+		switch spec.network {
+		case "tcp":
+			l, err := net.Listen("tcp", spec.addr)
+			if err != nil {
+				return fail(err)
+			}
+			listeners = append(listeners, Listener{l, spec})
+		case "unix":
+			l, err := listenUnix(spec.addr)
+			if err != nil {
+				return fail(err)
+			}
+			listeners = append(listeners, Listener{l, spec})
+		case "systemd":
+			found := false
+			for i, socket := range activated {
+				// a bare systemd takes what isn't asked for by name
+				if spec.addr == socket.name || spec.addr == "" && !named[socket.name] {
+					if claimed[i] {
+						continue
+					}
+					claimed[i], found = true, true
+					listeners = append(listeners, Listener{socket.Listener, spec})
+				}
+			}
+			if !found {
+				return fail(fmt.Errorf("listener %q: systemd passed no such socket", spec.raw))
+			}
+		}
+	}
+	for i, socket := range activated {
+		if !claimed[i] {
+			log.Println("closing unused systemd socket", socket.name)
+			socket.Close()
+		}
+	}
+	return listeners, nil
+}
+
+// listenUnix will listen on a unix socket at path, a stale one left by a
+// crash is replaced but not one a running server answers on
+func listenUnix(path string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(ListenSocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_SOCKET_MODE %q isn't an octal mode", ListenSocketMode)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: another server is listening on it", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// a socket passed by systemd and its FileDescriptorName=
+type systemdSocket struct {
+	net.Listener
+	name string
+}
+
+// the first fd systemd passes, after stdin, stdout and stderr
+const systemdFirstFD = 3
+
+// systemdSockets will take the sockets systemd passed by socket activation.
+// the env that says so is cleared so ffmpeg and the like don't think the
+// sockets are theirs
+func systemdSockets() ([]systemdSocket, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("LISTEN has systemd listeners but the server wasn't started by socket activation")
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count <= 0 {
+		return nil, errors.New("systemd passed no sockets")
+	}
+	nameOf := strings.Split(names, ":")
+	var sockets []systemdSocket
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(systemdFirstFD+i)
+		if i < len(nameOf) && nameOf[i] != "" {
+			name = nameOf[i]
+		}
+		// the listener has a close-on-exec copy, the inherited fd goes
+		file := os.NewFile(uintptr(systemdFirstFD+i), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, socket := range sockets {
+				socket.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s isn't a listening socket: %w", name, err)
+		}
+		sockets = append(sockets, systemdSocket{l, name})
+	}
+	return sockets, nil
+}
+
+// listenTLSConfig will load the certificate of the https listeners
+func listenTLSConfig() (*tls.Config, error) {
+	if TLSCertFile == "" || TLSKeyFile == "" {
+		return nil, errors.New("https listeners need TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	cert, err := tls.LoadX509KeyPair(TLSCertFile, TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the tls certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// Serve will serve the api on every listener until one of them fails
+func (s *Server) Serve(listeners []Listener) error {
+	var tlsConfig *tls.Config
+	for _, l := range listeners {
+		if l.spec.tls && tlsConfig == nil {
+			var err error
+			if tlsConfig, err = listenTLSConfig(); err != nil {
+				return err
+			}
+		}
+	}
+
+	handler := s.Handler()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		server := newHTTPServer("", handler)
+		go func() {
+			if l.spec.tls {
+				server.TLSConfig = tlsConfig.Clone()
+				errs <- fmt.Errorf("%s: %w", l, server.ServeTLS(l, "", ""))
+				return
+			}
+			errs <- fmt.Errorf("%s: %w", l, server.Serve(l))
+		}()
+	}
+	return <-errs
+}
+
+// checkListen will check a listener of LISTEN can be opened
+func (d *doctor) checkListen(spec listenSpec) {
+	switch spec.network {
+	case "tcp":
+		d.checkPort(spec.raw, spec.addr)
+	case "unix":
+		if conn, err := net.Dial("unix", spec.addr); err == nil {
+			conn.Close()
+			d.fail(spec.raw, "another server is listening on it")
+			return
+		}
+		d.ok(spec.raw, "can be made")
+	case "systemd":
+		d.ok(spec.raw, "is passed by systemd at startup")
+	}
+	if spec.tls {
+		if _, err := listenTLSConfig(); err != nil {
+			d.fail(spec.raw, "%v", err)
+		}
+	}
+}
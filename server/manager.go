@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// constants for video chunks for the video streaming
+// it will be 2 mb chunks
+
+const (
+	ChunkSize           = 1024 * 1024 * 2
+	MaxConcurrentSteams = 100
+	FFmpegPath          = "ffmpeg"
+	FFprobePath         = "ffprobe"
+)
+
+// where the videos and the server's state are kept, Config.StoragePath
+// moves it for an embedded server
+var VideoStoragePath = "./videos"
+
+// stream manager will manage the video streaming
+type StreamManager struct {
+	activeStreams  sync.Map
+	uploadSessions sync.Map
+	tokens         *TokenStore
+	diagnostics    *Diagnostics
+	metadata       *MetadataStore
+	storage        Storage
+	scanner        UploadScanner
+	events         *EventBus
+	tenants        *Tenants
+	audit          *AuditLog
+	jobs           *JobQueue
+	history        *HistoryStore
+	demand         *DemandStore
+	pins           *PinStore
+	cache          *SegmentCache
+	transcodes     *TranscodeQueue
+	profiles       *ProfileStore
+	links          *LinkStore
+	analytics      *Analytics
+	keys           *Keyring
+	geoip          *GeoIP
+	egress         *EgressLimiter
+	// nudges the collection tree to be built again, nil without one
+	collectionTree chan struct{}
+	// WORM_TAGS, tags that make a video write once and for how long
+	wormTags map[string]time.Duration
+	// uploads being fetched from a url, see pull.go
+	pulls sync.Map
+
+	// requests serving video bytes right now
+	streams atomic.Int64
+}
+
+// upload session to tracks a video upload session
+type UploadSession struct {
+	FileID       string
+	FileName     string
+	File         *os.File
+	FileSize     int64
+	UploadedSize int64
+	LastUpdated  time.Time
+	mu           sync.Mutex
+
+	// running checksum of the bytes written so far
+	hash hash.Hash
+	// sha256 the client says the whole upload has, hex, empty when it didn't
+	expected string
+	// measured throughput for status and progress events
+	progress uploadProgress
+	// unix nanos a paused upload is kept until, 0 when it isn't paused. read
+	// without mu so a running upload request can be told to stop
+	pausedUntil atomic.Int64
+	// bytes synced to disk with their state saved, where a retry starts.
+	// read without mu like pausedUntil
+	committed atomic.Int64
+}
+
+// stramsSession will track active viewing sessions
+type StreamSession struct {
+	FileID       string
+	ViewerCount  int
+	LastAccessed time.Time
+	mu           sync.Mutex
+
+	// live event stream subscribers and watch parties
+	subscribers map[*subscriber]struct{}
+	parties     map[string]*WatchParty
+}
+
+// NewStreamManager will create a new stream manager, over VideoStoragePath
+// and the config from the environment
+func NewStreamManager() (*StreamManager, error) {
+
+	sm := &StreamManager{}
+
+	// ** create vidoes dir if not created
+	if err := os.MkdirAll(VideoStoragePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create video storage dir: %w", err)
+	}
+	// fail before binding the port, not on the first upload
+	if err := checkWritable(VideoStoragePath); err != nil {
+		return nil, fmt.Errorf("video storage dir is not writable: %w", err)
+	}
+
+	sm.tokens = NewTokenStore(AuthSecret, tokenStatePath())
+	authenticators, err := NewAuthenticatorsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up authentication: %w", err)
+	}
+	for _, a := range authenticators {
+		sm.tokens.AddAuthenticator(a)
+	}
+	if !sm.tokens.Enabled() {
+		log.Println("AUTH_SECRET not set, playback and upload are not authenticated")
+	}
+	tenants, err := NewTenants(TenantsFile, sm.tokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tenants: %w", err)
+	}
+	sm.tenants = tenants
+	audit, err := NewAuditLog(auditLogPath(), tenants)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	sm.audit = audit
+	wormTags, err := parseWORMTags(WORMTags)
+	if err != nil {
+		return nil, err
+	}
+	sm.wormTags = wormTags
+	sm.diagnostics = NewDiagnostics()
+
+	metadata, err := NewMetadataStore(metadataPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if err := metadata.Backfill(VideoStoragePath); err != nil {
+		return nil, fmt.Errorf("failed to backfill metadata: %w", err)
+	}
+	if err := metadata.SetLock(sm.lockWORM); err != nil {
+		return nil, fmt.Errorf("failed to lock write once videos: %w", err)
+	}
+	sm.metadata = metadata
+	history, err := NewHistoryStore(historyPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load playback history: %w", err)
+	}
+	sm.history = history
+	demand, err := NewDemandStore(demandPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rendition demand: %w", err)
+	}
+	sm.demand = demand
+	pins, err := NewPinStore(pinsPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pinned videos: %w", err)
+	}
+	sm.pins = pins
+	sm.recoverUploadSessions()
+	sm.storage = NewWORMStorage(NewTracedStorage(NewStorageFromEnv()), sm.wormLocked)
+	keys, err := NewKeyringFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+	}
+	sm.keys = keys
+	sm.cache = NewSegmentCache(SegmentCacheBytes)
+	sm.cache.pinned = sm.pins.Pinned
+	sm.transcodes = NewTranscodeQueue()
+	profiles, err := NewProfileStore(profilesPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transcode profiles: %w", err)
+	}
+	sm.profiles = profiles
+	links, err := NewLinkStore(linksPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load short links: %w", err)
+	}
+	sm.links = links
+	analytics, err := NewAnalytics(analyticsPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load analytics: %w", err)
+	}
+	sm.analytics = analytics
+	geoip, err := LoadGeoIP(GeoIPDatabase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load GEOIP_DB: %w", err)
+	}
+	sm.geoip = geoip
+	sm.egress = NewEgressLimiter(EgressLimit)
+	if CollectionTreePath != "" {
+		sm.collectionTree = make(chan struct{}, 1)
+	}
+
+	if err := checkProbeAvailable(); err != nil {
+		return nil, err
+	}
+	scanner, err := NewUploadScanner(UploadScannerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPLOAD_SCANNER: %w", err)
+	}
+	sm.scanner = scanner
+
+	jobs, err := NewJobQueue(jobsDir(), sm.jobHandlers())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the job queue: %w", err)
+	}
+	sm.jobs = jobs
+	events, err := NewEventBusFromEnv(jobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up event publishing: %w", err)
+	}
+	sm.events = events
+	sm.diagnostics.events = events
+	return sm, nil
+}
+
+func (sm *StreamManager) cleanupRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(15 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		now := time.Now()
+		sm.expirePins()
+
+		// clean up the upload session, the saved state stays on disk so it can
+		// still be resumed until the storage cleanup removes it
+		sm.uploadSessions.Range(func(key, value interface{}) bool {
+			session := value.(*UploadSession)
+			if now.Sub(session.LastUpdated) > 1*time.Hour && !session.paused() {
+				session.mu.Lock()
+				if session.File != nil {
+					session.File.Close()
+					session.File = nil
+				}
+				session.mu.Unlock()
+				sm.uploadSessions.Delete(key)
+			}
+			return true
+		})
+
+		// clean up the stream session
+		sm.activeStreams.Range(func(key, value interface{}) bool {
+			session := value.(*StreamSession)
+			session.mu.Lock()
+			if now.Sub(session.LastAccessed) > 1*time.Hour && session.ViewerCount == 0 {
+				sm.activeStreams.Delete(key)
+			}
+			session.mu.Unlock()
+			return true
+		})
+	}
+
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// markers kept per video, every one goes into the hls playlist
+const maxVideoMarkers = 500
+
+var (
+	// marker classes are reverse dns like names, "poll.started"
+	markerClass = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+	// data keys become X- attributes of the playlist's date ranges
+	markerDataKey = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+)
+
+// Marker is a timed event of a video, a chapter, an ad break or a "poll
+// started". players get them in the hls playlist as EXT-X-DATERANGE tags and
+// live on the video's event stream when they are added
+type Marker struct {
+	ID    string `json:"id"`
+	Class string `json:"class"`
+	// seconds from the start of the video
+	Time     float64           `json:"time"`
+	Duration float64           `json:"duration,omitempty"`
+	Data     map[string]string `json:"data,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// validate will check a marker against the video's duration when it is known
+func (m Marker) validate(video VideoRecord) error {
+	if !markerClass.MatchString(m.Class) {
+		return errors.New("class must be a lowercase name like poll.started")
+	}
+	if m.Time < 0 || m.Duration < 0 {
+		return errors.New("time and duration can't be negative")
+	}
+	if video.Duration > 0 && m.Time > video.Duration {
+		return errors.New("time is past the end of the video")
+	}
+	if len(m.Data) > 16 {
+		return errors.New("at most 16 data values")
+	}
+	for key, value := range m.Data {
+		if !markerDataKey.MatchString(key) {
+			return errors.New("invalid data key " + strconv.Quote(key))
+		}
+		if len(value) > 1024 || strings.ContainsAny(value, "\"\r\n") {
+			return errors.New("data values can't have quotes or line breaks")
+		}
+	}
+	return nil
+}
+
+// handleListMarkers will return a video's markers in time order
+func (sm *StreamManager) handleListMarkers(w http.ResponseWriter, r *http.Request) {
+	video, ok := sm.metadata.GetVideo(tenantFrom(r).VideoID(r.PathValue("id")))
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	markers := video.Markers
+	if markers == nil {
+		markers = []Marker{}
+	}
+	writeJSON(w, http.StatusOK, markers)
+}
+
+// handleCreateMarker will add a marker to a video and push it to everyone
+// on the video's event stream
+func (sm *StreamManager) handleCreateMarker(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Class    string            `json:"class"`
+		Time     *float64          `json:"time"`
+		Duration float64           `json:"duration"`
+		Data     map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 32<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Time == nil {
+		writeError(w, http.StatusBadRequest, "time is required")
+		return
+	}
+
+	fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+	marker := Marker{
+		ID:        newID(),
+		Class:     req.Class,
+		Time:      *req.Time,
+		Duration:  req.Duration,
+		Data:      req.Data,
+		CreatedAt: time.Now().UTC(),
+	}
+	if video, ok := sm.metadata.GetVideo(fileID); ok && video.Locked() {
+		lockedError(w, video)
+		return
+	}
+	var invalid error
+	err := sm.metadata.UpdateVideo(fileID, func(video *VideoRecord) {
+		if invalid = marker.validate(*video); invalid != nil {
+			return
+		}
+		if len(video.Markers) >= maxVideoMarkers {
+			invalid = errors.New("at most " + strconv.Itoa(maxVideoMarkers) + " markers")
+			return
+		}
+		// a new slice, copies of the record handed out share the old one
+		markers := append(append([]Marker{}, video.Markers...), marker)
+		sort.SliceStable(markers, func(i, j int) bool { return markers[i].Time < markers[j].Time })
+		video.Markers = markers
+	})
+	if err == ErrNotFound {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if invalid != nil {
+		writeError(w, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save marker")
+		return
+	}
+
+	sm.streamSession(fileID).broadcast("", sseMessage{Event: "marker", Data: marker})
+	writeJSON(w, http.StatusCreated, marker)
+}
+
+// handleDeleteMarker will remove a marker from a video
+func (sm *StreamManager) handleDeleteMarker(w http.ResponseWriter, r *http.Request) {
+	fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+	if video, ok := sm.metadata.GetVideo(fileID); ok && video.Locked() {
+		lockedError(w, video)
+		return
+	}
+	found := false
+	err := sm.metadata.UpdateVideo(fileID, func(video *VideoRecord) {
+		markers := make([]Marker, 0, len(video.Markers))
+		for _, marker := range video.Markers {
+			if marker.ID == r.PathValue("marker") {
+				found = true
+				continue
+			}
+			markers = append(markers, marker)
+		}
+		video.Markers = markers
+	})
+	if err == ErrNotFound || (err == nil && !found) {
+		writeError(w, http.StatusNotFound, "marker not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save video")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hlsDateFormat is the ISO 8601 form EXT-X-PROGRAM-DATE-TIME and date ranges use
+const hlsDateFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// addHLSMarkers will put a video's markers into its playlist as date ranges.
+// those are dates, so the playlist's first segment is dated with the upload
+// time and every marker is that plus its time
+func addHLSMarkers(playlist []byte, video VideoRecord) []byte {
+	if len(video.Markers) == 0 {
+		return playlist
+	}
+	start := video.CreatedAt.UTC()
+	var tags strings.Builder
+	fmt.Fprintf(&tags, "#EXT-X-PROGRAM-DATE-TIME:%s\n", start.Format(hlsDateFormat))
+	for _, marker := range video.Markers {
+		at := start.Add(time.Duration(marker.Time * float64(time.Second)))
+		fmt.Fprintf(&tags, `#EXT-X-DATERANGE:ID="%s",CLASS="%s",START-DATE="%s"`, marker.ID, marker.Class, at.Format(hlsDateFormat))
+		if marker.Duration > 0 {
+			fmt.Fprintf(&tags, ",DURATION=%s", strconv.FormatFloat(marker.Duration, 'f', 3, 64))
+		}
+		keys := make([]string, 0, len(marker.Data))
+		for key := range marker.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&tags, `,X-%s="%s"`, strings.ToUpper(key), marker.Data[key])
+		}
+		tags.WriteByte('\n')
+	}
+
+	// the tags go right before the first segment
+	text := string(playlist)
+	at := strings.Index(text, "#EXTINF")
+	if at < 0 {
+		return playlist
+	}
+	return []byte(text[:at] + tags.String() + text[at:])
+}
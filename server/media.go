@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// largest image we accept in pixels, a tiny file can claim to be huge
+var MaxImagePixels = envInt64("MAX_IMAGE_PIXELS", 50_000_000)
+
+// what a stored file is, records from before there was more than video have none
+const (
+	MediaVideo = "video"
+	MediaAudio = "audio"
+	MediaImage = "image"
+)
+
+// a format we store besides video, what it is and how it is served
+type mediaFormat struct {
+	kind        string
+	contentType string
+	ext         string
+}
+
+// audio files and images (poster art) are stored under the same key as a
+// video, only the record knows what they are
+var mediaFormats = map[string]mediaFormat{
+	"mp4":  {kind: MediaVideo, contentType: "video/mp4", ext: ".mp4"},
+	"mp3":  {kind: MediaAudio, contentType: "audio/mpeg", ext: ".mp3"},
+	"m4a":  {kind: MediaAudio, contentType: "audio/mp4", ext: ".m4a"},
+	"ogg":  {kind: MediaAudio, contentType: "audio/ogg", ext: ".ogg"},
+	"jpeg": {kind: MediaImage, contentType: "image/jpeg", ext: ".jpg"},
+	"png":  {kind: MediaImage, contentType: "image/png", ext: ".png"},
+	"gif":  {kind: MediaImage, contentType: "image/gif", ext: ".gif"},
+}
+
+// mediaFormat is what the record says the file is, mp4 when it says nothing
+func (v VideoRecord) mediaFormat() mediaFormat {
+	if format, ok := mediaFormats[v.Format]; ok {
+		return format
+	}
+	return mediaFormats["mp4"]
+}
+
+// IsVideo reports whether the record is a video, the renditions (hls,
+// audio, previews, clips) are only made of videos
+func (v VideoRecord) IsVideo() bool {
+	return v.mediaFormat().kind == MediaVideo
+}
+
+// ContentType is what the stored file is served as
+func (v VideoRecord) ContentType() string {
+	return v.mediaFormat().contentType
+}
+
+// errUnknownMedia is a file that isn't any format we store
+var errUnknownMedia = errors.New("not a supported video, audio or image file")
+
+// sniffMedia will tell the formats apart by their first bytes, an mp4 is
+// then checked by ffprobe. anything else is refused, not guessed
+func sniffMedia(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, 16)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return "jpeg", nil
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "png", nil
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif", nil
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return "ogg", nil
+	// an id3 tag, or straight into an mpeg audio frame
+	case bytes.HasPrefix(head, []byte("ID3")), len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0:
+		return "mp3", nil
+	// an mp4 says it's audio only with its major brand
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		switch string(head[8:12]) {
+		case "M4A ", "M4B ":
+			return "m4a", nil
+		}
+		return "mp4", nil
+	// old quicktime files start with another box than ftyp
+	case len(head) >= 8 && (string(head[4:8]) == "moov" || string(head[4:8]) == "mdat" ||
+		string(head[4:8]) == "wide" || string(head[4:8]) == "free" || string(head[4:8]) == "skip"):
+		return "mp4", nil
+	}
+	return "", errUnknownMedia
+}
+
+// validateImage will check an image decodes as the format it looks like
+// and isn't too large, it returns its size
+func validateImage(path, format string) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	config, decoded, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, fmt.Errorf("not a valid image: %w", err)
+	}
+	if decoded != format {
+		return 0, 0, fmt.Errorf("not a valid image: looks like %s but is %s", format, decoded)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return 0, 0, fmt.Errorf("not a valid image: no size")
+	}
+	if MaxImagePixels > 0 && int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return 0, 0, fmt.Errorf("image is larger than %d pixels", MaxImagePixels)
+	}
+	return config.Width, config.Height, nil
+}
+
+// tenantImage will return an image of the video's tenant for its poster or
+// watermark, it has to be ready
+func (sm *StreamManager) tenantImage(video VideoRecord, imageID string) (VideoRecord, bool) {
+	poster, ok := sm.metadata.GetVideo(scopeID(video.Tenant, imageID))
+	if !ok || !poster.Available() || poster.Kind != MediaImage {
+		return VideoRecord{}, false
+	}
+	return poster, true
+}
+
+// servePosterArt will serve the image uploaded as a video's poster
+func (sm *StreamManager) servePosterArt(w http.ResponseWriter, r *http.Request, poster VideoRecord) {
+	file, err := sm.openVideo(r.Context(), poster.Key())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "poster image not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to open poster")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to open poster")
+		return
+	}
+
+	etag := videoETag(poster, info)
+	setCachePolicy(w, r, CacheContent, etag)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", poster.ContentType())
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
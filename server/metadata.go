@@ -0,0 +1,468 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// video states, a video is only served once it is ready
+const (
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	VideoStatusRejected   = "rejected"
+	// the stored file doesn't match its checksum, it isn't served
+	VideoStatusCorrupt = "corrupt"
+)
+
+// what we know about a stored video
+type VideoRecord struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Title     string    `json:"title"`
+	Size      int64     `json:"size"`
+	Duration  float64   `json:"duration,omitempty"`
+	Codec     string    `json:"codec,omitempty"`
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+	FrameRate float64   `json:"frame_rate,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	ClipOf    string    `json:"clip_of,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	Profile   string    `json:"profile,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// deleted by the reaper then, the tenant's retention applies when unset
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// can't be changed or deleted before then, see worm.go
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// stored as fields, transcodes deinterlace it when the profile says so
+	Interlaced bool `json:"interlaced,omitempty"`
+	// bits per second of the whole file, and its first audio stream (codec
+	// is the video stream's of a video), all from ffprobe
+	Bitrate       int64  `json:"bitrate,omitempty"`
+	AudioCodec    string `json:"audio_codec,omitempty"`
+	AudioChannels int    `json:"audio_channels,omitempty"`
+
+	// free text and tags, both searchable
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// playback starts
+	Views int64 `json:"views"`
+	// timed events, in time order
+	Markers []Marker `json:"markers,omitempty"`
+	// named sections, in time order, see chapters.go
+	Chapters []Chapter `json:"chapters,omitempty"`
+	// seconds in the poster and animated preview show, picked from the
+	// heatmap (see previews.go), a tenth in when unset
+	PreviewAt *float64 `json:"preview_at,omitempty"`
+
+	// keep search engines away (noindex, left out of the sitemap) and link
+	// previews from showing the video
+	NoIndex  bool `json:"noindex,omitempty"`
+	NoUnfurl bool `json:"nounfurl,omitempty"`
+	// countries, sites and networks it may be played from, over the
+	// tenant's. see restrictions.go
+	Playback *PlaybackPolicy `json:"playback_policy,omitempty"`
+	// the collection it is filed in, "" at the top. see collections.go
+	Collection string `json:"collection,omitempty"`
+
+	// video, audio or image and the file format, "" for videos from
+	// before. see media.go
+	Kind   string `json:"kind,omitempty"`
+	Format string `json:"format,omitempty"`
+	// an image's id shown as the poster instead of a frame
+	Poster string `json:"poster,omitempty"`
+	// burned into the hls package, over the tenant's. see watermark.go
+	Watermark *Watermark `json:"watermark,omitempty"`
+}
+
+// Available reports whether the video may be served, records from before
+// statuses existed have none and are available. an expired video isn't
+// served while it waits for the reaper
+func (v VideoRecord) Available() bool {
+	if v.ExpiresAt != nil && time.Now().After(*v.ExpiresAt) {
+		return false
+	}
+	return v.Status == "" || v.Status == VideoStatusReady
+}
+
+// Key is the tenant namespaced id the record is stored under
+func (v VideoRecord) Key() string {
+	return scopeID(v.Tenant, v.ID)
+}
+
+// inTenant reports whether a record belongs to a tenant, records from before
+// tenants existed belong to the default one
+func inTenant(recordTenant, tenantID string) bool {
+	if recordTenant == "" {
+		recordTenant = DefaultTenantID
+	}
+	return recordTenant == tenantID
+}
+
+// a named, ordered list of videos
+type Playlist struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	VideoIDs    []string  `json:"video_ids"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// MetadataStore will keep video and playlist records, persisted as a json file
+// next to the videos so it survives restarts
+type MetadataStore struct {
+	path string
+
+	mu          sync.RWMutex
+	videos      map[string]*VideoRecord
+	playlists   map[string]*Playlist
+	collections map[string]*Collection
+	// catalog totals per tenant, see stats.go
+	stats map[string]*libraryStats
+	// words and tags per tenant, see search.go
+	search map[string]*searchIndex
+	// view counts changed since the last save, they are saved in the background
+	dirty bool
+	// sets a record's write once period, run on every write
+	lock func(video *VideoRecord)
+}
+
+// on disk form of the metadata store
+type metadataState struct {
+	Videos      map[string]*VideoRecord `json:"videos"`
+	Playlists   map[string]*Playlist    `json:"playlists"`
+	Collections map[string]*Collection  `json:"collections,omitempty"`
+}
+
+// NewMetadataStore will load the store from path, a missing file is an empty store
+func NewMetadataStore(path string) (*MetadataStore, error) {
+	ms := &MetadataStore{
+		path:        path,
+		videos:      make(map[string]*VideoRecord),
+		playlists:   make(map[string]*Playlist),
+		collections: make(map[string]*Collection),
+		stats:       make(map[string]*libraryStats),
+		search:      make(map[string]*searchIndex),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var state metadataState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		for id, video := range state.Videos {
+			ms.videos[id] = video
+			ms.countLocked(video, 1)
+			ms.indexLocked(video, 1)
+		}
+		for id, playlist := range state.Playlists {
+			ms.playlists[id] = playlist
+		}
+		for id, collection := range state.Collections {
+			ms.collections[id] = collection
+		}
+	}
+	supervisor.Go(context.Background(), "metadata-flush", RestartAlways, ms.flushRoutine)
+	return ms, nil
+}
+
+// saveLocked will write the store to disk, caller holds mu
+func (ms *MetadataStore) saveLocked() error {
+	data, err := json.MarshalIndent(metadataState{Videos: ms.videos, Playlists: ms.playlists, Collections: ms.collections}, "", "  ")
+	if err != nil {
+		return err
+	}
+	ms.dirty = false
+	return writeFileAtomic(ms.path, data)
+}
+
+// flushRoutine will save view counts, a save per playback would be too many
+func (ms *MetadataStore) flushRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		ms.mu.Lock()
+		if ms.dirty {
+			if err := ms.saveLocked(); err != nil {
+				log.Println("failed to save view counts", err)
+			}
+		}
+		ms.mu.Unlock()
+	}
+}
+
+// Backfill will register videos that are on disk but missing from the store,
+// so libraries uploaded before the store existed show up
+func (ms *MetadataStore) Backfill(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.mp4"))
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	changed := false
+	for _, match := range matches {
+		id := strings.TrimSuffix(filepath.Base(match), ".mp4")
+		if _, ok := ms.videos[id]; ok {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		ms.videos[id] = &VideoRecord{ID: id, Title: id, Size: info.Size(), Status: VideoStatusReady, CreatedAt: info.ModTime()}
+		ms.countLocked(ms.videos[id], 1)
+		ms.indexLocked(ms.videos[id], 1)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return ms.saveLocked()
+}
+
+// PutVideo will create or replace a video record
+func (ms *MetadataStore) PutVideo(video VideoRecord) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if old, ok := ms.videos[video.Key()]; ok {
+		ms.countLocked(old, -1)
+		ms.indexLocked(old, -1)
+		if video.LockedUntil == nil {
+			video.LockedUntil = old.LockedUntil
+		}
+	}
+	if ms.lock != nil {
+		ms.lock(&video)
+	}
+	ms.videos[video.Key()] = &video
+	ms.countLocked(&video, 1)
+	ms.indexLocked(&video, 1)
+	return ms.saveLocked()
+}
+
+// UpdateVideo will apply update to a video record under the store lock and save it
+func (ms *MetadataStore) UpdateVideo(id string, update func(video *VideoRecord)) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	video, ok := ms.videos[id]
+	if !ok {
+		return ErrNotFound
+	}
+	ms.countLocked(video, -1)
+	ms.indexLocked(video, -1)
+	update(video)
+	if ms.lock != nil {
+		ms.lock(video)
+	}
+	ms.countLocked(video, 1)
+	ms.indexLocked(video, 1)
+	return ms.saveLocked()
+}
+
+// SetLock will set the write once hook and run it over the stored records,
+// so a tenant's or tag's new write once period covers videos it already has
+func (ms *MetadataStore) SetLock(lock func(video *VideoRecord)) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.lock = lock
+	changed := false
+	for _, video := range ms.videos {
+		before := video.LockedUntil
+		lock(video)
+		changed = changed || video.LockedUntil != before
+	}
+	if !changed {
+		return nil
+	}
+	return ms.saveLocked()
+}
+
+// DeleteVideo will remove a video record
+func (ms *MetadataStore) DeleteVideo(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	video, ok := ms.videos[id]
+	if !ok {
+		return ErrNotFound
+	}
+	ms.countLocked(video, -1)
+	ms.indexLocked(video, -1)
+	delete(ms.videos, id)
+	return ms.saveLocked()
+}
+
+// AddView will count a playback start of a video
+func (ms *MetadataStore) AddView(id string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if video, ok := ms.videos[id]; ok {
+		video.Views++
+		ms.dirty = true
+	}
+}
+
+// GetVideo will return a copy of a video record
+func (ms *MetadataStore) GetVideo(id string) (VideoRecord, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	video, ok := ms.videos[id]
+	if !ok {
+		return VideoRecord{}, false
+	}
+	return *video, true
+}
+
+// ListVideos will return a tenant's video records, oldest first
+func (ms *MetadataStore) ListVideos(tenantID string) []VideoRecord {
+	ms.mu.RLock()
+	videos := make([]VideoRecord, 0, len(ms.videos))
+	for _, video := range ms.videos {
+		if inTenant(video.Tenant, tenantID) {
+			videos = append(videos, *video)
+		}
+	}
+	ms.mu.RUnlock()
+
+	sort.Slice(videos, func(i, j int) bool { return videos[i].CreatedAt.Before(videos[j].CreatedAt) })
+	return videos
+}
+
+// AllVideos will return every tenant's video records
+func (ms *MetadataStore) AllVideos() []VideoRecord {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	videos := make([]VideoRecord, 0, len(ms.videos))
+	for _, video := range ms.videos {
+		videos = append(videos, *video)
+	}
+	return videos
+}
+
+// TenantUsage will count a tenant's videos and their bytes, rejected uploads
+// are deleted so they don't count
+func (ms *MetadataStore) TenantUsage(tenantID string) (int, int64) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	videos, bytes := 0, int64(0)
+	for _, video := range ms.videos {
+		if inTenant(video.Tenant, tenantID) && video.Status != VideoStatusRejected {
+			videos++
+			bytes += video.Size
+		}
+	}
+	return videos, bytes
+}
+
+// CreatePlaylist will store a new playlist
+func (ms *MetadataStore) CreatePlaylist(playlist Playlist) (Playlist, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	playlist.VideoIDs = append([]string{}, playlist.VideoIDs...)
+	ms.playlists[playlist.ID] = &playlist
+	return copyPlaylist(&playlist), ms.saveLocked()
+}
+
+// GetPlaylist will return a copy of a playlist
+func (ms *MetadataStore) GetPlaylist(id string) (Playlist, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	playlist, ok := ms.playlists[id]
+	if !ok {
+		return Playlist{}, ErrNotFound
+	}
+	return copyPlaylist(playlist), nil
+}
+
+// ListPlaylists will return a tenant's playlists, oldest first
+func (ms *MetadataStore) ListPlaylists(tenantID string) []Playlist {
+	ms.mu.RLock()
+	playlists := make([]Playlist, 0, len(ms.playlists))
+	for _, playlist := range ms.playlists {
+		if inTenant(playlist.Tenant, tenantID) {
+			playlists = append(playlists, copyPlaylist(playlist))
+		}
+	}
+	ms.mu.RUnlock()
+
+	sort.Slice(playlists, func(i, j int) bool { return playlists[i].CreatedAt.Before(playlists[j].CreatedAt) })
+	return playlists
+}
+
+// UpdatePlaylist will apply update to a playlist under the store lock and save it
+func (ms *MetadataStore) UpdatePlaylist(id string, update func(playlist *Playlist) error) (Playlist, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	current, ok := ms.playlists[id]
+	if !ok {
+		return Playlist{}, ErrNotFound
+	}
+
+	// work on a copy so a failed update leaves the playlist untouched
+	updated := copyPlaylist(current)
+	if err := update(&updated); err != nil {
+		return Playlist{}, err
+	}
+	updated.UpdatedAt = time.Now()
+	ms.playlists[id] = &updated
+	return copyPlaylist(&updated), ms.saveLocked()
+}
+
+// DeletePlaylist will remove a playlist
+func (ms *MetadataStore) DeletePlaylist(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.playlists[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.playlists, id)
+	return ms.saveLocked()
+}
+
+func copyPlaylist(playlist *Playlist) Playlist {
+	cp := *playlist
+	cp.VideoIDs = append([]string{}, playlist.VideoIDs...)
+	return cp
+}
+
+// metadataPath is where the metadata store is persisted
+func metadataPath() string {
+	return filepath.Join(VideoStoragePath, ".metadata.json")
+}
+
+// newID will return a random hex id
+func newID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
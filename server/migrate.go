@@ -0,0 +1,518 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bytes per second a storage migration copies at unless it says otherwise,
+// so it leaves the disk and uplink to viewers. 0 doesn't limit
+var MigrateRate = envInt64("MIGRATE_RATE", 20<<20)
+
+// migration states
+const (
+	MigrationRunning   = "running"
+	MigrationDone      = "done"
+	MigrationCancelled = "cancelled"
+	// nothing was copied, the items say what would be
+	MigrationDryRun = "dry_run"
+)
+
+// what a migration does with a video
+const (
+	// not at the destination, it is copied
+	MigrateCopy = "copy"
+	// already at the destination with the same size
+	MigratePresent = "present"
+	// not at the source, like a video whose local copy was published
+	MigrateMissing = "missing"
+	// still processing, it is published the usual way once it is done
+	MigrateSkipped = "skipped"
+	// copied and verified, the source copy is kept
+	MigrateCopied = "copied"
+	// copied, verified and removed from the source
+	MigrateMoved  = "moved"
+	MigrateFailed = "failed"
+)
+
+const (
+	// failures a migration remembers, the rest are only counted
+	migrateMaxFailures = 100
+	// a migration lock this old was left by an instance that went away, it
+	// is only held to read and write the migration file
+	migrationLockStale = 30 * time.Second
+)
+
+// MigrationRequest is what POST /admin/storage/migrate takes. a storage is
+// local (the videos directory), dir:/path or storage (the STORAGE_DRIVER
+// videos are served from)
+type MigrationRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// only report what would be copied
+	DryRun bool `json:"dry_run,omitempty"`
+	// bytes per second, MIGRATE_RATE when 0
+	Rate int64 `json:"rate,omitempty"`
+	// remove each video from the source once its copy is verified, only
+	// when moving into storage so the video is still served
+	DeleteSource bool `json:"delete_source,omitempty"`
+	// only this tenant's videos
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// MigrationItem is what a migration did, or would do, with a video
+type MigrationItem struct {
+	Video  string `json:"video"`
+	Size   int64  `json:"size"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Migration is a storage migration and how far it got. it is kept in the
+// videos directory, a restart picks it up where it was with the videos that
+// made it counted as present
+type Migration struct {
+	ID string `json:"id"`
+	MigrationRequest
+	Status string `json:"status"`
+	Videos int    `json:"videos"`
+	// bytes of the videos to copy or move, and of the ones done so far
+	Bytes       int64 `json:"bytes"`
+	CopiedBytes int64 `json:"copied_bytes"`
+	// videos per action
+	Counts   map[string]int  `json:"counts"`
+	Failures []MigrationItem `json:"failures,omitempty"`
+	// every video, for a dry run
+	Items      []MigrationItem `json:"items,omitempty"`
+	StartedAt  time.Time       `json:"started_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// migrationPath is where the current or last migration is kept
+func migrationPath() string {
+	return filepath.Join(VideoStoragePath, ".migration.json")
+}
+
+func loadMigration() (*Migration, error) {
+	data, err := os.ReadFile(migrationPath())
+	if err != nil {
+		return nil, err
+	}
+	var m Migration
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// migrationMu makes reading the migration, checking it and saving it one
+// step on this instance, the lock file next to it does across instances
+var migrationMu sync.Mutex
+
+// lockMigration will hold the migration file until the returned func is called
+func lockMigration() (func(), error) {
+	migrationMu.Lock()
+	path := migrationPath() + ".lock"
+	start := time.Now()
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			return func() {
+				os.Remove(path)
+				migrationMu.Unlock()
+			}, nil
+		}
+		if !os.IsExist(err) {
+			migrationMu.Unlock()
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > migrationLockStale {
+			os.Remove(path)
+			continue
+		}
+		if time.Since(start) > 5*time.Second {
+			migrationMu.Unlock()
+			return nil, errors.New("migration is locked by another instance")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func saveMigration(m *Migration) error {
+	m.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(migrationPath(), data)
+}
+
+// migrationStorage will open a storage of a migration request
+func (sm *StreamManager) migrationStorage(name string) (Storage, error) {
+	switch {
+	case name == "local":
+		return NewLocalStorage(VideoStoragePath), nil
+	case name == "storage":
+		return sm.storage, nil
+	case strings.HasPrefix(name, "dir:"):
+		dir := strings.TrimPrefix(name, "dir:")
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("%s isn't an absolute path", name)
+		}
+		return NewLocalStorage(dir), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q, it is local, dir:/path or storage", name)
+	}
+}
+
+// localRoot is the directory of a storage on local disk, "" when it isn't
+func localRoot(s Storage) string {
+	for {
+		wrapped, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			break
+		}
+		s = wrapped.Unwrap()
+	}
+	if local, ok := s.(*LocalStorage); ok {
+		return filepath.Clean(local.root)
+	}
+	return ""
+}
+
+// checkMigration will open both storages of a request and check it makes sense
+func (sm *StreamManager) checkMigration(req MigrationRequest) (from, to Storage, err error) {
+	if from, err = sm.migrationStorage(req.From); err != nil {
+		return nil, nil, err
+	}
+	if to, err = sm.migrationStorage(req.To); err != nil {
+		return nil, nil, err
+	}
+	if req.From == req.To || localRoot(from) != "" && localRoot(from) == localRoot(to) {
+		return nil, nil, errors.New("from and to are the same storage")
+	}
+	// a video only in a storage that isn't served would be gone
+	if req.DeleteSource && req.To != "storage" {
+		return nil, nil, errors.New("delete_source is only for moving into storage, videos are served from there")
+	}
+	if req.Rate < 0 {
+		return nil, nil, errors.New("rate can't be negative")
+	}
+	return from, to, nil
+}
+
+// handleMigrateStorage will start a storage migration, or with dry_run report
+// what it would copy. moving the videos directory into object storage is
+// from local to storage with delete_source, once STORAGE_DRIVER points at
+// it: a video is served from its local copy until the copy in storage is
+// verified and the local one removed, so nothing goes offline
+func (sm *StreamManager) handleMigrateStorage(w http.ResponseWriter, r *http.Request) {
+	req := MigrationRequest{From: "local", To: "storage"}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	from, to, err := sm.checkMigration(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Rate == 0 {
+		req.Rate = MigrateRate
+	}
+	now := time.Now().UTC()
+	m := &Migration{ID: newID(), MigrationRequest: req, Status: MigrationRunning, Counts: make(map[string]int), StartedAt: now, UpdatedAt: now}
+
+	if req.DryRun {
+		m.Status = MigrationDryRun
+		if err := sm.runMigration(r.Context(), m, from, to, nil); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+		return
+	}
+
+	unlock, err := lockMigration()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if current, err := loadMigration(); err == nil && current.Status == MigrationRunning {
+		unlock()
+		writeError(w, http.StatusConflict, "migration "+current.ID+" is running")
+		return
+	}
+	err = saveMigration(m)
+	unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save migration")
+		return
+	}
+	if err := sm.jobs.Enqueue(JobMigrateStorage, "storage", nil); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to queue migration")
+		return
+	}
+	auditAs(r, "", m.ID, req.From+" to "+req.To)
+	writeJSON(w, http.StatusAccepted, m)
+}
+
+// handleMigration will report the running or last migration (GET) or cancel
+// it (DELETE), the video being copied is finished first
+func (sm *StreamManager) handleMigration(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		unlock, err := lockMigration()
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		defer unlock()
+	}
+	m, err := loadMigration()
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no migration")
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if m.Status != MigrationRunning {
+			writeError(w, http.StatusConflict, "migration isn't running")
+			return
+		}
+		m.Status = MigrationCancelled
+		if err := saveMigration(m); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save migration")
+			return
+		}
+		auditAs(r, "", m.ID, "")
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// migrateStorage is the job of the running migration
+func (sm *StreamManager) migrateStorage(ctx context.Context, job *Job) error {
+	m, err := loadMigration()
+	if err != nil || m.Status != MigrationRunning {
+		return nil
+	}
+	// saves m unless another migration took its place, false stops it
+	save := func() (bool, error) {
+		unlock, err := lockMigration()
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+		current, err := loadMigration()
+		if err != nil || current.ID != m.ID {
+			// superseded, the job runs again for the new one
+			return false, nil
+		}
+		// cancelling is saved by whichever instance got the request
+		if current.Status == MigrationCancelled {
+			m.Status = MigrationCancelled
+		}
+		if err := saveMigration(m); err != nil {
+			return false, err
+		}
+		return m.Status == MigrationRunning, nil
+	}
+
+	from, to, err := sm.checkMigration(m.MigrationRequest)
+	if err != nil {
+		// the storages changed since it was started
+		m.Status, m.Failures = MigrationCancelled, append(m.Failures, MigrationItem{Action: MigrateFailed, Error: err.Error()})
+		_, err := save()
+		return err
+	}
+	// counted again, what got copied before a restart is present now
+	m.Counts, m.Failures, m.Bytes, m.CopiedBytes = make(map[string]int), nil, 0, 0
+	return sm.runMigration(ctx, m, from, to, save)
+}
+
+// runMigration will go through every video in id order, a dry run when save
+// is nil. save is called after every video and stops it by returning false
+func (sm *StreamManager) runMigration(ctx context.Context, m *Migration, from, to Storage, save func() (bool, error)) error {
+	var videos []VideoRecord
+	for _, video := range sm.metadata.AllVideos() {
+		if m.Tenant == "" || inTenant(video.Tenant, m.Tenant) {
+			videos = append(videos, video)
+		}
+	}
+	sort.Slice(videos, func(i, j int) bool { return videos[i].Key() < videos[j].Key() })
+	m.Videos = len(videos)
+
+	limiter := NewEgressLimiter(m.Rate)
+	for _, video := range videos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var item MigrationItem
+		if video.Status == VideoStatusProcessing {
+			item = MigrationItem{Video: video.Key(), Action: MigrateSkipped}
+		} else {
+			item = migrateVideo(ctx, from, to, videoKey(video.Key()), save == nil, m.DeleteSource, limiter)
+			item.Video = video.Key()
+		}
+		m.Counts[item.Action]++
+		switch item.Action {
+		case MigrateCopy:
+			m.Bytes += item.Size
+		case MigrateCopied, MigrateMoved:
+			m.Bytes += item.Size
+			m.CopiedBytes += item.Size
+		case MigrateFailed:
+			log.Println("failed to migrate video", item.Video, item.Error)
+			if len(m.Failures) < migrateMaxFailures {
+				m.Failures = append(m.Failures, item)
+			}
+		}
+		if save == nil {
+			m.Items = append(m.Items, item)
+			continue
+		}
+		if running, err := save(); err != nil || !running {
+			return err
+		}
+	}
+
+	if save == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	m.Status, m.FinishedAt = MigrationDone, &now
+	_, err := save()
+	return err
+}
+
+// migrateVideo will copy a stored file from one storage to the other unless
+// it is there already, the copy is read back and checked against the
+// source before the source is removed
+func migrateVideo(ctx context.Context, from, to Storage, key string, dryRun, deleteSource bool, limiter *EgressLimiter) MigrationItem {
+	failed := func(err error) MigrationItem {
+		return MigrationItem{Action: MigrateFailed, Error: err.Error()}
+	}
+	source, err := from.Stat(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return MigrationItem{Action: MigrateMissing}
+	} else if err != nil {
+		return failed(err)
+	}
+	item := MigrationItem{Size: source.Size(), Action: MigrateCopy}
+	if target, err := to.Stat(ctx, key); err == nil && target.Size() == source.Size() {
+		item.Action = MigratePresent
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return failed(err)
+	}
+	if dryRun || item.Action == MigratePresent && !deleteSource {
+		return item
+	}
+
+	if err := copyStored(ctx, from, to, key, source.Size(), item.Action == MigratePresent, limiter); err != nil {
+		return failed(err)
+	}
+	if item.Action == MigrateCopy {
+		item.Action = MigrateCopied
+	}
+	if !deleteSource {
+		return item
+	}
+
+	// a new upload may have replaced the source while it was copied, it is
+	// published the usual way
+	if now, err := from.Stat(ctx, key); err != nil || now.Size() != source.Size() || !now.ModTime().Equal(source.ModTime()) {
+		return item
+	}
+	if err := from.Delete(ctx, key); err != nil {
+		item.Error = "copied but not removed from the source: " + err.Error()
+		return item
+	}
+	item.Action = MigrateMoved
+	return item
+}
+
+// copyStored will copy key at limiter's rate and check the copy has the
+// source's sha256, a copy that doesn't is removed. with present the
+// destination already has it and is only checked
+func copyStored(ctx context.Context, from, to Storage, key string, size int64, present bool, limiter *EgressLimiter) error {
+	source, err := from.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	hash := sha256.New()
+	reader := io.TeeReader(&throttledReader{r: source, limiter: limiter, ctx: ctx}, hash)
+	if present {
+		_, err = io.Copy(io.Discard, reader)
+	} else {
+		err = to.Put(ctx, key, reader, size)
+	}
+	if err != nil {
+		return err
+	}
+	want := hex.EncodeToString(hash.Sum(nil))
+
+	got, err := storedSHA256(ctx, to, key, limiter)
+	if err != nil {
+		return fmt.Errorf("reading the copy back: %w", err)
+	}
+	if got != want {
+		if !present {
+			to.Delete(context.WithoutCancel(ctx), key)
+		}
+		return fmt.Errorf("copy has sha256 %s, the source %s", got, want)
+	}
+	return nil
+}
+
+// storedSHA256 is the sha256 of a stored file as it is stored
+func storedSHA256(ctx context.Context, s Storage, key string, limiter *EgressLimiter) (string, error) {
+	obj, err := s.Open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &throttledReader{r: obj, limiter: limiter, ctx: ctx}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// throttledReader reads no faster than its limiter allows, nil doesn't limit
+type throttledReader struct {
+	r       io.Reader
+	limiter *EgressLimiter
+	ctx     context.Context
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if tr.limiter == nil {
+		return tr.r.Read(p)
+	}
+	// the limiter hands out a chunk at a time
+	if len(p) > egressChunk {
+		p = p[:egressChunk]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if waitErr := tr.limiter.take(tr.ctx, EgressBulk, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,527 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// apiOperation documents a route for the openapi document. the routes
+// themselves come from what is registered, so a route without docs still
+// shows up, just without a summary
+type apiOperation struct {
+	ID      string
+	Summary string
+	// playback, upload, download, session, account or admin, "" for none
+	Auth string
+	// query parameters and what they do
+	Query map[string]string
+	// what the request body is, "" for none. json unless BodyType says
+	Body     string
+	BodyType string
+	// a value of the type the success response is, nil when it isn't json
+	Response interface{}
+	// content type of a response that isn't json
+	ResponseType string
+	Status       int
+}
+
+var apiOperations = map[string]apiOperation{
+	"POST /api/upload": {ID: "upload", Summary: "Upload a video, audio file (mp3, m4a, ogg) or image (jpeg, png, gif), resumable in chunks", Auth: ScopeUpload,
+		Query:    map[string]string{"id": "upload id, chosen by the client", "title": "title", "description": "description", "tags": "comma separated tags", "profile": "transcode profile", "ttl": "how long the video is kept"},
+		Body:     "the bytes of the chunk, at Upload-Offset. X-Content-SHA256 or Digest checks the whole upload. a presigned url's token works here too",
+		BodyType: "application/octet-stream", Response: VideoWithURLs{}},
+	"GET /api/upload": {ID: "getUploadStatus", Summary: "Committed offset of an upload, for resuming", Auth: ScopeUpload,
+		Query: map[string]string{"id": "upload id"}, Response: map[string]interface{}{}},
+	"GET /api/upload/{id}/offset": {ID: "getUploadOffset", Summary: "Bytes of an upload synced to disk, the Upload-Offset its next chunk has to have", Auth: ScopeUpload,
+		Response: map[string]interface{}{}},
+	"POST /api/uploads/presign": {ID: "presignUpload", Summary: "Make a single use upload url for a browser, bound to an id, max size and content type", Auth: ScopeUpload,
+		Body: "id, max_size, content_type, ttl", Response: map[string]interface{}{}, Status: http.StatusCreated},
+	"POST /api/upload/from-url": {ID: "uploadFromURL", Summary: "Upload a video the server fetches from a url", Auth: ScopeUpload,
+		Body: "id, url, title, description, tags, profile, ttl, sha256", Response: map[string]interface{}{}, Status: http.StatusAccepted},
+	"POST /api/upload/pause":  {ID: "pauseUpload", Summary: "Pause an upload and keep it past the idle cleanup", Auth: ScopeUpload, Query: map[string]string{"id": "upload id", "seconds": "how long to keep it"}, Response: map[string]interface{}{}},
+	"POST /api/upload/resume": {ID: "resumeUpload", Summary: "Resume a paused upload", Auth: ScopeUpload, Query: map[string]string{"id": "upload id"}, Response: map[string]interface{}{}},
+
+	"GET /api/subtitles":  {ID: "getSubtitles", Summary: "Subtitles of a video as webvtt", Auth: ScopePlayback, Query: map[string]string{"id": "video id", "lang": "language", "format": "vtt or srt", "offset": "seconds to shift the cues by"}, ResponseType: "text/vtt"},
+	"POST /api/subtitles": {ID: "uploadSubtitles", Summary: "Upload subtitles as srt or webvtt", Auth: ScopeUpload, Query: map[string]string{"id": "video id", "lang": "language"}, Body: "srt or webvtt", BodyType: "text/plain"},
+
+	"/api/watch": {ID: "watch", Summary: "Stream a video, audio file or image, with range requests", Auth: ScopePlayback,
+		Query: map[string]string{"id": "video id", "audio": "1 streams the audio only rendition"}, ResponseType: "application/octet-stream"},
+	"GET /api/audio/{id}":                          {ID: "getAudio", Summary: "Audio only stream of a video", Auth: ScopePlayback, ResponseType: "audio/mp4"},
+	"GET /api/hls/{id}/index.m3u8":                 {ID: "getHLSPlaylist", Summary: "HLS playlist of a video, the master playlist of every rendition when its profile has abr", Auth: ScopePlayback, ResponseType: "application/vnd.apple.mpegurl"},
+	"GET /api/dash/{id}/manifest.mpd":              {ID: "getDASHManifest", Summary: "DASH manifest of a video whose profile has abr with fmp4 segments", Auth: ScopePlayback, ResponseType: "application/dash+xml"},
+	"GET /api/hls/{id}/{file}":                     {ID: "getHLSFile", Summary: "HLS variant playlist or segment", Auth: ScopeSession, ResponseType: "application/octet-stream"},
+	"GET /api/download/{id}":                       {ID: "download", Summary: "Download the original file", Auth: ScopeDownload, ResponseType: "application/octet-stream"},
+	"GET /healthz":                                 {ID: "healthz", Summary: "Liveness", Response: map[string]string{}},
+	"GET /readyz":                                  {ID: "readyz", Summary: "Readiness, 503 while the server can't take traffic", Response: map[string]interface{}{}},
+	"GET /watch/{id}":                              {ID: "player", Summary: "Player page of a video", ResponseType: "text/html"},
+	"POST /api/beacon":                             {ID: "beacon", Summary: "Player session events and errors", Body: "session events of a player", Response: map[string]string{}, Status: http.StatusAccepted},
+	"GET /admin/diagnostics":                       {ID: "listDiagnostics", Summary: "Player diagnostics", Auth: "admin", Query: map[string]string{"video": "video id", "session": "session id"}, Response: []*DiagnosticRecord{}},
+	"GET /s/{code}":                                {ID: "followShortLink", Summary: "Redirect a short link", Status: http.StatusFound},
+	"GET /api/links":                               {ID: "listLinks", Summary: "List short links", Auth: ScopeUpload, Response: []linkResponse{}},
+	"POST /api/links":                              {ID: "createLink", Summary: "Create a short link", Auth: ScopeUpload, Body: "video_id, target, expires_in, token_ttl", Response: linkResponse{}, Status: http.StatusCreated},
+	"GET /api/links/{code}":                        {ID: "getLink", Summary: "Get a short link", Auth: ScopeUpload, Response: linkResponse{}},
+	"DELETE /api/links/{code}":                     {ID: "deleteLink", Summary: "Delete a short link", Auth: ScopeUpload, Status: http.StatusNoContent},
+	"GET /api/videos/{id}/events":                  {ID: "videoEvents", Summary: "Live events of a video as server sent events", Auth: ScopePlayback, ResponseType: "text/event-stream"},
+	"POST /api/videos/{id}/parties":                {ID: "createParty", Summary: "Start a watch party", Auth: ScopePlayback, Body: "action, position", Response: map[string]string{}, Status: http.StatusCreated},
+	"POST /api/videos/{id}/parties/{party}/events": {ID: "partyEvent", Summary: "Play, pause or seek a watch party", Body: "action, position", Status: http.StatusNoContent},
+
+	"GET /api/videos/{id}/markers":             {ID: "listMarkers", Summary: "Timed markers of a video", Auth: ScopePlayback, Response: []Marker{}},
+	"POST /api/videos/{id}/markers":            {ID: "createMarker", Summary: "Add a timed marker", Auth: ScopeUpload, Body: "class, time, duration, data", Response: Marker{}, Status: http.StatusCreated},
+	"DELETE /api/videos/{id}/markers/{marker}": {ID: "deleteMarker", Summary: "Remove a timed marker", Auth: ScopeUpload, Status: http.StatusNoContent},
+	"GET /api/videos/{id}/chapters":            {ID: "getChapters", Summary: "Chapters of a video", Auth: ScopePlayback, Response: []Chapter{}},
+	"GET /api/videos/{id}/chapters.vtt":        {ID: "getChaptersVTT", Summary: "Chapters of a video as webvtt", Auth: ScopePlayback, ResponseType: "text/vtt"},
+	"PUT /api/videos/{id}/chapters":            {ID: "putChapters", Summary: "Replace the chapters of a video", Auth: ScopeUpload, Body: "a list of chapters", Response: []Chapter{}},
+	"GET /api/videos/{id}/poster.jpg":          {ID: "getPoster", Summary: "Poster image of a video, or the image set as its poster", Auth: ScopePlayback, ResponseType: "image/jpeg"},
+	"GET /api/videos/{id}/preview.webp":        {ID: "getPreview", Summary: "Animated preview of a video", Auth: ScopePlayback, ResponseType: "image/webp"},
+	"GET /api/videos/{id}/watermark.jpg": {ID: "previewWatermark", Summary: "A frame of a video with its watermark, or the one in the query", Auth: ScopeUpload,
+		Query: map[string]string{"text": "watermark text", "image": "id of an uploaded image", "position": "top-left, top-right, bottom-left, bottom-right or center", "opacity": "0 to 1", "size": "height as a share of the video's"}, ResponseType: "image/jpeg"},
+
+	"GET /api/videos": {ID: "listVideos", Summary: "List and search videos, the total is in X-Total-Count", Auth: ScopePlayback,
+		Query: map[string]string{"q": "search in title, description and tags", "tag": "only videos with this tag", "kind": "video, audio or image", "sort": "created, duration or views", "order": "asc or desc", "limit": "page size", "offset": "videos to skip",
+			"collection": "only videos in this collection, empty for the top", "recursive": "1 takes the collections inside it too"},
+		Response: []VideoRecord{}},
+	"GET /api/videos/{id}": {ID: "getVideo", Summary: "Get a video with its playback urls", Auth: ScopePlayback, Response: VideoWithURLs{}},
+	"PATCH /api/videos/{id}": {ID: "updateVideo", Summary: "Change a video's details", Auth: ScopeUpload,
+		Body: "title, description, tags, noindex, nounfurl, profile, ttl, playback_policy, collection, poster, watermark", Response: VideoRecord{}},
+	"GET /api/videos/{id}/analytics": {ID: "getVideoAnalytics", Summary: "Views, watch time and heatmap of a video", Auth: ScopeUpload, Response: AnalyticsReport{}},
+	"POST /api/videos/{id}/clip": {ID: "createClip", Summary: "Cut a clip out of a video into a new one", Auth: ScopeUpload,
+		Body: "id, title, start, end, accurate, priority", Response: VideoRecord{}, Status: http.StatusAccepted},
+
+	"GET /api/transcodes":         {ID: "listTranscodes", Summary: "Queued and running transcodes", Auth: ScopeUpload, Response: []TranscodeJob{}},
+	"DELETE /api/transcodes/{id}": {ID: "cancelTranscode", Summary: "Cancel a transcode", Auth: ScopeUpload, Status: http.StatusNoContent},
+	"POST /api/estimate":          {ID: "estimate", Summary: "Estimate the renditions and cost of a transcode", Body: "video_id or source, profile", Response: map[string]interface{}{}},
+	"GET /robots.txt":             {ID: "robots", Summary: "robots.txt", ResponseType: "text/plain"},
+	"GET /sitemap.xml":            {ID: "sitemap", Summary: "Video sitemap", ResponseType: "application/xml"},
+
+	"GET /api/me":                                 {ID: "getAccount", Summary: "The signed in user and their usage", Auth: "account", Response: map[string]interface{}{}},
+	"GET /api/me/videos":                          {ID: "listAccountVideos", Summary: "Videos the user uploaded", Auth: "account", Response: []VideoRecord{}},
+	"DELETE /api/me/videos/{id}":                  {ID: "deleteAccountVideo", Summary: "Delete a video the user uploaded", Auth: "account", Status: http.StatusNoContent},
+	"GET /api/me/tokens":                          {ID: "listAccountTokens", Summary: "Tokens issued to the user", Auth: "account", Response: []TokenClaims{}},
+	"POST /api/me/tokens":                         {ID: "issueAccountToken", Summary: "Issue a token for the user", Auth: "account", Body: "scope, video_id, ttl", Response: map[string]interface{}{}, Status: http.StatusCreated},
+	"DELETE /api/me/tokens/{jti}":                 {ID: "revokeAccountToken", Summary: "Revoke a token of the user", Auth: "account", Status: http.StatusNoContent},
+	"GET /api/me/history":                         {ID: "getAccountHistory", Summary: "Playback history of the user", Auth: "account", Response: []HistoryEntry{}},
+	"DELETE /api/me/history":                      {ID: "clearAccountHistory", Summary: "Clear the playback history of the user", Auth: "account", Status: http.StatusNoContent},
+	"GET /api/playlists":                          {ID: "listPlaylists", Summary: "List playlists", Auth: ScopePlayback, Response: []Playlist{}},
+	"POST /api/playlists":                         {ID: "createPlaylist", Summary: "Create a playlist", Auth: ScopeUpload, Body: "name, description, video_ids", Response: Playlist{}, Status: http.StatusCreated},
+	"GET /api/playlists/{id}":                     {ID: "getPlaylist", Summary: "Get a playlist", Auth: ScopePlayback, Response: Playlist{}},
+	"PATCH /api/playlists/{id}":                   {ID: "updatePlaylist", Summary: "Rename or describe a playlist", Auth: ScopeUpload, Body: "name, description", Response: Playlist{}},
+	"DELETE /api/playlists/{id}":                  {ID: "deletePlaylist", Summary: "Delete a playlist", Auth: ScopeUpload, Status: http.StatusNoContent},
+	"POST /api/playlists/{id}/videos":             {ID: "addPlaylistVideo", Summary: "Add a video to a playlist", Auth: ScopeUpload, Body: "video_id, position", Response: Playlist{}},
+	"PUT /api/playlists/{id}/videos":              {ID: "reorderPlaylist", Summary: "Reorder the videos of a playlist", Auth: ScopeUpload, Body: "video_ids", Response: Playlist{}},
+	"DELETE /api/playlists/{id}/videos/{videoID}": {ID: "removePlaylistVideo", Summary: "Remove a video from a playlist", Auth: ScopeUpload, Response: Playlist{}},
+	"GET /api/playlists/{id}/{format}":            {ID: "getPlaylistManifest", Summary: "A playlist as m3u8 or json feed", Auth: ScopePlayback, ResponseType: "application/vnd.apple.mpegurl"},
+	"GET /api/collections":                        {ID: "listCollections", Summary: "List the collections in a collection, the top ones without parent", Auth: ScopePlayback, Query: map[string]string{"parent": "collection id"}, Response: []Collection{}},
+	"POST /api/collections":                       {ID: "createCollection", Summary: "Create a collection", Auth: ScopeUpload, Body: "name, parent, editors", Response: Collection{}, Status: http.StatusCreated},
+	"GET /api/collections/{id}":                   {ID: "getCollection", Summary: "Get a collection with its path and what's in it", Auth: ScopePlayback, Response: CollectionListing{}},
+	"PATCH /api/collections/{id}":                 {ID: "updateCollection", Summary: "Rename, move or change the editors of a collection", Auth: ScopeUpload, Body: "name, parent, editors", Response: Collection{}},
+	"DELETE /api/collections/{id}": {ID: "deleteCollection", Summary: "Delete an empty collection, or everything in it", Auth: ScopeUpload,
+		Query: map[string]string{"recursive": "1 deletes the collections and videos in it too"}, Status: http.StatusNoContent},
+	"POST /api/collections/{id}/videos": {ID: "moveToCollection", Summary: "File videos in a collection", Auth: ScopeUpload, Body: "video_ids", Response: CollectionListing{}},
+
+	"GET /admin/tokens":             {ID: "listTokens", Summary: "Outstanding tokens", Auth: "admin", Query: map[string]string{"video": "video id", "sub": "subject"}, Response: []TokenClaims{}},
+	"POST /admin/tokens":            {ID: "issueToken", Summary: "Issue a token", Auth: "admin", Body: "scope, video_id, sub, tenant, ttl", Response: map[string]interface{}{}, Status: http.StatusCreated},
+	"POST /admin/tokens/introspect": {ID: "introspectToken", Summary: "Check a token and read its claims", Auth: "admin", Body: "token", Response: map[string]interface{}{}},
+	"POST /admin/tokens/revoke":     {ID: "revokeTokens", Summary: "Revoke a token, or every token of a video, tenant or subject", Auth: "admin", Body: "token, jti, video_id, tenant or sub", Status: http.StatusNoContent},
+	"GET /admin/cache":              {ID: "getCache", Summary: "Segment cache stats", Auth: "admin", Response: map[string]interface{}{}},
+	"DELETE /admin/cache":           {ID: "purgeCache", Summary: "Empty the segment cache", Auth: "admin", Status: http.StatusNoContent},
+	"GET /admin/egress":             {ID: "getEgress", Summary: "Egress limit and what each class sent", Auth: "admin", Response: map[string]interface{}{}},
+	"GET /admin/pins":               {ID: "listPins", Summary: "Pinned videos, how warm they are and the streams they reserve", Auth: "admin", Response: map[string]interface{}{}},
+	"GET /admin/pins/{id}":          {ID: "getPin", Summary: "Pin of a video", Auth: "admin", Query: map[string]string{"tenant": "tenant of the video"}, Response: Pin{}},
+	"PUT /admin/pins/{id}": {ID: "pinVideo", Summary: "Pin a video ahead of a launch: make its renditions, warm the caches and reserve streams", Auth: "admin",
+		Query: map[string]string{"tenant": "tenant of the video"}, Body: "until (when it is unpinned), reserve (streams kept for it)", Response: Pin{}, Status: http.StatusAccepted},
+	"DELETE /admin/pins/{id}":       {ID: "unpinVideo", Summary: "Unpin a video", Auth: "admin", Query: map[string]string{"tenant": "tenant of the video"}, Status: http.StatusNoContent},
+	"GET /admin/profiles":           {ID: "listProfiles", Summary: "Transcode profiles", Auth: "admin", Response: []TranscodeProfile{}},
+	"POST /admin/profiles":          {ID: "createProfile", Summary: "Create a transcode profile", Auth: "admin", Body: "a transcode profile", Response: TranscodeProfile{}},
+	"GET /admin/profiles/{name}":    {ID: "getProfile", Summary: "Get a transcode profile", Auth: "admin", Response: TranscodeProfile{}},
+	"PUT /admin/profiles/{name}":    {ID: "putProfile", Summary: "Create or replace a transcode profile", Auth: "admin", Body: "a transcode profile", Response: TranscodeProfile{}},
+	"DELETE /admin/profiles/{name}": {ID: "deleteProfile", Summary: "Delete a transcode profile", Auth: "admin", Status: http.StatusNoContent},
+	"GET /admin/stats":              {ID: "getLibraryStats", Summary: "Library stats by codec, resolution and status", Auth: "admin", Response: libraryReport{}},
+	"GET /admin/tenants":            {ID: "listTenants", Summary: "Tenants and their usage", Auth: "admin", Response: []map[string]interface{}{}},
+	"GET /admin/leader":             {ID: "getLeader", Summary: "Which replica runs the singleton tasks", Auth: "admin", Response: map[string]interface{}{}},
+	"GET /admin/audit": {ID: "listAudit", Summary: "Audit trail, newest first, or all of it as jsonl with format=jsonl", Auth: "admin",
+		Query: map[string]string{"action": "action, or a prefix ending in a dot like video.", "actor": "token subject, admin, tenant:<id> or system", "tenant": "tenant",
+			"target": "video, token or other id acted on", "outcome": "success, failure or denied", "since": "rfc3339 time", "until": "rfc3339 time",
+			"limit": "most entries, 100 by default and up to 1000", "format": "jsonl to export"}, Response: []AuditEntry{}},
+	"GET /admin/workers": {ID: "listWorkers", Summary: "Background workers, their restarts and last errors", Auth: "admin", Response: map[string]interface{}{}},
+	"GET /admin/jobs": {ID: "listJobs", Summary: "Background jobs, oldest first, status=dead for the ones out of tries", Auth: "admin",
+		Query: map[string]string{"status": "queued, running or dead", "kind": "job kind like hls.package", "limit": "most jobs, 100 by default and up to 1000"}, Response: []Job{}},
+	"GET /admin/jobs/{id}":        {ID: "getJob", Summary: "Get a background job", Auth: "admin", Response: Job{}},
+	"DELETE /admin/jobs/{id}":     {ID: "deleteJob", Summary: "Drop a job that isn't running", Auth: "admin", Status: http.StatusNoContent},
+	"POST /admin/jobs/{id}/retry": {ID: "retryJob", Summary: "Run a dead or waiting job now with all its tries", Auth: "admin", Response: Job{}},
+	"POST /admin/storage/migrate": {ID: "migrateStorage", Summary: "Copy or move the videos between storages (local, dir:/path or storage), dry_run reports what would be copied", Auth: "admin",
+		Body: "from, to, dry_run, rate in bytes per second, delete_source and tenant", Response: Migration{}},
+	"GET /admin/storage/migrate":    {ID: "getMigration", Summary: "The running or last storage migration", Auth: "admin", Response: Migration{}},
+	"DELETE /admin/storage/migrate": {ID: "cancelMigration", Summary: "Stop the running storage migration after the video it is copying", Auth: "admin", Response: Migration{}},
+
+	"GET /api/openapi.json":   {ID: "openapi", Summary: "This document", Response: map[string]interface{}{}},
+	"GET /api/docs":           {ID: "docs", Summary: "Docs page of this document, it can send the requests", ResponseType: "text/html"},
+	"GET /api/clients/{lang}": {ID: "getClient", Summary: "A client generated from this document, go is a go package and ts a typescript module", ResponseType: "text/plain"},
+}
+
+// apiMux registers the routes on the server's mux and keeps their patterns
+// for the openapi document
+type apiMux struct {
+	s *Server
+}
+
+func (m apiMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.s.patterns = append(m.s.patterns, pattern)
+	m.s.mux.HandleFunc(pattern, m.s.sm.audit.route(pattern, handler))
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)(\.\.\.)?\}`)
+
+// openAPI will build the openapi 3 document of the registered routes
+func (s *Server) openAPI(r *http.Request) map[string]interface{} {
+	schemas := schemaBuilder{components: map[string]interface{}{}}
+	errorSchema := schemas.schema(reflect.TypeOf(struct {
+		Error APIError `json:"error"`
+	}{}))
+
+	paths := map[string]map[string]interface{}{}
+	for _, pattern := range s.patterns {
+		method, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			// a pattern without a method takes any, players only GET it
+			method, path = "GET", pattern
+		}
+		doc := apiOperations[pattern]
+
+		operation := map[string]interface{}{"tags": []string{apiTag(path)}}
+		if doc.ID == "" {
+			doc.ID = operationID(method, path)
+		}
+		operation["operationId"] = doc.ID
+		if doc.Summary != "" {
+			operation["summary"] = doc.Summary
+		}
+
+		var parameters []map[string]interface{}
+		for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name": match[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+		query := make([]string, 0, len(doc.Query))
+		for name := range doc.Query {
+			query = append(query, name)
+		}
+		sort.Strings(query)
+		for _, name := range query {
+			parameters = append(parameters, map[string]interface{}{
+				"name": name, "in": "query", "description": doc.Query[name], "schema": map[string]string{"type": "string"},
+			})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+
+		if doc.Body != "" {
+			contentType := doc.BodyType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			operation["requestBody"] = map[string]interface{}{
+				"description": doc.Body,
+				"content":     map[string]interface{}{contentType: map[string]interface{}{}},
+			}
+		}
+
+		status := doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case doc.Response != nil:
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(doc.Response))},
+			}
+		case doc.ResponseType != "":
+			success["content"] = map[string]interface{}{doc.ResponseType: map[string]interface{}{}}
+		}
+		operation["responses"] = map[string]interface{}{
+			fmt.Sprint(status): success,
+			"default": map[string]interface{}{
+				"description": "error",
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+			},
+		}
+		if security := apiSecurity(doc.Auth); security != nil {
+			operation["security"] = security
+			if doc.Auth != "admin" && doc.Auth != "account" {
+				operation["description"] = "needs a token of the " + doc.Auth + " scope when AUTH_SECRET is set"
+			}
+		}
+
+		path = pathParam.ReplaceAllString(path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "video streaming server",
+			"version": "1",
+		},
+		"servers": []map[string]string{{"url": publicBase(r)}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer",
+					"description": "a signed token, a jwt or an api key with the scope the route needs"},
+				"token": map[string]string{"type": "apiKey", "in": "query", "name": "token",
+					"description": "the same token as a query parameter, for players"},
+				"session": map[string]string{"type": "apiKey", "in": "query", "name": "st",
+					"description": "the session token an hls playlist puts in its urls"},
+				"adminKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// apiSecurity is what an operation of auth needs. the scope of a token isn't
+// a thing openapi can say outside oauth, it goes in the description
+func apiSecurity(auth string) []map[string][]string {
+	switch auth {
+	case "":
+		return nil
+	case "admin":
+		return []map[string][]string{{"adminKey": {}}}
+	case "account":
+		return []map[string][]string{{"bearer": {}}}
+	case ScopeSession:
+		return []map[string][]string{{"session": {}}, {"bearer": {}}, {"token": {}}}
+	}
+	return []map[string][]string{{"bearer": {}}, {"token": {}}}
+}
+
+// apiTag groups the operations by the first part of the path after /api
+func apiTag(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case parts[0] == "api" && len(parts) > 1:
+		return parts[1]
+	case parts[0] == "admin":
+		return "admin"
+	}
+	return "pages"
+}
+
+// operationID is the id of an undocumented operation, like getApiFooId
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+// schemaBuilder will turn go types into json schemas by their json tags,
+// named structs go in the components and are referenced
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := []rune(t.Name())
+		name[0] = unicode.ToUpper(name[0])
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + string(name)}
+		if _, ok := b.components[string(name)]; !ok {
+			// in first, a type that contains itself references it
+			b.components[string(name)] = nil
+			b.components[string(name)] = b.object(t)
+		}
+		return ref
+	}
+	// interfaces, anything goes
+	return map[string]interface{}{}
+}
+
+// object is the schema of a struct's fields, embedded structs are flattened
+// like encoding/json does
+func (b schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				add(field.Type)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = b.schema(field.Type)
+			if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// handleOpenAPI will serve the openapi document of the api
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.openAPI(r))
+}
+
+// the docs page is all in the binary, it renders openapi.json and can send
+// the requests, swagger ui would need its assets from a cdn
+const docsPage = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>api docs</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+details { border: 1px solid #ddd; border-radius: 4px; margin: .4em 0; padding: .4em .6em; }
+summary { cursor: pointer; }
+.method { display: inline-block; width: 4.5em; font-weight: bold; font-family: monospace; }
+.path { font-family: monospace; }
+label { display: block; margin: .3em 0; font-family: monospace; }
+input, textarea { font-family: monospace; width: 100%; box-sizing: border-box; }
+pre { background: #f5f5f5; padding: .6em; overflow: auto; max-height: 30em; }
+.auth { color: #a60; font-size: .9em; }
+</style>
+</head>
+<body>
+<h1>api docs</h1>
+<p><a href="openapi.json">openapi.json</a>, clients: <a href="clients/go">go</a> <a href="clients/ts">typescript</a></p>
+<label>token <input id="token" placeholder="sent as a bearer token"></label>
+<label>admin key <input id="apikey" placeholder="sent as X-API-Key"></label>
+<div id="docs">loading</div>
+<script>
+const el = (tag, props, ...children) => {
+  const node = Object.assign(document.createElement(tag), props || {});
+  node.append(...children);
+  return node;
+};
+
+function operation(path, method, op) {
+  const inputs = {};
+  const form = el("div");
+  for (const param of op.parameters || []) {
+    inputs[param.name] = {in: param.in, input: el("input", {placeholder: param.description || ""})};
+    form.append(el("label", {}, param.name + " (" + param.in + ")", inputs[param.name].input));
+  }
+  let body;
+  if (op.requestBody) {
+    body = el("textarea", {rows: 4, placeholder: op.requestBody.description || ""});
+    form.append(el("label", {}, "body", body));
+  }
+  const output = el("pre");
+  const send = el("button", {textContent: "send"});
+  send.onclick = async () => {
+    let url = path.replace(/\{(\w+)\}/g, (_, name) => encodeURIComponent(inputs[name].input.value));
+    const query = new URLSearchParams();
+    for (const [name, param] of Object.entries(inputs)) {
+      if (param.in === "query" && param.input.value) query.set(name, param.input.value);
+    }
+    if ([...query].length) url += "?" + query;
+    const headers = {};
+    const token = document.getElementById("token").value;
+    const apikey = document.getElementById("apikey").value;
+    if (token) headers["Authorization"] = "Bearer " + token;
+    if (apikey) headers["X-API-Key"] = apikey;
+    if (body) headers["Content-Type"] = Object.keys(op.requestBody.content || {})[0] || "application/json";
+    output.textContent = "...";
+    try {
+      const resp = await fetch(url, {method: method.toUpperCase(), headers, body: body ? body.value : undefined});
+      let text = await resp.text();
+      try { text = JSON.stringify(JSON.parse(text), null, 2); } catch (e) {}
+      output.textContent = resp.status + " " + resp.statusText + "\n\n" + text;
+    } catch (e) {
+      output.textContent = String(e);
+    }
+  };
+  return el("details", {},
+    el("summary", {}, el("span", {className: "method", textContent: method.toUpperCase()}),
+      el("span", {className: "path", textContent: path}), " ", op.summary || ""),
+    op.description ? el("p", {className: "auth", textContent: op.description}) : "",
+    op.security ? el("p", {className: "auth", textContent: "auth: " + op.security.map(s => Object.keys(s).join("+")).join(" or ")}) : "",
+    form, send, output);
+}
+
+fetch("openapi.json").then(resp => resp.json()).then(doc => {
+  const tags = {};
+  for (const [path, methods] of Object.entries(doc.paths).sort()) {
+    for (const [method, op] of Object.entries(methods)) {
+      (tags[op.tags[0]] = tags[op.tags[0]] || []).push(operation(path, method, op));
+    }
+  }
+  const docs = document.getElementById("docs");
+  docs.textContent = "";
+  for (const tag of Object.keys(tags).sort()) {
+    docs.append(el("h2", {textContent: tag}), ...tags[tag]);
+  }
+}).catch(e => { document.getElementById("docs").textContent = "failed to load openapi.json: " + e; });
+</script>
+</body>
+</html>
+`
+
+// handleAPIDocs will serve the docs page over /api/openapi.json
+func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsPage))
+}
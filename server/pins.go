@@ -0,0 +1,464 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bytes from the start of a pinned video read into the caches, viewers of
+// a launch all start at the beginning
+var PinWarmBytes = envInt64("PIN_WARM_BYTES", 64<<20)
+
+// pin states
+const (
+	PinWarming = "warming"
+	PinWarm    = "warm"
+	PinFailed  = "failed"
+)
+
+// Pin is a video held ready for a launch: its renditions are made ahead of
+// time, the start of it is read into the caches, its cached blocks are
+// evicted last and streams can be reserved for it
+type Pin struct {
+	VideoID  string    `json:"video_id"`
+	PinnedAt time.Time `json:"pinned_at"`
+	// unpinned by the cleanup then, nil stays pinned until it is unpinned
+	Until *time.Time `json:"until,omitempty"`
+	// streams other videos can't take while it is pinned
+	Reserve int64 `json:"reserve,omitempty"`
+
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	WarmedAt *time.Time `json:"warmed_at,omitempty"`
+}
+
+func (p *Pin) active(now time.Time) bool {
+	return p.Until == nil || now.Before(*p.Until)
+}
+
+// PinStore will keep the pinned videos, persisted next to the videos so a
+// restart warms them again
+type PinStore struct {
+	path string
+
+	mu   sync.Mutex
+	pins map[string]*Pin
+	// stops the warming of a pin that is unpinned
+	cancel map[string]context.CancelFunc
+}
+
+// NewPinStore will load the pins from path, a missing file is empty
+func NewPinStore(path string) (*PinStore, error) {
+	ps := &PinStore{path: path, pins: make(map[string]*Pin), cancel: make(map[string]context.CancelFunc)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &ps.pins); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// pinsPath is where the pins are persisted
+func pinsPath() string {
+	return filepath.Join(VideoStoragePath, ".pins.json")
+}
+
+// Pinned reports whether a video is pinned right now
+func (ps *PinStore) Pinned(fileID string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pin, ok := ps.pins[fileID]
+	return ok && pin.active(time.Now())
+}
+
+// Reserved is how many streams the pinned videos reserve together
+func (ps *PinStore) Reserved() int64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	now := time.Now()
+	var reserved int64
+	for _, pin := range ps.pins {
+		if pin.active(now) {
+			reserved += pin.Reserve
+		}
+	}
+	return reserved
+}
+
+// Get will return a pin
+func (ps *PinStore) Get(fileID string) (Pin, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pin, ok := ps.pins[fileID]
+	if !ok {
+		return Pin{}, false
+	}
+	return *pin, true
+}
+
+// List will return every pin, by video
+func (ps *PinStore) List() []Pin {
+	ps.mu.Lock()
+	pins := make([]Pin, 0, len(ps.pins))
+	for _, pin := range ps.pins {
+		pins = append(pins, *pin)
+	}
+	ps.mu.Unlock()
+	sort.Slice(pins, func(i, j int) bool { return pins[i].VideoID < pins[j].VideoID })
+	return pins
+}
+
+// Put will pin a video or change its pin, cancel stops its warming when it
+// is unpinned or pinned again
+func (ps *PinStore) Put(pin Pin, cancel context.CancelFunc) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if old, ok := ps.pins[pin.VideoID]; ok {
+		pin.PinnedAt = old.PinnedAt
+	}
+	if stop, ok := ps.cancel[pin.VideoID]; ok {
+		stop()
+		delete(ps.cancel, pin.VideoID)
+	}
+	if cancel != nil {
+		ps.cancel[pin.VideoID] = cancel
+	}
+	ps.pins[pin.VideoID] = &pin
+	return ps.saveLocked()
+}
+
+// Delete will unpin a video and stop its warming
+func (ps *PinStore) Delete(fileID string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.pins[fileID]; !ok {
+		return ErrNotFound
+	}
+	if stop, ok := ps.cancel[fileID]; ok {
+		stop()
+		delete(ps.cancel, fileID)
+	}
+	delete(ps.pins, fileID)
+	return ps.saveLocked()
+}
+
+// Expired will return the pins whose time is up
+func (ps *PinStore) Expired() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	now := time.Now()
+	var expired []string
+	for fileID, pin := range ps.pins {
+		if !pin.active(now) {
+			expired = append(expired, fileID)
+		}
+	}
+	return expired
+}
+
+// setState will note how warming a pin went, err is kept on a failed one
+func (ps *PinStore) setState(fileID, state string, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pin, ok := ps.pins[fileID]
+	if !ok {
+		return
+	}
+	pin.State, pin.Error = state, ""
+	if err != nil {
+		pin.Error = err.Error()
+	}
+	if state == PinWarm {
+		now := time.Now().UTC()
+		pin.WarmedAt = &now
+	}
+	if err := ps.saveLocked(); err != nil {
+		log.Println("failed to save pins", err)
+	}
+}
+
+func (ps *PinStore) saveLocked() error {
+	data, err := json.Marshal(ps.pins)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ps.path, data)
+}
+
+// pin will pin a video and warm it in the background, telling the edges to
+// keep its segments too
+func (sm *StreamManager) pin(pin Pin) error {
+	pin.State = PinWarming
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := sm.pins.Put(pin, cancel); err != nil {
+		cancel()
+		return err
+	}
+	supervisor.Go(ctx, "pin-warm "+pin.VideoID, RestartOnFailure, func(ctx context.Context) error {
+		return sm.warmPin(ctx, pin.VideoID)
+	})
+	sm.tellEdgesPin(pin.VideoID, &pin)
+	return nil
+}
+
+// unpin will let a video go back to being like any other
+func (sm *StreamManager) unpin(fileID string) error {
+	if err := sm.pins.Delete(fileID); err != nil {
+		return err
+	}
+	sm.tellEdgesPin(fileID, nil)
+	return nil
+}
+
+// warmPins will warm every pin again, the caches are empty after a restart
+func (sm *StreamManager) warmPins() {
+	for _, pin := range sm.pins.List() {
+		if err := sm.pin(pin); err != nil {
+			log.Println("failed to warm pinned video", pin.VideoID, err)
+		}
+	}
+}
+
+// expirePins will unpin the videos whose launch is over
+func (sm *StreamManager) expirePins() {
+	for _, fileID := range sm.pins.Expired() {
+		log.Println("unpinning", fileID)
+		if err := sm.unpin(fileID); err != nil && err != ErrNotFound {
+			log.Println("failed to unpin", fileID, err)
+		}
+	}
+}
+
+// warmPin will make every rendition of a pinned video and read the start of
+// it into the caches. a rendition that can't be made here (no ffmpeg) fails
+// the pin for good, anything else is tried again by the supervisor
+func (sm *StreamManager) warmPin(ctx context.Context, fileID string) error {
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || !video.Available() {
+		sm.pins.setState(fileID, PinFailed, errors.New("video is not available"))
+		return nil
+	}
+
+	type rendition struct {
+		name  string
+		build func() error
+	}
+	var renditions []rendition
+	// audio files and images have nothing made of them, only the file is warmed
+	if video.IsVideo() {
+		renditions = append(renditions, rendition{"hls", func() error { return sm.packageHLS(ctx, fileID, PriorityViewer) }})
+		for name, format := range audioFormats {
+			renditions = append(renditions, rendition{name, func() error {
+				if err := sm.extractAudio(ctx, fileID, format, PriorityViewer); !errors.Is(err, errNoAudio) {
+					return err
+				}
+				return nil
+			}})
+		}
+	}
+	if video.IsVideo() && video.Duration > 0 {
+		for name, format := range previewFormats {
+			renditions = append(renditions, rendition{name, func() error {
+				return sm.makePreview(ctx, video, name, format, PriorityViewer)
+			}})
+		}
+	}
+	var missing []string
+	for _, job := range renditions {
+		err := job.build()
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, exec.ErrNotFound):
+			missing = append(missing, job.name)
+		case err != nil:
+			err = fmt.Errorf("%s: %w", job.name, err)
+			sm.pins.setState(fileID, PinFailed, err)
+			return err
+		}
+	}
+
+	if err := sm.warmSource(ctx, video); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = fmt.Errorf("reading the video: %w", err)
+		sm.pins.setState(fileID, PinFailed, err)
+		return err
+	}
+	sm.warmHLS(fileID)
+
+	if len(missing) > 0 {
+		sm.pins.setState(fileID, PinFailed, fmt.Errorf("%s need ffmpeg", strings.Join(missing, ", ")))
+		return nil
+	}
+	sm.pins.setState(fileID, PinWarm, nil)
+	return nil
+}
+
+// warmSource will read the start of a video the way watch does, into the
+// block cache when it caches the video and the os page cache when it doesn't
+func (sm *StreamManager) warmSource(ctx context.Context, video VideoRecord) error {
+	fileID := video.Key()
+	file, err := sm.openVideo(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	file = sm.cache.Wrap(file, fileID, videoETag(video, info), info.Size(), nil)
+	_, err = io.CopyN(io.Discard, file, min(info.Size(), PinWarmBytes))
+	return err
+}
+
+// warmHLS will read the first segments of a video's package into the os
+// page cache, the origin serves them from the files
+func (sm *StreamManager) warmHLS(fileID string) {
+	entries, err := os.ReadDir(hlsDir(fileID))
+	if err != nil {
+		return
+	}
+	budget := PinWarmBytes
+	for _, entry := range entries {
+		if budget <= 0 {
+			return
+		}
+		data, err := sm.readHLSFile(fileID, entry.Name())
+		if err != nil {
+			continue
+		}
+		budget -= int64(len(data))
+	}
+}
+
+// tellEdgesPin will pin a video on the edges too, so their caches keep its
+// segments over other videos'. nil unpins it
+func (sm *StreamManager) tellEdgesPin(fileID string, pin *Pin) {
+	req := map[string]interface{}{"id": fileID, "pinned": pin != nil}
+	if pin != nil && pin.Until != nil {
+		req["until"] = pin.Until
+	}
+	body, _ := json.Marshal(req)
+	tellEdges("/internal/edge/pin", "pin "+fileID, body)
+}
+
+// handlePin will pin (PUT), show (GET) or unpin (DELETE) a video, the video
+// is ?tenant='s. pinning answers right away, GET tells when it is warm
+func (sm *StreamManager) handlePin(w http.ResponseWriter, r *http.Request) {
+	fileID := scopeID(r.URL.Query().Get("tenant"), r.PathValue("id"))
+
+	switch r.Method {
+	case http.MethodGet:
+		pin, ok := sm.pins.Get(fileID)
+		if !ok {
+			writeError(w, http.StatusNotFound, "video is not pinned")
+			return
+		}
+		writeJSON(w, http.StatusOK, pin)
+
+	case http.MethodPut:
+		var req struct {
+			Until   *time.Time `json:"until"`
+			Reserve int64      `json:"reserve"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+		}
+		if req.Until != nil && !req.Until.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, "until must be in the future")
+			return
+		}
+		video, ok := sm.metadata.GetVideo(fileID)
+		if !ok || !video.Available() {
+			writeError(w, http.StatusNotFound, "video not found")
+			return
+		}
+		// some streams have to stay for everything else
+		reserved := sm.pins.Reserved()
+		if old, ok := sm.pins.Get(fileID); ok && old.active(time.Now()) {
+			reserved -= old.Reserve
+		}
+		if req.Reserve < 0 || reserved+req.Reserve >= MaxConcurrentSteams {
+			writeError(w, http.StatusConflict, fmt.Sprintf("reserve must be between 0 and %d", max(MaxConcurrentSteams-reserved-1, 0)))
+			return
+		}
+
+		pin := Pin{VideoID: fileID, PinnedAt: time.Now().UTC(), Until: req.Until, Reserve: req.Reserve}
+		if err := sm.pin(pin); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save pin")
+			return
+		}
+		pin, _ = sm.pins.Get(fileID)
+		writeJSON(w, http.StatusAccepted, pin)
+
+	case http.MethodDelete:
+		switch err := sm.unpin(fileID); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrNotFound:
+			writeError(w, http.StatusNotFound, "video is not pinned")
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to save pins")
+		}
+	}
+}
+
+// handleListPins will list the pinned videos and how warm they are
+func (sm *StreamManager) handleListPins(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pins":     sm.pins.List(),
+		"reserved": sm.pins.Reserved(),
+		"streams":  sm.streams.Load(),
+	})
+}
+
+// handlePin will keep a video's segments in the cache over other videos',
+// the origin calls it when the video is pinned or unpinned
+func (e *Edge) handlePin(w http.ResponseWriter, r *http.Request) {
+	if !validClusterSecret(r) {
+		writeError(w, http.StatusUnauthorized, "cluster secret required")
+		return
+	}
+	var req struct {
+		ID     string     `json:"id"`
+		Pinned bool       `json:"pinned"`
+		Until  *time.Time `json:"until"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.ID == "" {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var err error
+	if req.Pinned {
+		err = e.sm.pins.Put(Pin{VideoID: req.ID, PinnedAt: time.Now().UTC(), Until: req.Until}, nil)
+	} else if err = e.sm.pins.Delete(req.ID); err == ErrNotFound {
+		err = nil
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save pins")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// a subtitle track offered by the player page
+type playerTrack struct {
+	Lang string
+	Src  string
+}
+
+type playerPage struct {
+	VideoID string
+	Title   string
+	Src     string
+	Events  string
+	Tracks  []playerTrack
+	// webvtt chapters track and the list of chapters to jump to, empty
+	// when the video has none
+	ChaptersSrc string
+	Chapters    []Chapter
+	// still from the video's preview moment, see previews.go
+	Poster  string
+	NoIndex bool
+	// link preview tags, nil when the video opted out of unfurling
+	Unfurl *playerUnfurl
+	// playback session started by the page, the media requests carry it
+	Session   string
+	SessionID string
+}
+
+// open graph details for link previews
+type playerUnfurl struct {
+	URL   string
+	Video string
+	Image string
+}
+
+// the embedded player, it reports fatal media errors back to /api/beacon together
+// with a playback session id so they can be matched with the server logs
+var playerTemplate = template.Must(template.New("player").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+{{if .NoIndex}}<meta name="robots" content="noindex, nofollow">
+{{end}}{{with .Unfurl}}<meta property="og:type" content="video.other">
+<meta property="og:title" content="{{$.Title}}">
+<meta property="og:url" content="{{.URL}}">
+{{if .Video}}<meta property="og:video" content="{{.Video}}">
+<meta property="og:video:type" content="video/mp4">
+{{end}}{{if .Image}}<meta property="og:image" content="{{.Image}}">
+{{end}}<meta name="twitter:card" content="summary">
+{{end}}<style>body{margin:0;background:#000}video{width:100vw;height:100vh}#viewers{position:fixed;top:8px;right:12px;color:#fff;font:13px sans-serif;opacity:.7}#chapters{position:fixed;top:8px;left:12px;max-height:60vh;overflow:auto;font:13px sans-serif}#chapters button{display:flex;align-items:center;gap:6px;margin:0 0 4px;border:0;border-radius:3px;padding:3px 6px;background:rgba(0,0,0,.6);color:#fff;opacity:.7;cursor:pointer}#chapters button:hover,#chapters button.current{opacity:1}#chapters img{height:24px}</style>
+</head>
+<body>
+<video id="player" controls preload="metadata" data-video="{{.VideoID}}" data-src="{{.Src}}" data-events="{{.Events}}" data-sid="{{.SessionID}}" data-ps="{{.Session}}"{{if .Poster}} poster="{{.Poster}}"{{end}}>
+{{range .Tracks}}<track kind="subtitles" srclang="{{.Lang}}" label="{{.Lang}}" src="{{.Src}}">
+{{end}}{{with .ChaptersSrc}}<track kind="chapters" srclang="en" label="Chapters" src="{{.}}" default>
+{{end}}</video>
+<div id="viewers"></div>
+{{with .Chapters}}<nav id="chapters">
+{{range .}}<button type="button" data-start="{{.Start}}" data-end="{{.End}}">{{with .Thumbnail}}<img src="{{.}}" alt="">{{end}}{{.Name}}</button>
+{{end}}</nav>
+{{end}}<script>
+(function () {
+  var video = document.getElementById("player");
+  var sid = video.dataset.sid || ((window.crypto && crypto.randomUUID) ? crypto.randomUUID() : String(Math.random()).slice(2));
+  var src = video.dataset.src;
+  video.src = src + (src.indexOf("?") === -1 ? "?" : "&") + "sid=" + encodeURIComponent(sid);
+  if (video.dataset.ps) video.src += "&ps=" + encodeURIComponent(video.dataset.ps);
+
+  // jump to a chapter, and highlight the one playing
+  var chapters = document.querySelectorAll("#chapters button");
+  chapters.forEach(function (button) {
+    button.addEventListener("click", function () {
+      video.currentTime = parseFloat(button.dataset.start);
+      video.play();
+    });
+  });
+  video.addEventListener("timeupdate", function () {
+    chapters.forEach(function (button) {
+      var current = video.currentTime >= parseFloat(button.dataset.start) && video.currentTime < parseFloat(button.dataset.end);
+      button.classList.toggle("current", current);
+    });
+  });
+
+  function buffered() {
+    var out = [];
+    for (var i = 0; i < video.buffered.length; i++) {
+      out.push(video.buffered.start(i).toFixed(2) + "-" + video.buffered.end(i).toFixed(2));
+    }
+    return out.join(",");
+  }
+
+  // live viewer count, and following the host when opened with ?party=
+  if (window.EventSource) {
+    var params = new URLSearchParams(location.search);
+    var events = video.dataset.events + "?";
+    if (params.get("party")) events += "party=" + encodeURIComponent(params.get("party")) + "&";
+    if (params.get("token")) events += "token=" + encodeURIComponent(params.get("token"));
+    var es = new EventSource(events);
+    es.addEventListener("viewers", function (e) {
+      var n = JSON.parse(e.data).viewers;
+      document.getElementById("viewers").textContent = n + (n === 1 ? " viewer" : " viewers");
+    });
+    es.addEventListener("party", function (e) {
+      var state = JSON.parse(e.data);
+      var position = state.position;
+      if (state.action === "play") position += (Date.now() - Date.parse(state.sent_at)) / 1000;
+      if (Math.abs(video.currentTime - position) > 1) video.currentTime = position;
+      if (state.action === "play") video.play(); else if (state.action === "pause") video.pause();
+    });
+  }
+
+  video.addEventListener("error", function () {
+    var err = video.error || {};
+    var body = JSON.stringify({
+      session_id: sid,
+      video_id: video.dataset.video,
+      code: err.code || 0,
+      message: err.message || "",
+      current_time: video.currentTime,
+      buffered: buffered()
+    });
+    if (navigator.sendBeacon) {
+      navigator.sendBeacon("/api/beacon", new Blob([body], {type: "application/json"}));
+    } else {
+      fetch("/api/beacon", {method: "POST", body: body, keepalive: true});
+    }
+  });
+})();
+</script>
+</body>
+</html>
+`))
+
+// handlePlayer will serve the embedded player page for a video
+func (sm *StreamManager) handlePlayer(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r)
+	rawID := r.PathValue("id")
+	if rawID == "" {
+		writeError(w, http.StatusBadRequest, "fileid is missing")
+		return
+	}
+
+	// the page has no secrets, but the media urls need the viewer's token
+	suffix := ""
+	if token := r.URL.Query().Get("token"); token != "" {
+		suffix = "&token=" + url.QueryEscape(token)
+	}
+
+	fileID := tenant.VideoID(rawID)
+	video, _ := sm.metadata.GetVideo(fileID)
+
+	// videos that opted out of link previews don't show their title to unfurl bots at all
+	if video.NoUnfurl && isUnfurlBot(r.UserAgent()) {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+
+	page := playerPage{
+		VideoID: rawID,
+		Title:   rawID,
+		Src:     tenant.Path("/api/watch") + "?id=" + url.QueryEscape(rawID) + suffix,
+		Events:  tenant.Path("/api/videos/" + url.PathEscape(rawID) + "/events"),
+		NoIndex: video.NoIndex,
+	}
+	if video.Title != "" {
+		page.Title = video.Title
+	}
+	if video.Available() {
+		page.Poster = tenant.Path("/api/videos/"+url.PathEscape(rawID)+"/poster.jpg") + strings.Replace(suffix, "&", "?", 1)
+	}
+	if video.ID != "" {
+		token, session := sm.diagnostics.playback.Issue(rawID, tenant.ID)
+		page.Session, page.SessionID = token, session.ID
+	}
+	if !video.NoUnfurl {
+		base := baseURL(r)
+		page.Unfurl = &playerUnfurl{URL: base + tenant.Path("/watch/"+url.PathEscape(rawID))}
+		// never put a viewer's token into a preview
+		if suffix == "" {
+			page.Unfurl.Video = base + page.Src
+			if page.Poster != "" {
+				page.Unfurl.Image = base + page.Poster
+			}
+		}
+	}
+	if video.NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	// pin the current version so the video bytes can be cached as immutable
+	if info, err := sm.statLocalVideo(fileID); err == nil {
+		page.Src += "&v=" + strings.Trim(videoETag(video, info), `"`)
+	}
+
+	if isSafeName(rawID) {
+		matches, _ := filepath.Glob(filepath.Join(VideoStoragePath, fileID+".*.vtt"))
+		for _, match := range matches {
+			lang := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(match), rawID+"."), ".vtt")
+			page.Tracks = append(page.Tracks, playerTrack{
+				Lang: lang,
+				Src:  tenant.Path("/api/subtitles") + "?id=" + rawID + "&lang=" + lang + suffix,
+			})
+		}
+	}
+
+	if len(video.Chapters) > 0 && video.Available() {
+		page.Chapters = video.Chapters
+		page.ChaptersSrc = tenant.Path("/api/videos/"+url.PathEscape(rawID)+"/chapters.vtt") + strings.Replace(suffix, "&", "?", 1)
+	}
+
+	setCachePolicy(w, r, CachePage, "")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	playerTemplate.Execute(w, page)
+}
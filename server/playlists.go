@@ -0,0 +1,311 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// an entry of the aggregate playlist manifest
+type playlistEntry struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	Size  int64  `json:"size"`
+}
+
+// handleListPlaylists will list the tenant's playlists
+func (sm *StreamManager) handleListPlaylists(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sm.metadata.ListPlaylists(tenantFrom(r).ID))
+}
+
+// handleCreatePlaylist will create a named playlist, optionally with videos
+func (sm *StreamManager) handleCreatePlaylist(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		VideoIDs    []string `json:"video_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if err := sm.checkVideosExist(r, req.VideoIDs); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	playlist, err := sm.metadata.CreatePlaylist(Playlist{
+		ID:          newID(),
+		Tenant:      tenantFrom(r).ID,
+		Name:        req.Name,
+		Description: req.Description,
+		VideoIDs:    req.VideoIDs,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save playlist")
+		return
+	}
+	writeJSON(w, http.StatusCreated, playlist)
+}
+
+// handleGetPlaylist will return a single playlist
+func (sm *StreamManager) handleGetPlaylist(w http.ResponseWriter, r *http.Request) {
+	playlist, err := sm.tenantPlaylist(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "playlist not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, playlist)
+}
+
+// handleUpdatePlaylist will rename a playlist or change its description
+func (sm *StreamManager) handleUpdatePlaylist(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		writeError(w, http.StatusBadRequest, "name can't be empty")
+		return
+	}
+
+	sm.writePlaylistUpdate(w, r, func(playlist *Playlist) error {
+		if req.Name != nil {
+			playlist.Name = *req.Name
+		}
+		if req.Description != nil {
+			playlist.Description = *req.Description
+		}
+		return nil
+	})
+}
+
+// handleDeletePlaylist will delete a playlist, the videos are untouched
+func (sm *StreamManager) handleDeletePlaylist(w http.ResponseWriter, r *http.Request) {
+	if _, err := sm.tenantPlaylist(r); err != nil {
+		writeError(w, http.StatusNotFound, "playlist not found")
+		return
+	}
+	if err := sm.metadata.DeletePlaylist(r.PathValue("id")); err != nil {
+		if err == ErrNotFound {
+			writeError(w, http.StatusNotFound, "playlist not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to delete playlist")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAddPlaylistVideo will insert a video at position (appends when missing)
+func (sm *StreamManager) handleAddPlaylistVideo(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		VideoID  string `json:"video_id"`
+		Position *int   `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := sm.checkVideosExist(r, []string{req.VideoID}); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sm.writePlaylistUpdate(w, r, func(playlist *Playlist) error {
+		position := len(playlist.VideoIDs)
+		if req.Position != nil {
+			position = *req.Position
+		}
+		if position < 0 || position > len(playlist.VideoIDs) {
+			return fmt.Errorf("position out of range")
+		}
+		playlist.VideoIDs = append(playlist.VideoIDs[:position], append([]string{req.VideoID}, playlist.VideoIDs[position:]...)...)
+		return nil
+	})
+}
+
+// handleRemovePlaylistVideo will remove every occurrence of a video from a playlist
+func (sm *StreamManager) handleRemovePlaylistVideo(w http.ResponseWriter, r *http.Request) {
+	videoID := r.PathValue("videoID")
+	sm.writePlaylistUpdate(w, r, func(playlist *Playlist) error {
+		kept := playlist.VideoIDs[:0]
+		for _, id := range playlist.VideoIDs {
+			if id != videoID {
+				kept = append(kept, id)
+			}
+		}
+		if len(kept) == len(playlist.VideoIDs) {
+			return fmt.Errorf("video is not in the playlist")
+		}
+		playlist.VideoIDs = kept
+		return nil
+	})
+}
+
+// handleReorderPlaylist will replace the order of a playlist, the new order must
+// contain exactly the same videos
+func (sm *StreamManager) handleReorderPlaylist(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		VideoIDs []string `json:"video_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	sm.writePlaylistUpdate(w, r, func(playlist *Playlist) error {
+		counts := make(map[string]int)
+		for _, id := range playlist.VideoIDs {
+			counts[id]++
+		}
+		for _, id := range req.VideoIDs {
+			counts[id]--
+		}
+		for _, n := range counts {
+			if n != 0 {
+				return fmt.Errorf("video_ids must be a reordering of the current playlist")
+			}
+		}
+		playlist.VideoIDs = req.VideoIDs
+		return nil
+	})
+}
+
+// handlePlaylistManifest will serve the playlist as json or m3u for client apps
+func (sm *StreamManager) handlePlaylistManifest(w http.ResponseWriter, r *http.Request) {
+	playlist, err := sm.tenantPlaylist(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "playlist not found")
+		return
+	}
+
+	tenant := tenantFrom(r)
+	base := baseURL(r) + tenant.Path("/api/watch")
+	entries := make([]playlistEntry, 0, len(playlist.VideoIDs))
+	for _, id := range playlist.VideoIDs {
+		// videos deleted since they were added are skipped, and ids that
+		// could reach another tenant's videos
+		if !isSafeName(id) {
+			continue
+		}
+		video, ok := sm.metadata.GetVideo(tenant.VideoID(id))
+		if !ok || !inTenant(video.Tenant, tenant.ID) {
+			continue
+		}
+		title := video.Title
+		if title == "" {
+			title = video.ID
+		}
+		entries = append(entries, playlistEntry{
+			ID:    video.ID,
+			Title: title,
+			URL:   base + "?id=" + url.QueryEscape(video.ID),
+			Size:  video.Size,
+		})
+	}
+
+	setCachePolicy(w, r, CacheManifest, "")
+
+	switch r.PathValue("format") {
+	case "manifest.json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":      playlist.ID,
+			"name":    playlist.Name,
+			"entries": entries,
+		})
+	case "manifest.m3u":
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+		fmt.Fprintf(w, "#EXTM3U\n#PLAYLIST:%s\n", oneLine(playlist.Name))
+		for _, entry := range entries {
+			fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", oneLine(entry.Title), entry.URL)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "unknown manifest format")
+	}
+}
+
+// tenantPlaylist will return the playlist in the path, other tenants' playlists are not found
+func (sm *StreamManager) tenantPlaylist(r *http.Request) (Playlist, error) {
+	playlist, err := sm.metadata.GetPlaylist(r.PathValue("id"))
+	if err != nil {
+		return Playlist{}, err
+	}
+	if !inTenant(playlist.Tenant, tenantFrom(r).ID) {
+		return Playlist{}, ErrNotFound
+	}
+	return playlist, nil
+}
+
+// writePlaylistUpdate will run an update on the playlist in the path and write the result or the error
+func (sm *StreamManager) writePlaylistUpdate(w http.ResponseWriter, r *http.Request, update func(playlist *Playlist) error) {
+	tenantID := tenantFrom(r).ID
+	playlist, err := sm.metadata.UpdatePlaylist(r.PathValue("id"), func(playlist *Playlist) error {
+		if !inTenant(playlist.Tenant, tenantID) {
+			return ErrNotFound
+		}
+		return update(playlist)
+	})
+	if err != nil {
+		if err == ErrNotFound {
+			writeError(w, http.StatusNotFound, "playlist not found")
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, playlist)
+}
+
+// checkVideosExist will make sure every id is a known video of the tenant,
+// an id with a slash would name another tenant's
+func (sm *StreamManager) checkVideosExist(r *http.Request, ids []string) error {
+	tenant := tenantFrom(r)
+	for _, id := range ids {
+		if !isSafeName(id) {
+			return fmt.Errorf("invalid video id %q", id)
+		}
+		if video, ok := sm.metadata.GetVideo(tenant.VideoID(id)); !ok || !inTenant(video.Tenant, tenant.ID) {
+			return fmt.Errorf("video %q not found", id)
+		}
+	}
+	return nil
+}
+
+// baseURL will return scheme://host of the request for building absolute urls
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if TrustProxyHeaders {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+// oneLine will keep user supplied text from breaking line based formats
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+var (
+	// how long a presigned upload url works when the request doesn't say
+	PresignTTL = envDuration("PRESIGN_TTL", 15*time.Minute)
+	// and the longest it can ask for
+	PresignMaxTTL = envDuration("PRESIGN_MAX_TTL", 24*time.Hour)
+)
+
+type presignContextKey struct{}
+
+// handlePresignUpload will mint a url a browser can upload one file to
+// without an api key of its own. it is bound to the id, a max size and a
+// content type, and stops working once the upload completes or it expires
+func (sm *StreamManager) handlePresignUpload(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID          string `json:"id"`
+		MaxSize     int64  `json:"max_size"`
+		ContentType string `json:"content_type"`
+		TTL         string `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !isSafeName(req.ID) {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	if req.MaxSize <= 0 || (MaxUploadSize > 0 && req.MaxSize > MaxUploadSize) {
+		writeError(w, http.StatusBadRequest, "max_size must be positive and at most the upload limit")
+		return
+	}
+	if !uploadContentType(req.ContentType) {
+		writeError(w, http.StatusBadRequest, "content_type must be a video, audio or image type we store")
+		return
+	}
+	ttl := PresignTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 || ttl > PresignMaxTTL {
+			writeError(w, http.StatusBadRequest, "ttl must be a positive duration up to "+PresignMaxTTL.String())
+			return
+		}
+	}
+
+	tenant := tenantFrom(r)
+	// a presigned url doesn't replace what is there
+	if _, ok := sm.metadata.GetVideo(tenant.VideoID(req.ID)); ok {
+		writeError(w, http.StatusConflict, "a video with this id already exists")
+		return
+	}
+	claims := TokenClaims{Scope: ScopePresigned, VideoID: req.ID, Subject: sm.tokens.Subject(r), MaxSize: req.MaxSize, ContentType: req.ContentType}
+	if tenant.ID != DefaultTenantID {
+		claims.Tenant = tenant.ID
+	}
+	token, claims, err := sm.tokens.Issue(claims, ttl)
+	if err == ErrTokenUnsigned {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to presign upload")
+		return
+	}
+	auditAs(r, "", req.ID, "presigned "+claims.ID)
+
+	query := url.Values{"id": {req.ID}, "token": {token}}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"url":          publicBase(r) + "/api/upload?" + query.Encode(),
+		"method":       http.MethodPost,
+		"headers":      map[string]string{"Content-Type": req.ContentType},
+		"id":           req.ID,
+		"max_size":     req.MaxSize,
+		"content_type": req.ContentType,
+		"expires_at":   time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+// uploadContentType reports whether files of contentType can be stored
+func uploadContentType(contentType string) bool {
+	for _, format := range mediaFormats {
+		if format.contentType == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireUpload will wrap the routes of an upload like Require(ScopeUpload),
+// and also let a presigned url through for the one upload it is for
+func (ts *TokenStore) RequireUpload(next http.HandlerFunc) http.HandlerFunc {
+	upload := ts.Require(ScopeUpload, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ts.Signs() {
+			upload(w, r)
+			return
+		}
+		// anything else, a used up url included, gets the usual answer
+		claims, err := ts.Verify(tokenFromRequest(r))
+		if err != nil || claims.Scope != ScopePresigned {
+			upload(w, r)
+			return
+		}
+		if claims.VideoID != requestedVideoID(r) || !inTenant(claims.Tenant, tenantFrom(r).ID) {
+			writeError(w, http.StatusForbidden, ErrTokenScope.Error())
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), presignContextKey{}, claims)))
+	}
+}
+
+// presignedUpload will return the claims of the presigned url a request
+// came with
+func presignedUpload(r *http.Request) (TokenClaims, bool) {
+	claims, ok := r.Context().Value(presignContextKey{}).(TokenClaims)
+	return claims, ok
+}
+
+// checkPresignedChunk will check a chunk sent to a presigned url is the
+// content type it was made for
+func checkPresignedChunk(w http.ResponseWriter, r *http.Request, claims TokenClaims) bool {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != claims.ContentType {
+		writeError(w, http.StatusUnsupportedMediaType, "this upload url is for "+claims.ContentType)
+		return false
+	}
+	return true
+}
+
+// checkPresignedFile will check the finished file of a presigned upload is
+// what it was made for, a file that isn't is thrown away so the url can be
+// used again. caller holds mu
+func (sm *StreamManager) checkPresignedFile(w http.ResponseWriter, s *UploadSession, claims TokenClaims) bool {
+	format, err := sniffMedia(s.FileName)
+	if err == nil && mediaFormats[format].contentType == claims.ContentType {
+		return true
+	}
+	s.finish()
+	os.Remove(s.FileName)
+	sm.uploadSessions.Delete(s.FileID)
+	writeError(w, http.StatusUnsupportedMediaType, "the file isn't "+claims.ContentType+", upload it again")
+	return false
+}
+
+// uploadLimit is the most an upload may be, a presigned url's max size
+// under the server's own limit
+func uploadLimit(r *http.Request) int64 {
+	limit := MaxUploadSize
+	if claims, ok := presignedUpload(r); ok && (limit <= 0 || claims.MaxSize < limit) {
+		limit = claims.MaxSize
+	}
+	return limit
+}
+
+// presignUsed will make a presigned url's token unusable once its upload is in
+func (sm *StreamManager) presignUsed(claims TokenClaims) {
+	if err := sm.tokens.RevokeID(claims.ID); err != nil {
+		log.Println("failed to revoke used presigned upload", claims.ID, err)
+	}
+}
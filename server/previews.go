@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// sessions a video needs before its heatmap picks the preview moment,
+	// before that it is a tenth into the video
+	PreviewMinSessions = envInt64("PREVIEW_MIN_SESSIONS", 20)
+	// how often preview moments are picked again as views come in
+	PreviewRefresh = envDuration("PREVIEW_REFRESH", 6*time.Hour)
+	// make the poster and preview when an upload becomes ready and when
+	// its moment moves, instead of on their first request
+	PreviewEager = envBool("PREVIEW_EAGER", false)
+)
+
+const (
+	// length of the animated preview
+	previewLength = 3 * time.Second
+	// how long making a poster or a preview may take
+	previewTimeout = 5 * time.Minute
+)
+
+// a still or animated image of a video, made from its preview moment
+type previewFormat struct {
+	ext         string
+	contentType string
+	args        func(at time.Duration) []string
+}
+
+var previewFormats = map[string]previewFormat{
+	"poster": {
+		ext:         "jpg",
+		contentType: "image/jpeg",
+		args: func(at time.Duration) []string {
+			return []string{"-ss", formatSeconds(at), "-frames:v", "1", "-q:v", "3", "-f", "mjpeg"}
+		},
+	},
+	"preview": {
+		ext:         "webp",
+		contentType: "image/webp",
+		args: func(at time.Duration) []string {
+			return []string{"-ss", formatSeconds(at), "-t", formatSeconds(previewLength),
+				"-vf", "fps=10,scale=480:-2", "-an", "-c:v", "libwebp", "-q:v", "60", "-loop", "0", "-f", "webp"}
+		},
+	},
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// previewPath is where a video's poster or preview is kept, next to the video
+func previewPath(fileID string, name string, format previewFormat) string {
+	return filepath.Join(VideoStoragePath, fileID+"."+name+"."+format.ext)
+}
+
+// previewAt is the moment of a video its poster and preview show
+func previewAt(video VideoRecord) time.Duration {
+	at := video.Duration / 10
+	if video.PreviewAt != nil {
+		at = *video.PreviewAt
+	}
+	// the preview has to fit before the end
+	at = min(at, video.Duration-previewLength.Seconds())
+	return time.Duration(max(at, 0) * float64(time.Second))
+}
+
+// pickPreviewMoment will find where in a video viewers jump to and rewatch,
+// as a bucket of the heatmap. every session starts at the beginning and
+// drops off from there, so a bucket counts by how far it rises over the
+// lowest point before it. false when nothing stands out
+func pickPreviewMoment(heatmap []int64) (int, bool) {
+	best, bestScore := 0, int64(0)
+	if len(heatmap) == 0 {
+		return 0, false
+	}
+	lowest := heatmap[0]
+	for bucket := 1; bucket < len(heatmap); bucket++ {
+		lowest = min(lowest, heatmap[bucket])
+		if score := heatmap[bucket] - lowest; score > bestScore {
+			best, bestScore = bucket, score
+		}
+	}
+	return best, bestScore > 0
+}
+
+// handlePreview will serve a video's poster (jpeg) or animated preview (webp),
+// made on the first request
+func (sm *StreamManager) handlePreview(name string) http.HandlerFunc {
+	format := previewFormats[name]
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+		video, ok := sm.metadata.GetVideo(fileID)
+		if !ok || !video.Available() {
+			writeError(w, http.StatusNotFound, "video not found")
+			return
+		}
+		// uploaded poster art goes before a frame of the video, one that was
+		// deleted since falls back to the frame
+		if poster, ok := sm.tenantImage(video, video.Poster); ok && name == "poster" && video.Poster != "" {
+			sm.servePosterArt(w, r, poster)
+			return
+		}
+		if !video.IsVideo() {
+			writeError(w, http.StatusNotFound, "only videos have a "+name)
+			return
+		}
+
+		ctx, cancel := renditionContext(r.Context())
+		defer cancel()
+		if err := sm.makePreview(ctx, video, name, format, PriorityViewer); err != nil {
+			switch {
+			case stillProcessing(r, err):
+				writeProcessing(w, r)
+			case errors.Is(err, exec.ErrNotFound):
+				writeError(w, http.StatusServiceUnavailable, "previews need ffmpeg")
+			case r.Context().Err() != nil:
+			default:
+				log.Println("failed to make", name, fileID, err)
+				writeError(w, http.StatusInternalServerError, "failed to make "+name)
+			}
+			return
+		}
+
+		plain, err := os.Open(previewPath(fileID, name, format))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to open "+name)
+			return
+		}
+		file, err := sm.keys.Open(plain)
+		if err != nil {
+			plain.Close()
+			log.Println("failed to decrypt", name, fileID, err)
+			writeError(w, http.StatusInternalServerError, "failed to open "+name)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to open "+name)
+			return
+		}
+
+		setCachePolicy(w, r, CacheContent, strongETag(info))
+		w.Header().Set("ETag", strongETag(info))
+		w.Header().Set("Content-Type", format.contentType)
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	}
+}
+
+// makePreview will make sure the poster or preview exists, waiting for it
+// when it is being made already
+func (sm *StreamManager) makePreview(ctx context.Context, video VideoRecord, name string, format previewFormat, priority int) error {
+	path := previewPath(video.Key(), name, format)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	job := &TranscodeJob{Kind: name, VideoID: video.Key(), Priority: priority, Duration: previewLength.Seconds()}
+	return sm.buildOnce(ctx, path, job, func(ctx context.Context) error {
+		return sm.runPreview(ctx, video, format, path)
+	})
+}
+
+func (sm *StreamManager) runPreview(ctx context.Context, video VideoRecord, format previewFormat, path string) error {
+	if _, err := exec.LookPath(FFmpegPath); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+
+	source, cleanup, err := sm.localVideoPath(ctx, video.Key())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	output := filepath.Join(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	defer os.Remove(output)
+
+	// seeking before the input is fast and lands on the frame asked for
+	args := format.args(previewAt(video))
+	args = append([]string{"-hide_banner", "-nostats", "-y", args[0], args[1], "-i", source}, args[2:]...)
+	args = append(args, output)
+	if out, err := exec.CommandContext(ctx, FFmpegPath, args...).CombinedOutput(); err != nil {
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		return fmt.Errorf("ffmpeg failed: %s", lines[len(lines)-1])
+	}
+	if err := sm.keys.EncryptFile(output); err != nil {
+		return err
+	}
+	return os.Rename(output, path)
+}
+
+// removePreviews will delete a video's poster and preview
+func removePreviews(fileID string) {
+	for name, format := range previewFormats {
+		os.Remove(previewPath(fileID, name, format))
+	}
+}
+
+// refreshPreviews will move each video's preview moment to where its viewers
+// rewatch, once it has enough sessions. the poster and preview of a video
+// whose moment moved are made again on their next request, or right away
+// with PREVIEW_EAGER
+func (sm *StreamManager) refreshPreviews(ctx context.Context) {
+	for _, video := range sm.metadata.AllVideos() {
+		if ctx.Err() != nil {
+			return
+		}
+		if !video.Available() || video.Duration <= 0 {
+			continue
+		}
+		report := sm.analytics.Report(video)
+		if report.Sessions < PreviewMinSessions {
+			continue
+		}
+		bucket, ok := pickPreviewMoment(report.Heatmap)
+		if !ok {
+			continue
+		}
+		at := float64(bucket) * video.Duration / float64(len(report.Heatmap))
+		// a bucket's worth of drift isn't worth new images
+		if video.PreviewAt != nil && math.Abs(*video.PreviewAt-at) < video.Duration/float64(len(report.Heatmap))*2 {
+			continue
+		}
+		if err := sm.metadata.UpdateVideo(video.Key(), func(video *VideoRecord) {
+			video.PreviewAt = &at
+		}); err != nil {
+			log.Println("failed to save preview moment", video.Key(), err)
+			continue
+		}
+		log.Println("moved preview of", video.Key(), "to", formatSeconds(time.Duration(at*float64(time.Second))))
+		removePreviews(video.Key())
+		if PreviewEager {
+			if err := sm.jobs.Enqueue(JobMakePreview, video.Key(), nil); err != nil {
+				log.Println("failed to queue", JobMakePreview, video.Key(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// one stream as reported by ffprobe
+type ProbeStream struct {
+	Index     int    `json:"index"`
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	// progressive, or tt / bb / tb / bt for interlaced video
+	FieldOrder   string `json:"field_order,omitempty"`
+	AvgFrameRate string `json:"avg_frame_rate,omitempty"`
+	// bits per second, not every container has it per stream
+	BitRate  string `json:"bit_rate,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+}
+
+// Interlaced reports whether the stream is stored as fields
+func (s ProbeStream) Interlaced() bool {
+	switch s.FieldOrder {
+	case "tt", "bb", "tb", "bt":
+		return true
+	}
+	return false
+}
+
+// FrameRate will return the average frames per second, 0 when unknown
+func (s ProbeStream) FrameRate() float64 {
+	return parseFrameRate(s.AvgFrameRate)
+}
+
+// parseFrameRate will parse a rate ffmpeg style, "25" or "30000/1001"
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// ProbeResult is the part of ffprobe's output we care about
+type ProbeResult struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// Duration will return the container duration in seconds, 0 when unknown
+func (p *ProbeResult) Duration() float64 {
+	d, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return d
+}
+
+// BitRate will return the bits per second of the whole file, 0 when unknown
+func (p *ProbeResult) BitRate() int64 {
+	rate, _ := strconv.ParseInt(p.Format.BitRate, 10, 64)
+	return rate
+}
+
+// VideoStream will return the first video stream, if there is one
+func (p *ProbeResult) VideoStream() (ProbeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "video" {
+			return stream, true
+		}
+	}
+	return ProbeStream{}, false
+}
+
+// AudioStream will return the first audio stream, if there is one
+func (p *ProbeResult) AudioStream() (ProbeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "audio" {
+			return stream, true
+		}
+	}
+	return ProbeStream{}, false
+}
+
+// probeMedia will run ffprobe on a file
+func probeMedia(ctx context.Context, path string) (*ProbeResult, error) {
+	cmd := exec.CommandContext(ctx, FFprobePath,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("ffprobe: %s", exitErr.Stderr)
+		}
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	var result ProbeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return &result, nil
+}
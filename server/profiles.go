@@ -0,0 +1,479 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProfileName is the profile used when neither the video nor its tenant names one
+const DefaultProfileName = "default"
+
+var ErrProfileInUse = errors.New("profile is in use")
+
+// ffmpeg encoders of the codecs a profile may use
+var videoEncoders = map[string]string{
+	"h264": "libx264",
+	"hevc": "libx265",
+	"vp9":  "libvpx-vp9",
+	"av1":  "libsvtav1",
+}
+
+var audioEncoders = map[string]string{
+	"aac":  "aac",
+	"opus": "libopus",
+	"mp3":  "libmp3lame",
+}
+
+// TranscodeProfile is a named set of renditions and how to encode them
+type TranscodeProfile struct {
+	Name       string      `json:"name"`
+	Renditions []Rendition `json:"renditions"`
+	// x264/x265 speed preset, faster presets make bigger files
+	Preset string `json:"preset,omitempty"`
+	// hls segment length and container (ts or fmp4)
+	SegmentSeconds int    `json:"segment_seconds"`
+	SegmentFormat  string `json:"segment_format"`
+	// on, off, or auto to deinterlace sources probed as interlaced
+	Deinterlace string `json:"deinterlace"`
+	// output frame rate: empty keeps the source's, auto moves odd rates
+	// (variable rate phone video, 29.87) to the nearest standard one, or a
+	// rate like 25 or 30000/1001
+	FrameRate string `json:"frame_rate,omitempty"`
+	// hls (and dash for fmp4) of every rendition the source is big enough
+	// for, players switch between them. without it the source is copied
+	// into a single stream, see abr.go
+	ABR       bool      `json:"abr,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// frame rates players and displays expect
+var standardFrameRates = []string{"24000/1001", "24", "25", "30000/1001", "30", "50", "60000/1001", "60"}
+
+// Rendition is one output of a profile, quality is either constant (crf) or
+// a target bitrate
+type Rendition struct {
+	Name         string `json:"name"`
+	Height       int    `json:"height"`
+	VideoCodec   string `json:"video_codec"`
+	CRF          int    `json:"crf,omitempty"`
+	VideoBitrate string `json:"video_bitrate,omitempty"`
+	AudioCodec   string `json:"audio_codec"`
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+}
+
+// the profile used until an admin changes it
+func builtinProfile() TranscodeProfile {
+	return TranscodeProfile{
+		Name: DefaultProfileName,
+		Renditions: []Rendition{
+			{Name: "1080p", Height: 1080, VideoCodec: "h264", CRF: 21, AudioCodec: "aac", AudioBitrate: "192k"},
+			{Name: "720p", Height: 720, VideoCodec: "h264", CRF: 22, AudioCodec: "aac", AudioBitrate: "128k"},
+			{Name: "480p", Height: 480, VideoCodec: "h264", CRF: 23, AudioCodec: "aac", AudioBitrate: "96k"},
+			{Name: "360p", Height: 360, VideoCodec: "h264", CRF: 24, AudioCodec: "aac", AudioBitrate: "96k"},
+		},
+		Preset:         "veryfast",
+		SegmentSeconds: 6,
+		SegmentFormat:  "fmp4",
+		Deinterlace:    "auto",
+	}
+}
+
+// Validate will check a profile can be encoded
+func (p *TranscodeProfile) Validate() error {
+	if !isSafeName(p.Name) {
+		return errors.New("invalid profile name")
+	}
+	if len(p.Renditions) == 0 {
+		return errors.New("a profile needs at least one rendition")
+	}
+	if p.SegmentSeconds == 0 {
+		p.SegmentSeconds = 6
+	}
+	if p.SegmentSeconds < 1 || p.SegmentSeconds > 60 {
+		return errors.New("segment_seconds must be between 1 and 60")
+	}
+	if p.SegmentFormat == "" {
+		p.SegmentFormat = "fmp4"
+	}
+	if p.SegmentFormat != "ts" && p.SegmentFormat != "fmp4" {
+		return errors.New("segment_format must be ts or fmp4")
+	}
+	if p.Deinterlace == "" {
+		p.Deinterlace = "off"
+	}
+	if p.Deinterlace != "on" && p.Deinterlace != "off" && p.Deinterlace != "auto" {
+		return errors.New("deinterlace must be on, off or auto")
+	}
+	if rate := parseFrameRate(p.FrameRate); p.FrameRate != "" && p.FrameRate != "auto" && (rate <= 0 || rate > 240) {
+		return errors.New("frame_rate must be auto or a rate like 25 or 30000/1001")
+	}
+
+	names := make(map[string]bool)
+	for i := range p.Renditions {
+		rendition := &p.Renditions[i]
+		if rendition.Name == "" {
+			rendition.Name = strconv.Itoa(rendition.Height) + "p"
+		}
+		if !isSafeName(rendition.Name) || names[rendition.Name] {
+			return fmt.Errorf("invalid or duplicate rendition name %q", rendition.Name)
+		}
+		if p.ABR && rendition.Name == abrAudioName {
+			return fmt.Errorf("rendition name %q is the audio of abr packages", abrAudioName)
+		}
+		names[rendition.Name] = true
+
+		if rendition.Height < 144 || rendition.Height > 4320 || rendition.Height%2 != 0 {
+			return fmt.Errorf("rendition %s: height must be even and between 144 and 4320", rendition.Name)
+		}
+		if rendition.VideoCodec == "" {
+			rendition.VideoCodec = "h264"
+		}
+		if _, ok := videoEncoders[rendition.VideoCodec]; !ok {
+			return fmt.Errorf("rendition %s: video_codec must be h264, hevc, vp9 or av1", rendition.Name)
+		}
+		if rendition.AudioCodec == "" {
+			rendition.AudioCodec = "aac"
+		}
+		if _, ok := audioEncoders[rendition.AudioCodec]; !ok {
+			return fmt.Errorf("rendition %s: audio_codec must be aac, opus or mp3", rendition.Name)
+		}
+		if rendition.CRF == 0 && rendition.VideoBitrate == "" {
+			rendition.CRF = 23
+		}
+		if rendition.CRF < 0 || rendition.CRF > 63 {
+			return fmt.Errorf("rendition %s: crf must be between 0 and 63", rendition.Name)
+		}
+		if !isBitrate(rendition.VideoBitrate) || !isBitrate(rendition.AudioBitrate) {
+			return fmt.Errorf("rendition %s: bitrates look like 2500k or 5M", rendition.Name)
+		}
+	}
+	return nil
+}
+
+// isBitrate reports whether s is empty or an ffmpeg bitrate like 128k or 5M
+func isBitrate(s string) bool {
+	if s == "" {
+		return true
+	}
+	digits := s
+	if last := s[len(s)-1]; last == 'k' || last == 'M' {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(digits)
+	return err == nil && n > 0
+}
+
+// Top will return the highest rendition, what single output encodes like clips use
+func (p TranscodeProfile) Top() Rendition {
+	top := p.Renditions[0]
+	for _, rendition := range p.Renditions[1:] {
+		if rendition.Height > top.Height {
+			top = rendition
+		}
+	}
+	return top
+}
+
+// Targets will return the renditions made of a source height pixels high,
+// none above it. a small source gets the top one
+func (p TranscodeProfile) Targets(height int) []Rendition {
+	var targets []Rendition
+	for _, rendition := range p.Renditions {
+		if rendition.Height <= height {
+			targets = append(targets, rendition)
+		}
+	}
+	if len(targets) == 0 {
+		targets = []Rendition{p.Top()}
+	}
+	return targets
+}
+
+// encodeArgs will return the ffmpeg video and audio encoding args of a
+// rendition of source, scaled to the rendition's height when scale is set
+// and with mark burned in when it isn't nil
+func (p TranscodeProfile) encodeArgs(rendition Rendition, source VideoRecord, mark *watermarkFilter, scale bool) []string {
+	// the gpu encoder when TRANSCODE_HWACCEL has one for the codec, the
+	// x264/x265 presets don't apply to it
+	hw, onGPU := hardwareEncoder(rendition.VideoCodec)
+	var args []string
+	filters := p.videoFilters(source)
+	height := source.Height
+	if scale {
+		filters = append(filters, "scale=-2:"+strconv.Itoa(rendition.Height))
+		height = rendition.Height
+	}
+	var upload []string
+	if onGPU {
+		upload = hw.filters
+	}
+	switch {
+	case mark != nil:
+		args = append(args, "-vf", mark.graph(height, filters, upload))
+	case len(filters)+len(upload) > 0:
+		args = append(args, "-vf", strings.Join(append(filters, upload...), ","))
+	}
+	if onGPU {
+		args = append(args, hw.args...)
+		args = append(args, "-c:v", hw.encoder)
+	} else {
+		args = append(args, "-c:v", videoEncoders[rendition.VideoCodec])
+	}
+	if p.Preset != "" && !onGPU && (rendition.VideoCodec == "h264" || rendition.VideoCodec == "hevc") {
+		args = append(args, "-preset", p.Preset)
+	}
+	if rendition.VideoBitrate != "" {
+		args = append(args, "-b:v", rendition.VideoBitrate)
+	} else if onGPU {
+		args = append(args, hw.quality, strconv.Itoa(rendition.CRF))
+	} else {
+		args = append(args, "-crf", strconv.Itoa(rendition.CRF))
+		if rendition.VideoCodec == "vp9" {
+			// vp9 is only constant quality with an unlimited bitrate
+			args = append(args, "-b:v", "0")
+		}
+	}
+	return append(args, rendition.audioArgs()...)
+}
+
+// audioArgs will return the ffmpeg audio encoding args of the rendition
+func (r Rendition) audioArgs() []string {
+	args := []string{"-c:a", audioEncoders[r.AudioCodec]}
+	if r.AudioBitrate != "" {
+		args = append(args, "-b:a", r.AudioBitrate)
+	}
+	return args
+}
+
+// videoFilters will deinterlace (a frame per frame, 29.97i becomes 29.97p)
+// and change the frame rate as the profile says
+func (p TranscodeProfile) videoFilters(source VideoRecord) []string {
+	var filters []string
+	if p.Deinterlace == "on" || p.Deinterlace == "auto" && source.Interlaced {
+		filters = append(filters, "bwdif=mode=send_frame:deint=all")
+	}
+	switch p.FrameRate {
+	case "":
+	case "auto":
+		if rate, odd := nearestFrameRate(source.FrameRate); odd {
+			filters = append(filters, "fps="+rate)
+		}
+	default:
+		// frames aren't made up for a source that has fewer
+		if source.FrameRate <= 0 || parseFrameRate(p.FrameRate) < source.FrameRate-0.01 {
+			filters = append(filters, "fps="+p.FrameRate)
+		}
+	}
+	return filters
+}
+
+// nearestFrameRate will return the standard rate closest to rate and whether
+// rate is off from it enough to play unevenly, unknown rates are left alone
+func nearestFrameRate(rate float64) (string, bool) {
+	if rate <= 0 {
+		return "", false
+	}
+	nearest := standardFrameRates[0]
+	for _, standard := range standardFrameRates[1:] {
+		if math.Abs(parseFrameRate(standard)-rate) < math.Abs(parseFrameRate(nearest)-rate) {
+			nearest = standard
+		}
+	}
+	return nearest, math.Abs(parseFrameRate(nearest)-rate) > 0.01
+}
+
+// ProfileStore keeps the transcode profiles, they are read on every use so
+// changes apply to the next job without a restart
+type ProfileStore struct {
+	path string
+
+	mu       sync.RWMutex
+	profiles map[string]TranscodeProfile
+}
+
+// NewProfileStore will load the profiles from path, the builtin default is
+// there until it is replaced
+func NewProfileStore(path string) (*ProfileStore, error) {
+	ps := &ProfileStore{path: path, profiles: make(map[string]TranscodeProfile)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &ps.profiles); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := ps.profiles[DefaultProfileName]; !ok {
+		ps.profiles[DefaultProfileName] = builtinProfile()
+	}
+	return ps, nil
+}
+
+// Get will return a profile by name
+func (ps *ProfileStore) Get(name string) (TranscodeProfile, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	profile, ok := ps.profiles[name]
+	return profile, ok
+}
+
+// List will return every profile, by name
+func (ps *ProfileStore) List() []TranscodeProfile {
+	ps.mu.RLock()
+	profiles := make([]TranscodeProfile, 0, len(ps.profiles))
+	for _, profile := range ps.profiles {
+		profiles = append(profiles, profile)
+	}
+	ps.mu.RUnlock()
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// Put will create or replace a profile
+func (ps *ProfileStore) Put(profile TranscodeProfile) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	profile.UpdatedAt = time.Now()
+	ps.profiles[profile.Name] = profile
+	return ps.saveLocked()
+}
+
+// Delete will remove a profile, the default one can only be changed
+func (ps *ProfileStore) Delete(name string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.profiles[name]; !ok {
+		return ErrNotFound
+	}
+	if name == DefaultProfileName {
+		return ErrProfileInUse
+	}
+	delete(ps.profiles, name)
+	return ps.saveLocked()
+}
+
+func (ps *ProfileStore) saveLocked() error {
+	data, err := json.Marshal(ps.profiles)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ps.path, data)
+}
+
+// profilesPath is where the transcode profiles are persisted
+func profilesPath() string {
+	return filepath.Join(VideoStoragePath, ".profiles.json")
+}
+
+// profileFor will return the profile a video is encoded with, its own, else
+// its tenant's, else the default
+func (sm *StreamManager) profileFor(video VideoRecord) TranscodeProfile {
+	names := []string{video.Profile}
+	if tenant, ok := sm.tenants.byID[video.Tenant]; ok {
+		names = append(names, tenant.Profile)
+	}
+	for _, name := range names {
+		if profile, ok := sm.profiles.Get(name); ok && name != "" {
+			return profile
+		}
+	}
+	if profile, ok := sm.profiles.Get(DefaultProfileName); ok {
+		return profile
+	}
+	return builtinProfile()
+}
+
+// profileInUse reports whether a tenant or a video still names a profile
+func (sm *StreamManager) profileInUse(name string) bool {
+	for _, tenant := range sm.tenants.All() {
+		if tenant.Profile == name {
+			return true
+		}
+		for _, video := range sm.metadata.ListVideos(tenant.ID) {
+			if video.Profile == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleListProfiles will list the transcode profiles
+func (sm *StreamManager) handleListProfiles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sm.profiles.List())
+}
+
+// handleGetProfile will return one transcode profile
+func (sm *StreamManager) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	profile, ok := sm.profiles.Get(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "profile not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// handlePutProfile will create (POST) or replace (PUT /{name}) a transcode profile
+func (sm *StreamManager) handlePutProfile(w http.ResponseWriter, r *http.Request) {
+	var profile TranscodeProfile
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 65536)).Decode(&profile); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	status := http.StatusOK
+	if name := r.PathValue("name"); name != "" {
+		if profile.Name != "" && profile.Name != name {
+			writeError(w, http.StatusBadRequest, "profile name doesn't match the url")
+			return
+		}
+		profile.Name = name
+	} else {
+		if _, exists := sm.profiles.Get(profile.Name); exists {
+			writeError(w, http.StatusConflict, "a profile with this name already exists")
+			return
+		}
+		status = http.StatusCreated
+	}
+	if err := profile.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := sm.profiles.Put(profile); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save profile")
+		return
+	}
+	profile, _ = sm.profiles.Get(profile.Name)
+	writeJSON(w, status, profile)
+}
+
+// handleDeleteProfile will remove a transcode profile nothing uses anymore
+func (sm *StreamManager) handleDeleteProfile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if sm.profileInUse(name) {
+		writeError(w, http.StatusConflict, ErrProfileInUse.Error())
+		return
+	}
+	switch err := sm.profiles.Delete(name); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrNotFound:
+		writeError(w, http.StatusNotFound, "profile not found")
+	case ErrProfileInUse:
+		writeError(w, http.StatusConflict, "the default profile can be changed but not deleted")
+	default:
+		writeError(w, http.StatusInternalServerError, "failed to save profiles")
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+var (
+	// proxy for all outbound requests, overrides HTTP_PROXY / HTTPS_PROXY when set
+	OutboundProxy = envString("OUTBOUND_PROXY", "")
+	// proxy credentials for when they can't be put in the proxy url
+	OutboundProxyUsername = envString("OUTBOUND_PROXY_USERNAME", "")
+	OutboundProxyPassword = envString("OUTBOUND_PROXY_PASSWORD", "")
+	// extra CA bundle, for corporate proxies that re-sign tls traffic
+	OutboundCAFile = envString("OUTBOUND_CA_FILE", "")
+)
+
+// newOutboundClient will create an http client for talking to the outside world
+// (object storage, url imports, webhooks) that goes through the configured proxy.
+// without OUTBOUND_PROXY the usual HTTP_PROXY, HTTPS_PROXY and NO_PROXY apply
+func newOutboundClient(timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	proxy, err := outboundProxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
+
+	if OutboundCAFile != "" {
+		pem, err := os.ReadFile(OutboundCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OUTBOUND_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("OUTBOUND_CA_FILE has no certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// outboundProxyFunc will pick the proxy for a request. credentials go in the
+// proxy url, the transport turns them into Proxy-Authorization (also on CONNECT)
+func outboundProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	withAuth := func(proxy *url.URL) *url.URL {
+		if proxy == nil || proxy.User != nil || OutboundProxyUsername == "" {
+			return proxy
+		}
+		withUser := *proxy
+		withUser.User = url.UserPassword(OutboundProxyUsername, OutboundProxyPassword)
+		return &withUser
+	}
+
+	if OutboundProxy != "" {
+		proxy, err := url.Parse(OutboundProxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid OUTBOUND_PROXY %q", OutboundProxy)
+		}
+		proxy = withAuth(proxy)
+		return func(*http.Request) (*url.URL, error) { return proxy, nil }, nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxy, err := http.ProxyFromEnvironment(req)
+		if err != nil {
+			return nil, err
+		}
+		return withAuth(proxy), nil
+	}, nil
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// hosts pull uploads may fetch from, comma separated, any public host when empty
+	PullUploadHosts = envString("PULL_UPLOAD_HOSTS", "")
+	// let pull uploads reach private and loopback addresses, off so an upload
+	// token can't be used to probe the network. pulls only go through
+	// OUTBOUND_PROXY / HTTP(S)_PROXY when it's on, a proxy would dial for us
+	PullUploadPrivate = envBool("PULL_UPLOAD_PRIVATE", false)
+)
+
+const (
+	// a pull is retried this many times, each resuming where the last stopped
+	pullAttempts = 5
+	// how long a pull may take reading nothing before it is retried
+	pullIdleTimeout = 2 * time.Minute
+)
+
+// pullState is a pull upload, kept after it failed so its status can say why
+type pullState struct {
+	URL string
+
+	mu      sync.Mutex
+	running bool
+	err     string
+}
+
+func (p *pullState) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running = false
+	if err != nil {
+		p.err = err.Error()
+	}
+}
+
+// handlePullUpload will start fetching a video from a url into an upload
+// session, so progress, pause and the status endpoint work like for a
+// pushed upload. posting it again resumes a pull that failed or was paused
+func (sm *StreamManager) handlePullUpload(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID          string   `json:"id"`
+		URL         string   `json:"url"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+		Profile     string   `json:"profile"`
+		TTL         string   `json:"ttl"`
+		// hex sha256 the download has to match, checked before it is saved
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !isSafeName(req.ID) {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	if err := checkPullURL(req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if sum, err := hex.DecodeString(req.SHA256); req.SHA256 != "" && (err != nil || len(sum) != 32) {
+		writeError(w, http.StatusBadRequest, "sha256 must be 64 hex characters")
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var expiresAt *time.Time
+	if req.TTL != "" {
+		ttl, err := parseTTL(req.TTL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		expires := time.Now().Add(ttl).UTC()
+		expiresAt = &expires
+	}
+	if _, ok := sm.profiles.Get(req.Profile); req.Profile != "" && !ok {
+		writeError(w, http.StatusBadRequest, "unknown profile")
+		return
+	}
+
+	tenant := tenantFrom(r)
+	fileID := tenant.VideoID(req.ID)
+	if video, ok := sm.metadata.GetVideo(fileID); ok && video.Locked() {
+		lockedError(w, video)
+		return
+	}
+	isNew := !sm.hasUploadSession(fileID)
+	session, err := sm.uploadSession(fileID, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load upload session")
+		return
+	}
+	// held until the pull is done, like an upload request holds it
+	if !session.mu.TryLock() {
+		writeError(w, http.StatusConflict, "the upload is in progress")
+		return
+	}
+	fail := func(status int, message string) {
+		if isNew {
+			sm.uploadSessions.Delete(fileID)
+		}
+		session.mu.Unlock()
+		writeError(w, status, message)
+	}
+	if session.paused() {
+		fail(http.StatusConflict, "upload is paused, resume it first")
+		return
+	}
+
+	client, err := pullClient()
+	if err != nil {
+		fail(http.StatusInternalServerError, "failed to set up the download")
+		return
+	}
+	body, size, err := openPullURL(client, req.URL, session.UploadedSize)
+	if err != nil {
+		fail(http.StatusBadGateway, err.Error())
+		return
+	}
+	switch {
+	case size < 0:
+		body.Close()
+		fail(http.StatusUnprocessableEntity, "the source doesn't say how large the video is")
+		return
+	case MaxUploadSize > 0 && size > MaxUploadSize:
+		body.Close()
+		fail(http.StatusRequestEntityTooLarge, "upload is too large")
+		return
+	case session.UploadedSize > 0 && size != session.FileSize:
+		body.Close()
+		fail(http.StatusConflict, "the source's size doesn't match the upload being resumed")
+		return
+	}
+	if session.UploadedSize == 0 {
+		if err := sm.checkTenantQuota(tenant, size); err != nil {
+			body.Close()
+			fail(http.StatusInsufficientStorage, err.Error())
+			return
+		}
+		session.FileSize = size
+	}
+
+	pull := &pullState{URL: req.URL, running: true}
+	sm.pulls.Store(fileID, pull)
+	record := VideoRecord{
+		ID:          req.ID,
+		Tenant:      tenant.ID,
+		Title:       req.Title,
+		Description: req.Description,
+		Tags:        tags,
+		ExpiresAt:   expiresAt,
+		Owner:       sm.tokens.Subject(r),
+		Profile:     req.Profile,
+	}
+	go func() {
+		defer session.mu.Unlock()
+		err := sm.runPull(session, tenant, client, body, req.URL, req.SHA256, record)
+		if err != nil {
+			log.Println("pull upload failed", fileID, err)
+			sm.streamSession(fileID).broadcast("", sseMessage{Event: "upload.failed", Data: map[string]string{"error": err.Error()}})
+		}
+		pull.finish(err)
+	}()
+
+	w.Header().Set("Location", tenant.Path("/api/upload")+"?id="+url.QueryEscape(req.ID))
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"id":     req.ID,
+		"offset": session.UploadedSize,
+		"size":   session.FileSize,
+		"source": req.URL,
+	})
+}
+
+// runPull will copy the source into the session, reopening it at the
+// committed offset when the connection fails, and save the video once it is
+// all there and matches the checksum. caller holds mu
+func (sm *StreamManager) runPull(s *UploadSession, tenant *Tenant, client *http.Client, body io.ReadCloser, source, checksum string, record VideoRecord) error {
+	if err := s.open(); err != nil {
+		body.Close()
+		return err
+	}
+	pooled := chunkBuffers.Get().(*[]byte)
+	defer chunkBuffers.Put(pooled)
+	buffer := *pooled
+	var err error
+	for attempt := 1; ; attempt++ {
+		if body == nil {
+			var size int64
+			body, size, err = openPullURL(client, source, s.UploadedSize)
+			if err == nil && size != s.FileSize {
+				body.Close()
+				return errors.New("the source changed size while it was being fetched")
+			}
+		}
+		if err == nil {
+			err = sm.pullInto(s, tenant, body, buffer)
+			body.Close()
+			body = nil
+			s.LastUpdated = time.Now()
+			if commitErr := s.commit(); commitErr != nil {
+				log.Println("failed to save upload state", s.FileID, commitErr)
+			}
+		}
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errUploadPaused) {
+			// a long pause holds no file open, like a paused pushed upload
+			s.File.Close()
+			s.File = nil
+			return err
+		}
+		if errors.Is(err, syscall.ENOSPC) || attempt == pullAttempts {
+			return err
+		}
+		log.Println("pull upload", s.FileID, "failed at", s.UploadedSize, "retrying:", err)
+		time.Sleep(time.Duration(attempt*attempt) * time.Second)
+	}
+
+	if s.UploadedSize != s.FileSize {
+		return fmt.Errorf("the source ended at %d of %d bytes", s.UploadedSize, s.FileSize)
+	}
+	if got := hex.EncodeToString(s.hash.Sum(nil)); checksum != "" && got != checksum {
+		// start over on the next try instead of resuming a corrupt file
+		s.finish()
+		os.Remove(s.FileName)
+		sm.uploadSessions.Delete(s.FileID)
+		return fmt.Errorf("sha256 mismatch, got %s", got)
+	}
+	_, err = sm.completeUpload(s, record)
+	return err
+}
+
+// errUploadPaused stops a pull that was paused, posting it again resumes it
+var errUploadPaused = errors.New("upload was paused")
+
+// pullInto will copy body into the session until it ends, fails or the
+// upload is paused. caller holds mu
+func (sm *StreamManager) pullInto(s *UploadSession, tenant *Tenant, body io.Reader, buffer []byte) error {
+	for s.UploadedSize < s.FileSize {
+		n, err := body.Read(buffer[:min(int64(len(buffer)), s.FileSize-s.UploadedSize)])
+		if n > 0 {
+			if writeErr := s.write(buffer[:n]); writeErr != nil {
+				return writeErr
+			}
+			sm.uploadWritten(s, n)
+			tenant.stats.uploadedBytes.Add(int64(n))
+		}
+		if s.paused() {
+			return errUploadPaused
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPullURL will only let http(s) urls to allowed hosts through, s3://
+// isn't offered since it would read with the server's credentials
+func checkPullURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an http or https url")
+	}
+	if PullUploadHosts == "" {
+		return nil
+	}
+	for _, host := range strings.Split(PullUploadHosts, ",") {
+		if strings.EqualFold(strings.TrimSpace(host), u.Hostname()) {
+			return nil
+		}
+	}
+	return errors.New("pulling from " + u.Hostname() + " isn't allowed")
+}
+
+// pullClient is the outbound client that won't connect to private addresses
+// unless PULL_UPLOAD_PRIVATE is on, checked on the address actually dialed.
+// with the check on it connects directly, through a proxy the address dialed
+// would be the proxy's and the source could be anything behind it
+func pullClient() (*http.Client, error) {
+	client, err := newOutboundClient(0)
+	if err != nil {
+		return nil, err
+	}
+	transport := client.Transport.(*http.Transport)
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !PullUploadPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, _ := net.SplitHostPort(address)
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+				return fmt.Errorf("pulling from %s isn't allowed", host)
+			}
+			return nil
+		}
+		transport.Proxy = nil
+	}
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = pullIdleTimeout
+	return client, nil
+}
+
+// pullBody is a source being read, it is cut off when it sends nothing for
+// pullIdleTimeout so a stalled server gets retried instead of holding the upload
+type pullBody struct {
+	io.ReadCloser
+	idle   *time.Timer
+	cancel context.CancelFunc
+}
+
+func (b *pullBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.idle.Reset(pullIdleTimeout)
+	return n, err
+}
+
+func (b *pullBody) Close() error {
+	b.idle.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// openPullURL will open the source at offset, size is the whole video's or
+// -1 when unknown. a server that ignores the range has the start skipped
+func openPullURL(client *http.Client, raw string, offset int64) (io.ReadCloser, int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+	resp.Body = &pullBody{ReadCloser: resp.Body, idle: time.AfterFunc(pullIdleTimeout, cancel), cancel: cancel}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// Content-Range: bytes start-end/size
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		size, err := strconv.ParseInt(total, 10, 64)
+		if err != nil || !strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-") {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("fetching %s returned an unusable range", raw)
+		}
+		return resp.Body, size, nil
+	case resp.StatusCode == http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		return resp.Body, resp.ContentLength, nil
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("fetching %s returned %s", raw, resp.Status)
+	}
+}
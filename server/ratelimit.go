@@ -0,0 +1,288 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// token bucket for a single client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket limiter keyed by client ip or api key
+type RateLimiter struct {
+	name   string
+	burst  float64
+	rate   float64 // tokens per second
+	key    func(r *http.Request) string
+	mu     sync.Mutex
+	bucket map[string]*bucket
+}
+
+// the limiters for each class of api call
+type RateLimits struct {
+	Upload   *RateLimiter
+	Playback *RateLimiter
+	Metadata *RateLimiter
+	// open streams of a client, seeks don't use up playback tokens so this
+	// is what stops one client opening any number of them
+	Streams *StreamLimiter
+}
+
+// StreamLimiter caps how many streams a client has open at once
+type StreamLimiter struct {
+	max  int64
+	key  func(r *http.Request) string
+	mu   sync.Mutex
+	open map[string]int64
+}
+
+// NewStreamLimiter will allow max open streams per client, nil when max is 0
+func NewStreamLimiter(max int64) *StreamLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &StreamLimiter{
+		max:  max,
+		key:  func(r *http.Request) string { return "ip:" + clientIP(r) },
+		open: make(map[string]int64),
+	}
+}
+
+// Limit will wrap a streaming handler, a client with max streams open gets a
+// 429 until one of them ends. a nil limiter lets everything through
+func (sl *StreamLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	if sl == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := sl.key(r)
+		sl.mu.Lock()
+		if sl.open[key] >= sl.max {
+			sl.mu.Unlock()
+			tenantFrom(r).stats.throttled.Add(1)
+			writeTooMany(w, "open stream", time.Second)
+			return
+		}
+		sl.open[key]++
+		sl.mu.Unlock()
+		defer func() {
+			sl.mu.Lock()
+			if sl.open[key]--; sl.open[key] <= 0 {
+				delete(sl.open, key)
+			}
+			sl.mu.Unlock()
+		}()
+		next(w, r)
+	}
+}
+
+// NewRateLimiter will create a limiter from a spec like "10/1m" (10 requests per minute).
+// an empty spec or "off" disables the limiter and returns nil
+func NewRateLimiter(name, spec string) (*RateLimiter, error) {
+	if spec == "" || spec == "off" {
+		return nil, nil
+	}
+
+	count, period, ok := strings.Cut(spec, "/")
+	if !ok {
+		return nil, fmt.Errorf("rate limit %q must look like 10/1m", spec)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("rate limit %q has an invalid count", spec)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("rate limit %q has an invalid period", spec)
+	}
+
+	rl := &RateLimiter{
+		name:   name,
+		burst:  float64(n),
+		rate:   float64(n) / d.Seconds(),
+		key:    func(r *http.Request) string { return "ip:" + clientIP(r) },
+		bucket: make(map[string]*bucket),
+	}
+	supervisor.Go(context.Background(), "ratelimit-sweep", RestartAlways, rl.sweepRoutine)
+	return rl, nil
+}
+
+// NewRateLimits will build the per class limiters from the environment,
+// key identifies the client a request belongs to
+func NewRateLimits(key func(r *http.Request) string) *RateLimits {
+	build := func(name, env, def string) *RateLimiter {
+		rl, err := NewRateLimiter(name, envString(env, def))
+		if err != nil {
+			log.Fatal("invalid ", env, ": ", err)
+		}
+		if rl != nil && key != nil {
+			rl.key = key
+		}
+		return rl
+	}
+	streams := NewStreamLimiter(envInt64("RATE_LIMIT_STREAMS", 8))
+	if streams != nil && key != nil {
+		streams.key = key
+	}
+	return &RateLimits{
+		Upload:   build("upload", "RATE_LIMIT_UPLOAD", "10/1m"),
+		Playback: build("playback", "RATE_LIMIT_PLAYBACK", "60/1m"),
+		Metadata: build("metadata", "RATE_LIMIT_METADATA", "120/1m"),
+		Streams:  streams,
+	}
+}
+
+// Allow will take a token for key, when empty it returns how long until one is available
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.bucket[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.bucket[key] = b
+	}
+
+	// refill since the last call
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / rl.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Limit will wrap a handler, counts decides which requests use up a token
+// (eg only new uploads, not every chunk). a nil limiter lets everything through
+func (rl *RateLimiter) Limit(counts func(r *http.Request) bool, next http.HandlerFunc) http.HandlerFunc {
+	if rl == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if counts == nil || counts(r) {
+			tenant := tenantFrom(r)
+			if ok, wait := rl.Allow(rl.key(r)); !ok {
+				tenant.stats.throttled.Add(1)
+				writeTooMany(w, rl.name, wait)
+				return
+			}
+			// tenant wide limits come on top of the per client ones
+			if ok, wait := tenant.Allow(rl.name); !ok {
+				tenant.stats.throttled.Add(1)
+				writeTooMany(w, rl.name, wait)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// writeTooMany will answer a request that ran out of rate limit tokens
+func writeTooMany(w http.ResponseWriter, name string, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "too many "+name+" requests")
+}
+
+// sweepRoutine will drop buckets that have been full for a while so the map doesn't grow forever
+func (rl *RateLimiter) sweepRoutine(ctx context.Context) error {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		rl.mu.Lock()
+		for key, b := range rl.bucket {
+			refill := time.Since(b.last).Seconds() * rl.rate
+			if b.tokens+refill >= rl.burst {
+				delete(rl.bucket, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// trustedProxies is TRUSTED_PROXIES parsed, bad entries are logged and left out
+var trustedProxies = func() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, raw := range strings.Split(TrustedProxies, ",") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		prefix, err := parseIPPrefix(raw)
+		if err != nil {
+			log.Println("ignoring TRUSTED_PROXIES entry", raw, err)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}()
+
+func isTrustedProxy(raw string) bool {
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP will return the remote address, only trusting proxy headers when
+// configured. the proxy appends who connected to it, so that is read from
+// the right past TRUSTED_PROXIES, never the leftmost entry a client can set
+func clientIP(r *http.Request) string {
+	if TrustProxyHeaders {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop != "" && (i == 0 || !isTrustedProxy(hop)) {
+				return hop
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isPlaybackStart will count only the first request of a viewing, not every
+// seek. the header is the client's, limits.Streams caps what it can open
+func isPlaybackStart(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	return rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+// isNewUpload will count only requests that start a new upload session
+func (sm *StreamManager) isNewUpload(r *http.Request) bool {
+	return !sm.hasUploadSession(tenantFrom(r).VideoID(r.URL.Query().Get("id")))
+}
@@ -0,0 +1,22 @@
+//go:build linux && (amd64 || arm64)
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+const fadvSequential = 2 // POSIX_FADV_SEQUENTIAL
+
+// set READAHEAD_SEQUENTIAL=false to leave the kernel readahead at its default
+var ReadaheadSequential = envBool("READAHEAD_SEQUENTIAL", true)
+
+// adviseSequential will tell the kernel the file is read front to back so it
+// doubles the readahead window for it, errors are ignored since it is only a hint
+func adviseSequential(file *os.File) {
+	if !ReadaheadSequential {
+		return
+	}
+	syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, fadvSequential, 0, 0)
+}
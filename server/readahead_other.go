@@ -0,0 +1,8 @@
+//go:build !(linux && (amd64 || arm64))
+
+package server
+
+import "os"
+
+// adviseSequential is a no-op where fadvise isn't available
+func adviseSequential(file *os.File) {}
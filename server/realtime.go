@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// how often an idle event stream gets a keepalive comment
+const sseKeepalive = 25 * time.Second
+
+// a message pushed to event stream subscribers
+type sseMessage struct {
+	Event string
+	Data  interface{}
+}
+
+// WatchParty relays the host's play/pause/seek to everyone following along
+type WatchParty struct {
+	ID      string     `json:"id"`
+	hostKey string     // only the host may drive the party
+	State   PartyState `json:"state"`
+}
+
+// PartyState is the last thing the host did, late joiners start from it
+type PartyState struct {
+	Action   string    `json:"action"`
+	Position float64   `json:"position"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// subscriber of a video's event stream
+type subscriber struct {
+	party string
+	ch    chan sseMessage
+}
+
+// streamSession will return the session tracking live viewers of a video
+func (sm *StreamManager) streamSession(fileID string) *StreamSession {
+	session, _ := sm.activeStreams.LoadOrStore(fileID, &StreamSession{
+		FileID:       fileID,
+		LastAccessed: time.Now(),
+	})
+	return session.(*StreamSession)
+}
+
+// subscribe will add a viewer and announce the new count
+func (s *StreamSession) subscribe(party string) *subscriber {
+	sub := &subscriber{party: party, ch: make(chan sseMessage, 16)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[*subscriber]struct{})
+	}
+	s.subscribers[sub] = struct{}{}
+	s.ViewerCount = len(s.subscribers)
+	s.LastAccessed = time.Now()
+
+	// late joiners start where the party is
+	if p, ok := s.parties[party]; ok && !p.State.SentAt.IsZero() {
+		sub.ch <- sseMessage{Event: "party", Data: p.State}
+	}
+	s.broadcastLocked("", sseMessage{Event: "viewers", Data: map[string]int{"viewers": s.ViewerCount}})
+	return sub
+}
+
+// unsubscribe will remove a viewer and announce the new count
+func (s *StreamSession) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, sub)
+	s.ViewerCount = len(s.subscribers)
+	s.LastAccessed = time.Now()
+	s.broadcastLocked("", sseMessage{Event: "viewers", Data: map[string]int{"viewers": s.ViewerCount}})
+}
+
+// broadcast will send msg to every subscriber, or only a party's
+func (s *StreamSession) broadcast(party string, msg sseMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcastLocked(party, msg)
+}
+
+// broadcastLocked will send msg to every subscriber (or only a party's when
+// party is set), slow subscribers miss messages instead of blocking everyone
+func (s *StreamSession) broadcastLocked(party string, msg sseMessage) {
+	for sub := range s.subscribers {
+		if party != "" && sub.party != party {
+			continue
+		}
+		select {
+		case sub.ch <- msg:
+		default:
+		}
+	}
+}
+
+// handleVideoEvents will stream live viewer counts and watch party events (?party=) as SSE
+func (sm *StreamManager) handleVideoEvents(w http.ResponseWriter, r *http.Request) {
+	session := sm.streamSession(tenantFrom(r).VideoID(r.PathValue("id")))
+	party := r.URL.Query().Get("party")
+	if party != "" {
+		session.mu.Lock()
+		_, ok := session.parties[party]
+		session.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "party not found")
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	sub := session.subscribe(party)
+	connected := time.Now()
+	defer func() {
+		session.unsubscribe(sub)
+		sm.events.Emit(EventViewSessionClosed, session.FileID, map[string]interface{}{
+			"party":    party,
+			"duration": time.Since(connected).Seconds(),
+		})
+	}()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case msg := <-sub.ch:
+			data, _ := json.Marshal(msg.Data)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Event, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handleCreateParty will start a watch party, the host key is only returned here
+func (sm *StreamManager) handleCreateParty(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r)
+	session := sm.streamSession(tenant.VideoID(r.PathValue("id")))
+
+	party := &WatchParty{ID: newID(), hostKey: newID() + newID()}
+	session.mu.Lock()
+	if session.parties == nil {
+		session.parties = make(map[string]*WatchParty)
+	}
+	session.parties[party.ID] = party
+	session.LastAccessed = time.Now()
+	session.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"party_id":   party.ID,
+		"host_key":   party.hostKey,
+		"follow_url": tenant.Path("/watch/"+r.PathValue("id")) + "?party=" + party.ID,
+	})
+}
+
+// handlePartyEvent will relay a play/pause/seek from the host (X-Party-Key) to the followers
+func (sm *StreamManager) handlePartyEvent(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Action   string  `json:"action"`
+		Position float64 `json:"position"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Action != "play" && req.Action != "pause" && req.Action != "seek" {
+		writeError(w, http.StatusBadRequest, "action must be play, pause or seek")
+		return
+	}
+
+	session := sm.streamSession(tenantFrom(r).VideoID(r.PathValue("id")))
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	party, ok := session.parties[r.PathValue("party")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "party not found")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Party-Key")), []byte(party.hostKey)) != 1 {
+		writeError(w, http.StatusForbidden, "only the host can control the party")
+		return
+	}
+
+	party.State = PartyState{Action: req.Action, Position: req.Position, SentAt: time.Now()}
+	session.LastAccessed = party.State.SentAt
+	session.broadcastLocked(party.ID, sseMessage{Event: "party", Data: party.State})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+var (
+	// csv of ip ranges and the country they are in, either "start,end,country"
+	// lines (db-ip and similar lite databases) or "network,country" with a
+	// cidr network. countries are ISO 3166 codes
+	GeoIPDatabase = envString("GEOIP_DB", "")
+	// request header a cdn puts the viewer's country in, like CF-IPCountry,
+	// it wins over the database. only read with TRUST_PROXY_HEADERS
+	GeoIPHeader = envString("GEOIP_HEADER", "")
+)
+
+// PlaybackPolicy restricts where a video may be played from. a tenant's
+// policy covers all its videos, each list a video sets replaces the
+// tenant's one
+type PlaybackPolicy struct {
+	// only viewers in these countries may play, or nobody in these
+	AllowCountries []string `json:"allow_countries,omitempty"`
+	BlockCountries []string `json:"block_countries,omitempty"`
+	// sites that may embed the video, a domain covers its subdomains. the
+	// server's own player pages always may
+	AllowReferrers []string `json:"allow_referrers,omitempty"`
+	// only viewers from these addresses or cidr networks may play
+	AllowIPs []string `json:"allow_ips,omitempty"`
+}
+
+// normalizePlaybackPolicy will check a policy and tidy its lists, nil when
+// it restricts nothing
+func normalizePlaybackPolicy(policy *PlaybackPolicy) (*PlaybackPolicy, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	countries := func(codes []string) ([]string, error) {
+		var normalized []string
+		for _, code := range codes {
+			code = strings.ToUpper(strings.TrimSpace(code))
+			if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+				return nil, fmt.Errorf("invalid country %q, use two letter codes", code)
+			}
+			normalized = append(normalized, code)
+		}
+		return normalized, nil
+	}
+	var normalized PlaybackPolicy
+	var err error
+	if normalized.AllowCountries, err = countries(policy.AllowCountries); err != nil {
+		return nil, err
+	}
+	if normalized.BlockCountries, err = countries(policy.BlockCountries); err != nil {
+		return nil, err
+	}
+	for _, referrer := range policy.AllowReferrers {
+		domain := referrerDomain(referrer)
+		if domain == "" {
+			return nil, fmt.Errorf("invalid referrer %q", referrer)
+		}
+		normalized.AllowReferrers = append(normalized.AllowReferrers, domain)
+	}
+	for _, raw := range policy.AllowIPs {
+		prefix, err := parseIPPrefix(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip %q", raw)
+		}
+		normalized.AllowIPs = append(normalized.AllowIPs, prefix.String())
+	}
+	if normalized.AllowCountries == nil && normalized.BlockCountries == nil &&
+		normalized.AllowReferrers == nil && normalized.AllowIPs == nil {
+		return nil, nil
+	}
+	return &normalized, nil
+}
+
+// referrerDomain is the host of a referrer rule or header, "" when it has none
+func referrerDomain(raw string) string {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	raw = strings.TrimPrefix(raw, "*.")
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Hostname(), ".")
+}
+
+// parseIPPrefix will parse a cidr network or a single address
+func parseIPPrefix(raw string) (netip.Prefix, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.Contains(raw, "/") {
+		prefix, err := netip.ParsePrefix(raw)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// merge will lay a video's policy over its tenant's
+func (p *PlaybackPolicy) merge(video *PlaybackPolicy) *PlaybackPolicy {
+	if p == nil {
+		return video
+	}
+	if video == nil {
+		return p
+	}
+	merged := *p
+	if video.AllowCountries != nil || video.BlockCountries != nil {
+		merged.AllowCountries, merged.BlockCountries = video.AllowCountries, video.BlockCountries
+	}
+	if video.AllowReferrers != nil {
+		merged.AllowReferrers = video.AllowReferrers
+	}
+	if video.AllowIPs != nil {
+		merged.AllowIPs = video.AllowIPs
+	}
+	return &merged
+}
+
+// restrictPlayback will refuse a request the video's or its tenant's playback
+// policy doesn't allow, before anything is served
+func (sm *StreamManager) restrictPlayback(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := tenantFrom(r)
+		video, _ := sm.metadata.GetVideo(tenant.VideoID(requestedVideoID(r)))
+		policy := tenant.Playback.merge(video.Playback)
+		if reason := sm.checkPlayback(r, policy); reason != "" {
+			setCachePolicy(w, r, CacheNoStore, "")
+			writeError(w, http.StatusForbidden, reason)
+			return
+		}
+		// another viewer might not pass, so it can't go in a shared cache
+		if policy != nil {
+			r = r.WithContext(context.WithValue(r.Context(), restrictedKey{}, true))
+		}
+		next(w, r)
+	}
+}
+
+// checkPlayback will say why policy doesn't allow r, "" when it does
+func (sm *StreamManager) checkPlayback(r *http.Request, policy *PlaybackPolicy) string {
+	if policy == nil {
+		return ""
+	}
+	ip, _ := netip.ParseAddr(clientIP(r))
+	ip = ip.Unmap()
+
+	if policy.AllowIPs != nil {
+		allowed := false
+		for _, raw := range policy.AllowIPs {
+			if prefix, err := parseIPPrefix(raw); err == nil && prefix.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "playback isn't allowed from your network"
+		}
+	}
+
+	if policy.AllowCountries != nil || policy.BlockCountries != nil {
+		// a viewer whose country isn't known can't be in an allowed one
+		country := sm.viewerCountry(r, ip)
+		if policy.AllowCountries != nil && (country == "" || !slices.Contains(policy.AllowCountries, country)) {
+			return "playback isn't allowed in your country"
+		}
+		if country != "" && slices.Contains(policy.BlockCountries, country) {
+			return "playback isn't allowed in your country"
+		}
+	}
+
+	if policy.AllowReferrers != nil && !referrerAllowed(r, policy.AllowReferrers) {
+		return "playback isn't allowed from this site"
+	}
+	return ""
+}
+
+// referrerAllowed reports whether the page r comes from may embed the video,
+// by its Origin or else its Referer. no referrer isn't allowed
+func referrerAllowed(r *http.Request, domains []string) bool {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+	host := referrerDomain(source)
+	if host == "" {
+		return false
+	}
+	// media requests of the server's own player
+	own := []string{referrerDomain(r.Host)}
+	if PublicURL != "" {
+		own = append(own, referrerDomain(PublicURL))
+	}
+	for _, domain := range append(own, domains...) {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// viewerCountry is the country code of a viewer, "" when it isn't known
+func (sm *StreamManager) viewerCountry(r *http.Request, ip netip.Addr) string {
+	if TrustProxyHeaders && GeoIPHeader != "" {
+		if country := strings.ToUpper(strings.TrimSpace(r.Header.Get(GeoIPHeader))); len(country) == 2 && country != "XX" {
+			return country
+		}
+	}
+	return sm.geoip.Country(ip)
+}
+
+// GeoIP will look up the country of an address in ranges loaded from GEOIP_DB
+type GeoIP struct {
+	// sorted by start, they don't overlap
+	ranges []geoRange
+}
+
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// LoadGeoIP will read a GEOIP_DB csv, an empty path gives a database that
+// knows no address
+func LoadGeoIP(path string) (*GeoIP, error) {
+	g := &GeoIP{}
+	if path == "" {
+		return g, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry, err := parseGeoRange(record)
+		if err != nil {
+			// a header line
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		g.ranges = append(g.ranges, entry)
+	}
+	sort.Slice(g.ranges, func(i, j int) bool { return g.ranges[i].start.Less(g.ranges[j].start) })
+	return g, nil
+}
+
+func parseGeoRange(record []string) (geoRange, error) {
+	switch len(record) {
+	case 2:
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			return geoRange{}, err
+		}
+		prefix = prefix.Masked()
+		start := prefix.Addr().Unmap()
+		end := start
+		// the last address of the network, the host bits all set
+		bytes := end.AsSlice()
+		for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+			bytes[bit/8] |= 0x80 >> (bit % 8)
+		}
+		end, _ = netip.AddrFromSlice(bytes)
+		return geoRange{start: start, end: end, country: strings.ToUpper(strings.TrimSpace(record[1]))}, nil
+	case 3, 4:
+		start, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			return geoRange{}, err
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if err != nil {
+			return geoRange{}, err
+		}
+		return geoRange{start: start.Unmap(), end: end.Unmap(), country: strings.ToUpper(strings.TrimSpace(record[2]))}, nil
+	}
+	return geoRange{}, errors.New("expected start,end,country or network,country")
+}
+
+// Country is the country code of ip, "" when no range has it
+func (g *GeoIP) Country(ip netip.Addr) string {
+	if g == nil || !ip.IsValid() {
+		return ""
+	}
+	// the last range starting at or before ip
+	i := sort.Search(len(g.ranges), func(i int) bool { return ip.Less(g.ranges[i].start) }) - 1
+	if i < 0 || g.ranges[i].end.Less(ip) || g.ranges[i].start.BitLen() != ip.BitLen() {
+		return ""
+	}
+	return g.ranges[i].country
+}
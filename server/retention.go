@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// how long the default tenant's videos are kept, forever when 0. other
+// tenants set theirs with "retention" in the tenants file
+var VideoRetention = envDuration("VIDEO_RETENTION", 0)
+
+// EventVideoExpired is sent for every video the reaper deletes, before the
+// video.deleted of the delete itself
+const EventVideoExpired = "video.expired"
+
+// parseTTL will parse an upload or update ttl like 72h, it has to be positive
+func parseTTL(raw string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New("ttl must be a positive duration like 72h")
+	}
+	return ttl, nil
+}
+
+// retentionFor will return how long a tenant keeps its videos, 0 is forever
+func (sm *StreamManager) retentionFor(tenantID string) time.Duration {
+	if tenant, ok := sm.tenants.byID[tenantID]; ok {
+		return tenant.retention
+	}
+	return VideoRetention
+}
+
+// expiresAt is when a video is deleted, its own expiry or else its tenant's
+// retention counted from the upload
+func (sm *StreamManager) expiresAt(video VideoRecord) (time.Time, bool) {
+	if video.ExpiresAt != nil {
+		return *video.ExpiresAt, true
+	}
+	if retention := sm.retentionFor(tenantOf(video.Key())); retention > 0 {
+		return video.CreatedAt.Add(retention), true
+	}
+	return time.Time{}, false
+}
+
+// reapExpiredVideos will queue the deletion of videos past their ttl or
+// their tenant's retention. it runs on the leader
+func (sm *StreamManager) reapExpiredVideos(ctx context.Context) {
+	now := time.Now()
+	for _, video := range sm.metadata.AllVideos() {
+		if ctx.Err() != nil {
+			return
+		}
+		expires, ok := sm.expiresAt(video)
+		if !ok || now.Before(expires) {
+			continue
+		}
+		// the write once period outlasts the retention, it goes once that ends
+		if video.Locked() {
+			continue
+		}
+		if err := sm.jobs.Enqueue(JobExpireVideo, video.Key(), nil); err != nil {
+			log.Println("failed to queue deleting expired video", video.Key(), err)
+		}
+	}
+}
+
+// expireVideo will delete a video that expired with its renditions and
+// metadata, unless it was given longer or locked since it was queued
+func (sm *StreamManager) expireVideo(ctx context.Context, fileID string) error {
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok {
+		return nil
+	}
+	expires, ok := sm.expiresAt(video)
+	if !ok || time.Now().Before(expires) || video.Locked() {
+		return nil
+	}
+	log.Println("deleting expired video", fileID)
+	sm.events.Emit(EventVideoExpired, fileID, map[string]interface{}{"expired_at": expires.UTC(), "created_at": video.CreatedAt.UTC()})
+	entry := AuditEntry{Action: "video.delete", Outcome: AuditSuccess, Actor: "system", Tenant: tenantOf(fileID), Target: video.ID, Detail: "retention"}
+	err := sm.deleteVideo(ctx, fileID)
+	if err != nil {
+		entry.Outcome = AuditFailure
+	}
+	sm.audit.Record(entry)
+	return err
+}
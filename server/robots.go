@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// user agents of the link preview fetchers of chat apps and social networks
+var unfurlBots = []string{
+	"slackbot", "slack-imgproxy", "twitterbot", "facebookexternalhit", "facebookcatalog",
+	"discordbot", "linkedinbot", "whatsapp", "telegrambot", "skypeuripreview", "redditbot",
+	"embedly", "iframely", "mastodon",
+}
+
+// isUnfurlBot reports whether a request comes from a link preview fetcher
+func isUnfurlBot(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, bot := range unfurlBots {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRobots will keep crawlers on the player pages and point them at the sitemap
+func (sm *StreamManager) handleRobots(w http.ResponseWriter, r *http.Request) {
+	setCachePolicy(w, r, CacheManifest, "")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "User-agent: *\nDisallow: /api/\nDisallow: /admin/\nAllow: /watch/\n\nSitemap: %s/sitemap.xml\n", baseURL(r))
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// handleSitemap will list the player pages of ready videos, videos marked
+// noindex and tenants that need an api key are left out
+func (sm *StreamManager) handleSitemap(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	urlset := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, tenant := range sm.tenants.All() {
+		if len(tenant.APIKeys) > 0 {
+			continue
+		}
+		for _, video := range sm.metadata.ListVideos(tenant.ID) {
+			if video.NoIndex || !video.Available() || !video.IsVideo() {
+				continue
+			}
+			urlset.URLs = append(urlset.URLs, sitemapURL{
+				Loc:     base + tenant.Path("/watch/"+url.PathEscape(video.ID)),
+				LastMod: video.CreatedAt.UTC().Format("2006-01-02"),
+			})
+		}
+	}
+
+	setCachePolicy(w, r, CacheManifest, "")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(urlset)
+}
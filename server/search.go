@@ -0,0 +1,296 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxVideoTags = 20
+	// pages of search results are at most this long
+	maxSearchLimit = 100
+)
+
+// orders GET /api/videos can sort by, views are most first unless asked otherwise
+var videoSorts = map[string]func(a, b *VideoRecord) int{
+	"created":  func(a, b *VideoRecord) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"duration": func(a, b *VideoRecord) int { return compareNumbers(a.Duration, b.Duration) },
+	"views":    func(a, b *VideoRecord) int { return compareNumbers(a.Views, b.Views) },
+}
+
+func compareNumbers[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// searchIndex maps the words of a tenant's titles, descriptions and tags and
+// the tags themselves to the videos they appear in, kept up to date by the
+// metadata store like the stats so a search never walks the library
+type searchIndex struct {
+	terms map[string]map[string]struct{}
+	tags  map[string]map[string]struct{}
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		terms: make(map[string]map[string]struct{}),
+		tags:  make(map[string]map[string]struct{}),
+	}
+}
+
+// index will add (sign 1) or remove (sign -1) a video
+func (si *searchIndex) index(video *VideoRecord, sign int) {
+	key := video.Key()
+	text := video.Title + " " + video.Description + " " + strings.Join(video.Tags, " ")
+	for _, term := range searchTerms(text) {
+		addPosting(si.terms, term, key, sign)
+	}
+	for _, tag := range video.Tags {
+		addPosting(si.tags, tag, key, sign)
+	}
+}
+
+func addPosting(postings map[string]map[string]struct{}, term, key string, sign int) {
+	keys, ok := postings[term]
+	if sign < 0 {
+		delete(keys, key)
+		if ok && len(keys) == 0 {
+			delete(postings, term)
+		}
+		return
+	}
+	if !ok {
+		keys = make(map[string]struct{})
+		postings[term] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// match will return the videos having every term (as a word or the start of
+// one, so results show up while typing) and every tag
+func (si *searchIndex) match(terms, tags []string) map[string]struct{} {
+	var matched map[string]struct{}
+	narrow := func(keys map[string]struct{}) {
+		if matched == nil {
+			matched = keys
+			return
+		}
+		for key := range matched {
+			if _, ok := keys[key]; !ok {
+				delete(matched, key)
+			}
+		}
+	}
+	for _, tag := range tags {
+		keys := make(map[string]struct{}, len(si.tags[tag]))
+		for key := range si.tags[tag] {
+			keys[key] = struct{}{}
+		}
+		narrow(keys)
+	}
+	for _, term := range terms {
+		keys := make(map[string]struct{})
+		for word, posting := range si.terms {
+			if strings.HasPrefix(word, term) {
+				for key := range posting {
+					keys[key] = struct{}{}
+				}
+			}
+		}
+		narrow(keys)
+	}
+	return matched
+}
+
+// searchTerms will split text into lowercase words, each once
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	}) {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// normalizeTags will lowercase and dedupe tags, they are names like ids
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !isSafeName(tag) {
+			return nil, errors.New("invalid tag " + strconv.Quote(tag))
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxVideoTags {
+		return nil, errors.New("at most " + strconv.Itoa(maxVideoTags) + " tags")
+	}
+	return normalized, nil
+}
+
+// indexLocked will update the tenant's search index for a video, caller holds mu
+func (ms *MetadataStore) indexLocked(video *VideoRecord, sign int) {
+	tenantID := video.Tenant
+	if tenantID == "" {
+		tenantID = DefaultTenantID
+	}
+	si, ok := ms.search[tenantID]
+	if !ok {
+		si = newSearchIndex()
+		ms.search[tenantID] = si
+	}
+	si.index(video, sign)
+}
+
+// VideoQuery narrows and orders a tenant's videos
+type VideoQuery struct {
+	Text string
+	Tags []string
+	Sort string
+	Desc bool
+	// a page of the results, all of them when Limit is 0
+	Limit  int
+	Offset int
+	// only videos filed in one of these collections, "" is the top. nil
+	// doesn't look at collections
+	Collections map[string]bool
+	// video, audio or image, "" is all of them
+	Kind string
+}
+
+// SearchVideos will return a page of the tenant's videos matching the query
+// and how many matched in total
+func (ms *MetadataStore) SearchVideos(tenantID string, query VideoQuery) ([]VideoRecord, int) {
+	terms := searchTerms(query.Text)
+	tags, _ := normalizeTags(query.Tags)
+
+	ms.mu.RLock()
+	var videos []*VideoRecord
+	if len(terms) == 0 && len(tags) == 0 {
+		for _, video := range ms.videos {
+			if inTenant(video.Tenant, tenantID) {
+				videos = append(videos, video)
+			}
+		}
+	} else if si, ok := ms.search[tenantID]; ok {
+		for key := range si.match(terms, tags) {
+			if video, ok := ms.videos[key]; ok {
+				videos = append(videos, video)
+			}
+		}
+	}
+
+	if query.Collections != nil {
+		filed := videos[:0]
+		for _, video := range videos {
+			if query.Collections[video.Collection] {
+				filed = append(filed, video)
+			}
+		}
+		videos = filed
+	}
+	if query.Kind != "" {
+		kind := videos[:0]
+		for _, video := range videos {
+			if video.mediaFormat().kind == query.Kind {
+				kind = append(kind, video)
+			}
+		}
+		videos = kind
+	}
+
+	compare, ok := videoSorts[query.Sort]
+	if !ok {
+		compare = videoSorts["created"]
+	}
+	sort.Slice(videos, func(i, j int) bool {
+		c := compare(videos[i], videos[j])
+		if query.Desc {
+			c = -c
+		}
+		if c == 0 {
+			return videos[i].Key() < videos[j].Key()
+		}
+		return c < 0
+	})
+
+	total := len(videos)
+	start := min(max(query.Offset, 0), total)
+	end := total
+	if query.Limit > 0 {
+		end = min(start+query.Limit, total)
+	}
+	page := make([]VideoRecord, 0, end-start)
+	for _, video := range videos[start:end] {
+		page = append(page, *video)
+	}
+	ms.mu.RUnlock()
+	return page, total
+}
+
+// parseVideoQuery will read ?q=&tag=&kind=&sort=&order=&limit=&offset=, tag can be
+// given more than once or comma separated
+func parseVideoQuery(r *http.Request) (VideoQuery, error) {
+	params := r.URL.Query()
+	query := VideoQuery{Text: params.Get("q"), Sort: params.Get("sort")}
+	for _, tag := range params["tag"] {
+		query.Tags = append(query.Tags, strings.Split(tag, ",")...)
+	}
+	if _, err := normalizeTags(query.Tags); err != nil {
+		return query, err
+	}
+
+	if query.Sort == "" {
+		query.Sort = "created"
+	}
+	if _, ok := videoSorts[query.Sort]; !ok {
+		return query, errors.New("sort must be created, duration or views")
+	}
+	switch params.Get("order") {
+	case "":
+		query.Desc = query.Sort == "views"
+	case "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return query, errors.New("order must be asc or desc")
+	}
+
+	switch query.Kind = params.Get("kind"); query.Kind {
+	case "", MediaVideo, MediaAudio, MediaImage:
+	default:
+		return query, errors.New("kind must be video, audio or image")
+	}
+
+	var err error
+	if raw := params.Get("limit"); raw != "" {
+		if query.Limit, err = strconv.Atoi(raw); err != nil || query.Limit < 1 || query.Limit > maxSearchLimit {
+			return query, errors.New("limit must be between 1 and " + strconv.Itoa(maxSearchLimit))
+		}
+	}
+	if raw := params.Get("offset"); raw != "" {
+		if query.Offset, err = strconv.Atoi(raw); err != nil || query.Offset < 0 {
+			return query, errors.New("invalid offset")
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,424 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// memory for hot video blocks, 0 disables the cache
+	SegmentCacheBytes = envInt64("SEGMENT_CACHE_BYTES", 256<<20)
+	// local files already sit in the os page cache and go out with sendfile,
+	// so by default only videos from remote storage are cached. turn it on
+	// when many viewers seeking around the same videos thrash the disk
+	SegmentCacheLocal = envBool("SEGMENT_CACHE_LOCAL", false)
+	// blocks read ahead of a viewer in the background, 0 reads only what is asked for
+	SegmentReadahead = envInt64("SEGMENT_READAHEAD", 2)
+)
+
+const (
+	// videos are cached in aligned blocks of this size
+	segmentBlockSize = 1 << 20
+	// readaheads running at once, more are skipped
+	maxSegmentReadaheads = 8
+)
+
+// buffers of video blocks, an evicted block's buffer is reused once no reader has it
+var segmentBlocks = sync.Pool{New: func() interface{} {
+	buf := make([]byte, segmentBlockSize)
+	return &buf
+}}
+
+// SegmentCache is an lru of video blocks so popular videos are served from
+// memory instead of going to storage for every viewer. it is also the read
+// scheduler of a video's file: readers of overlapping ranges share one read
+// of each block, and the blocks ahead of a viewer are read before it asks
+type SegmentCache struct {
+	capacity int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	items   map[segmentKey]*list.Element
+	loading map[segmentKey]*segmentLoad
+
+	readaheads chan struct{}
+	// videos whose blocks are evicted last, see pins.go
+	pinned func(fileID string) bool
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	evictions  atomic.Int64
+	readBlocks atomic.Int64
+	readahead  atomic.Int64
+}
+
+// segmentKey is a block of one version of an object
+type segmentKey struct {
+	object string
+	block  int64
+}
+
+// fileID is the video the block is of
+func (key segmentKey) fileID() string {
+	fileID, _, _ := strings.Cut(key.object, "@")
+	return fileID
+}
+
+type segmentEntry struct {
+	key  segmentKey
+	data []byte
+
+	// pooled blocks go back to segmentBlocks once they are out of the cache
+	// and the last reader is done with them
+	buf     *[]byte
+	refs    int
+	evicted bool
+}
+
+// a block being read from storage, concurrent misses wait for it instead of
+// all reading the same bytes
+type segmentLoad struct {
+	done  chan struct{}
+	entry *segmentEntry
+	err   error
+	// readers waiting, the entry is handed to each with a reference
+	waiters int
+}
+
+// NewSegmentCache will create a cache holding up to capacity bytes
+func NewSegmentCache(capacity int64) *SegmentCache {
+	return &SegmentCache{
+		capacity:   capacity,
+		lru:        list.New(),
+		items:      make(map[segmentKey]*list.Element),
+		loading:    make(map[segmentKey]*segmentLoad),
+		readaheads: make(chan struct{}, maxSegmentReadaheads),
+	}
+}
+
+// Enabled reports whether anything is cached
+func (sc *SegmentCache) Enabled() bool {
+	return sc.capacity > 0
+}
+
+// Get will return a block, calling load on a miss
+func (sc *SegmentCache) Get(key segmentKey, load func() ([]byte, error)) ([]byte, error) {
+	entry, err := sc.acquire(key, func() (*segmentEntry, error) {
+		data, err := load()
+		return &segmentEntry{data: data}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// not pooled, the data stays valid for the caller
+	sc.release(entry)
+	return entry.data, nil
+}
+
+// acquire will return a block with a reference held, calling load on a
+// miss. release gives the reference back
+func (sc *SegmentCache) acquire(key segmentKey, load func() (*segmentEntry, error)) (*segmentEntry, error) {
+	sc.mu.Lock()
+	if elem, ok := sc.items[key]; ok {
+		sc.lru.MoveToFront(elem)
+		entry := elem.Value.(*segmentEntry)
+		entry.refs++
+		sc.mu.Unlock()
+		sc.hits.Add(1)
+		return entry, nil
+	}
+	if pending, ok := sc.loading[key]; ok {
+		pending.waiters++
+		sc.mu.Unlock()
+		<-pending.done
+		sc.hits.Add(1)
+		return pending.entry, pending.err
+	}
+	pending := &segmentLoad{done: make(chan struct{})}
+	sc.loading[key] = pending
+	sc.mu.Unlock()
+	sc.misses.Add(1)
+
+	entry, err := load()
+	sc.mu.Lock()
+	delete(sc.loading, key)
+	if err != nil {
+		pending.err = err
+		if entry != nil && entry.buf != nil {
+			segmentBlocks.Put(entry.buf)
+		}
+	} else {
+		entry.key = key
+		entry.refs = 1 + pending.waiters
+		pending.entry = entry
+		if !sc.addLocked(entry) {
+			entry.evicted = true
+		}
+	}
+	sc.mu.Unlock()
+	close(pending.done)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// release will give back a reference from acquire
+func (sc *SegmentCache) release(entry *segmentEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	entry.refs--
+	sc.recycleLocked(entry)
+}
+
+// recycleLocked will put an evicted block's buffer back in the pool once
+// nobody reads it
+func (sc *SegmentCache) recycleLocked(entry *segmentEntry) {
+	if entry.evicted && entry.refs == 0 && entry.buf != nil {
+		segmentBlocks.Put(entry.buf)
+		entry.buf, entry.data = nil, nil
+	}
+}
+
+// contains reports whether a block is cached or being read
+func (sc *SegmentCache) contains(key segmentKey) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	_, cached := sc.items[key]
+	_, loading := sc.loading[key]
+	return cached || loading
+}
+
+func (sc *SegmentCache) addLocked(entry *segmentEntry) bool {
+	if int64(len(entry.data)) > sc.capacity {
+		return false
+	}
+	if _, ok := sc.items[entry.key]; ok {
+		return false
+	}
+	sc.items[entry.key] = sc.lru.PushFront(entry)
+	sc.size += int64(len(entry.data))
+	for sc.size > sc.capacity {
+		sc.removeLocked(sc.victimLocked())
+		sc.evictions.Add(1)
+	}
+	return true
+}
+
+// victimLocked is the least recently used block, one of a pinned video only
+// when nothing else is left
+func (sc *SegmentCache) victimLocked() *list.Element {
+	if sc.pinned != nil {
+		for elem := sc.lru.Back(); elem != nil; elem = elem.Prev() {
+			if !sc.pinned(elem.Value.(*segmentEntry).key.fileID()) {
+				return elem
+			}
+		}
+	}
+	return sc.lru.Back()
+}
+
+func (sc *SegmentCache) removeLocked(elem *list.Element) {
+	entry := sc.lru.Remove(elem).(*segmentEntry)
+	delete(sc.items, entry.key)
+	sc.size -= int64(len(entry.data))
+	entry.evicted = true
+	sc.recycleLocked(entry)
+}
+
+// Invalidate will drop every cached block of a video
+func (sc *SegmentCache) Invalidate(fileID string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for key, elem := range sc.items {
+		if strings.HasPrefix(key.object, fileID+"@") {
+			sc.removeLocked(elem)
+		}
+	}
+}
+
+// Flush will empty the cache
+func (sc *SegmentCache) Flush() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for sc.lru.Len() > 0 {
+		sc.removeLocked(sc.lru.Back())
+	}
+}
+
+// Wrap will serve an opened video through the cache, the etag is part of the
+// key so a replaced video never gets old blocks. reopen opens another copy of
+// the video for reading ahead, nil doesn't read ahead
+func (sc *SegmentCache) Wrap(file Object, fileID, etag string, size int64, reopen func() (Object, error)) Object {
+	if !sc.Enabled() {
+		return file
+	}
+	if _, local := file.(*os.File); local && !SegmentCacheLocal {
+		return file
+	}
+	return &cachedObject{Object: file, cache: sc, object: fileID + "@" + etag, size: size, reopen: reopen}
+}
+
+// readBlock will read a whole block of object from file into a pooled buffer
+func (sc *SegmentCache) readBlock(file Object, size, block int64) (*segmentEntry, error) {
+	start := block * segmentBlockSize
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := segmentBlocks.Get().(*[]byte)
+	entry := &segmentEntry{buf: buf, data: (*buf)[:min(segmentBlockSize, size-start)]}
+	if _, err := io.ReadFull(file, entry.data); err != nil {
+		return entry, err
+	}
+	sc.readBlocks.Add(1)
+	return entry, nil
+}
+
+// readAhead will read the blocks after block that aren't cached yet in the
+// background, from a copy of the video of its own
+func (sc *SegmentCache) readAhead(object string, size, block int64, reopen func() (Object, error)) {
+	if reopen == nil || SegmentReadahead <= 0 {
+		return
+	}
+	var ahead []int64
+	for next := block + 1; next <= block+SegmentReadahead && next*segmentBlockSize < size; next++ {
+		if !sc.contains(segmentKey{object: object, block: next}) {
+			ahead = append(ahead, next)
+		}
+	}
+	if len(ahead) == 0 {
+		return
+	}
+	select {
+	case sc.readaheads <- struct{}{}:
+	default:
+		// busy, the viewer reads the blocks itself
+		return
+	}
+	go func() {
+		defer func() { <-sc.readaheads }()
+		file, err := reopen()
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		for _, next := range ahead {
+			entry, err := sc.acquire(segmentKey{object: object, block: next}, func() (*segmentEntry, error) {
+				sc.readahead.Add(1)
+				return sc.readBlock(file, size, next)
+			})
+			if err != nil {
+				return
+			}
+			sc.release(entry)
+		}
+	}()
+}
+
+// cachedObject reads an object block by block from the cache
+type cachedObject struct {
+	Object
+	cache  *SegmentCache
+	object string
+	size   int64
+	offset int64
+	reopen func() (Object, error)
+
+	// the block being read, held so the cache is only asked once per block
+	current *segmentEntry
+}
+
+func (o *cachedObject) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	block := o.offset / segmentBlockSize
+	if o.current == nil || o.current.key.block != block {
+		o.drop()
+		entry, err := o.cache.acquire(segmentKey{object: o.object, block: block}, func() (*segmentEntry, error) {
+			// consecutive blocks continue the same read since the position already matches
+			return o.cache.readBlock(o.Object, o.size, block)
+		})
+		if err != nil {
+			return 0, err
+		}
+		o.current = entry
+		o.cache.readAhead(o.object, o.size, block, o.reopen)
+	}
+	start := o.offset - block*segmentBlockSize
+	if start >= int64(len(o.current.data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, o.current.data[start:])
+	o.offset += int64(n)
+	return n, nil
+}
+
+// drop will let go of the block being read
+func (o *cachedObject) drop() {
+	if o.current != nil {
+		o.cache.release(o.current)
+		o.current = nil
+	}
+}
+
+func (o *cachedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *cachedObject) Close() error {
+	o.drop()
+	return o.Object.Close()
+}
+
+// handleCache will report the cache's hit rate and size (GET) or flush it (DELETE)
+func (sc *SegmentCache) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		sc.Flush()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sc.mu.Lock()
+	size, blocks := sc.size, len(sc.items)
+	sc.mu.Unlock()
+	hits, misses := sc.hits.Load(), sc.misses.Load()
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":    sc.Enabled(),
+		"capacity":   sc.capacity,
+		"bytes":      size,
+		"blocks":     blocks,
+		"block_size": segmentBlockSize,
+		"hits":       hits,
+		"misses":     misses,
+		"evictions":  sc.evictions.Load(),
+		"hit_ratio":  hitRatio,
+		// blocks read from storage, and how many of them ahead of a viewer
+		"blocks_read":      sc.readBlocks.Load(),
+		"blocks_readahead": sc.readahead.Load(),
+	})
+}
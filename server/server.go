@@ -0,0 +1,423 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+var (
+	// origins allowed to call the api from a browser, comma separated, * is any
+	CORSOrigins = envString("CORS_ORIGINS", "")
+	// log a line per request with its status, size and duration
+	AccessLog = envBool("ACCESS_LOG", false)
+)
+
+// Middleware wraps a handler, the router's and the per route ones (auth,
+// rate limits) are all this shape
+type Middleware func(http.Handler) http.Handler
+
+// Chain will wrap h in middleware, the first one given runs first
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Server is the http api over a stream manager, its routes are on its own
+// mux so more than one can run in a process and tests can use Handler()
+type Server struct {
+	sm       *StreamManager
+	limits   *RateLimits
+	election *LeaderElection
+	mux      *http.ServeMux
+	// set with CLUSTER_ROLE=edge, it takes every request instead of mux
+	edge *Edge
+	// every route registered, for the openapi document
+	patterns []string
+
+	// wrap every request, outermost first, after the defaults
+	Middleware []Middleware
+}
+
+// NewServer will register the routes of the api for sm
+func NewServer(sm *StreamManager) (*Server, error) {
+	elector, err := NewElectorFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		sm:       sm,
+		limits:   NewRateLimits(sm.tokens.ClientKey),
+		election: &LeaderElection{elector: elector},
+		mux:      http.NewServeMux(),
+	}
+	if ClusterRole == "edge" {
+		if s.edge, err = NewEdge(sm); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	s.routes()
+	if err := sm.tenants.reserveRoutes(s.patterns...); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Config is what a program embedding the server sets, anything left zero
+// comes from the environment like it does for the binary. the config is
+// process wide, so there is one server per process
+type Config struct {
+	// directory the videos and the server's state are kept in, ./videos
+	// when empty
+	StoragePath string
+	// signs and verifies tokens, AUTH_SECRET when empty
+	AuthSecret string
+	// key of the /admin routes, ADMIN_API_KEY when empty
+	AdminAPIKey string
+	// accept uploads without checking them with ffprobe, like
+	// PROBE_UPLOADS=false
+	DisableProbe bool
+	// credentials of the program's own auth, next to the built in ones
+	Authenticators []Authenticator
+}
+
+// New will set up the server the binary runs for an embedding program. it
+// only serves once Start and Serve are called, or Handler is mounted
+func New(cfg Config) (*Server, error) {
+	if cfg.StoragePath != "" {
+		VideoStoragePath = cfg.StoragePath
+	}
+	if cfg.AuthSecret != "" {
+		AuthSecret = cfg.AuthSecret
+	}
+	if cfg.AdminAPIKey != "" {
+		AdminAPIKey = cfg.AdminAPIKey
+	}
+	if cfg.DisableProbe {
+		ProbeUploads = false
+	}
+	sm, err := NewStreamManager()
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewServer(sm)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range cfg.Authenticators {
+		s.AddAuthenticator(a)
+	}
+	return s, nil
+}
+
+// Handle will add a route next to the builtin ones, for programs that add
+// their own endpoints
+func (s *Server) Handle(pattern string, h http.Handler) {
+	if err := s.sm.tenants.reserveRoutes(pattern); err != nil {
+		log.Println(err)
+	}
+	s.patterns = append(s.patterns, pattern)
+	s.mux.Handle(pattern, h)
+}
+
+// AddAuthenticator will accept the credentials of another auth system on
+// every route that needs a token, see auth.go
+func (s *Server) AddAuthenticator(a Authenticator) {
+	s.sm.tokens.AddAuthenticator(a)
+}
+
+// Handler is the whole api, recovery and logging go around the tenant
+// resolution so they see every request
+func (s *Server) Handler() http.Handler {
+	// the origin does cors and error bodies for what the edge passes on
+	if s.edge != nil {
+		return Chain(s.edge, append([]Middleware{DropSlowClients, s.Trace, Recover, LogRequests}, s.Middleware...)...)
+	}
+	middleware := append([]Middleware{DropSlowClients, s.Trace, Recover, LogRequests, CORS, JSONErrors, s.sm.audit.Middleware, s.sm.tenants.Resolve}, s.Middleware...)
+	return Chain(s.mux, middleware...)
+}
+
+// Start will run the background work, per replica cleanup, the leader
+// election for the singletons, the ingest consumers and the grpc api
+func (s *Server) Start(ctx context.Context) error {
+	if tracer != nil {
+		supervisor.Go(ctx, "trace-export", RestartAlways, tracer.export)
+	}
+	// an edge has no videos, the origin does all of this
+	if s.edge != nil {
+		return nil
+	}
+	sources, err := NewIngestSourcesFromEnv()
+	if err != nil {
+		return err
+	}
+	supervisor.Go(ctx, "leader-election", RestartAlways, func(ctx context.Context) error {
+		s.election.Run(ctx, func(ctx context.Context) {
+			runSingletonTasks(ctx, s.sm.singletonTasks())
+		})
+		return nil
+	})
+	supervisor.Go(ctx, "session-cleanup", RestartAlways, s.sm.cleanupRoutine)
+	s.sm.jobs.Start(ctx)
+	s.sm.warmPins()
+	if CollectionTreePath != "" {
+		supervisor.Go(ctx, "collection-tree", RestartAlways, s.sm.collectionTreeRoutine)
+	}
+	// every replica consumes the ingest queues as part of a group
+	s.sm.runIngest(ctx, sources)
+
+	// grpc api for internal services, same manager and storage as the http one
+	if GRPCAddr != "" {
+		supervisor.Go(ctx, "grpc", RestartAlways, func(ctx context.Context) error {
+			return s.sm.serveGRPC(GRPCAddr, s.limits)
+		})
+	}
+	return nil
+}
+
+func (s *Server) routes() {
+	sm, limits, mux := s.sm, s.limits, apiMux{s}
+	tokens := sm.tokens
+	diagnostics := sm.diagnostics
+
+	// upload, resumable in chunks
+	mux.HandleFunc("POST /api/upload", limits.Upload.Limit(sm.isNewUpload, tokens.RequireUpload(sm.handleUpload)))
+
+	// committed offset of an upload, for resuming after a failure or restart
+	mux.HandleFunc("GET /api/upload", limits.Metadata.Limit(nil, tokens.RequireUpload(sm.handleUploadStatus)))
+	mux.HandleFunc("GET /api/upload/{id}/offset", limits.Metadata.Limit(nil, tokens.RequireUpload(sm.handleUploadOffset)))
+	// a url a browser can upload one file to without a key, see presign.go
+	mux.HandleFunc("POST /api/uploads/presign", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handlePresignUpload)))
+	// the server fetches the video itself, for moving libraries over
+	mux.HandleFunc("POST /api/upload/from-url", limits.Upload.Limit(nil, tokens.Require(ScopeUpload, sm.handlePullUpload)))
+	// pausing keeps an upload from being cleaned up for up to UPLOAD_PAUSE_MAX
+	mux.HandleFunc("POST /api/upload/pause", limits.Metadata.Limit(nil, tokens.RequireUpload(sm.handlePauseUpload)))
+	mux.HandleFunc("POST /api/upload/resume", limits.Metadata.Limit(nil, tokens.RequireUpload(sm.handleResumeUpload)))
+
+	// subtitle upload and webvtt conversion
+	mux.HandleFunc("GET /api/subtitles", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleSubtitles)))
+	mux.HandleFunc("POST /api/subtitles", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleSubtitles)))
+
+	// this will handle the video streaming
+	mux.HandleFunc("/api/watch", diagnostics.Track(sm.trackAnalytics(sm.countStream(limits.Streams.Limit(limits.Playback.Limit(isPlaybackStart, tokens.Require(ScopePlayback, sm.restrictPlayback(sm.egress.Limit(EgressInteractive, sm.handleWatch)))))))))
+
+	// audio only rendition, for podcast style listening and slow connections
+	mux.HandleFunc("GET /api/audio/{id}", diagnostics.Track(sm.countStream(limits.Streams.Limit(limits.Playback.Limit(isPlaybackStart, tokens.Require(ScopePlayback, sm.restrictPlayback(sm.egress.Limit(EgressInteractive, sm.handleAudio))))))))
+
+	// hls packaging, segments and the aes key need the playlist's session token
+	mux.HandleFunc("GET /api/hls/{id}/index.m3u8", diagnostics.Track(sm.trackAnalytics(limits.Playback.Limit(isPlaybackStart, tokens.Require(ScopePlayback, sm.restrictPlayback(sm.egress.Limit(EgressInteractive, sm.handleHLSPlaylist)))))))
+	mux.HandleFunc("GET /api/hls/{id}/{file}", diagnostics.Track(sm.trackAnalytics(sm.countStream(limits.Streams.Limit(tokens.RequireSession(sm.restrictPlayback(sm.egress.Limit(EgressInteractive, sm.handleHLSFile))))))))
+	// dash of abr packages, its segments are the hls ones
+	mux.HandleFunc("GET /api/dash/{id}/manifest.mpd", diagnostics.Track(sm.trackAnalytics(limits.Playback.Limit(isPlaybackStart, tokens.Require(ScopePlayback, sm.restrictPlayback(sm.egress.Limit(EgressInteractive, sm.handleDASHManifest)))))))
+
+	// original file as an attachment, needs its own token scope
+	mux.HandleFunc("GET /api/download/{id}", diagnostics.Track(sm.countStream(limits.Streams.Limit(limits.Playback.Limit(isPlaybackStart, tokens.Require(ScopeDownload, sm.restrictPlayback(sm.egress.Limit(EgressBulk, sm.handleDownload))))))))
+
+	// liveness and readiness probes for kubernetes and load balancers
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", sm.handleReadyz)
+
+	// embedded player and its error beacon
+	mux.HandleFunc("GET /watch/{id}", sm.restrictPlayback(sm.handlePlayer))
+	mux.HandleFunc("POST /api/beacon", limits.Metadata.Limit(nil, diagnostics.handleBeacon))
+	mux.HandleFunc("GET /admin/diagnostics", requireAdmin(diagnostics.handleListDiagnostics))
+
+	// short links for sharing, they resolve to the watch page or a signed stream url
+	mux.HandleFunc("GET /s/{code}", limits.Metadata.Limit(nil, sm.handleShortLink))
+	mux.HandleFunc("GET /api/links", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleListLinks)))
+	mux.HandleFunc("POST /api/links", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleCreateLink)))
+	mux.HandleFunc("GET /api/links/{code}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleGetLink)))
+	mux.HandleFunc("DELETE /api/links/{code}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleDeleteLink)))
+
+	// live viewer counts and watch parties
+	mux.HandleFunc("GET /api/videos/{id}/events", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleVideoEvents)))
+	mux.HandleFunc("POST /api/videos/{id}/parties", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleCreateParty)))
+	mux.HandleFunc("POST /api/videos/{id}/parties/{party}/events", limits.Metadata.Limit(nil, sm.handlePartyEvent))
+
+	// timed events like chapters or "poll started", added while people watch
+	mux.HandleFunc("GET /api/videos/{id}/markers", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleListMarkers)))
+	mux.HandleFunc("POST /api/videos/{id}/markers", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleCreateMarker)))
+	mux.HandleFunc("DELETE /api/videos/{id}/markers/{marker}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleDeleteMarker)))
+	mux.HandleFunc("GET /api/videos/{id}/chapters", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleGetChapters)))
+	mux.HandleFunc("GET /api/videos/{id}/chapters.vtt", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleChaptersVTT)))
+	mux.HandleFunc("PUT /api/videos/{id}/chapters", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handlePutChapters)))
+	// poster and animated preview from the moment viewers rewatch most
+	mux.HandleFunc("GET /api/videos/{id}/poster.jpg", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handlePreview("poster"))))
+	mux.HandleFunc("GET /api/videos/{id}/preview.webp", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handlePreview("preview"))))
+	// a frame with the watermark the hls package gets, or one to try out
+	mux.HandleFunc("GET /api/videos/{id}/watermark.jpg", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleWatermarkPreview)))
+
+	// video metadata
+	mux.HandleFunc("GET /api/videos", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleListVideos)))
+	mux.HandleFunc("GET /api/videos/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleGetVideo)))
+	mux.HandleFunc("PATCH /api/videos/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleUpdateVideo)))
+	mux.HandleFunc("GET /api/videos/{id}/analytics", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleVideoAnalytics)))
+	mux.HandleFunc("POST /api/videos/{id}/clip", limits.Upload.Limit(nil, tokens.Require(ScopeUpload, sm.handleCreateClip)))
+
+	// encodes and packaging running or waiting for a worker
+	mux.HandleFunc("GET /api/transcodes", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleListTranscodes)))
+	mux.HandleFunc("DELETE /api/transcodes/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleCancelTranscode)))
+
+	// when an upload would be ready, for upload ui progress
+	mux.HandleFunc("POST /api/estimate", limits.Metadata.Limit(nil, sm.handleEstimate))
+
+	// crawler and indexing controls
+	mux.HandleFunc("GET /robots.txt", limits.Metadata.Limit(nil, sm.handleRobots))
+	mux.HandleFunc("GET /sitemap.xml", limits.Metadata.Limit(nil, sm.handleSitemap))
+
+	// self service account endpoints for the signed in user
+	mux.HandleFunc("GET /api/me", limits.Metadata.Limit(nil, sm.handleAccount))
+	mux.HandleFunc("GET /api/me/videos", limits.Metadata.Limit(nil, sm.handleAccountVideos))
+	mux.HandleFunc("DELETE /api/me/videos/{id}", limits.Metadata.Limit(nil, sm.handleAccountDeleteVideo))
+	mux.HandleFunc("GET /api/me/tokens", limits.Metadata.Limit(nil, sm.handleAccountTokens))
+	mux.HandleFunc("POST /api/me/tokens", limits.Metadata.Limit(nil, sm.handleAccountIssueToken))
+	mux.HandleFunc("DELETE /api/me/tokens/{jti}", limits.Metadata.Limit(nil, sm.handleAccountRevokeToken))
+	mux.HandleFunc("GET /api/me/history", limits.Metadata.Limit(nil, sm.handleAccountHistory))
+	mux.HandleFunc("DELETE /api/me/history", limits.Metadata.Limit(nil, sm.handleAccountHistory))
+
+	// playlists
+	mux.HandleFunc("GET /api/playlists", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleListPlaylists)))
+	mux.HandleFunc("POST /api/playlists", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleCreatePlaylist)))
+	mux.HandleFunc("GET /api/playlists/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleGetPlaylist)))
+	mux.HandleFunc("PATCH /api/playlists/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleUpdatePlaylist)))
+	mux.HandleFunc("DELETE /api/playlists/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleDeletePlaylist)))
+	mux.HandleFunc("POST /api/playlists/{id}/videos", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleAddPlaylistVideo)))
+	mux.HandleFunc("PUT /api/playlists/{id}/videos", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleReorderPlaylist)))
+	mux.HandleFunc("DELETE /api/playlists/{id}/videos/{videoID}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleRemovePlaylistVideo)))
+	mux.HandleFunc("GET /api/playlists/{id}/{format}", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handlePlaylistManifest)))
+
+	// collections, nested folders of videos
+	mux.HandleFunc("GET /api/collections", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleListCollections)))
+	mux.HandleFunc("POST /api/collections", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleCreateCollection)))
+	mux.HandleFunc("GET /api/collections/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopePlayback, sm.handleGetCollection)))
+	mux.HandleFunc("PATCH /api/collections/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleUpdateCollection)))
+	mux.HandleFunc("DELETE /api/collections/{id}", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleDeleteCollection)))
+	mux.HandleFunc("POST /api/collections/{id}/videos", limits.Metadata.Limit(nil, tokens.Require(ScopeUpload, sm.handleMoveToCollection)))
+
+	// token management for playback and upload tokens
+	mux.HandleFunc("GET /admin/tokens", requireAdmin(tokens.handleListTokens))
+	mux.HandleFunc("POST /admin/tokens", requireAdmin(tokens.handleIssueToken))
+	mux.HandleFunc("POST /admin/tokens/introspect", requireAdmin(tokens.handleIntrospectToken))
+	mux.HandleFunc("POST /admin/tokens/revoke", requireAdmin(tokens.handleRevokeTokens))
+
+	// hot video block cache stats and flush
+	mux.HandleFunc("GET /admin/cache", requireAdmin(sm.cache.handleCache))
+	mux.HandleFunc("DELETE /admin/cache", requireAdmin(sm.cache.handleCache))
+	// bytes each egress class sent under EGRESS_LIMIT
+	mux.HandleFunc("GET /admin/egress", requireAdmin(sm.egress.handleEgress))
+
+	// pinned videos, made and cached ahead of a launch with streams reserved
+	mux.HandleFunc("GET /admin/pins", requireAdmin(sm.handleListPins))
+	mux.HandleFunc("GET /admin/pins/{id}", requireAdmin(sm.handlePin))
+	mux.HandleFunc("PUT /admin/pins/{id}", requireAdmin(sm.handlePin))
+	mux.HandleFunc("DELETE /admin/pins/{id}", requireAdmin(sm.handlePin))
+
+	// transcode profiles, picked per tenant or video by name
+	mux.HandleFunc("GET /admin/profiles", requireAdmin(sm.handleListProfiles))
+	mux.HandleFunc("POST /admin/profiles", requireAdmin(sm.handlePutProfile))
+	mux.HandleFunc("GET /admin/profiles/{name}", requireAdmin(sm.handleGetProfile))
+	mux.HandleFunc("PUT /admin/profiles/{name}", requireAdmin(sm.handlePutProfile))
+	mux.HandleFunc("DELETE /admin/profiles/{name}", requireAdmin(sm.handleDeleteProfile))
+
+	// catalog totals by codec, resolution, duration, age and tenant
+	mux.HandleFunc("GET /admin/stats", requireAdmin(sm.handleLibraryStats))
+
+	// tenant quotas, usage and request stats
+	mux.HandleFunc("GET /admin/tenants", requireAdmin(sm.handleListTenants))
+
+	// which replica runs the singleton tasks
+	mux.HandleFunc("GET /admin/leader", requireAdmin(s.election.handleLeaderStatus))
+
+	// audit trail of uploads, deletes, tokens, admin changes and refused requests
+	mux.HandleFunc("GET /admin/audit", requireAdmin(sm.handleAudit))
+
+	// background workers, restarts and last errors
+	mux.HandleFunc("GET /admin/workers", requireAdmin(supervisor.handleWorkers))
+
+	// the persistent job queue, dead jobs are the ones that ran out of tries
+	mux.HandleFunc("GET /admin/jobs", requireAdmin(sm.jobs.handleListJobs))
+	mux.HandleFunc("GET /admin/jobs/{id}", requireAdmin(sm.jobs.handleJob))
+	mux.HandleFunc("DELETE /admin/jobs/{id}", requireAdmin(sm.jobs.handleJob))
+	mux.HandleFunc("POST /admin/jobs/{id}/retry", requireAdmin(sm.jobs.handleRetryJob))
+
+	// moving the videos between storages, dry_run reports what would move
+	mux.HandleFunc("POST /admin/storage/migrate", requireAdmin(sm.handleMigrateStorage))
+	mux.HandleFunc("GET /admin/storage/migrate", requireAdmin(sm.handleMigration))
+	mux.HandleFunc("DELETE /admin/storage/migrate", requireAdmin(sm.handleMigration))
+
+	// openapi document of the routes above, a docs page over it and the
+	// clients generated from it
+	mux.HandleFunc("GET /api/openapi.json", limits.Metadata.Limit(nil, s.handleOpenAPI))
+	mux.HandleFunc("GET /api/docs", limits.Metadata.Limit(nil, handleAPIDocs))
+	mux.HandleFunc("GET /api/clients/{lang}", limits.Metadata.Limit(nil, s.handleAPIClient))
+}
+
+// Recover will turn a panic in a handler into a 500 instead of a dropped
+// connection, aborted requests still abort
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			writeError(w, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LogRequests will log every request when ACCESS_LOG is on. the query isn't
+// logged, it can carry tokens
+func LogRequests(next http.Handler) http.Handler {
+	if !AccessLog {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s %s %d %d %s", clientIP(r), r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// CORS will let browsers on CORS_ORIGINS call the api and answer their
+// preflight requests, nothing is added when it is empty
+func CORS(next http.Handler) http.Handler {
+	if CORSOrigins == "" {
+		return next
+	}
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(CORSOrigins, ",") {
+		allowed[strings.TrimSpace(origin)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Upload-Offset, X-Total-Count, ETag, Content-Range, X-Content-SHA256, Digest")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Range, Upload-Offset, X-API-Key, X-Content-SHA256, Digest")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// signs playback session tokens, every instance behind the load balancer
+	// needs the same one. falls back to AUTH_SECRET
+	PlaybackSessionSecret = envString("PLAYBACK_SESSION_SECRET", "")
+	// how long a playback session token is accepted
+	PlaybackSessionTTL = envDuration("PLAYBACK_SESSION_TTL", 12*time.Hour)
+	// publish every request of a playback session as an event, for analytics
+	// that stitch sessions together across instances
+	PlaybackRequestEvents = envBool("PLAYBACK_REQUEST_EVENTS", false)
+)
+
+// EventPlaybackRequest is a request made in a playback session
+const EventPlaybackRequest = "playback.request"
+
+// PlaybackSession identifies one viewing of a video, whichever instance the
+// viewer's requests land on
+type PlaybackSession struct {
+	ID      string `json:"sid"`
+	VideoID string `json:"vid"`
+	Tenant  string `json:"tnt,omitempty"`
+	// instance that started the session
+	Origin    string `json:"org"`
+	StartedAt int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// PlaybackSessions will issue and check signed playback session tokens, they
+// carry everything needed so no instance has to share state with another
+type PlaybackSessions struct {
+	secret   []byte
+	instance string
+}
+
+// NewPlaybackSessions will create the signer, a random secret only works on a single instance
+func NewPlaybackSessions() *PlaybackSessions {
+	secret := PlaybackSessionSecret
+	if secret == "" {
+		secret = AuthSecret
+	}
+	if secret == "" {
+		random := make([]byte, 32)
+		rand.Read(random)
+		secret = string(random)
+		log.Println("PLAYBACK_SESSION_SECRET not set, playback sessions only work on this instance")
+	}
+	return &PlaybackSessions{secret: []byte(secret), instance: leaderIdentity()}
+}
+
+// Issue will start a playback session of a video
+func (ps *PlaybackSessions) Issue(videoID, tenantID string) (string, PlaybackSession) {
+	id := make([]byte, 12)
+	rand.Read(id)
+	now := time.Now()
+	session := PlaybackSession{
+		ID:        hex.EncodeToString(id),
+		VideoID:   videoID,
+		Tenant:    tenantID,
+		Origin:    ps.instance,
+		StartedAt: now.Unix(),
+		ExpiresAt: now.Add(PlaybackSessionTTL).Unix(),
+	}
+	payload, _ := json.Marshal(session)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + ps.sign(encoded), session
+}
+
+var errPlaybackSession = errors.New("invalid playback session")
+
+// Parse will check a playback session token's signature and expiry
+func (ps *PlaybackSessions) Parse(token string) (PlaybackSession, error) {
+	var session PlaybackSession
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(ps.sign(encoded))) {
+		return session, errPlaybackSession
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &session) != nil {
+		return session, errPlaybackSession
+	}
+	if time.Now().Unix() >= session.ExpiresAt {
+		return session, errPlaybackSession
+	}
+	return session, nil
+}
+
+func (ps *PlaybackSessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, ps.secret)
+	mac.Write([]byte("playback-session:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// FromRequest will return the request's playback session (X-Playback-Session
+// header or ?ps=), it must be for the requested video
+func (ps *PlaybackSessions) FromRequest(r *http.Request) (string, PlaybackSession, bool) {
+	token := r.Header.Get("X-Playback-Session")
+	if token == "" {
+		token = r.URL.Query().Get("ps")
+	}
+	if token == "" {
+		return "", PlaybackSession{}, false
+	}
+	session, err := ps.Parse(token)
+	if err != nil || session.VideoID != requestedVideoID(r) || !inTenant(session.Tenant, tenantFrom(r).ID) {
+		return "", PlaybackSession{}, false
+	}
+	return token, session, true
+}
+
+type playbackSessionKey struct{}
+
+// the playback session Track found or started for a request
+type playbackContext struct {
+	token   string
+	session PlaybackSession
+}
+
+// playbackSessionFrom will return the playback session token Track found or
+// started for a request, to be carried in urls the response hands out
+func playbackSessionFrom(ctx context.Context) string {
+	pc, _ := ctx.Value(playbackSessionKey{}).(playbackContext)
+	return pc.token
+}
+
+// playbackSessionOf will return the playback session of a request
+func playbackSessionOf(ctx context.Context) (PlaybackSession, bool) {
+	pc, ok := ctx.Value(playbackSessionKey{}).(playbackContext)
+	return pc.session, ok
+}
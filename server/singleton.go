@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partial uploads nobody has touched for this long are abandoned
+var StaleUploadAge = envDuration("STALE_UPLOAD_AGE", 24*time.Hour)
+
+// SingletonTask is background work that must run on only one replica at a time,
+// it runs on the elected leader
+type SingletonTask struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context)
+}
+
+// singletonTasks is the cluster wide background work
+func (sm *StreamManager) singletonTasks() []SingletonTask {
+	return []SingletonTask{
+		{Name: "storage-cleanup", Interval: 15 * time.Minute, Run: sm.cleanupStorage},
+		{Name: "retention-reaper", Interval: time.Minute, Run: sm.reapExpiredVideos},
+		{Name: "clip-resume", Interval: time.Minute, Run: sm.resumeClipJobs},
+		{Name: "job-sweep", Interval: time.Minute, Run: sm.jobs.sweepJobs},
+		{Name: "rendition-prune", Interval: time.Hour, Run: sm.pruneRenditions},
+		{Name: "preview-refresh", Interval: PreviewRefresh, Run: sm.refreshPreviews},
+	}
+}
+
+// runSingletonTasks will run every task on its interval until ctx is cancelled,
+// which happens when leadership is lost
+func runSingletonTasks(ctx context.Context, tasks []SingletonTask) {
+	for _, task := range tasks {
+		supervisor.Go(ctx, task.Name, RestartAlways, func(ctx context.Context) error {
+			ticker := time.NewTicker(task.Interval)
+			defer ticker.Stop()
+			for {
+				task.Run(ctx)
+				select {
+				case <-ctx.Done():
+					log.Println("stopped singleton task", task.Name)
+					return nil
+				case <-ticker.C:
+				}
+			}
+		})
+	}
+}
+
+// cleanupStorage will delete partial uploads that were abandoned (on any
+// replica) and temp files left behind by a crash
+func (sm *StreamManager) cleanupStorage(ctx context.Context) {
+	sm.cleanupDir(ctx, VideoStoragePath, DefaultTenantID, false)
+	sm.cleanupDir(ctx, filepath.Join(VideoStoragePath, ".staging"), DefaultTenantID, true)
+}
+
+// cleanupDir will clean one directory, tenant directories are cleaned from
+// the top one. in staging a partial upload may replace a video that has a
+// record
+func (sm *StreamManager) cleanupDir(ctx context.Context, dir, tenantID string, staging bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// nothing was ever staged
+		if staging && os.IsNotExist(err) {
+			return
+		}
+		log.Println("storage cleanup:", err)
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if entry.IsDir() {
+			if tenantID == DefaultTenantID && sm.tenants.byID[name] != nil {
+				sm.cleanupDir(ctx, path, name, staging)
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(name, ".tmp-") && now.Sub(info.ModTime()) > time.Hour:
+			os.Remove(path)
+
+		case strings.HasSuffix(name, ".mp4") && now.Sub(info.ModTime()) > StaleUploadAge:
+			// finished uploads have a record, partial ones don't
+			fileID := scopeID(tenantID, strings.TrimSuffix(name, ".mp4"))
+			if _, ok := sm.metadata.GetVideo(fileID); ok && !staging {
+				continue
+			}
+			if _, active := sm.uploadSessions.Load(fileID); active {
+				continue
+			}
+			// paused on another replica
+			if saved, err := loadUploadSession(uploadStatePath(path)); err == nil && saved.paused() {
+				continue
+			}
+			log.Println("removing abandoned upload", fileID)
+			os.Remove(path)
+			os.Remove(uploadStatePath(path))
+		}
+	}
+}
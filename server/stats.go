@@ -0,0 +1,219 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// a count of videos and their bytes
+type statsBucket struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (b *statsBucket) add(size int64, sign int) {
+	b.Count += sign
+	b.Bytes += int64(sign) * size
+}
+
+// libraryStats are a tenant's catalog totals, kept up to date by the metadata
+// store on every change so reporting them never walks the library
+type libraryStats struct {
+	total      statsBucket
+	codec      map[string]*statsBucket
+	resolution map[string]*statsBucket
+	duration   map[string]*statsBucket
+	status     map[string]*statsBucket
+	// by day created, ages move with the clock so they are bucketed when asked
+	created map[string]*statsBucket
+}
+
+func newLibraryStats() *libraryStats {
+	return &libraryStats{
+		codec:      make(map[string]*statsBucket),
+		resolution: make(map[string]*statsBucket),
+		duration:   make(map[string]*statsBucket),
+		status:     make(map[string]*statsBucket),
+		created:    make(map[string]*statsBucket),
+	}
+}
+
+// count will add (sign 1) or remove (sign -1) a video, rejected uploads are
+// deleted so they don't count
+func (ls *libraryStats) count(video *VideoRecord, sign int) {
+	if video.Status == VideoStatusRejected {
+		return
+	}
+	status := video.Status
+	if status == "" {
+		status = VideoStatusReady
+	}
+	codec := codecName(video.Codec)
+	if codec == "" {
+		codec = "unknown"
+	}
+	ls.total.add(video.Size, sign)
+	addStat(ls.codec, codec, video.Size, sign)
+	addStat(ls.resolution, resolutionBucket(video.Height), video.Size, sign)
+	addStat(ls.duration, durationBucket(video.Duration), video.Size, sign)
+	addStat(ls.status, status, video.Size, sign)
+	addStat(ls.created, video.CreatedAt.UTC().Format(time.DateOnly), video.Size, sign)
+}
+
+func addStat(buckets map[string]*statsBucket, key string, size int64, sign int) {
+	b, ok := buckets[key]
+	if !ok {
+		b = &statsBucket{}
+		buckets[key] = b
+	}
+	b.add(size, sign)
+	if b.Count == 0 {
+		delete(buckets, key)
+	}
+}
+
+func mergeStat(buckets map[string]*statsBucket, key string, from *statsBucket) {
+	b, ok := buckets[key]
+	if !ok {
+		b = &statsBucket{}
+		buckets[key] = b
+	}
+	b.Count += from.Count
+	b.Bytes += from.Bytes
+}
+
+func resolutionBucket(height int) string {
+	for _, standard := range []int{2160, 1440, 1080, 720, 480, 360} {
+		if height >= standard {
+			return strconv.Itoa(standard) + "p"
+		}
+	}
+	if height > 0 {
+		return "below-360p"
+	}
+	return "unknown"
+}
+
+func durationBucket(seconds float64) string {
+	switch {
+	case seconds <= 0:
+		return "unknown"
+	case seconds < 60:
+		return "0-1m"
+	case seconds < 5*60:
+		return "1m-5m"
+	case seconds < 20*60:
+		return "5m-20m"
+	case seconds < 60*60:
+		return "20m-1h"
+	default:
+		return "1h+"
+	}
+}
+
+func ageBucket(age time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case age < day:
+		return "0-1d"
+	case age < 7*day:
+		return "1d-7d"
+	case age < 30*day:
+		return "7d-30d"
+	case age < 365*day:
+		return "30d-1y"
+	default:
+		return "1y+"
+	}
+}
+
+// the json report of one or more tenants' stats
+type libraryReport struct {
+	Total      statsBucket             `json:"total"`
+	Codec      map[string]*statsBucket `json:"codec"`
+	Resolution map[string]*statsBucket `json:"resolution"`
+	Duration   map[string]*statsBucket `json:"duration"`
+	Age        map[string]*statsBucket `json:"age"`
+	Status     map[string]*statsBucket `json:"status"`
+	Tenant     map[string]*statsBucket `json:"tenant"`
+}
+
+// countLocked will add a video to (sign 1) or remove it from (sign -1) its
+// tenant's stats, caller holds mu
+func (ms *MetadataStore) countLocked(video *VideoRecord, sign int) {
+	tenantID := video.Tenant
+	if tenantID == "" {
+		tenantID = DefaultTenantID
+	}
+	ls, ok := ms.stats[tenantID]
+	if !ok {
+		ls = newLibraryStats()
+		ms.stats[tenantID] = ls
+	}
+	ls.count(video, sign)
+}
+
+// LibraryStats will sum the stats of the given tenants, all of them when nil
+func (ms *MetadataStore) LibraryStats(tenantIDs []string) libraryReport {
+	report := libraryReport{
+		Codec:      make(map[string]*statsBucket),
+		Resolution: make(map[string]*statsBucket),
+		Duration:   make(map[string]*statsBucket),
+		Age:        make(map[string]*statsBucket),
+		Status:     make(map[string]*statsBucket),
+		Tenant:     make(map[string]*statsBucket),
+	}
+	merge := func(into, from map[string]*statsBucket) {
+		for key, b := range from {
+			mergeStat(into, key, b)
+		}
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if tenantIDs == nil {
+		for tenantID := range ms.stats {
+			tenantIDs = append(tenantIDs, tenantID)
+		}
+		sort.Strings(tenantIDs)
+	}
+	today := time.Now().UTC()
+	for _, tenantID := range tenantIDs {
+		ls, ok := ms.stats[tenantID]
+		if !ok || ls.total.Count == 0 {
+			continue
+		}
+		report.Total.Count += ls.total.Count
+		report.Total.Bytes += ls.total.Bytes
+		total := ls.total
+		report.Tenant[tenantID] = &total
+		merge(report.Codec, ls.codec)
+		merge(report.Resolution, ls.resolution)
+		merge(report.Duration, ls.duration)
+		merge(report.Status, ls.status)
+		for date, b := range ls.created {
+			created, err := time.Parse(time.DateOnly, date)
+			if err != nil {
+				continue
+			}
+			mergeStat(report.Age, ageBucket(today.Sub(created)), b)
+		}
+	}
+	return report
+}
+
+// handleLibraryStats will report catalog totals for capacity planning,
+// ?tenant= narrows them to one tenant
+func (sm *StreamManager) handleLibraryStats(w http.ResponseWriter, r *http.Request) {
+	var tenantIDs []string
+	if tenantID := r.URL.Query().Get("tenant"); tenantID != "" {
+		if _, ok := sm.tenants.byID[tenantID]; !ok && tenantID != DefaultTenantID {
+			writeError(w, http.StatusNotFound, "tenant not found")
+			return
+		}
+		tenantIDs = []string{tenantID}
+	}
+	writeJSON(w, http.StatusOK, sm.metadata.LibraryStats(tenantIDs))
+}
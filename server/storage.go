@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Object is an opened stored file, *os.File satisfies it so local files keep
+// the sendfile path when served
+type Object interface {
+	io.ReadSeekCloser
+	Stat() (os.FileInfo, error)
+}
+
+// Storage is where finished videos live
+type Storage interface {
+	// Put will store size bytes read from r under key
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open will open key for reading
+	Open(ctx context.Context, key string) (Object, error)
+	// Stat will return size and modification time of key
+	Stat(ctx context.Context, key string) (os.FileInfo, error)
+	// Delete will remove key
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalStorage will store files in a directory
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage will create a local storage rooted at dir
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+func (ls *LocalStorage) path(key string) string {
+	return filepath.Join(ls.root, filepath.FromSlash(key))
+}
+
+func (ls *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path := ls.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (ls *LocalStorage) Open(ctx context.Context, key string) (Object, error) {
+	return os.Open(ls.path(key))
+}
+
+func (ls *LocalStorage) Stat(ctx context.Context, key string) (os.FileInfo, error) {
+	return os.Stat(ls.path(key))
+}
+
+func (ls *LocalStorage) Delete(ctx context.Context, key string) error {
+	return os.Remove(ls.path(key))
+}
+
+// NewStorageFromEnv will build the storage driver selected by STORAGE_DRIVER
+func NewStorageFromEnv() Storage {
+	s, err := storageFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+func storageFromEnv() (Storage, error) {
+	switch driver := envString("STORAGE_DRIVER", "local"); driver {
+	case "local":
+		return NewLocalStorage(VideoStoragePath), nil
+	case "s3":
+		s3, err := NewS3Storage(S3ConfigFromEnv())
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 storage config: %w", err)
+		}
+		if StorageReadIdle > 0 {
+			return NewCoalescingStorage(s3), nil
+		}
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %s", driver)
+	}
+}
+
+// isLocalStorage reports whether videos are served straight from VideoStoragePath
+func isLocalStorage(s Storage) bool {
+	for {
+		wrapped, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			break
+		}
+		s = wrapped.Unwrap()
+	}
+	_, ok := s.(*LocalStorage)
+	return ok
+}
+
+// videoKey is the storage key of a video's original file
+func videoKey(fileID string) string {
+	return fileID + ".mp4"
+}
+
+// openVideo will open a video, preferring the local copy (uploads that haven't
+// been published yet, or local storage) over the storage driver. encrypted
+// videos are decrypted as they are read
+func (sm *StreamManager) openVideo(ctx context.Context, fileID string) (Object, error) {
+	var obj Object
+	file, err := os.Open(filepath.Join(VideoStoragePath, videoKey(fileID)))
+	if err == nil {
+		obj = file
+	} else if isLocalStorage(sm.storage) {
+		return nil, err
+	} else if obj, err = sm.storage.Open(ctx, videoKey(fileID)); err != nil {
+		return nil, err
+	}
+
+	decrypted, err := sm.keys.Open(obj)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// statLocalVideo will stat a video's local copy, encrypted ones report their
+// decrypted size
+func (sm *StreamManager) statLocalVideo(fileID string) (os.FileInfo, error) {
+	file, err := os.Open(filepath.Join(VideoStoragePath, videoKey(fileID)))
+	if err != nil {
+		return nil, err
+	}
+	obj, err := sm.keys.Open(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	defer obj.Close()
+	return obj.Stat()
+}
+
+// localVideoPath will return a file ffmpeg can read for a video, videos in
+// remote storage or encrypted are fetched into a temp file that cleanup removes
+func (sm *StreamManager) localVideoPath(ctx context.Context, fileID string) (string, func(), error) {
+	source, err := sm.openVideo(ctx, fileID)
+	if err != nil {
+		return "", nil, err
+	}
+	defer source.Close()
+	if file, ok := source.(*os.File); ok {
+		return file.Name(), func() {}, nil
+	}
+
+	dir := filepath.Dir(filepath.Join(VideoStoragePath, videoKey(fileID)))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = io.Copy(tmp, source)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+// publishVideo will copy a finished upload into remote storage and drop the local copy
+func (sm *StreamManager) publishVideo(fileID string) {
+	if isLocalStorage(sm.storage) {
+		return
+	}
+
+	localPath := filepath.Join(VideoStoragePath, videoKey(fileID))
+	file, err := os.Open(localPath)
+	if err != nil {
+		log.Println("failed to open video for publishing", fileID, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Println("failed to stat video for publishing", fileID, err)
+		return
+	}
+
+	if err := sm.storage.Put(context.Background(), videoKey(fileID), file, info.Size()); err != nil {
+		log.Println("failed to publish video", fileID, err)
+		return
+	}
+	os.Remove(localPath)
+}
+
+// files derived from a video (audio, hls) that are being built, a second
+// request for the same output waits for the first
+var derivedBuilds sync.Map
+
+type derivedBuild struct {
+	done chan struct{}
+	err  error
+	job  *TranscodeJob
+}
+
+// buildOnce will run build for output as a transcode job unless it is
+// running already and wait for it. the build outlives the request that
+// started it, others may be waiting, but stays in its trace. a waiting
+// build is raised to the priority of the latest request for it
+func (sm *StreamManager) buildOnce(ctx context.Context, output string, job *TranscodeJob, build func(ctx context.Context) error) error {
+	running := &derivedBuild{done: make(chan struct{}), job: job}
+	if existing, loaded := derivedBuilds.LoadOrStore(output, running); loaded {
+		running = existing.(*derivedBuild)
+		sm.transcodes.Raise(running.job.ID, job.Priority)
+	} else {
+		job.ID = newID()
+		go func() {
+			running.err = sm.transcodes.Run(context.WithoutCancel(ctx), job, build)
+			close(running.done)
+			derivedBuilds.Delete(output)
+		}()
+	}
+
+	select {
+	case <-running.done:
+		return running.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
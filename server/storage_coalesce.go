@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// how long a remote read stays open after its request is done, waiting
+	// for the viewer's next range to continue it. 0 gives every range its
+	// own GET
+	StorageReadIdle = envDuration("STORAGE_READ_IDLE", 15*time.Second)
+	// remote reads are buffered in chunks of this size, so small ranges
+	// don't each wait on the network
+	StorageReadBuffer = envInt64("STORAGE_READ_BUFFER", 1<<20)
+)
+
+const (
+	// open reads kept for later ranges, the oldest is closed past this
+	maxParkedReads = 256
+	// sizes are asked for once per this long, players send many requests
+	// for one video
+	storageStatTTL = 5 * time.Second
+)
+
+// rangeOpener is a remote storage that can read a key from an offset on
+type rangeOpener interface {
+	OpenRange(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+}
+
+// CoalescingStorage will serve a viewer's sequential range requests from one
+// remote read instead of a GET each. when a request is done its read is
+// parked at the offset it stopped, and a request starting there picks it up
+type CoalescingStorage struct {
+	Storage
+	remote rangeOpener
+
+	mu     sync.Mutex
+	parked []*parkedRead
+	stats  map[string]cachedStat
+}
+
+type parkedRead struct {
+	key    string
+	offset int64
+	read   *remoteRead
+	timer  *time.Timer
+}
+
+type cachedStat struct {
+	info os.FileInfo
+	at   time.Time
+}
+
+// remoteRead is an open ranged GET, buffered. it is cancelled on its own
+// since it outlives the request that started it
+type remoteRead struct {
+	*bufio.Reader
+	body   io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (rr *remoteRead) Close() error {
+	rr.cancel()
+	return rr.body.Close()
+}
+
+// NewCoalescingStorage will wrap s, which has to be able to read ranges
+func NewCoalescingStorage(s Storage) *CoalescingStorage {
+	return &CoalescingStorage{Storage: s, remote: s.(rangeOpener), stats: make(map[string]cachedStat)}
+}
+
+func (cs *CoalescingStorage) Open(ctx context.Context, key string) (Object, error) {
+	info, err := cs.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &coalescedObject{cs: cs, ctx: ctx, key: key, info: info}, nil
+}
+
+func (cs *CoalescingStorage) Stat(ctx context.Context, key string) (os.FileInfo, error) {
+	cs.mu.Lock()
+	cached, ok := cs.stats[key]
+	cs.mu.Unlock()
+	if ok && time.Since(cached.at) < storageStatTTL {
+		return cached.info, nil
+	}
+
+	info, err := cs.Storage.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	cs.mu.Lock()
+	cs.stats[key] = cachedStat{info: info, at: time.Now()}
+	// forget sizes nobody asked for again
+	for other, cached := range cs.stats {
+		if time.Since(cached.at) >= storageStatTTL {
+			delete(cs.stats, other)
+		}
+	}
+	cs.mu.Unlock()
+	return info, nil
+}
+
+func (cs *CoalescingStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	defer cs.forget(key)
+	return cs.Storage.Put(ctx, key, r, size)
+}
+
+func (cs *CoalescingStorage) Delete(ctx context.Context, key string) error {
+	defer cs.forget(key)
+	return cs.Storage.Delete(ctx, key)
+}
+
+// Unwrap will return the storage underneath
+func (cs *CoalescingStorage) Unwrap() Storage {
+	return cs.Storage
+}
+
+// forget will drop the size and the parked reads of a key that changed
+func (cs *CoalescingStorage) forget(key string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.stats, key)
+	kept := cs.parked[:0]
+	for _, parked := range cs.parked {
+		if parked.key == key {
+			parked.timer.Stop()
+			parked.read.Close()
+			continue
+		}
+		kept = append(kept, parked)
+	}
+	clear(cs.parked[len(kept):])
+	cs.parked = kept
+}
+
+// read will continue a parked read at offset, or start a new one
+func (cs *CoalescingStorage) read(ctx context.Context, key string, offset int64) (*remoteRead, error) {
+	cs.mu.Lock()
+	for i, parked := range cs.parked {
+		if parked.key == key && parked.offset == offset && parked.timer.Stop() {
+			cs.parked = append(cs.parked[:i], cs.parked[i+1:]...)
+			cs.mu.Unlock()
+			return parked.read, nil
+		}
+	}
+	cs.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	body, err := cs.remote.OpenRange(ctx, key, offset)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &remoteRead{Reader: bufio.NewReaderSize(body, int(StorageReadBuffer)), body: body, cancel: cancel}, nil
+}
+
+// park will keep a read open at offset for the next range
+func (cs *CoalescingStorage) park(key string, offset int64, read *remoteRead) {
+	parked := &parkedRead{key: key, offset: offset, read: read}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	parked.timer = time.AfterFunc(StorageReadIdle, func() { cs.expire(parked) })
+	cs.parked = append(cs.parked, parked)
+	if len(cs.parked) > maxParkedReads && cs.parked[0].timer.Stop() {
+		cs.parked[0].read.Close()
+		cs.parked = cs.parked[1:]
+	}
+}
+
+// expire will close a parked read nobody continued
+func (cs *CoalescingStorage) expire(parked *parkedRead) {
+	cs.mu.Lock()
+	for i, other := range cs.parked {
+		if other == parked {
+			cs.parked = append(cs.parked[:i], cs.parked[i+1:]...)
+			break
+		}
+	}
+	cs.mu.Unlock()
+	parked.read.Close()
+}
+
+// coalescedObject reads a remote object through the storage's shared reads
+type coalescedObject struct {
+	cs     *CoalescingStorage
+	ctx    context.Context
+	key    string
+	info   os.FileInfo
+	offset int64
+	read   *remoteRead
+}
+
+func (o *coalescedObject) Read(p []byte) (int, error) {
+	if o.offset >= o.info.Size() {
+		return 0, io.EOF
+	}
+	if err := o.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if o.read == nil {
+		read, err := o.cs.read(o.ctx, o.key, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.read = read
+	}
+	n, err := o.read.Read(p)
+	o.offset += int64(n)
+	if err != nil {
+		// a broken read isn't parked
+		o.read.Close()
+		o.read = nil
+	}
+	return n, err
+}
+
+func (o *coalescedObject) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = o.offset + offset
+	case io.SeekEnd:
+		next = o.info.Size() + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if next < 0 {
+		return 0, errors.New("negative position")
+	}
+	if next != o.offset {
+		o.release()
+	}
+	o.offset = next
+	return next, nil
+}
+
+// release will park the current read where it stopped
+func (o *coalescedObject) release() {
+	if o.read == nil {
+		return
+	}
+	if o.offset < o.info.Size() {
+		o.cs.park(o.key, o.offset, o.read)
+	} else {
+		o.read.Close()
+	}
+	o.read = nil
+}
+
+func (o *coalescedObject) Close() error {
+	o.release()
+	return nil
+}
+
+func (o *coalescedObject) Stat() (os.FileInfo, error) {
+	return o.info, nil
+}
@@ -0,0 +1,485 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 requires parts of at least 5MiB, except the last one
+const minS3PartSize = 5 * 1024 * 1024
+
+// S3Config configures the s3 driver, it works with AWS and compatible stores (MinIO, Ceph RGW)
+type S3Config struct {
+	// custom endpoint like https://minio.local:9000, empty means AWS
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// path style puts the bucket in the path instead of the host name, most
+	// self hosted stores need it
+	PathStyle bool
+	// send x-amz-request-payer so requester pays buckets can be read
+	RequesterPays bool
+	// server side encryption, "AES256" or "aws:kms"
+	SSE      string
+	KMSKeyID string
+	// multipart part size in bytes
+	PartSize int64
+}
+
+// S3ConfigFromEnv will read the s3 config from S3_* (and the standard AWS_*) variables
+func S3ConfigFromEnv() S3Config {
+	return S3Config{
+		Endpoint:      envString("S3_ENDPOINT", ""),
+		Region:        envString("S3_REGION", envString("AWS_REGION", "us-east-1")),
+		Bucket:        envString("S3_BUCKET", ""),
+		Prefix:        envString("S3_PREFIX", ""),
+		AccessKey:     envString("S3_ACCESS_KEY_ID", envString("AWS_ACCESS_KEY_ID", "")),
+		SecretKey:     envString("S3_SECRET_ACCESS_KEY", envString("AWS_SECRET_ACCESS_KEY", "")),
+		SessionToken:  envString("AWS_SESSION_TOKEN", ""),
+		PathStyle:     envBool("S3_PATH_STYLE", false),
+		RequesterPays: envBool("S3_REQUESTER_PAYS", false),
+		SSE:           envString("S3_SSE", ""),
+		KMSKeyID:      envString("S3_SSE_KMS_KEY_ID", ""),
+		PartSize:      envInt64("S3_PART_SIZE", 16*1024*1024),
+	}
+}
+
+// S3Storage is a storage driver talking the s3 rest api, signed with sigv4
+type S3Storage struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Storage will validate the config and create the driver
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("access key and secret key are required")
+	}
+	if cfg.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("part size must be at least %d bytes", minS3PartSize)
+	}
+	if cfg.SSE != "" && cfg.SSE != "AES256" && cfg.SSE != "aws:kms" {
+		return nil, fmt.Errorf("unsupported server side encryption %q", cfg.SSE)
+	}
+	if cfg.KMSKeyID != "" && cfg.SSE != "aws:kms" {
+		return nil, errors.New("a kms key id needs S3_SSE=aws:kms")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+
+	// no overall timeout, video bodies stream for as long as the viewer watches
+	client, err := newOutboundClient(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{cfg: cfg, endpoint: u, client: client}, nil
+}
+
+// objectURL will build the url of a key using path or virtual host addressing
+func (s *S3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	objectPath := "/" + strings.TrimPrefix(path.Join(s.cfg.Prefix, key), "/")
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket + objectPath
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = objectPath
+	}
+	// send the path escaped exactly the way it is signed
+	u.RawPath = sigv4Escape(u.Path, false)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do will sign and send a request, non 2xx responses become errors
+func (s *S3Storage) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.cfg.RequesterPays {
+		req.Header.Set("X-Amz-Request-Payer", "requester")
+	}
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp, nil
+}
+
+// encryptionHeaders are sent when an object is created
+func (s *S3Storage) encryptionHeaders() http.Header {
+	header := http.Header{}
+	if s.cfg.SSE != "" {
+		header.Set("X-Amz-Server-Side-Encryption", s.cfg.SSE)
+	}
+	if s.cfg.KMSKeyID != "" {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.cfg.KMSKeyID)
+	}
+	return header
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	// small objects go up in one request
+	if size >= 0 && size <= s.cfg.PartSize {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		header := s.encryptionHeaders()
+		header.Set("Content-Type", "video/mp4")
+		resp, err := s.do(ctx, http.MethodPut, key, nil, header, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return s.putMultipart(ctx, key, r)
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart will upload r in PartSize parts
+func (s *S3Storage) putMultipart(ctx context.Context, key string, r io.Reader) error {
+	header := s.encryptionHeaders()
+	header.Set("Content-Type", "video/mp4")
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to parse multipart upload response: %w", err)
+	}
+
+	abort := func(cause error) error {
+		if resp, err := s.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+		return cause
+	}
+
+	var parts []completedPart
+	buf := make([]byte, s.cfg.PartSize)
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			query := url.Values{
+				"partNumber": {strconv.Itoa(partNumber)},
+				"uploadId":   {initiated.UploadID},
+			}
+			resp, err := s.do(ctx, http.MethodPut, key, query, nil, buf[:n])
+			if err != nil {
+				return abort(err)
+			}
+			resp.Body.Close()
+			parts = append(parts, completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return abort(readErr)
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, nil, body)
+	if err != nil {
+		return abort(err)
+	}
+	defer resp.Body.Close()
+
+	// complete can fail with a 200 and an error document
+	data, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(data, []byte("<Error>")) {
+		return abort(fmt.Errorf("s3 complete multipart upload failed: %s", data))
+	}
+	return nil
+}
+
+func (s *S3Storage) Open(ctx context.Context, key string) (Object, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{s3: s, ctx: ctx, key: key, info: info}, nil
+}
+
+// OpenRange will read key from offset to the end
+func (s *S3Storage) OpenRange(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := s.do(ctx, http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (os.FileInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("s3 head %s: missing content length", key)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3FileInfo{name: path.Base(key), size: size, modTime: modTime}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sign will add sigv4 headers to req
+func (s *S3Storage) sign(req *http.Request, body []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	// sign host and every x-amz header
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		sigv4Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery will sort and escape query params the way sigv4 wants
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, sigv4Escape(key, true)+"="+sigv4Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sigv4Escape will percent encode everything but unreserved characters (and / in paths)
+func sigv4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// s3Error will turn an s3 error response into an error, 404 becomes os.ErrNotExist
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &body) == nil && body.Code != "" {
+		return fmt.Errorf("s3 %s: %s: %s", resp.Status, body.Code, body.Message)
+	}
+	return fmt.Errorf("s3 %s", resp.Status)
+}
+
+// s3Object reads an object with ranged GETs, a seek drops the current body and
+// the next read starts a new request at the new offset
+type s3Object struct {
+	s3     *S3Storage
+	ctx    context.Context
+	key    string
+	info   os.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.info.Size() {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		body, err := o.s3.OpenRange(o.ctx, o.key, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = o.offset + offset
+	case io.SeekEnd:
+		next = o.info.Size() + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if next < 0 {
+		return 0, errors.New("negative position")
+	}
+	if next != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = next
+	return next, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+func (o *s3Object) Stat() (os.FileInfo, error) {
+	return o.info, nil
+}
+
+// s3FileInfo is the os.FileInfo of an object
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return false }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
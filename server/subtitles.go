@@ -0,0 +1,455 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// max size of a subtitle file we accept, caption files are tiny
+const MaxSubtitleSize = 10 * 1024 * 1024
+
+// a single caption cue
+type SubtitleCue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+var (
+	// matches both srt (00:00:01,000) and vtt (00:01.000) timings
+	cueTimingRegex = regexp.MustCompile(`^\s*((?:\d+:)?\d{1,2}:\d{2}[,.]\d{1,3})\s*-->\s*((?:\d+:)?\d{1,2}:\d{2}[,.]\d{1,3})`)
+	assTagRegex    = regexp.MustCompile(`\{[^}]*\}`)
+	silenceRegex   = regexp.MustCompile(`silence_(start|end):\s*(-?[0-9.]+)`)
+)
+
+// handleSubtitles will accept subtitle uploads (POST) and serve the webvtt track (GET)
+func (sm *StreamManager) handleSubtitles(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("id") == "" {
+		writeError(w, http.StatusBadRequest, "fileid is missing")
+		return
+	}
+	fileID := tenantFrom(r).VideoID(r.URL.Query().Get("id"))
+
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = "en"
+	}
+	if !isSafeName(lang) {
+		writeError(w, http.StatusBadRequest, "invalid language")
+		return
+	}
+
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if r.Method == http.MethodPost && video.Locked() {
+		lockedError(w, video)
+		return
+	}
+
+	trackPath := filepath.Join(VideoStoragePath, fileID+"."+lang+".vtt")
+
+	switch r.Method {
+	case http.MethodGet:
+		file, err := os.Open(trackPath)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "subtitle not found")
+			return
+		}
+		defer file.Close()
+		setCachePolicy(w, r, CacheManifest, "")
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		io.Copy(w, file)
+
+	case http.MethodPost:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxSubtitleSize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to read subtitle file")
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = detectSubtitleFormat(data)
+		}
+
+		var cues []SubtitleCue
+		switch strings.ToLower(format) {
+		case "srt", "vtt", "webvtt":
+			cues, err = parseCueBlocks(data)
+		case "ass", "ssa":
+			cues, err = parseASS(data)
+		default:
+			writeError(w, http.StatusBadRequest, "unsupported subtitle format")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to parse subtitle file: "+err.Error())
+			return
+		}
+		if len(cues) == 0 {
+			writeError(w, http.StatusBadRequest, "subtitle file has no cues")
+			return
+		}
+
+		// manual offset first, eg offset=-1.5s
+		var offset time.Duration
+		if raw := r.URL.Query().Get("offset"); raw != "" {
+			offset, err = time.ParseDuration(raw)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid offset")
+				return
+			}
+		}
+
+		// optional audio alignment pass to fix a constant offset, a manual
+		// offset is applied on top of it
+		if r.URL.Query().Get("sync") == "1" {
+			videoPath, cleanup, err := sm.localVideoPath(r.Context(), fileID)
+			if err != nil {
+				writeError(w, http.StatusNotFound, "video not found")
+				return
+			}
+			speechStart, err := detectSpeechStart(videoPath)
+			cleanup()
+			if err != nil {
+				writeError(w, http.StatusUnprocessableEntity, "failed to align subtitles: "+err.Error())
+				return
+			}
+			offset += speechStart - cues[0].Start
+		}
+
+		cues = shiftCues(cues, offset)
+
+		if err := writeFileAtomic(trackPath, renderWebVTT(cues)); err != nil {
+			writeError(w, storageErrorStatus(err), "failed to save subtitle file")
+			return
+		}
+
+		w.Header().Set("X-Subtitle-Offset", offset.String())
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// detectSubtitleFormat will guess the format from the file content
+func detectSubtitleFormat(data []byte) string {
+	head := bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	head = bytes.TrimSpace(head)
+	switch {
+	case bytes.HasPrefix(head, []byte("WEBVTT")):
+		return "vtt"
+	case bytes.Contains(head, []byte("[Script Info]")), bytes.Contains(head, []byte("[Events]")):
+		return "ass"
+	default:
+		return "srt"
+	}
+}
+
+// parseCueBlocks will parse srt and vtt files, both are blank line separated cue blocks
+func parseCueBlocks(data []byte) ([]SubtitleCue, error) {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var cues []SubtitleCue
+	for _, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+
+		// find the timing line, anything before it is a cue number or identifier
+		timingIdx := -1
+		for i, line := range lines {
+			if strings.Contains(line, "-->") {
+				timingIdx = i
+				break
+			}
+		}
+		if timingIdx == -1 {
+			// header, NOTE or STYLE blocks
+			continue
+		}
+
+		match := cueTimingRegex.FindStringSubmatch(lines[timingIdx])
+		if match == nil {
+			return nil, fmt.Errorf("invalid timing line %q", lines[timingIdx])
+		}
+		start, err := parseCueTimestamp(match[1])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseCueTimestamp(match[2])
+		if err != nil {
+			return nil, err
+		}
+
+		cues = append(cues, SubtitleCue{
+			Start: start,
+			End:   end,
+			Text:  strings.Join(lines[timingIdx+1:], "\n"),
+		})
+	}
+	return cues, nil
+}
+
+// parseCueTimestamp will parse hh:mm:ss,mmm or mm:ss.mmm
+func parseCueTimestamp(value string) (time.Duration, error) {
+	value = strings.ReplaceAll(value, ",", ".")
+	parts := strings.Split(value, ":")
+
+	var hours, minutes int
+	var err error
+	secPart := parts[len(parts)-1]
+	if len(parts) == 3 {
+		if hours, err = strconv.Atoi(parts[0]); err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+	}
+	if minutes, err = strconv.Atoi(parts[len(parts)-2]); err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+	seconds, err := strconv.ParseFloat(secPart, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+
+	return time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)), nil
+}
+
+// parseASS will read the dialogue lines out of an ass/ssa [Events] section
+func parseASS(data []byte) ([]SubtitleCue, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), MaxSubtitleSize)
+
+	inEvents := false
+	var fields []string
+	var cues []SubtitleCue
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+
+		if strings.HasPrefix(line, "Format:") {
+			fields = nil
+			for _, f := range strings.Split(strings.TrimPrefix(line, "Format:"), ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(f)))
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(line, "Dialogue:") {
+			continue
+		}
+		if fields == nil {
+			return nil, fmt.Errorf("dialogue line before format line")
+		}
+
+		// text is always the last field and may contain commas
+		values := strings.SplitN(strings.TrimPrefix(line, "Dialogue:"), ",", len(fields))
+		if len(values) != len(fields) {
+			return nil, fmt.Errorf("invalid dialogue line %q", line)
+		}
+
+		var cue SubtitleCue
+		for i, name := range fields {
+			value := strings.TrimSpace(values[i])
+			var err error
+			switch name {
+			case "start":
+				cue.Start, err = parseCueTimestamp(value)
+			case "end":
+				cue.End, err = parseCueTimestamp(value)
+			case "text":
+				cue.Text = cleanASSText(values[i])
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if cue.Text != "" {
+			cues = append(cues, cue)
+		}
+	}
+
+	return cues, scanner.Err()
+}
+
+// cleanASSText will strip override tags and convert ass line breaks
+func cleanASSText(text string) string {
+	text = assTagRegex.ReplaceAllString(text, "")
+	text = strings.ReplaceAll(text, `\N`, "\n")
+	text = strings.ReplaceAll(text, `\n`, "\n")
+	text = strings.ReplaceAll(text, `\h`, " ")
+	return strings.TrimSpace(text)
+}
+
+// shiftCues will move every cue by offset, dropping cues that end before zero
+func shiftCues(cues []SubtitleCue, offset time.Duration) []SubtitleCue {
+	if offset == 0 {
+		return cues
+	}
+	shifted := make([]SubtitleCue, 0, len(cues))
+	for _, cue := range cues {
+		cue.Start += offset
+		cue.End += offset
+		if cue.End <= 0 {
+			continue
+		}
+		if cue.Start < 0 {
+			cue.Start = 0
+		}
+		shifted = append(shifted, cue)
+	}
+	return shifted
+}
+
+// renderWebVTT will write the cues out as a webvtt document
+func renderWebVTT(cues []SubtitleCue) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&buf, "%s --> %s\n%s\n\n", formatVTTTimestamp(cue.Start), formatVTTTimestamp(cue.End), escapeVTTText(cue.Text))
+	}
+	return buf.Bytes()
+}
+
+// vtt cue text is markup, a literal & or < would be read as an entity or a
+// tag and a "-->" as a timing line. escaping > breaks up the "-->" too
+var vttTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// escapeVTTText will escape cue text and drop blank lines, which would end the cue
+func escapeVTTText(text string) string {
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			kept = append(kept, vttTextEscaper.Replace(line))
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+func formatVTTTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, (ms/60000)%60, (ms/1000)%60, ms%1000)
+}
+
+// detectSpeechStart will run ffmpeg silencedetect over the start of the video
+// and return where the audio first becomes non silent. aligning the first cue
+// to that point fixes the common "whole file is off by N seconds" case.
+func detectSpeechStart(videoPath string) (time.Duration, error) {
+	if _, err := os.Stat(videoPath); err != nil {
+		return 0, fmt.Errorf("video not found")
+	}
+
+	cmd := exec.Command(FFmpegPath,
+		"-hide_banner", "-nostats",
+		"-t", "600",
+		"-i", videoPath,
+		"-vn", "-af", "silencedetect=noise=-30dB:d=0.5",
+		"-f", "null", "-",
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+
+	// only a silence starting at zero means speech starts later
+	leadingSilence := false
+	for _, match := range silenceRegex.FindAllStringSubmatch(string(output), -1) {
+		seconds, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			continue
+		}
+		if match[1] == "start" {
+			leadingSilence = seconds <= 0.05
+			continue
+		}
+		if leadingSilence {
+			return time.Duration(seconds * float64(time.Second)), nil
+		}
+		break
+	}
+	return 0, nil
+}
+
+// isSafeName will check a user supplied name can be used as part of a file name
+func isSafeName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic will write to a temp file and rename it into place
+func writeFileAtomic(path string, data []byte) error {
+	return writeFile(path, data, false)
+}
+
+// writeFileDurable is writeFileAtomic that survives a power loss once it
+// returns, the file and the directory entry of the rename are synced
+func writeFileDurable(path string, data []byte) error {
+	return writeFile(path, data, true)
+}
+
+func writeFile(path string, data []byte, durable bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if durable {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if !durable {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
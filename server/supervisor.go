@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// RestartPolicy is what happens when a worker's run returns or panics
+type RestartPolicy int
+
+const (
+	// loops that should run as long as their context, returning at all is a failure
+	RestartAlways RestartPolicy = iota
+	// work that finishes, only an error or a panic runs it again
+	RestartOnFailure
+	// a failure is reported and that's it
+	RestartNever
+)
+
+const (
+	// a failed worker waits this long before its first restart, doubling up to the max
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+	// a run this long resets the backoff, the failure was a one off
+	healthyRunTime = time.Minute
+)
+
+// worker states
+const (
+	WorkerRunning    = "running"
+	WorkerRestarting = "restarting"
+	WorkerDone       = "done"
+	WorkerFailed     = "failed"
+)
+
+// Supervisor owns the background loops of the process. a loop that panics
+// or gives up is logged and restarted by its policy instead of quietly
+// being gone, and /admin/workers lists how each is doing
+type Supervisor struct {
+	mu      sync.Mutex
+	workers []*worker
+}
+
+type worker struct {
+	name   string
+	policy RestartPolicy
+
+	// guarded by the supervisor's mu
+	state     string
+	startedAt time.Time
+	restarts  int
+	lastError string
+	failedAt  time.Time
+}
+
+// WorkerStatus is a worker as /admin/workers reports it
+type WorkerStatus struct {
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	StartedAt time.Time  `json:"started_at"`
+	Restarts  int        `json:"restarts"`
+	LastError string     `json:"last_error,omitempty"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+}
+
+// the background loops of this process
+var supervisor = &Supervisor{}
+
+// Go will run a worker until ctx is done, restarting it by policy. a worker
+// whose ctx is done is forgotten, like the singleton tasks when leadership
+// moves to another replica
+func (s *Supervisor) Go(ctx context.Context, name string, policy RestartPolicy, run func(ctx context.Context) error) {
+	w := &worker{name: name, policy: policy, state: WorkerRunning, startedAt: time.Now()}
+	s.mu.Lock()
+	s.workers = append(s.workers, w)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.forget(w)
+		backoff := minRestartBackoff
+		for {
+			started := time.Now()
+			err := runWorker(ctx, run)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				if policy != RestartAlways {
+					s.setState(w, WorkerDone, nil)
+					return
+				}
+				err = fmt.Errorf("returned")
+			}
+			log.Println("worker", name, "failed:", err)
+			if policy == RestartNever {
+				s.setState(w, WorkerFailed, err)
+				return
+			}
+
+			if time.Since(started) >= healthyRunTime {
+				backoff = minRestartBackoff
+			}
+			s.setState(w, WorkerRestarting, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxRestartBackoff)
+
+			s.mu.Lock()
+			w.state = WorkerRunning
+			w.startedAt = time.Now()
+			w.restarts++
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// runWorker will run once, a panic becomes an error with its stack logged
+func runWorker(ctx context.Context, run func(ctx context.Context) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("worker panic: %v\n%s", p, debug.Stack())
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return run(ctx)
+}
+
+func (s *Supervisor) setState(w *worker, state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.state = state
+	if err != nil {
+		w.lastError = err.Error()
+		w.failedAt = time.Now()
+	}
+}
+
+// forget will drop a worker whose context is done, failed and finished
+// ones stay listed
+func (s *Supervisor) forget(w *worker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w.state != WorkerRunning && w.state != WorkerRestarting {
+		return
+	}
+	for i, other := range s.workers {
+		if other == w {
+			s.workers = append(s.workers[:i], s.workers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Status will list the workers, healthy is false while one is failed or
+// waiting to restart
+func (s *Supervisor) Status() ([]WorkerStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	healthy := true
+	statuses := make([]WorkerStatus, 0, len(s.workers))
+	for _, w := range s.workers {
+		status := WorkerStatus{Name: w.name, State: w.state, StartedAt: w.startedAt, Restarts: w.restarts, LastError: w.lastError}
+		if !w.failedAt.IsZero() {
+			failedAt := w.failedAt
+			status.FailedAt = &failedAt
+		}
+		statuses = append(statuses, status)
+		healthy = healthy && w.state != WorkerFailed && w.state != WorkerRestarting
+	}
+	return statuses, healthy
+}
+
+// handleWorkers will report every background worker and how it is doing
+func (s *Supervisor) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	workers, healthy := s.Status()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"healthy": healthy,
+		"workers": workers,
+	})
+}
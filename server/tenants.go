@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTenantID is the namespace of requests that don't name a tenant, its
+// video ids aren't prefixed so single tenant installs keep their files
+const DefaultTenantID = "default"
+
+// json file with the tenants, empty runs everything in the default tenant
+var TenantsFile = envString("TENANTS_FILE", "")
+
+var ErrTenantQuota = errors.New("tenant quota exceeded")
+
+// Tenant is a team sharing the instance, it gets its own video namespace,
+// storage prefix, quotas and rate limits
+type Tenant struct {
+	ID        string   `json:"id"`
+	APIKeys   []string `json:"api_keys,omitempty"`
+	MaxVideos int      `json:"max_videos,omitempty"`
+	MaxBytes  int64    `json:"max_bytes,omitempty"`
+	// per class limits shared by all of the tenant's clients, eg {"upload": "100/1h"}
+	RateLimits map[string]string `json:"rate_limits,omitempty"`
+	// transcode profile of the tenant's videos, the default one when empty
+	Profile string `json:"profile,omitempty"`
+	// videos are deleted this long after upload (eg "720h"), forever when empty
+	Retention string `json:"retention,omitempty"`
+	// videos can't be changed or deleted this long after upload (eg "8760h")
+	WORM string `json:"worm,omitempty"`
+	// where the tenant's videos may be played from
+	Playback *PlaybackPolicy `json:"playback_policy,omitempty"`
+	// burned into the hls packages of the tenant's videos
+	Watermark *Watermark `json:"watermark,omitempty"`
+
+	retention time.Duration
+	worm      time.Duration
+	limiters  map[string]*RateLimiter
+	stats     tenantCounters
+}
+
+type tenantCounters struct {
+	requests      atomic.Int64
+	throttled     atomic.Int64
+	uploadedBytes atomic.Int64
+}
+
+// Tenants will work out which tenant a request belongs to
+type Tenants struct {
+	tokens *TokenStore
+	def    *Tenant
+	byID   map[string]*Tenant
+	byKey  map[string]*Tenant
+	// the segments after /api/ and /watch/ that are routes, taken from the
+	// registered patterns so they can't be tenant ids
+	routes map[string]bool
+}
+
+type tenantContextKey struct{}
+
+// NewTenants will load the tenants from path, an empty path only has the default tenant
+func NewTenants(path string, tokens *TokenStore) (*Tenants, error) {
+	ts := &Tenants{
+		tokens: tokens,
+		def:    &Tenant{ID: DefaultTenantID},
+		byID:   make(map[string]*Tenant),
+		byKey:  make(map[string]*Tenant),
+		routes: make(map[string]bool),
+	}
+	if path == "" {
+		return ts, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []*Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, err
+	}
+
+	for _, tenant := range tenants {
+		if !isSafeName(tenant.ID) || tenant.ID == DefaultTenantID {
+			return nil, fmt.Errorf("invalid tenant id %q", tenant.ID)
+		}
+		if _, ok := ts.byID[tenant.ID]; ok {
+			return nil, fmt.Errorf("duplicate tenant %q", tenant.ID)
+		}
+		ts.byID[tenant.ID] = tenant
+		if tenant.Retention != "" {
+			retention, err := time.ParseDuration(tenant.Retention)
+			if err != nil || retention <= 0 {
+				return nil, fmt.Errorf("tenant %q: retention must be a positive duration like 720h", tenant.ID)
+			}
+			tenant.retention = retention
+		}
+		if tenant.WORM != "" {
+			worm, err := time.ParseDuration(tenant.WORM)
+			if err != nil || worm <= 0 {
+				return nil, fmt.Errorf("tenant %q: worm must be a positive duration like 8760h", tenant.ID)
+			}
+			tenant.worm = worm
+		}
+
+		if tenant.Playback, err = normalizePlaybackPolicy(tenant.Playback); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", tenant.ID, err)
+		}
+		if tenant.Watermark, err = normalizeWatermark(tenant.Watermark); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", tenant.ID, err)
+		}
+
+		for _, key := range tenant.APIKeys {
+			if _, ok := ts.byKey[key]; ok || key == "" || key == AdminAPIKey {
+				return nil, fmt.Errorf("tenant %q has an empty or reused api key", tenant.ID)
+			}
+			ts.byKey[key] = tenant
+		}
+
+		tenant.limiters = make(map[string]*RateLimiter)
+		for class, spec := range tenant.RateLimits {
+			rl, err := NewRateLimiter(class, spec)
+			if err != nil {
+				return nil, fmt.Errorf("tenant %q: %w", tenant.ID, err)
+			}
+			if rl != nil {
+				// one bucket for the whole tenant
+				rl.key = func(r *http.Request) string { return "tenant" }
+				tenant.limiters[class] = rl
+			}
+		}
+	}
+	return ts, nil
+}
+
+// Resolve will wrap the router, it strips a tenant from /api/{tenant}/... and
+// /watch/{tenant}/... and otherwise finds it by api key (X-API-Key) or token
+func (ts *Tenants) Resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a slash in an id would reach into another tenant's namespace
+		escaped := strings.ToLower(r.URL.EscapedPath())
+		if strings.ContainsAny(r.URL.Query().Get("id"), `/\`) || strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%5c") {
+			writeError(w, http.StatusBadRequest, "invalid video id")
+			return
+		}
+
+		pathTenant, r := ts.stripPathTenant(r)
+		keyTenant := ts.byKey[r.Header.Get("X-API-Key")]
+		var tokenTenant *Tenant
+		if ts.tokens.Enabled() {
+			if id, err := ts.tokens.Authenticate(r); err == nil && id.Tenant != "" {
+				tokenTenant = ts.byID[id.Tenant]
+			}
+		}
+
+		tenant := ts.def
+		switch {
+		case pathTenant != nil:
+			if keyTenant != nil && keyTenant != pathTenant {
+				writeError(w, http.StatusForbidden, "api key belongs to another tenant")
+				return
+			}
+			// tenants with keys are only reachable with one of them or a token issued for them
+			if len(pathTenant.APIKeys) > 0 && keyTenant == nil && tokenTenant != pathTenant {
+				writeError(w, http.StatusUnauthorized, "tenant api key required")
+				return
+			}
+			tenant = pathTenant
+		case keyTenant != nil:
+			tenant = keyTenant
+		case tokenTenant != nil:
+			tenant = tokenTenant
+		}
+
+		tenant.stats.requests.Add(1)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant)))
+	})
+}
+
+// reserveRoutes will keep the routes of patterns out of the tenants' way, it
+// fails when a configured tenant is named like one. called as routes are
+// registered, so a new route can't be forgotten
+func (ts *Tenants) reserveRoutes(patterns ...string) error {
+	for _, pattern := range patterns {
+		_, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			path = pattern
+		}
+		parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+		if len(parts) < 2 || (parts[0] != "api" && parts[0] != "watch") || strings.HasPrefix(parts[1], "{") {
+			continue
+		}
+		ts.routes[parts[1]] = true
+		if _, ok := ts.byID[parts[1]]; ok {
+			return fmt.Errorf("tenant id %q is taken by the route %s", parts[1], pattern)
+		}
+	}
+	return nil
+}
+
+// stripPathTenant will take a known tenant out of the second path segment,
+// a route's own segment is never a tenant
+func (ts *Tenants) stripPathTenant(r *http.Request) (*Tenant, *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) != 3 || (parts[0] != "api" && parts[0] != "watch") || ts.routes[parts[1]] {
+		return nil, r
+	}
+	tenant, ok := ts.byID[parts[1]]
+	if !ok {
+		return nil, r
+	}
+
+	stripped := new(http.Request)
+	*stripped = *r
+	u := *r.URL
+	u.Path = "/" + parts[0] + "/" + parts[2]
+	u.RawPath = ""
+	stripped.URL = &u
+	return tenant, stripped
+}
+
+// All will return the default tenant followed by the configured ones
+func (ts *Tenants) All() []*Tenant {
+	tenants := []*Tenant{ts.def}
+	for _, tenant := range ts.byID {
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants[1:], func(i, j int) bool { return tenants[i+1].ID < tenants[j+1].ID })
+	return tenants
+}
+
+// tenantFrom will return the tenant Resolve found for the request
+func tenantFrom(r *http.Request) *Tenant {
+	if tenant, ok := r.Context().Value(tenantContextKey{}).(*Tenant); ok {
+		return tenant
+	}
+	return &Tenant{ID: DefaultTenantID}
+}
+
+// scopeID will namespace a video id to a tenant, it doubles as the storage
+// prefix so every tenant's files live under their own directory
+func scopeID(tenantID, id string) string {
+	if tenantID == "" || tenantID == DefaultTenantID {
+		return id
+	}
+	return tenantID + "/" + id
+}
+
+// tenantOf will return the tenant of a namespaced video id
+func tenantOf(scopedID string) string {
+	if tenantID, _, ok := strings.Cut(scopedID, "/"); ok {
+		return tenantID
+	}
+	return DefaultTenantID
+}
+
+// VideoID will namespace a client supplied video id to this tenant
+func (t *Tenant) VideoID(id string) string {
+	return scopeID(t.ID, id)
+}
+
+// Path will put the tenant into a /api/... or /watch/... path for links we hand out
+func (t *Tenant) Path(path string) string {
+	if t.ID == DefaultTenantID {
+		return path
+	}
+	first, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return "/" + first + "/" + t.ID + "/" + rest
+}
+
+// Allow will take a token from the tenant wide limiter for a class of api call
+func (t *Tenant) Allow(class string) (bool, time.Duration) {
+	rl, ok := t.limiters[class]
+	if !ok {
+		return true, 0
+	}
+	return rl.Allow("tenant")
+}
+
+// checkTenantQuota will refuse a new upload of size bytes that takes the
+// tenant over its video count or storage quota
+func (sm *StreamManager) checkTenantQuota(tenant *Tenant, size int64) error {
+	if tenant.MaxVideos <= 0 && tenant.MaxBytes <= 0 {
+		return nil
+	}
+	videos, bytes := sm.tenantUsage(tenant.ID)
+	if tenant.MaxVideos > 0 && videos+1 > tenant.MaxVideos {
+		return fmt.Errorf("%w: at most %d videos", ErrTenantQuota, tenant.MaxVideos)
+	}
+	if tenant.MaxBytes > 0 && bytes+size > tenant.MaxBytes {
+		return fmt.Errorf("%w: at most %d bytes", ErrTenantQuota, tenant.MaxBytes)
+	}
+	return nil
+}
+
+// tenantUsage will count stored videos and uploads still in progress
+func (sm *StreamManager) tenantUsage(tenantID string) (int, int64) {
+	videos, bytes := sm.metadata.TenantUsage(tenantID)
+	sm.uploadSessions.Range(func(key, value interface{}) bool {
+		if tenantOf(key.(string)) == tenantID {
+			videos++
+			bytes += value.(*UploadSession).FileSize
+		}
+		return true
+	})
+	return videos, bytes
+}
+
+// handleListTenants will report each tenant's limits, usage and request stats
+func (sm *StreamManager) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	viewers := make(map[string]int)
+	sm.activeStreams.Range(func(key, value interface{}) bool {
+		session := value.(*StreamSession)
+		session.mu.Lock()
+		viewers[tenantOf(key.(string))] += session.ViewerCount
+		session.mu.Unlock()
+		return true
+	})
+
+	report := []map[string]interface{}{}
+	for _, tenant := range sm.tenants.All() {
+		videos, bytes := sm.tenantUsage(tenant.ID)
+		report = append(report, map[string]interface{}{
+			"id":             tenant.ID,
+			"max_videos":     tenant.MaxVideos,
+			"max_bytes":      tenant.MaxBytes,
+			"rate_limits":    tenant.RateLimits,
+			"videos":         videos,
+			"bytes":          bytes,
+			"viewers":        viewers[tenant.ID],
+			"requests":       tenant.stats.requests.Load(),
+			"throttled":      tenant.stats.throttled.Load(),
+			"uploaded_bytes": tenant.stats.uploadedBytes.Load(),
+		})
+	}
+	writeJSON(w, http.StatusOK, report)
+}
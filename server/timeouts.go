@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	// how long a client has to send the request headers
+	HTTPReadHeaderTimeout = envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	// how long a keep-alive connection waits for its next request
+	HTTPIdleTimeout = envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+	// how long a response write may make no progress before the client is
+	// dropped, a dead or stalled player otherwise holds its file open for
+	// good. 0 waits forever
+	HTTPWriteTimeout = envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second)
+)
+
+// a sendfile copy gets a fresh deadline every this many bytes, so a client
+// taking less than this per HTTP_WRITE_TIMEOUT is dropped
+const slowClientChunk = 256 << 10
+
+// newHTTPServer will create a server for handler with the timeouts above.
+// there is no overall write timeout, a long video takes as long as it takes
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: HTTPReadHeaderTimeout,
+		IdleTimeout:       HTTPIdleTimeout,
+	}
+}
+
+// DropSlowClients will give every write of a response HTTP_WRITE_TIMEOUT to
+// go through. it has to be the first middleware so its deadline is set right
+// before the connection is written to, not before a rate limit's wait
+func DropSlowClients(next http.Handler) http.Handler {
+	if HTTPWriteTimeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		// a keep-alive connection still has the last request's deadline, a
+		// handler that takes a while before writing mustn't trip over it
+		rc.SetWriteDeadline(time.Time{})
+		next.ServeHTTP(&deadlineWriter{ResponseWriter: w, rc: rc}, r)
+		// what's left buffered is written after the handler returns
+		rc.SetWriteDeadline(time.Now().Add(HTTPWriteTimeout))
+	})
+}
+
+// deadlineWriter will push the write deadline out before every write, a
+// write that doesn't finish by it fails and the handler's copy stops
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (dw *deadlineWriter) extend() {
+	// http2 without deadlines says ErrNotSupported, it has its own flow control
+	dw.rc.SetWriteDeadline(time.Now().Add(HTTPWriteTimeout))
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	dw.extend()
+	return dw.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps sendfile, copying a chunk at a time so each gets a deadline.
+// ServeContent hands over a LimitedReader of the file, it's split up without
+// wrapping it again so the file underneath is still seen
+func (dw *deadlineWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := dw.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{dw}, src)
+	}
+	limited, ok := src.(*io.LimitedReader)
+	if !ok {
+		limited = &io.LimitedReader{R: src, N: 1<<63 - 1}
+	}
+	var written int64
+	for limited.N > 0 {
+		left := limited.N
+		limited.N = min(left, slowClientChunk)
+		dw.extend()
+		n, err := rf.ReadFrom(limited)
+		written += n
+		limited.N = left - n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return written, nil
+}
+
+func (dw *deadlineWriter) Flush() {
+	dw.FlushError()
+}
+
+// FlushError is what http.ResponseController calls, the event stream stops
+// on its error
+func (dw *deadlineWriter) FlushError() error {
+	dw.extend()
+	return dw.rc.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the real writer
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
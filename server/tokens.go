@@ -0,0 +1,560 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// token scopes
+const (
+	ScopePlayback = "playback"
+	ScopeUpload   = "upload"
+	// saving the original file, streaming doesn't allow it
+	ScopeDownload = "download"
+	// short lived, put into hls playlist urls for the segments and key
+	ScopeSession = "session"
+	// one upload to a presigned url, see presign.go
+	ScopePresigned = "presigned_upload"
+)
+
+var (
+	ErrTokenMissing = errors.New("token is missing")
+	ErrTokenInvalid = errors.New("token is invalid")
+	ErrTokenExpired = errors.New("token has expired")
+	ErrTokenRevoked = errors.New("token has been revoked")
+	ErrTokenScope   = errors.New("token is not valid for this request")
+	// only AUTH_SECRET signs tokens, other authenticators just check them
+	ErrTokenUnsigned = errors.New("tokens can't be issued without AUTH_SECRET")
+)
+
+// claims carried inside a signed token
+type TokenClaims struct {
+	ID        string `json:"jti"`
+	Scope     string `json:"scope"`
+	VideoID   string `json:"video_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// what a presigned upload may send
+	MaxSize     int64  `json:"max_size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// TokenStore will issue and verify signed tokens and keep the revocation denylist
+type TokenStore struct {
+	secret []byte
+	path   string
+
+	mu     sync.Mutex
+	issued map[string]TokenClaims
+	// revoked token ids, kept until the token would have expired anyway
+	revokedIDs map[string]int64
+	// tokens issued before these times are revoked
+	revokedVideos   map[string]int64
+	revokedSubjects map[string]int64
+
+	// other kinds of credentials, see auth.go
+	authenticators []Authenticator
+}
+
+// on disk form of the token store
+type tokenState struct {
+	Issued          map[string]TokenClaims `json:"issued"`
+	RevokedIDs      map[string]int64       `json:"revoked_ids"`
+	RevokedVideos   map[string]int64       `json:"revoked_videos"`
+	RevokedSubjects map[string]int64       `json:"revoked_subjects"`
+}
+
+// NewTokenStore will create the token store, auth is disabled when secret is empty
+func NewTokenStore(secret, path string) *TokenStore {
+	ts := &TokenStore{
+		secret:          []byte(secret),
+		path:            path,
+		issued:          make(map[string]TokenClaims),
+		revokedIDs:      make(map[string]int64),
+		revokedVideos:   make(map[string]int64),
+		revokedSubjects: make(map[string]int64),
+	}
+
+	if !ts.Signs() {
+		return ts
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("failed to read token state", err)
+		}
+		return ts
+	}
+	var state tokenState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Fatal("failed to parse token state", err)
+	}
+	for id, claims := range state.Issued {
+		ts.issued[id] = claims
+	}
+	for id, exp := range state.RevokedIDs {
+		ts.revokedIDs[id] = exp
+	}
+	for id, at := range state.RevokedVideos {
+		ts.revokedVideos[id] = at
+	}
+	for sub, at := range state.RevokedSubjects {
+		ts.revokedSubjects[sub] = at
+	}
+	return ts
+}
+
+// Enabled reports whether tokens are being enforced, signed ones or the
+// credentials of another authenticator
+func (ts *TokenStore) Enabled() bool {
+	return ts.Signs() || len(ts.authenticators) > 0
+}
+
+// Signs reports whether the server can sign its own tokens, AUTH_SECRET is set
+func (ts *TokenStore) Signs() bool {
+	return len(ts.secret) > 0
+}
+
+// Issue will sign a new token for the claims, filling in id and timestamps
+func (ts *TokenStore) Issue(claims TokenClaims, ttl time.Duration) (string, TokenClaims, error) {
+	if !ts.Signs() {
+		return "", claims, ErrTokenUnsigned
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", claims, err
+	}
+	now := time.Now()
+	claims.ID = hex.EncodeToString(id)
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(ttl).Unix()
+
+	token, err := ts.encode(claims)
+	if err != nil {
+		return "", claims, err
+	}
+
+	ts.mu.Lock()
+	ts.issued[claims.ID] = claims
+	err = ts.saveLocked()
+	ts.mu.Unlock()
+
+	return token, claims, err
+}
+
+// SessionToken will derive a short lived session token for videoID from the
+// request's playback token. it isn't stored and keeps the playback token's id,
+// subject and issue time, so revoking that token revokes its sessions too.
+// credentials of another authenticator get a session of their subject
+func (ts *TokenStore) SessionToken(r *http.Request, videoID string, ttl time.Duration) (string, error) {
+	if !ts.Signs() {
+		return "", ErrTokenUnsigned
+	}
+	id, err := ts.Authenticate(r)
+	if err != nil {
+		return "", err
+	}
+	claims := id.claims
+	if id.Provider != "token" {
+		claims = TokenClaims{Subject: id.Subject, Tenant: id.Tenant, IssuedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(ttl).Unix()}
+		if !id.ExpiresAt.IsZero() {
+			claims.ExpiresAt = min(claims.ExpiresAt, id.ExpiresAt.Unix())
+		}
+	}
+	claims.Scope = ScopeSession
+	claims.VideoID = videoID
+	claims.ExpiresAt = min(claims.ExpiresAt, time.Now().Add(ttl).Unix())
+	return ts.encode(claims)
+}
+
+func (ts *TokenStore) encode(claims TokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + ts.sign(encoded), nil
+}
+
+// Parse will check the signature and expiry of a token without looking at the denylist
+func (ts *TokenStore) Parse(token string) (TokenClaims, error) {
+	var claims TokenClaims
+	if token == "" {
+		return claims, ErrTokenMissing
+	}
+
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(ts.sign(encoded))) {
+		return claims, ErrTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims, ErrTokenInvalid
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, ErrTokenInvalid
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// Verify will parse the token and check it against the denylist
+func (ts *TokenStore) Verify(token string) (TokenClaims, error) {
+	claims, err := ts.Parse(token)
+	if err != nil {
+		return claims, err
+	}
+	if ts.isRevoked(claims) {
+		return claims, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+func (ts *TokenStore) isRevoked(claims TokenClaims) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, ok := ts.revokedIDs[claims.ID]; ok {
+		return true
+	}
+	if at, ok := ts.revokedVideos[scopeID(claims.Tenant, claims.VideoID)]; ok && claims.VideoID != "" && claims.IssuedAt <= at {
+		return true
+	}
+	if at, ok := ts.revokedSubjects[claims.Subject]; ok && claims.Subject != "" && claims.IssuedAt <= at {
+		return true
+	}
+	return false
+}
+
+// Outstanding will list tokens that are neither expired nor revoked, optionally filtered
+func (ts *TokenStore) Outstanding(videoID, subject string) []TokenClaims {
+	now := time.Now().Unix()
+
+	ts.mu.Lock()
+	candidates := make([]TokenClaims, 0, len(ts.issued))
+	for id, claims := range ts.issued {
+		if claims.ExpiresAt <= now {
+			delete(ts.issued, id)
+			continue
+		}
+		if videoID != "" && claims.VideoID != videoID {
+			continue
+		}
+		if subject != "" && claims.Subject != subject {
+			continue
+		}
+		candidates = append(candidates, claims)
+	}
+	ts.mu.Unlock()
+
+	outstanding := candidates[:0]
+	for _, claims := range candidates {
+		if !ts.isRevoked(claims) {
+			outstanding = append(outstanding, claims)
+		}
+	}
+	return outstanding
+}
+
+// RevokeID will deny a single token
+func (ts *TokenStore) RevokeID(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	exp := time.Now().Add(24 * time.Hour).Unix()
+	if claims, ok := ts.issued[id]; ok {
+		exp = claims.ExpiresAt
+	}
+	ts.revokedIDs[id] = exp
+	return ts.saveLocked()
+}
+
+// RevokeVideo will deny every token issued so far for a (tenant namespaced) video
+func (ts *TokenStore) RevokeVideo(videoID string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.revokedVideos[videoID] = time.Now().Unix()
+	return ts.saveLocked()
+}
+
+// RevokeSubject will deny every token issued so far for a user
+func (ts *TokenStore) RevokeSubject(subject string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.revokedSubjects[subject] = time.Now().Unix()
+	return ts.saveLocked()
+}
+
+// saveLocked will persist the store so revocations survive a restart, caller holds mu
+func (ts *TokenStore) saveLocked() error {
+	if ts.path == "" {
+		return nil
+	}
+
+	// expired tokens don't need to be remembered
+	now := time.Now().Unix()
+	for id, exp := range ts.revokedIDs {
+		if exp <= now {
+			delete(ts.revokedIDs, id)
+		}
+	}
+	for id, claims := range ts.issued {
+		if claims.ExpiresAt <= now {
+			delete(ts.issued, id)
+		}
+	}
+
+	data, err := json.Marshal(tokenState{
+		Issued:          ts.issued,
+		RevokedIDs:      ts.revokedIDs,
+		RevokedVideos:   ts.revokedVideos,
+		RevokedSubjects: ts.revokedSubjects,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ts.path, data)
+}
+
+func (ts *TokenStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, ts.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Require will wrap a handler so it needs a valid token for scope, bound to the
+// requested video when the token names one and to its tenant. does nothing when auth is disabled
+func (ts *TokenStore) Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// authenticators may be added after the routes
+		if !ts.Enabled() {
+			next(w, r)
+			return
+		}
+		id, err := ts.Authenticate(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !id.allows(scope, requestedVideoID(r), tenantFrom(r).ID) {
+			writeError(w, http.StatusForbidden, ErrTokenScope.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireSession will wrap a handler so it needs a session token (?st=) for
+// the requested video, or a playback token like Require
+func (ts *TokenStore) RequireSession(next http.HandlerFunc) http.HandlerFunc {
+	playback := ts.Require(ScopePlayback, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := r.URL.Query().Get("st")
+		if session == "" || !ts.Signs() {
+			playback(w, r)
+			return
+		}
+		claims, err := ts.Verify(session)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if claims.Scope != ScopeSession || claims.VideoID != requestedVideoID(r) || !inTenant(claims.Tenant, tenantFrom(r).ID) {
+			writeError(w, http.StatusForbidden, ErrTokenScope.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requestedVideoID is the video a request is for, from the path or the id query param
+func requestedVideoID(r *http.Request) string {
+	if id := r.PathValue("id"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("id")
+}
+
+// Subject will return the user of a request's valid token, empty when there is none
+func (ts *TokenStore) Subject(r *http.Request) string {
+	if !ts.Enabled() {
+		return ""
+	}
+	id, err := ts.Authenticate(r)
+	if err != nil {
+		return ""
+	}
+	return id.Subject
+}
+
+// ClientKey will identify a client for rate limiting, by token subject when one
+// is verified and by ip otherwise so unverified keys can't dodge the limits
+func (ts *TokenStore) ClientKey(r *http.Request) string {
+	if ts.Enabled() {
+		if id, err := ts.Authenticate(r); err == nil && id.Subject != "" {
+			return "sub:" + id.Subject
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// tokenFromRequest will read a bearer token from the header or the token query param
+// (video elements can't set headers)
+func tokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// requireAdmin will only let requests with the admin api key through
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if AdminAPIKey == "" {
+			writeError(w, http.StatusForbidden, "admin api is disabled")
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(AdminAPIKey)) != 1 {
+			writeError(w, http.StatusUnauthorized, "admin api key required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleIssueToken will mint a playback or upload token
+func (ts *TokenStore) handleIssueToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Scope   string `json:"scope"`
+		VideoID string `json:"video_id"`
+		Subject string `json:"sub"`
+		Tenant  string `json:"tenant"`
+		TTL     string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Scope != ScopePlayback && req.Scope != ScopeUpload && req.Scope != ScopeDownload {
+		writeError(w, http.StatusBadRequest, "scope must be playback, upload or download")
+		return
+	}
+
+	ttl := time.Hour
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+	}
+
+	token, claims, err := ts.Issue(TokenClaims{Scope: req.Scope, VideoID: req.VideoID, Subject: req.Subject, Tenant: req.Tenant}, ttl)
+	if errors.Is(err, ErrTokenUnsigned) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to issue token")
+		return
+	}
+	auditAs(r, "", claims.ID, "scope "+claims.Scope)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"token": token, "claims": claims})
+}
+
+// handleListTokens will list outstanding tokens, ?video= and ?sub= filter the list
+func (ts *TokenStore) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	writeJSON(w, http.StatusOK, ts.Outstanding(query.Get("video"), query.Get("sub")))
+}
+
+// handleIntrospectToken will report whether a token is active and what it claims
+func (ts *TokenStore) handleIntrospectToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	claims, err := ts.Verify(req.Token)
+	resp := map[string]interface{}{"active": err == nil}
+	if err != ErrTokenInvalid && err != ErrTokenMissing {
+		resp["claims"] = claims
+	}
+	if err != nil {
+		resp["reason"] = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleRevokeTokens will revoke a single token, or all tokens for a video or user
+func (ts *TokenStore) handleRevokeTokens(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token   string `json:"token"`
+		ID      string `json:"jti"`
+		VideoID string `json:"video_id"`
+		Tenant  string `json:"tenant"`
+		Subject string `json:"sub"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// a full token can be revoked without knowing its id
+	if req.Token != "" {
+		claims, err := ts.Parse(req.Token)
+		if err != nil && err != ErrTokenExpired {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.ID = claims.ID
+	}
+
+	var err error
+	switch {
+	case req.ID != "":
+		auditAs(r, "", req.ID, "by id")
+		err = ts.RevokeID(req.ID)
+	case req.VideoID != "":
+		auditAs(r, "", req.VideoID, "every token of the video")
+		err = ts.RevokeVideo(scopeID(req.Tenant, req.VideoID))
+	case req.Subject != "":
+		auditAs(r, "", req.Subject, "every token of the subject")
+		err = ts.RevokeSubject(req.Subject)
+	default:
+		writeError(w, http.StatusBadRequest, "one of token, jti, video_id or sub is required")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save revocation")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tokenStatePath is where the denylist is persisted
+func tokenStatePath() string {
+	return filepath.Join(VideoStoragePath, ".tokens.json")
+}
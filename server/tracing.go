@@ -0,0 +1,475 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// an otlp/http collector, like http://otel-collector:4318, spans go to
+	// its /v1/traces. OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is the full url
+	// instead. tracing is off when neither is set
+	OTLPEndpoint       = envString("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	OTLPTracesEndpoint = envString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	// headers for the collector, "api-key=secret,x-team=video"
+	OTLPHeaders      = envString("OTEL_EXPORTER_OTLP_HEADERS", "")
+	TraceServiceName = envString("OTEL_SERVICE_NAME", "videoserver")
+	// share of the traces started here that are recorded, a caller's
+	// traceparent decides for the traces it started
+	TraceSampleRatio = envFloat64("OTEL_TRACES_SAMPLER_ARG", 1)
+)
+
+const (
+	// finished spans waiting for the exporter, more are dropped
+	traceQueue = 4096
+	// spans sent to the collector at once
+	traceBatch = 512
+	// how often the exporter sends what it has
+	traceFlush = 5 * time.Second
+)
+
+// otlp span kinds
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+// tracer is the process' tracer, nil when tracing is off
+var tracer = NewTracerFromEnv()
+
+// Tracer records spans and sends them to an otlp collector
+type Tracer struct {
+	url     string
+	headers http.Header
+	spans   chan *finishedSpan
+	client  *http.Client
+}
+
+// NewTracerFromEnv will create the tracer of OTEL_EXPORTER_OTLP_*, nil when
+// there is no collector
+func NewTracerFromEnv() *Tracer {
+	url := OTLPTracesEndpoint
+	if url == "" && OTLPEndpoint != "" {
+		url = strings.TrimSuffix(OTLPEndpoint, "/") + "/v1/traces"
+	}
+	if url == "" {
+		return nil
+	}
+	headers := make(http.Header)
+	for _, pair := range strings.Split(OTLPHeaders, ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			headers.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+	}
+	return &Tracer{
+		url:     url,
+		headers: headers,
+		spans:   make(chan *finishedSpan, traceQueue),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Span is a timed piece of work in a trace. a nil span is a no-op so callers
+// don't check whether tracing is on
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	attrs    map[string]interface{}
+}
+
+type spanContextKey struct{}
+
+// spanFrom is the span ctx is in, nil when there is none
+func spanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// startSpan will start a span under the one in ctx, or a new trace
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	return startSpanFrom(ctx, spanFrom(ctx), name, kind)
+}
+
+func startSpanFrom(ctx context.Context, parent *Span, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: tracer, name: name, kind: kind, start: time.Now()}
+	rand.Read(span.spanID[:])
+	if parent != nil {
+		span.traceID, span.parentID, span.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+		// by the trace id, like the otel ratio sampler
+		span.sampled = float64(binary.BigEndian.Uint64(span.traceID[8:])>>11)/(1<<53) < TraceSampleRatio
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// Set will add an attribute, strings, bools, ints and floats
+func (s *Span) Set(key string, value interface{}) {
+	if s == nil || !s.sampled {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// End will finish the span, a non nil err marks it failed
+func (s *Span) End(err error) {
+	if s == nil || !s.sampled {
+		return
+	}
+	if err != nil {
+		s.Set("error.message", err.Error())
+	}
+	finished := &finishedSpan{Span: s, end: time.Now(), failed: err != nil}
+	select {
+	case s.tracer.spans <- finished:
+	default:
+		// the collector is behind, tracing isn't worth blocking a request
+	}
+}
+
+// traceparent is the w3c trace context header of the span
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent will read a w3c traceparent header as the remote parent
+// of the spans of a request, nil when it isn't one
+func parseTraceparent(header string) *Span {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil
+	}
+	// a newer version may add fields after the flags
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil
+	}
+	var parent Span
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil || parent.traceID == [16]byte{} {
+		return nil
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil || parent.spanID == [8]byte{} {
+		return nil
+	}
+	parent.sampled = flags[0]&1 == 1
+	return &parent
+}
+
+// injectTrace will pass the trace of ctx on to an outgoing request
+func injectTrace(ctx context.Context, header http.Header) {
+	if span := spanFrom(ctx); span != nil {
+		header.Set("Traceparent", span.traceparent())
+	}
+}
+
+// Trace will record a server span for every request, under the caller's
+// traceparent when it sent one. the span is named for the route so a
+// trace backend can group them
+func (s *Server) Trace(next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Method
+		if s.edge == nil {
+			if _, pattern := s.mux.Handler(r); pattern != "" {
+				name = pattern
+			}
+		}
+		ctx, span := startSpanFrom(r.Context(), parseTraceparent(r.Header.Get("Traceparent")), name, SpanServer)
+		span.Set("http.request.method", r.Method)
+		span.Set("url.path", r.URL.Path)
+		span.Set("client.address", clientIP(r))
+		if rng := r.Header.Get("Range"); rng != "" {
+			span.Set("http.request.header.range", rng)
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.Set("http.response.status_code", rec.status)
+		span.Set("http.response.body.size", rec.bytes)
+		var err error
+		if rec.status >= 500 {
+			err = fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status))
+		}
+		span.End(err)
+	})
+}
+
+// TracedStorage will record a span for every storage call, so slow requests
+// show how long the storage took
+type TracedStorage struct {
+	Storage
+}
+
+// NewTracedStorage will wrap s when tracing is on
+func NewTracedStorage(s Storage) Storage {
+	if tracer == nil {
+		return s
+	}
+	return &TracedStorage{s}
+}
+
+func (ts *TracedStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	ctx, span := startSpan(ctx, "storage.put", SpanClient)
+	span.Set("storage.key", key)
+	span.Set("storage.size", size)
+	err := ts.Storage.Put(ctx, key, r, size)
+	span.End(err)
+	return err
+}
+
+func (ts *TracedStorage) Open(ctx context.Context, key string) (Object, error) {
+	openCtx, span := startSpan(ctx, "storage.open", SpanClient)
+	span.Set("storage.key", key)
+	obj, err := ts.Storage.Open(openCtx, key)
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	// local files keep their sendfile path, they aren't what is slow
+	if _, ok := obj.(*os.File); ok {
+		return obj, nil
+	}
+	_, read := startSpan(ctx, "storage.read", SpanClient)
+	read.Set("storage.key", key)
+	return &tracedObject{Object: obj, span: read}, nil
+}
+
+func (ts *TracedStorage) Stat(ctx context.Context, key string) (os.FileInfo, error) {
+	ctx, span := startSpan(ctx, "storage.stat", SpanClient)
+	span.Set("storage.key", key)
+	info, err := ts.Storage.Stat(ctx, key)
+	span.End(err)
+	return info, err
+}
+
+func (ts *TracedStorage) Delete(ctx context.Context, key string) error {
+	ctx, span := startSpan(ctx, "storage.delete", SpanClient)
+	span.Set("storage.key", key)
+	err := ts.Storage.Delete(ctx, key)
+	span.End(err)
+	return err
+}
+
+func (ts *TracedStorage) Unwrap() Storage {
+	return ts.Storage
+}
+
+// tracedObject is a remote object being read, its span lasts until it is
+// closed and says how much was read and how long the reads waited
+type tracedObject struct {
+	Object
+	span    *Span
+	bytes   int64
+	waiting time.Duration
+	err     error
+}
+
+func (o *tracedObject) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := o.Object.Read(p)
+	o.waiting += time.Since(start)
+	o.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		o.err = err
+	}
+	return n, err
+}
+
+func (o *tracedObject) Close() error {
+	err := o.Object.Close()
+	o.span.Set("storage.read.bytes", o.bytes)
+	o.span.Set("storage.read.wait_ms", o.waiting.Milliseconds())
+	o.span.End(o.err)
+	return err
+}
+
+// a span that has ended, waiting to be exported
+type finishedSpan struct {
+	*Span
+	end    time.Time
+	failed bool
+}
+
+// export will send finished spans to the collector in batches until ctx is
+// done
+func (t *Tracer) export(ctx context.Context) error {
+	ticker := time.NewTicker(traceFlush)
+	defer ticker.Stop()
+	var batch []*finishedSpan
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.send(ctx, batch); err != nil {
+			log.Println("failed to export", len(batch), "spans:", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			send()
+			return nil
+		case <-ticker.C:
+			send()
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= traceBatch {
+				send()
+			}
+		}
+	}
+}
+
+// otlp json, the ids are hex and 64 bit numbers strings
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	var out []otlpAttribute
+	for key, value := range attrs {
+		var v otlpValue
+		switch value := value.(type) {
+		case string:
+			v.StringValue = &value
+		case bool:
+			v.BoolValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			v.DoubleValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: key, Value: v})
+	}
+	return out
+}
+
+// send will post a batch of spans to the collector
+func (t *Tracer) send(ctx context.Context, batch []*finishedSpan) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		span := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			span.Status.Code = 2
+			span.Status.Message, _ = s.attrs["error.message"].(string)
+		}
+		spans = append(spans, span)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{
+					"service.name":        TraceServiceName,
+					"service.instance.id": leaderIdentity(),
+				}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "videoserver"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range t.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
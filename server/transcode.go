@@ -0,0 +1,358 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hardware encoding, nvenc (nvidia), vaapi (intel and amd on linux), auto
+// to use whichever is there, or empty for the software encoders
+var TranscodeHWAccel = envString("TRANSCODE_HWACCEL", "")
+
+// render node vaapi encodes on
+var VAAPIDevice = envString("VAAPI_DEVICE", "/dev/dri/renderD128")
+
+// job priorities, higher runs first. jobs of the same priority run shortest
+// video first
+const (
+	// a viewer is waiting for it
+	PriorityViewer = 10
+	// clips unless they ask for another
+	PriorityDefault = 0
+	// eager builds at ingest
+	PriorityBackground = -10
+)
+
+// ErrTranscodeCancelled is what a cancelled job ends with
+var ErrTranscodeCancelled = errors.New("transcode cancelled")
+
+// TranscodeJob is an encode or packaging job, waiting for a worker or running
+type TranscodeJob struct {
+	ID string `json:"id"`
+	// clip, hls, audio, poster, preview or watermark
+	Kind     string `json:"kind"`
+	VideoID  string `json:"video_id"`
+	Priority int    `json:"priority"`
+	// seconds of media to process
+	Duration  float64    `json:"duration"`
+	Status    string     `json:"status"`
+	Position  int        `json:"position,omitempty"`
+	QueuedAt  time.Time  `json:"queued_at"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+
+	estimate time.Duration
+	seq      int64
+	ready    chan struct{}
+	cancel   context.CancelCauseFunc
+}
+
+const (
+	TranscodeQueued  = "queued"
+	TranscodeRunning = "running"
+)
+
+// TranscodeQueue runs jobs on TRANSCODE_WORKERS workers, the rest wait in
+// priority order. it also tells how long a new job would wait, for estimates
+type TranscodeQueue struct {
+	mu      sync.Mutex
+	running map[string]*TranscodeJob
+	queued  []*TranscodeJob
+	seq     int64
+}
+
+// NewTranscodeQueue will create an empty queue
+func NewTranscodeQueue() *TranscodeQueue {
+	return &TranscodeQueue{running: make(map[string]*TranscodeJob)}
+}
+
+// Run will wait for a worker and run the job on it. the job's context is
+// cancelled with ErrTranscodeCancelled by Cancel, or when ctx is
+func (tq *TranscodeQueue) Run(ctx context.Context, job *TranscodeJob, run func(ctx context.Context) error) (err error) {
+	ctx, span := startSpan(ctx, "transcode "+job.Kind, SpanInternal)
+	span.Set("video.id", job.VideoID)
+	span.Set("transcode.duration", job.Duration)
+	defer func() { span.End(err) }()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	tq.mu.Lock()
+	if job.ID == "" {
+		job.ID = newID()
+	}
+	tq.seq++
+	job.seq, job.cancel, job.ready = tq.seq, cancel, make(chan struct{})
+	job.QueuedAt, job.Status = time.Now().UTC(), TranscodeQueued
+	if int64(len(tq.running)) < max(TranscodeWorkers, 1) {
+		tq.startLocked(job)
+	} else {
+		tq.queued = append(tq.queued, job)
+	}
+	tq.mu.Unlock()
+
+	select {
+	case <-job.ready:
+	case <-ctx.Done():
+		tq.mu.Lock()
+		queued := job.Status == TranscodeQueued
+		if queued {
+			tq.removeQueuedLocked(job)
+		}
+		tq.mu.Unlock()
+		// it got a worker as it was cancelled
+		if !queued {
+			tq.finish(job)
+		}
+		return context.Cause(ctx)
+	}
+	defer tq.finish(job)
+	span.Set("transcode.queued_ms", time.Since(job.QueuedAt).Milliseconds())
+
+	if err := run(ctx); err != nil {
+		if cause := context.Cause(ctx); cause != nil && cause != context.Canceled {
+			return cause
+		}
+		return err
+	}
+	return nil
+}
+
+func (tq *TranscodeQueue) startLocked(job *TranscodeJob) {
+	now := time.Now().UTC()
+	job.Status, job.StartedAt = TranscodeRunning, &now
+	tq.running[job.ID] = job
+	close(job.ready)
+}
+
+func (tq *TranscodeQueue) removeQueuedLocked(job *TranscodeJob) {
+	for i, queued := range tq.queued {
+		if queued == job {
+			tq.queued = append(tq.queued[:i], tq.queued[i+1:]...)
+			return
+		}
+	}
+}
+
+// finish will give the job's worker to the next job
+func (tq *TranscodeQueue) finish(job *TranscodeJob) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	delete(tq.running, job.ID)
+	if len(tq.queued) == 0 || int64(len(tq.running)) >= max(TranscodeWorkers, 1) {
+		return
+	}
+	tq.sortLocked()
+	next := tq.queued[0]
+	tq.queued = tq.queued[1:]
+	tq.startLocked(next)
+}
+
+// sortLocked will put the queue in run order, priority, then shortest, then
+// oldest. unknown durations go after known ones
+func (tq *TranscodeQueue) sortLocked() {
+	sort.SliceStable(tq.queued, func(i, j int) bool {
+		a, b := tq.queued[i], tq.queued[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if (a.Duration > 0) != (b.Duration > 0) {
+			return a.Duration > 0
+		}
+		if a.Duration != b.Duration {
+			return a.Duration < b.Duration
+		}
+		return a.seq < b.seq
+	})
+}
+
+// Raise will move a waiting job up to priority, a viewer now waits for it
+func (tq *TranscodeQueue) Raise(id string, priority int) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	for _, job := range tq.queued {
+		if job.ID == id && job.Priority < priority {
+			job.Priority = priority
+		}
+	}
+}
+
+// Get will return a job by id
+func (tq *TranscodeQueue) Get(id string) (TranscodeJob, bool) {
+	for _, job := range tq.List() {
+		if job.ID == id {
+			return job, true
+		}
+	}
+	return TranscodeJob{}, false
+}
+
+// Cancel will stop a job, a waiting one never starts
+func (tq *TranscodeQueue) Cancel(id string) bool {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	job, ok := tq.running[id]
+	if !ok {
+		for _, queued := range tq.queued {
+			if queued.ID == id {
+				job, ok = queued, true
+			}
+		}
+	}
+	if ok {
+		job.cancel(ErrTranscodeCancelled)
+	}
+	return ok
+}
+
+// List will return the running jobs, oldest first, then the waiting ones in
+// the order they will run
+func (tq *TranscodeQueue) List() []TranscodeJob {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	jobs := make([]TranscodeJob, 0, len(tq.running)+len(tq.queued))
+	for _, job := range tq.running {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].seq < jobs[j].seq })
+	tq.sortLocked()
+	for i, job := range tq.queued {
+		copied := *job
+		copied.Position = i + 1
+		jobs = append(jobs, copied)
+	}
+	return jobs
+}
+
+// Wait will estimate how long a new encode waits for a worker, the remaining
+// work spread over the workers once they are all busy
+func (tq *TranscodeQueue) Wait() (time.Duration, int) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	workers := max(TranscodeWorkers, 1)
+	if int64(len(tq.running)) < workers {
+		return 0, len(tq.running)
+	}
+	var remaining time.Duration
+	for _, job := range tq.running {
+		// an encode that overran is assumed to be nearly done
+		remaining += max(job.estimate-time.Since(*job.StartedAt), time.Second)
+	}
+	for _, job := range tq.queued {
+		remaining += max(job.estimate, time.Second)
+	}
+	return remaining / time.Duration(workers), len(tq.running)
+}
+
+// handleListTranscodes will return the tenant's jobs, running then waiting
+func (sm *StreamManager) handleListTranscodes(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r)
+	jobs := []TranscodeJob{}
+	for _, job := range sm.transcodes.List() {
+		if tenantOf(job.VideoID) == tenant.ID {
+			if _, id, ok := strings.Cut(job.VideoID, "/"); ok {
+				job.VideoID = id
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleCancelTranscode will stop one of the tenant's jobs
+func (sm *StreamManager) handleCancelTranscode(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, ok := sm.transcodes.Get(id)
+	if !ok || tenantOf(job.VideoID) != tenantFrom(r).ID {
+		writeError(w, http.StatusNotFound, "transcode not found")
+		return
+	}
+	if !sm.transcodes.Cancel(id) {
+		writeError(w, http.StatusNotFound, "transcode not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hwEncoder is how a codec is encoded on the gpu
+type hwEncoder struct {
+	encoder string
+	// constant quality option, takes the rendition's crf
+	quality string
+	// before the encoder and after the profile's filters
+	args    []string
+	filters []string
+}
+
+var hwEncoders = map[string]map[string]hwEncoder{
+	"nvenc": {
+		"h264": {encoder: "h264_nvenc", quality: "-cq", args: []string{"-rc", "vbr"}},
+		"hevc": {encoder: "hevc_nvenc", quality: "-cq", args: []string{"-rc", "vbr"}},
+		"av1":  {encoder: "av1_nvenc", quality: "-cq", args: []string{"-rc", "vbr"}},
+	},
+	"vaapi": {
+		"h264": {encoder: "h264_vaapi", quality: "-qp", filters: []string{"format=nv12", "hwupload"}},
+		"hevc": {encoder: "hevc_vaapi", quality: "-qp", filters: []string{"format=nv12", "hwupload"}},
+		"vp9":  {encoder: "vp9_vaapi", quality: "-global_quality", filters: []string{"format=nv12", "hwupload"}},
+		"av1":  {encoder: "av1_vaapi", quality: "-qp", filters: []string{"format=nv12", "hwupload"}},
+	},
+}
+
+var (
+	hwAccelOnce sync.Once
+	hwAccel     string
+)
+
+// hardwareAccel is the hardware encoding in use, "" for none. it is looked
+// up once, a gpu that isn't there falls back to software
+func hardwareAccel() string {
+	hwAccelOnce.Do(func() {
+		mode := strings.ToLower(TranscodeHWAccel)
+		if mode == "" {
+			return
+		}
+		out, err := exec.Command(FFmpegPath, "-hide_banner", "-encoders").Output()
+		if err != nil {
+			log.Println("TRANSCODE_HWACCEL is set but ffmpeg isn't usable, encoding in software")
+			return
+		}
+		available := func(accel string) bool {
+			device := "/dev/nvidia0"
+			if accel == "vaapi" {
+				device = VAAPIDevice
+			}
+			if _, err := os.Stat(device); err != nil {
+				return false
+			}
+			return strings.Contains(string(out), hwEncoders[accel]["h264"].encoder)
+		}
+		for _, accel := range []string{"nvenc", "vaapi"} {
+			if (mode == accel || mode == "auto") && available(accel) {
+				hwAccel = accel
+				log.Println("encoding with", accel)
+				return
+			}
+		}
+		log.Println("no", mode, "hardware encoder found, encoding in software")
+	})
+	return hwAccel
+}
+
+// hardwareEncoder is the gpu encoder of a codec when there is one
+func hardwareEncoder(codec string) (hwEncoder, bool) {
+	accel := hardwareAccel()
+	if accel == "" {
+		return hwEncoder{}, false
+	}
+	encoder, ok := hwEncoders[accel][codec]
+	if ok && accel == "vaapi" {
+		encoder.args = append([]string{"-vaapi_device", VAAPIDevice}, encoder.args...)
+	}
+	return encoder, ok
+}
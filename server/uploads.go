@@ -0,0 +1,843 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// on disk state of an upload, written next to the partial file after every
+// request so an upload can be resumed after a restart
+type uploadState struct {
+	FileID       string `json:"file_id"`
+	FileSize     int64  `json:"file_size"`
+	UploadedSize int64  `json:"uploaded_size"`
+	SHA256State  []byte `json:"sha256_state"`
+	// checksum the client sent for the whole upload
+	ExpectedSHA256 string    `json:"expected_sha256,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	// a paused upload isn't cleaned up until then
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+}
+
+// how long an upload may be paused, it is cleaned up like an abandoned one after
+var UploadPauseMax = envDuration("UPLOAD_PAUSE_MAX", 7*24*time.Hour)
+
+// ChunkSize buffers of upload and pull requests, reused instead of
+// allocated for every request
+var chunkBuffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, ChunkSize)
+	return &buf
+}}
+
+// uploadStagingPath is where an upload is written until it is complete and
+// its checksum matches, only then is it moved to where videos are served from
+func uploadStagingPath(fileID string) string {
+	return filepath.Join(VideoStoragePath, ".staging", videoKey(fileID))
+}
+
+// pendingUploadPath is where a finished upload waits for its validation, with
+// the record it will get next to it in a .json. the video being served is
+// only replaced once it passes
+func pendingUploadPath(fileID string) string {
+	return uploadStagingPath(fileID) + ".pending"
+}
+
+// uploadStatePath is where the state of an upload to fileName is kept
+func uploadStatePath(fileName string) string {
+	return fileName + ".upload.json"
+}
+
+// uploadSession will return the session for fileID, recovering it from disk
+// when the process restarted or it went idle, or start a new one of size bytes
+func (sm *StreamManager) uploadSession(fileID string, size int64) (*UploadSession, error) {
+	if session, ok := sm.uploadSessions.Load(fileID); ok {
+		return session.(*UploadSession), nil
+	}
+
+	fileName := uploadStagingPath(fileID)
+	session, err := loadUploadSession(uploadStatePath(fileName))
+	if os.IsNotExist(err) {
+		session = &UploadSession{FileID: fileID, FileName: fileName, FileSize: size, LastUpdated: time.Now(), hash: sha256.New()}
+	} else if err != nil {
+		return nil, err
+	}
+	actual, _ := sm.uploadSessions.LoadOrStore(fileID, session)
+	return actual.(*UploadSession), nil
+}
+
+// hasUploadSession reports whether fileID has an upload in progress, in memory or on disk
+func (sm *StreamManager) hasUploadSession(fileID string) bool {
+	if _, ok := sm.uploadSessions.Load(fileID); ok {
+		return true
+	}
+	_, err := os.Stat(uploadStatePath(uploadStagingPath(fileID)))
+	return err == nil
+}
+
+// loadUploadSession will read a saved upload state
+func loadUploadSession(statePath string) (*UploadSession, error) {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.SHA256State); err != nil {
+		return nil, err
+	}
+	session := &UploadSession{
+		FileID:       state.FileID,
+		FileName:     uploadStagingPath(state.FileID),
+		FileSize:     state.FileSize,
+		UploadedSize: state.UploadedSize,
+		LastUpdated:  state.UpdatedAt,
+		hash:         h,
+		expected:     state.ExpectedSHA256,
+	}
+	if state.PausedUntil != nil {
+		session.pausedUntil.Store(state.PausedUntil.UnixNano())
+	}
+	session.committed.Store(state.UploadedSize)
+	return session, nil
+}
+
+// recoverUploadSessions will load the uploads that were in progress when the
+// process stopped, including the ones in tenant directories
+func (sm *StreamManager) recoverUploadSessions() {
+	stageOldUploads()
+	staging := filepath.Join(VideoStoragePath, ".staging")
+	top, _ := filepath.Glob(filepath.Join(staging, "*.upload.json"))
+	nested, _ := filepath.Glob(filepath.Join(staging, "*", "*.upload.json"))
+	for _, statePath := range append(top, nested...) {
+		session, err := loadUploadSession(statePath)
+		if err != nil {
+			log.Println("failed to recover upload", statePath, err)
+			continue
+		}
+		sm.uploadSessions.Store(session.FileID, session)
+		log.Println("recovered upload", session.FileID, "at", session.UploadedSize, "of", session.FileSize, "bytes")
+	}
+}
+
+// stageOldUploads will move uploads that were in progress next to the videos,
+// from before they were staged, to the staging area so they can be resumed
+func stageOldUploads() {
+	top, _ := filepath.Glob(filepath.Join(VideoStoragePath, "*.upload.json"))
+	nested, _ := filepath.Glob(filepath.Join(VideoStoragePath, "*", "*.upload.json"))
+	for _, statePath := range append(top, nested...) {
+		fileName := strings.TrimSuffix(statePath, ".upload.json")
+		rel, err := filepath.Rel(VideoStoragePath, fileName)
+		// the * of the glob takes .staging too
+		if err != nil || strings.HasPrefix(rel, ".") {
+			continue
+		}
+		staged := filepath.Join(VideoStoragePath, ".staging", rel)
+		if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+			log.Println("failed to stage upload", statePath, err)
+			continue
+		}
+		if err := os.Rename(fileName, staged); err != nil && !os.IsNotExist(err) {
+			log.Println("failed to stage upload", statePath, err)
+			continue
+		}
+		if err := os.Rename(statePath, uploadStatePath(staged)); err != nil {
+			log.Println("failed to stage upload", statePath, err)
+		}
+	}
+}
+
+// open will open the partial file, anything past the committed offset was
+// written by a request that didn't finish and is cut off. caller holds mu
+func (s *UploadSession) open() error {
+	if s.File != nil {
+		return nil
+	}
+	// every tenant's files live in their own directory
+	if err := os.MkdirAll(filepath.Dir(s.FileName), 0755); err != nil {
+		return err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if s.UploadedSize == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(s.FileName, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(s.UploadedSize); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(s.UploadedSize, 0); err != nil {
+		file.Close()
+		return err
+	}
+	s.File = file
+	return nil
+}
+
+// write will append to the partial file, after a failed write the file is
+// reopened (and cut back) on the next request. caller holds mu
+func (s *UploadSession) write(p []byte) error {
+	if _, err := s.File.Write(p); err != nil {
+		s.File.Close()
+		s.File = nil
+		return err
+	}
+	s.hash.Write(p)
+	s.UploadedSize += int64(len(p))
+	return nil
+}
+
+// commit will flush the file and save the offset and checksum state, only
+// committed bytes survive a restart or a power loss. the state is synced
+// before the offset counts as committed. caller holds mu
+func (s *UploadSession) commit() error {
+	if s.File != nil {
+		if err := s.File.Sync(); err != nil {
+			return err
+		}
+	}
+	hashState, err := s.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	state := uploadState{
+		FileID:         s.FileID,
+		FileSize:       s.FileSize,
+		UploadedSize:   s.UploadedSize,
+		SHA256State:    hashState,
+		UpdatedAt:      s.LastUpdated,
+		ExpectedSHA256: s.expected,
+	}
+	if until, ok := s.pausedUntilTime(); ok {
+		state.PausedUntil = &until
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileDurable(uploadStatePath(s.FileName), data); err != nil {
+		return err
+	}
+	s.committed.Store(s.UploadedSize)
+	return nil
+}
+
+// finish will close the completed file and drop the saved state, it returns
+// the sha256 of the whole upload. caller holds mu
+func (s *UploadSession) finish() (string, error) {
+	if s.File != nil {
+		if err := s.File.Close(); err != nil {
+			return "", err
+		}
+		s.File = nil
+	}
+	os.Remove(uploadStatePath(s.FileName))
+	return hex.EncodeToString(s.hash.Sum(nil)), nil
+}
+
+// keepCorrupt will move a mismatched upload to where the video would live and
+// save its corrupt record, nothing serves it
+func (sm *StreamManager) keepCorrupt(s *UploadSession, video VideoRecord) error {
+	path := filepath.Join(VideoStoragePath, videoKey(s.FileID))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		os.Remove(s.FileName)
+		return err
+	}
+	if err := os.Rename(s.FileName, path); err != nil {
+		os.Remove(s.FileName)
+		return err
+	}
+	return sm.metadata.PutVideo(video)
+}
+
+// completeUpload will close a finished upload, register the video (id,
+// tenant, title, owner and profile come from the caller) and queue its
+// validation. it stays in staging until that passes, a video it replaces
+// keeps being served until then and stays when it is rejected. an
+// upload that isn't what the client sent is saved as corrupt with its file
+// kept to look at, unless it would replace a video, then it's thrown away and
+// the old video stays. caller holds mu
+func (sm *StreamManager) completeUpload(s *UploadSession, video VideoRecord) (VideoRecord, error) {
+	checksum, err := s.finish()
+	if err != nil {
+		return VideoRecord{}, err
+	}
+	sm.uploadSessions.Delete(s.FileID)
+	done := 0.0
+	sm.streamSession(s.FileID).broadcast("", sseMessage{Event: "upload", Data: UploadProgress{Offset: s.UploadedSize, Size: s.FileSize, ETASeconds: &done}})
+
+	if video.Title == "" {
+		video.Title = video.ID
+	}
+	video.Size = s.UploadedSize
+	video.SHA256 = checksum
+	video.Status = VideoStatusProcessing
+	video.CreatedAt = time.Now()
+	// what arrived isn't what the client sent
+	if s.expected != "" && s.expected != checksum {
+		video.Status = VideoStatusCorrupt
+		video.Reason = "upload has sha256 " + checksum + ", the client sent " + s.expected
+		log.Println("corrupt upload", s.FileID, video.Reason)
+		if _, exists := sm.metadata.GetVideo(s.FileID); exists {
+			os.Remove(s.FileName)
+		} else if err := sm.keepCorrupt(s, video); err != nil {
+			log.Println("failed to keep corrupt upload", s.FileID, err)
+		}
+		sm.events.Emit(EventVideoCorrupt, s.FileID, map[string]string{"reason": video.Reason})
+		return video, nil
+	}
+
+	data, err := json.Marshal(video)
+	if err != nil {
+		return VideoRecord{}, err
+	}
+	pending := pendingUploadPath(s.FileID)
+	if err := os.Rename(s.FileName, pending); err != nil {
+		return VideoRecord{}, err
+	}
+	if err := writeFileDurable(pending+".json", data); err != nil {
+		return VideoRecord{}, err
+	}
+	// a new video shows up as processing, one that is being served stays
+	if existing, ok := sm.metadata.GetVideo(s.FileID); !ok || !existing.Available() {
+		if err := sm.metadata.PutVideo(video); err != nil {
+			log.Println("failed to save video metadata", s.FileID, err)
+		}
+	}
+	if err := sm.jobs.Enqueue(JobFinalizeUpload, s.FileID, nil); err != nil {
+		return VideoRecord{}, err
+	}
+	return video, nil
+}
+
+// handleUploadStatus will report the committed offset of an upload so the
+// client knows where to resume (Upload-Offset / Upload-Length headers, json body)
+func (sm *StreamManager) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	rawID := r.URL.Query().Get("id")
+	if rawID == "" {
+		writeError(w, http.StatusBadRequest, "fileid is missing")
+		return
+	}
+	fileID := tenantFrom(r).VideoID(rawID)
+
+	// a pull that failed before anything was saved only has its error left
+	var pull *pullState
+	if state, ok := sm.pulls.Load(fileID); ok {
+		pull = state.(*pullState)
+	}
+
+	var session *UploadSession
+	if active, ok := sm.uploadSessions.Load(fileID); ok {
+		session = active.(*UploadSession)
+	} else if saved, err := loadUploadSession(uploadStatePath(uploadStagingPath(fileID))); err == nil {
+		session = saved
+	} else if video, ok := sm.metadata.GetVideo(fileID); ok {
+		// already finished
+		w.Header().Set("Upload-Offset", strconv.FormatInt(video.Size, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(video.Size, 10))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": rawID, "offset": video.Size, "size": video.Size, "complete": true})
+		return
+	} else if pull != nil {
+		pull.mu.Lock()
+		defer pull.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": rawID, "complete": false, "source": pull.URL, "pulling": pull.running, "error": pull.err})
+		return
+	} else {
+		writeError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+
+	// the session is locked for as long as an upload request runs, the
+	// progress of a running upload is read without waiting for it
+	progress, measured := session.progress.snapshot()
+	if !measured {
+		session.mu.Lock()
+		progress = UploadProgress{Offset: session.UploadedSize, Size: session.FileSize}
+		session.mu.Unlock()
+	}
+	session.markPaused(&progress)
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(progress.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(progress.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	status := map[string]interface{}{
+		"id":               rawID,
+		"offset":           progress.Offset,
+		"size":             progress.Size,
+		"complete":         false,
+		"bytes_per_second": progress.BytesPerSecond,
+		"eta_seconds":      progress.ETASeconds,
+		"stalled":          progress.Stalled,
+		"last_byte_at":     progress.LastByteAt,
+		"paused":           progress.Paused,
+		"paused_until":     progress.PausedUntil,
+	}
+	if pull != nil {
+		pull.mu.Lock()
+		status["source"], status["pulling"], status["error"] = pull.URL, pull.running, pull.err
+		pull.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleUploadOffset will report how many bytes of an upload are committed,
+// synced to disk with its state, for clients that retry chunks on their own.
+// a chunk sent with that as its Upload-Offset continues the upload
+func (sm *StreamManager) handleUploadOffset(w http.ResponseWriter, r *http.Request) {
+	rawID := r.PathValue("id")
+	fileID := tenantFrom(r).VideoID(rawID)
+
+	var offset, size int64
+	complete := false
+	if active, ok := sm.uploadSessions.Load(fileID); ok {
+		session := active.(*UploadSession)
+		offset, size = session.committed.Load(), session.FileSize
+	} else if saved, err := loadUploadSession(uploadStatePath(uploadStagingPath(fileID))); err == nil {
+		offset, size = saved.committed.Load(), saved.FileSize
+	} else if video, ok := sm.metadata.GetVideo(fileID); ok {
+		offset, size, complete = video.Size, video.Size, true
+	} else {
+		writeError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": rawID, "offset": offset, "size": size, "complete": complete})
+}
+
+// handlePauseUpload will pause an upload for ?seconds= (UPLOAD_PAUSE_MAX when
+// not given), a request sending it stops after the chunk it is writing. the
+// upload is kept for that long however long ago its last byte came
+func (sm *StreamManager) handlePauseUpload(w http.ResponseWriter, r *http.Request) {
+	pause := UploadPauseMax
+	if raw := r.URL.Query().Get("seconds"); raw != "" {
+		seconds, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || seconds <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid seconds")
+			return
+		}
+		pause = min(time.Duration(seconds)*time.Second, UploadPauseMax)
+	}
+	sm.setUploadPaused(w, r, time.Now().Add(pause))
+}
+
+// handleResumeUpload will unpause an upload so it can be sent again
+func (sm *StreamManager) handleResumeUpload(w http.ResponseWriter, r *http.Request) {
+	sm.setUploadPaused(w, r, time.Time{})
+}
+
+// setUploadPaused will pause the ?id= upload until then, or resume it when
+// until is zero, and save that with the upload's state
+func (sm *StreamManager) setUploadPaused(w http.ResponseWriter, r *http.Request, until time.Time) {
+	rawID := r.URL.Query().Get("id")
+	if rawID == "" {
+		writeError(w, http.StatusBadRequest, "fileid is missing")
+		return
+	}
+	fileID := tenantFrom(r).VideoID(rawID)
+	session, ok := sm.uploadSessions.Load(fileID)
+	if !ok {
+		saved, err := loadUploadSession(uploadStatePath(uploadStagingPath(fileID)))
+		if err != nil {
+			if _, done := sm.metadata.GetVideo(fileID); done {
+				writeError(w, http.StatusConflict, "upload is complete")
+				return
+			}
+			writeError(w, http.StatusNotFound, "upload not found")
+			return
+		}
+		session, _ = sm.uploadSessions.LoadOrStore(fileID, saved)
+	}
+	s := session.(*UploadSession)
+
+	var nanos int64
+	if !until.IsZero() {
+		nanos = until.UnixNano()
+	}
+	s.pausedUntil.Store(nanos)
+	// a running upload request saves the state when it stops, otherwise the
+	// partial file is closed so a long pause holds no file open
+	progress, measured := s.progress.snapshot()
+	if s.mu.TryLock() {
+		if s.File != nil && !until.IsZero() {
+			s.File.Close()
+			s.File = nil
+		}
+		if err := s.commit(); err != nil {
+			log.Println("failed to save upload state", fileID, err)
+		}
+		if !measured {
+			progress = UploadProgress{Offset: s.UploadedSize, Size: s.FileSize}
+		}
+		s.mu.Unlock()
+	}
+	s.markPaused(&progress)
+	sm.streamSession(fileID).broadcast("", sseMessage{Event: "upload", Data: progress})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":           rawID,
+		"offset":       progress.Offset,
+		"size":         progress.Size,
+		"paused":       progress.Paused,
+		"paused_until": progress.PausedUntil,
+	})
+}
+
+// paused reports whether the upload is paused right now
+func (s *UploadSession) paused() bool {
+	_, ok := s.pausedUntilTime()
+	return ok
+}
+
+func (s *UploadSession) pausedUntilTime() (time.Time, bool) {
+	nanos := s.pausedUntil.Load()
+	if nanos == 0 || time.Now().UnixNano() >= nanos {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos).UTC(), true
+}
+
+// markPaused will report a paused upload as paused instead of stalled
+func (s *UploadSession) markPaused(progress *UploadProgress) {
+	if until, ok := s.pausedUntilTime(); ok {
+		progress.Paused, progress.Stalled, progress.ETASeconds = true, false, nil
+		progress.PausedUntil = until.Format(time.RFC3339)
+	}
+}
+
+// throughput is measured over this many most recent seconds
+const uploadRateWindow = 10
+
+// an upload that got no bytes for this long is reported as stalled
+const uploadStallAfter = 15 * time.Second
+
+// uploadProgress measures how fast an upload is coming in. it has its own lock
+// since the session's is held for a whole upload request
+type uploadProgress struct {
+	mu     sync.Mutex
+	offset int64
+	size   int64
+	// bytes received in each of the last seconds, a ring indexed by unix second
+	seconds  [uploadRateWindow]int64
+	bytes    [uploadRateWindow]int64
+	started  time.Time
+	last     time.Time
+	reported time.Time
+}
+
+// UploadProgress is a measured snapshot of an upload
+type UploadProgress struct {
+	Offset         int64    `json:"offset"`
+	Size           int64    `json:"size"`
+	BytesPerSecond float64  `json:"bytes_per_second"`
+	ETASeconds     *float64 `json:"eta_seconds"`
+	Stalled        bool     `json:"stalled"`
+	LastByteAt     string   `json:"last_byte_at,omitempty"`
+	Paused         bool     `json:"paused,omitempty"`
+	PausedUntil    string   `json:"paused_until,omitempty"`
+}
+
+// record will count n bytes that moved the upload to offset, it reports
+// whether a progress event is due (about once a second)
+func (p *uploadProgress) record(n, offset, size int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	// a resumed upload measures from its first new byte, not the old ones
+	if p.started.IsZero() || now.Sub(p.last) > uploadStallAfter {
+		p.started = now
+	}
+	second := now.Unix()
+	i := second % uploadRateWindow
+	if p.seconds[i] != second {
+		p.seconds[i], p.bytes[i] = second, 0
+	}
+	p.bytes[i] += n
+	p.offset, p.size, p.last = offset, size, now
+	if now.Sub(p.reported) < time.Second {
+		return false
+	}
+	p.reported = now
+	return true
+}
+
+// snapshot will compute throughput and eta, ok is false before any byte
+// arrived in this process
+func (p *uploadProgress) snapshot() (UploadProgress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last.IsZero() {
+		return UploadProgress{}, false
+	}
+	now := time.Now()
+	var received int64
+	for i, second := range p.seconds {
+		if second > now.Unix()-uploadRateWindow {
+			received += p.bytes[i]
+		}
+	}
+	// an upload younger than the window is measured over its own age
+	span := min(now.Sub(p.started).Seconds(), uploadRateWindow)
+	progress := UploadProgress{
+		Offset:         p.offset,
+		Size:           p.size,
+		BytesPerSecond: math.Round(float64(received) / max(span, 1)),
+		Stalled:        p.offset < p.size && now.Sub(p.last) > uploadStallAfter,
+		LastByteAt:     p.last.UTC().Format(time.RFC3339),
+	}
+	if progress.BytesPerSecond > 0 && !progress.Stalled {
+		eta := math.Ceil(float64(p.size-p.offset) / progress.BytesPerSecond)
+		progress.ETASeconds = &eta
+	}
+	return progress, true
+}
+
+// uploadWritten will measure bytes written to an upload and push a progress
+// event to the video's event stream when one is due. caller holds mu
+func (sm *StreamManager) uploadWritten(s *UploadSession, n int) {
+	if !s.progress.record(int64(n), s.UploadedSize, s.FileSize) {
+		return
+	}
+	if progress, ok := s.progress.snapshot(); ok {
+		sm.streamSession(s.FileID).broadcast("", sseMessage{Event: "upload", Data: progress})
+	}
+}
+
+// handleUpload will append the request body to an upload, creating the
+// session on the first chunk and saving the video once it is all there
+func (sm *StreamManager) handleUpload(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r)
+	rawID := r.URL.Query().Get("id")
+	if rawID == "" {
+		writeError(w, http.StatusBadRequest, "fileid is missing")
+		return
+	}
+	// the same ids pull, presign and ingest take, anything else couldn't go
+	// in a playlist, collection or link
+	if !isSafeName(rawID) {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	fileID := tenant.VideoID(rawID)
+
+	contentLength := r.ContentLength
+	if contentLength <= 0 {
+		writeError(w, http.StatusBadRequest, "Content-length required")
+		return
+	}
+	presigned, isPresigned := presignedUpload(r)
+	if isPresigned && !checkPresignedChunk(w, r, presigned) {
+		return
+	}
+	limit := uploadLimit(r)
+	if limit > 0 && contentLength > limit {
+		writeError(w, http.StatusRequestEntityTooLarge, "upload is too large")
+		return
+	}
+
+	// the transcode profile can be picked at upload or changed later
+	profile := r.URL.Query().Get("profile")
+	if _, ok := sm.profiles.Get(profile); profile != "" && !ok {
+		writeError(w, http.StatusBadRequest, "unknown profile")
+		return
+	}
+	// the video is deleted once the ttl passes, instead of the tenant's retention
+	var expiresAt *time.Time
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		ttl, err := parseTTL(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		expires := time.Now().Add(ttl).UTC()
+		expiresAt = &expires
+	}
+	// comma separated, like the tag filter of the video list
+	var tags []string
+	if raw := r.URL.Query().Get("tags"); raw != "" {
+		var err error
+		if tags, err = normalizeTags(strings.Split(raw, ",")); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if sm.isNewUpload(r) {
+		if video, ok := sm.metadata.GetVideo(fileID); ok && video.Locked() {
+			lockedError(w, video)
+			return
+		}
+		if err := sm.checkTenantQuota(tenant, contentLength); err != nil {
+			writeError(w, http.StatusInsufficientStorage, err.Error())
+			return
+		}
+	}
+
+	// create a upload session, or pick up one that survived a restart
+	uploadedSession, err := sm.uploadSession(fileID, contentLength)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load upload session")
+		return
+	}
+	uploadedSession.mu.Lock()
+	defer uploadedSession.mu.Unlock()
+	if uploadedSession.paused() {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(uploadedSession.UploadedSize, 10))
+		writeError(w, http.StatusConflict, "upload is paused, resume it first")
+		return
+	}
+
+	// a resuming client says where it thinks the upload is, the bytes
+	// after the committed offset were lost so it has to send them again
+	committed := strconv.FormatInt(uploadedSession.committed.Load(), 10)
+	if offset := r.Header.Get("Upload-Offset"); offset != "" && offset != committed {
+		w.Header().Set("Upload-Offset", committed)
+		writeError(w, http.StatusConflict, "upload offset mismatch")
+		return
+	}
+
+	// any request of the upload may carry the checksum of the whole file,
+	// it is checked once the last byte is in
+	expected, err := uploadChecksum(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if expected != "" {
+		if uploadedSession.expected != "" && uploadedSession.expected != expected {
+			writeError(w, http.StatusConflict, "checksum differs from the one sent earlier")
+			return
+		}
+		uploadedSession.expected = expected
+	}
+
+	// craete a file
+	if err := uploadedSession.open(); err != nil {
+		writeError(w, storageErrorStatus(err), "failed to save video file")
+		return
+	}
+
+	// whatever made it to disk is committed, even when the request fails half way
+	complete := false
+	defer func() {
+		if !complete {
+			if err := uploadedSession.commit(); err != nil {
+				log.Println("failed to save upload state", fileID, err)
+				// the next request starts over from the last saved state,
+				// the bytes after it aren't committed
+				if uploadedSession.File != nil {
+					uploadedSession.File.Close()
+					uploadedSession.File = nil
+				}
+				sm.uploadSessions.CompareAndDelete(fileID, uploadedSession)
+			}
+		}
+	}()
+
+	// copy the data from r.body to file in chuncks
+
+	pooled := chunkBuffers.Get().(*[]byte)
+	defer chunkBuffers.Put(pooled)
+	buffer := *pooled
+	for {
+		n, err := r.Body.Read(buffer)
+		if n > 0 {
+			if limit > 0 && uploadedSession.UploadedSize+int64(n) > limit {
+				writeError(w, http.StatusRequestEntityTooLarge, "upload is too large")
+				return
+			}
+			// it is done at the size it started with, a resumed request
+			// can't add more than what is left
+			if uploadedSession.UploadedSize+int64(n) > uploadedSession.FileSize {
+				w.Header().Set("Upload-Offset", strconv.FormatInt(uploadedSession.UploadedSize, 10))
+				writeError(w, http.StatusBadRequest, "upload is larger than its size")
+				return
+			}
+			// a full disk is a 507, what was written is kept for resuming
+			if writeErr := uploadedSession.write(buffer[:n]); writeErr != nil {
+				writeError(w, storageErrorStatus(writeErr), "failed to write video file")
+				return
+			}
+			sm.uploadWritten(uploadedSession, n)
+			tenant.stats.uploadedBytes.Add(int64(n))
+		}
+
+		// paused while sending, what arrived so far is committed
+		if uploadedSession.paused() && uploadedSession.UploadedSize < uploadedSession.FileSize {
+			uploadedSession.LastUpdated = time.Now()
+			w.Header().Set("Upload-Offset", strconv.FormatInt(uploadedSession.UploadedSize, 10))
+			writeError(w, http.StatusConflict, "upload was paused")
+			return
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to read video file")
+			return
+		}
+	}
+
+	uploadedSession.LastUpdated = time.Now()
+
+	if uploadedSession.UploadedSize >= uploadedSession.FileSize {
+		complete = true
+		if isPresigned && !sm.checkPresignedFile(w, uploadedSession, presigned) {
+			return
+		}
+		video, err := sm.completeUpload(uploadedSession, VideoRecord{
+			ID:          rawID,
+			Tenant:      tenant.ID,
+			Title:       r.URL.Query().Get("title"),
+			Description: r.URL.Query().Get("description"),
+			Tags:        tags,
+			ExpiresAt:   expiresAt,
+			Owner:       sm.tokens.Subject(r),
+			Profile:     profile,
+		})
+		auditAs(r, "video.upload", rawID, "")
+		if err != nil {
+			writeError(w, storageErrorStatus(err), "failed to save video file")
+			return
+		}
+		if isPresigned {
+			auditAs(r, "", "", "presigned "+presigned.ID)
+			sm.presignUsed(presigned)
+		}
+		// the last chunk gets the video and where it will play once processed,
+		// and the checksum to compare with the client's own
+		w.Header().Set("Upload-Offset", strconv.FormatInt(uploadedSession.UploadedSize, 10))
+		setChecksumHeaders(w, video.SHA256)
+		if video.Status == VideoStatusCorrupt {
+			writeJSON(w, http.StatusUnprocessableEntity, sm.withURLs(publicBase(r), video))
+			return
+		}
+		writeJSON(w, http.StatusOK, sm.withURLs(publicBase(r), video))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(uploadedSession.UploadedSize, 10))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// scheme://host the urls in webhooks point at, relative urls when empty. api
+// responses use it too when set, or else the request's own host
+var PublicURL = strings.TrimSuffix(envString("PUBLIC_URL", ""), "/")
+
+// PlaybackURLs are the canonical urls of a video, integrators use these
+// instead of building them. with auth on they need a playback token
+// (download needs a download one), as ?token= or a bearer header. audio
+// files and images only have the ones that apply to them
+type PlaybackURLs struct {
+	Progressive string `json:"progressive"`
+	HLS         string `json:"hls,omitempty"`
+	// only when the video's profile makes abr packages with fmp4
+	DASH     string `json:"dash,omitempty"`
+	Audio    string `json:"audio,omitempty"`
+	Poster   string `json:"poster,omitempty"`
+	Preview  string `json:"preview,omitempty"`
+	Download string `json:"download"`
+	Embed    string `json:"embed,omitempty"`
+}
+
+// VideoWithURLs is a video record with its playback urls, what the video
+// api and the video.created webhook return
+type VideoWithURLs struct {
+	VideoRecord
+	URLs PlaybackURLs `json:"urls"`
+}
+
+// publicBase is the base of urls in responses to r
+func publicBase(r *http.Request) string {
+	if PublicURL != "" {
+		return PublicURL
+	}
+	return baseURL(r)
+}
+
+// playbackURLs will return a video's urls under base, tenant prefix included
+func (sm *StreamManager) playbackURLs(base string, video VideoRecord) PlaybackURLs {
+	tenant := sm.tenants.def
+	if configured, ok := sm.tenants.byID[tenantOf(video.Key())]; ok {
+		tenant = configured
+	}
+	id := url.PathEscape(video.ID)
+	urls := PlaybackURLs{
+		Progressive: base + tenant.Path("/api/watch") + "?id=" + url.QueryEscape(video.ID),
+		Download:    base + tenant.Path("/api/download/"+id),
+	}
+	switch video.mediaFormat().kind {
+	case MediaVideo:
+		urls.HLS = base + tenant.Path("/api/hls/"+id+"/index.m3u8")
+		if sm.hasDASH(video) {
+			urls.DASH = base + tenant.Path("/api/dash/"+id+"/manifest.mpd")
+		}
+		urls.Audio = base + tenant.Path("/api/audio/"+id)
+		urls.Poster = base + tenant.Path("/api/videos/"+id+"/poster.jpg")
+		urls.Preview = base + tenant.Path("/api/videos/"+id+"/preview.webp")
+		urls.Embed = base + tenant.Path("/watch/"+id)
+	case MediaAudio:
+		// cover art, when it was given one
+		if video.Poster != "" {
+			urls.Poster = base + tenant.Path("/api/videos/"+id+"/poster.jpg")
+		}
+	}
+	return urls
+}
+
+// withURLs will add a video's playback urls under base
+func (sm *StreamManager) withURLs(base string, video VideoRecord) VideoWithURLs {
+	return VideoWithURLs{VideoRecord: video, URLs: sm.playbackURLs(base, video)}
+}
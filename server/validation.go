@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// largest upload we accept in bytes, 0 means no limit
+	MaxUploadSize = envInt64("MAX_UPLOAD_SIZE", 0)
+	// longest video we accept, 0 means no limit
+	MaxUploadDuration = envDuration("MAX_UPLOAD_DURATION", 0)
+	// check uploads are playable with ffprobe before they become available
+	ProbeUploads = envBool("PROBE_UPLOADS", true)
+	// external scanner, clamd://host:3310, clamd:///run/clamd.sock or cmd:/path/to/script
+	UploadScannerURL = envString("UPLOAD_SCANNER", "")
+)
+
+// how long probing and scanning a single upload may take
+const validationTimeout = 10 * time.Minute
+
+// UploadScanner is a hook that checks an uploaded file before it is made
+// available, it returns an error when the file must be rejected
+type UploadScanner interface {
+	Scan(ctx context.Context, path string) error
+}
+
+// NewUploadScanner will build the scanner for a UPLOAD_SCANNER url, nil when empty
+func NewUploadScanner(raw string) (UploadScanner, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "clamd":
+		if u.Host != "" {
+			return &ClamdScanner{Network: "tcp", Address: u.Host}, nil
+		}
+		return &ClamdScanner{Network: "unix", Address: u.Path}, nil
+	case "cmd":
+		return &CommandScanner{Path: u.Opaque + u.Path}, nil
+	default:
+		return nil, fmt.Errorf("unknown scanner %q", raw)
+	}
+}
+
+// ClamdScanner will stream the file to clamd with the INSTREAM command
+type ClamdScanner struct {
+	Network string
+	Address string
+}
+
+func (cs *ClamdScanner) Scan(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, cs.Network, cs.Address)
+	if err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+
+	// chunks are prefixed with their length, a zero length chunk ends the stream
+	buf := make([]byte, 64*1024)
+	size := make([]byte, 4)
+	for {
+		n, readErr := file.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return fmt.Errorf("clamd: %w", err)
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return fmt.Errorf("clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+	if !strings.HasSuffix(reply, "OK") {
+		return fmt.Errorf("clamd: %s", strings.TrimPrefix(reply, "stream: "))
+	}
+	return nil
+}
+
+// CommandScanner will run an external command with the file path as the only
+// argument, a non zero exit rejects the file
+type CommandScanner struct {
+	Path string
+}
+
+func (cs *CommandScanner) Scan(ctx context.Context, path string) error {
+	output, err := exec.CommandContext(ctx, cs.Path, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("scanner: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// what validating an upload found out about it
+type checkedUpload struct {
+	format string
+	// nil when uploads aren't probed, and for images
+	probe *ProbeResult
+	// of an image, videos have theirs in the probe
+	width, height int
+}
+
+// validateUpload will check a finished upload is a playable video, audio
+// file or image within the limits and passes the scanner
+func (sm *StreamManager) validateUpload(ctx context.Context, path string) (*checkedUpload, error) {
+	format, err := sniffMedia(path)
+	if err != nil {
+		return nil, err
+	}
+	checked := &checkedUpload{format: format}
+	kind := mediaFormats[format].kind
+	switch {
+	case kind == MediaImage:
+		// the standard library can tell, no ffprobe needed
+		if checked.width, checked.height, err = validateImage(path, format); err != nil {
+			return nil, err
+		}
+	case ProbeUploads:
+		probe, err := probeMedia(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("not a playable %s: %w", kind, err)
+		}
+		// an mp3's cover art is a video stream too, it is told apart above
+		if _, ok := probe.VideoStream(); kind == MediaVideo && !ok {
+			return nil, fmt.Errorf("not a playable video: no video stream")
+		}
+		if _, ok := probe.AudioStream(); kind == MediaAudio && !ok {
+			return nil, fmt.Errorf("not a playable audio file: no audio stream")
+		}
+		duration := probe.Duration()
+		if duration <= 0 {
+			return nil, fmt.Errorf("not a playable %s: unknown duration", kind)
+		}
+		if MaxUploadDuration > 0 && duration > MaxUploadDuration.Seconds() {
+			return nil, fmt.Errorf("%s is longer than %s", kind, MaxUploadDuration)
+		}
+		checked.probe = probe
+	}
+
+	if sm.scanner != nil {
+		if err := sm.scanner.Scan(ctx, path); err != nil {
+			return nil, err
+		}
+	}
+	return checked, nil
+}
+
+// loadPendingUpload will read the record a staged upload gets once it passes,
+// ok is false when fileID has no upload waiting
+func loadPendingUpload(fileID string) (VideoRecord, bool, error) {
+	data, err := os.ReadFile(pendingUploadPath(fileID) + ".json")
+	if os.IsNotExist(err) {
+		return VideoRecord{}, false, nil
+	}
+	if err != nil {
+		return VideoRecord{}, false, err
+	}
+	var video VideoRecord
+	if err := json.Unmarshal(data, &video); err != nil {
+		return VideoRecord{}, false, err
+	}
+	return video, true, nil
+}
+
+// finalizeUpload will validate a finished upload and only then mark it
+// available and publish it, rejected files are deleted. an upload waits in
+// staging and is moved over the served file once it passes, clips and
+// ingested videos are checked where they are. it runs as a job, an error is
+// tried again
+func (sm *StreamManager) finalizeUpload(ctx context.Context, fileID string) error {
+	path := filepath.Join(VideoStoragePath, videoKey(fileID))
+	video, staged, err := loadPendingUpload(fileID)
+	if err != nil {
+		return err
+	}
+	if staged {
+		path = pendingUploadPath(fileID)
+	} else {
+		var ok bool
+		// replaced or deleted since, or a try that got this far already
+		if video, ok = sm.metadata.GetVideo(fileID); !ok || video.Status != VideoStatusProcessing {
+			return nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, validationTimeout)
+	defer cancel()
+
+	if err := verifyStoredUpload(path, video.SHA256); err != nil {
+		if staged {
+			log.Println("corrupt upload", fileID, err)
+			sm.discardPending(fileID, VideoStatusCorrupt, EventVideoCorrupt, err)
+			return nil
+		}
+		sm.markCorrupt(fileID, err.Error())
+		return nil
+	}
+	checked, err := sm.validateUpload(ctx, path)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		log.Println("rejected upload", fileID, err)
+		if staged {
+			sm.discardPending(fileID, VideoStatusRejected, EventVideoRejected, err)
+			return nil
+		}
+		os.Remove(path)
+		sm.metadata.UpdateVideo(fileID, func(video *VideoRecord) {
+			video.Status = VideoStatusRejected
+			video.Reason = err.Error()
+		})
+		sm.events.Emit(EventVideoRejected, fileID, map[string]string{"reason": err.Error()})
+		return nil
+	}
+	// a newer upload took its place while this one was checked, its own
+	// job picks it up
+	if current, ok, _ := loadPendingUpload(fileID); staged && (!ok || current.SHA256 != video.SHA256) {
+		return nil
+	}
+	// only checked plaintext is encrypted, before it can be served or published
+	if err := sm.keys.EncryptFile(path); err != nil {
+		return fmt.Errorf("failed to encrypt video: %w", err)
+	}
+
+	ready := func(video *VideoRecord) {
+		video.Status = VideoStatusReady
+		video.Kind, video.Format = mediaFormats[checked.format].kind, checked.format
+		video.Width, video.Height = checked.width, checked.height
+		if probe := checked.probe; probe != nil {
+			video.Duration, video.Bitrate = probe.Duration(), probe.BitRate()
+			if stream, ok := probe.AudioStream(); ok {
+				video.Codec, video.AudioCodec, video.AudioChannels = stream.CodecName, stream.CodecName, stream.Channels
+			}
+			if stream, ok := probe.VideoStream(); ok && video.IsVideo() {
+				video.Codec, video.Width, video.Height = stream.CodecName, stream.Width, stream.Height
+				video.FrameRate = math.Round(stream.FrameRate()*1000) / 1000
+				video.Interlaced = stream.Interlaced()
+			}
+		}
+	}
+	if staged {
+		// a rename, so the file being served is either the old one or all
+		// of the new one
+		served := filepath.Join(VideoStoragePath, videoKey(fileID))
+		if err := os.MkdirAll(filepath.Dir(served), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(path, served); err != nil {
+			return err
+		}
+		// a replaced video mustn't keep the old one's audio
+		removeAudio(fileID)
+		removeHLS(fileID)
+		removePreviews(fileID)
+		sm.invalidateEdges(fileID)
+		sm.demand.Delete(fileID)
+		sm.analytics.Delete(fileID)
+		ready(&video)
+		if err := sm.metadata.PutVideo(video); err != nil {
+			return fmt.Errorf("failed to mark video ready: %w", err)
+		}
+		os.Remove(path + ".json")
+	} else if err := sm.metadata.UpdateVideo(fileID, ready); err != nil {
+		return fmt.Errorf("failed to mark video ready: %w", err)
+	}
+	// nothing is made of audio files and images
+	stored, _ := sm.metadata.GetVideo(fileID)
+	eager := map[string]bool{JobExtractAudio: AudioEager, JobPackageHLS: HLSEager, JobMakePreview: PreviewEager}
+	for _, kind := range []string{JobExtractAudio, JobPackageHLS, JobMakePreview} {
+		if eager[kind] && stored.IsVideo() {
+			if err := sm.jobs.Enqueue(kind, fileID, nil); err != nil {
+				log.Println("failed to queue", kind, fileID, err)
+			}
+		}
+	}
+	sm.publishVideo(fileID)
+
+	if video, ok := sm.metadata.GetVideo(fileID); ok {
+		sm.events.Emit(EventVideoCreated, fileID, sm.withURLs(PublicURL, video))
+	}
+	return nil
+}
+
+// discardPending will throw away a staged upload that didn't pass. a video
+// being served stays as it is, a new one gets status and the reason
+func (sm *StreamManager) discardPending(fileID, status, event string, reason error) {
+	path := pendingUploadPath(fileID)
+	os.Remove(path)
+	os.Remove(path + ".json")
+	if existing, ok := sm.metadata.GetVideo(fileID); ok && !existing.Available() {
+		sm.metadata.UpdateVideo(fileID, func(video *VideoRecord) {
+			video.Status = status
+			video.Reason = reason.Error()
+		})
+	}
+	sm.events.Emit(event, fileID, map[string]string{"reason": reason.Error()})
+}
+
+// checkProbeAvailable will refuse to go on without ffprobe, unchecked uploads
+// would be served as whatever they claim to be. PROBE_UPLOADS=false accepts
+// them on purpose
+func checkProbeAvailable() error {
+	if !ProbeUploads {
+		log.Println("PROBE_UPLOADS is off, uploads will not be checked")
+		return nil
+	}
+	if _, err := exec.LookPath(FFprobePath); err != nil {
+		return fmt.Errorf("ffprobe not found, install it or set PROBE_UPLOADS=false to accept uploads unchecked: %w", err)
+	}
+	return nil
+}
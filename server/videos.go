@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleListVideos will list the tenant's video records, searched by title,
+// description and tags (?q=), filtered by tag (?tag=), kind (?kind=) and collection
+// (?collection=, "" is the top, &recursive=1 takes the collections in it
+// too) and sorted and paged with ?sort=created|duration|views&order=asc|desc
+// &limit=&offset=. the total before paging is in X-Total-Count
+func (sm *StreamManager) handleListVideos(w http.ResponseWriter, r *http.Request) {
+	query, err := parseVideoQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if params := r.URL.Query(); params.Has("collection") {
+		ids := []string{params.Get("collection")}
+		if ids[0] != "" {
+			if _, err := sm.tenantCollection(r, ids[0]); err != nil {
+				writeError(w, http.StatusNotFound, "collection not found")
+				return
+			}
+			if params.Get("recursive") == "1" {
+				ids = sm.metadata.CollectionTree(ids[0])
+			}
+		}
+		query.Collections = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			query.Collections[id] = true
+		}
+	}
+	videos, total := sm.metadata.SearchVideos(tenantFrom(r).ID, query)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, http.StatusOK, videos)
+}
+
+// handleGetVideo will return a video record, including why it was rejected
+func (sm *StreamManager) handleGetVideo(w http.ResponseWriter, r *http.Request) {
+	video, ok := sm.metadata.GetVideo(tenantFrom(r).VideoID(r.PathValue("id")))
+	if !ok {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.withURLs(publicBase(r), video))
+}
+
+// handleUpdateVideo will change a video's title, description and tags, its
+// indexing / unfurl flags, the transcode profile ("" goes back to the
+// tenant's), its ttl and the collection it is filed in
+func (sm *StreamManager) handleUpdateVideo(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Title       *string   `json:"title"`
+		Description *string   `json:"description"`
+		Tags        *[]string `json:"tags"`
+		NoIndex     *bool     `json:"noindex"`
+		NoUnfurl    *bool     `json:"nounfurl"`
+		Profile     *string   `json:"profile"`
+		// a duration from now, "" takes the expiry off
+		TTL *string `json:"ttl"`
+		// replaces the video's policy, {} takes it off
+		Playback *PlaybackPolicy `json:"playback_policy"`
+		// "" takes it out of its collection
+		Collection *string `json:"collection"`
+		// id of an uploaded image, "" goes back to a frame of the video
+		Poster *string `json:"poster"`
+		// replaces the video's watermark, {} goes back to the tenant's
+		Watermark *Watermark `json:"watermark"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Title != nil && strings.TrimSpace(*req.Title) == "" {
+		writeError(w, http.StatusBadRequest, "title can't be empty")
+		return
+	}
+	if req.Tags != nil {
+		tags, err := normalizeTags(*req.Tags)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Tags = &tags
+	}
+	var expiresAt *time.Time
+	if req.TTL != nil && *req.TTL != "" {
+		ttl, err := parseTTL(*req.TTL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		expires := time.Now().Add(ttl).UTC()
+		expiresAt = &expires
+	}
+	if req.Profile != nil && *req.Profile != "" {
+		if _, ok := sm.profiles.Get(*req.Profile); !ok {
+			writeError(w, http.StatusBadRequest, "unknown profile")
+			return
+		}
+	}
+	playback, err := normalizePlaybackPolicy(req.Playback)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	watermark, err := normalizeWatermark(req.Watermark)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+	if video, ok := sm.metadata.GetVideo(fileID); ok && video.Locked() {
+		lockedError(w, video)
+		return
+	}
+	if req.Poster != nil && *req.Poster != "" {
+		video, _ := sm.metadata.GetVideo(fileID)
+		if _, ok := sm.tenantImage(video, *req.Poster); !ok {
+			writeError(w, http.StatusBadRequest, "poster must be the id of an image")
+			return
+		}
+	}
+	if watermark != nil && watermark.Image != "" {
+		video, _ := sm.metadata.GetVideo(fileID)
+		if _, ok := sm.tenantImage(video, watermark.Image); !ok {
+			writeError(w, http.StatusBadRequest, "watermark image must be the id of an image")
+			return
+		}
+	}
+	if req.Collection != nil {
+		video, _ := sm.metadata.GetVideo(fileID)
+		if !sm.canEditCollection(r, video.Collection) {
+			writeError(w, http.StatusForbidden, "not an editor of the collection the video is in")
+			return
+		}
+		if !sm.checkCollection(w, r, *req.Collection) {
+			return
+		}
+	}
+	err = sm.metadata.UpdateVideo(fileID, func(video *VideoRecord) {
+		if req.Title != nil {
+			video.Title = *req.Title
+		}
+		if req.Description != nil {
+			video.Description = *req.Description
+		}
+		if req.Tags != nil {
+			video.Tags = *req.Tags
+		}
+		if req.NoIndex != nil {
+			video.NoIndex = *req.NoIndex
+		}
+		if req.NoUnfurl != nil {
+			video.NoUnfurl = *req.NoUnfurl
+		}
+		if req.Profile != nil {
+			video.Profile = *req.Profile
+		}
+		if req.TTL != nil {
+			video.ExpiresAt = expiresAt
+		}
+		if req.Playback != nil {
+			video.Playback = playback
+		}
+		if req.Collection != nil {
+			video.Collection = *req.Collection
+		}
+		if req.Poster != nil {
+			video.Poster = *req.Poster
+		}
+		if req.Watermark != nil {
+			video.Watermark = watermark
+		}
+	})
+	if err != nil {
+		if err == ErrNotFound {
+			writeError(w, http.StatusNotFound, "video not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to save video")
+		return
+	}
+	// the package is cut with the profile's segments and has the watermark
+	// burned in, the next request repackages
+	if req.Profile != nil || req.Watermark != nil {
+		removeHLS(fileID)
+		sm.invalidateEdges(fileID)
+	}
+	if req.Collection != nil || req.Title != nil {
+		sm.collectionsChanged()
+	}
+	video, _ := sm.metadata.GetVideo(fileID)
+	writeJSON(w, http.StatusOK, video)
+}
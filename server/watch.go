@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// handleWatch will stream a video, audio file or image with range requests,
+// ?audio=1 streams a video's audio only rendition instead
+func (sm *StreamManager) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("id") == "" {
+		writeError(w, http.StatusBadRequest, "fileid is missing")
+		return
+	}
+	fileID := tenantFrom(r).VideoID(r.URL.Query().Get("id"))
+	video, ok := sm.metadata.GetVideo(fileID)
+	// an audio file is its own audio rendition
+	if r.URL.Query().Get("audio") == "1" && video.Kind != MediaAudio {
+		sm.serveAudio(w, r, fileID)
+		return
+	}
+
+	if ok && !video.Available() {
+		writeError(w, http.StatusNotFound, "video is not available")
+		return
+	}
+	if video.NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	file, err := sm.openVideo(r.Context(), fileID)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to open video file")
+		return
+	}
+	// closes the cache's wrapper too, which lets go of the block it holds
+	defer func() { file.Close() }()
+	sm.recordPlay(r, r.URL.Query().Get("id"))
+
+	// get file info
+	fileInfo, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get file info")
+		return
+	}
+
+	// ServeContent does ranges and the conditional headers (If-None-Match,
+	// If-Modified-Since, If-Range) for us, and copies from the *os.File so
+	// the kernel can sendfile instead of going through a user space buffer
+	etag := videoETag(video, fileInfo)
+	setCachePolicy(w, r, CacheContent, etag)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", video.ContentType())
+	strictIfRange(r)
+	file = sm.cache.Wrap(file, fileID, etag, fileInfo.Size(), func() (Object, error) {
+		return sm.openVideo(context.Background(), fileID)
+	})
+	if local, ok := file.(*os.File); ok {
+		adviseSequential(local)
+	}
+	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), file)
+}
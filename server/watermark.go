@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// font file of text watermarks, fontconfig's default font when empty
+var WatermarkFont = envString("WATERMARK_FONT", "")
+
+// Watermark is text or an uploaded image burned into a video's hls package,
+// set on a tenant for all its videos or on a single video. packages made
+// before a change keep the old one until they are made again
+type Watermark struct {
+	Text string `json:"text,omitempty"`
+	// id of an image uploaded to the same tenant, see media.go
+	Image string `json:"image,omitempty"`
+	// top-left, top-right, bottom-left, bottom-right (the default) or center
+	Position string `json:"position,omitempty"`
+	// 0.6 when unset
+	Opacity float64 `json:"opacity,omitempty"`
+	// height of the text or image as a share of the video's, 0.05 when unset
+	Size float64 `json:"size,omitempty"`
+	// a video's watermark that is off goes without its tenant's
+	Off bool `json:"off,omitempty"`
+}
+
+var watermarkPositions = map[string]bool{
+	"top-left": true, "top-right": true, "bottom-left": true, "bottom-right": true, "center": true,
+}
+
+// normalizeWatermark will check a watermark and fill in its defaults, an
+// empty one is nil
+func normalizeWatermark(wm *Watermark) (*Watermark, error) {
+	if wm == nil {
+		return nil, nil
+	}
+	if wm.Off {
+		return &Watermark{Off: true}, nil
+	}
+	normalized := *wm
+	normalized.Text = strings.TrimSpace(normalized.Text)
+	if normalized.Text == "" && normalized.Image == "" {
+		return nil, nil
+	}
+	if normalized.Text != "" && normalized.Image != "" {
+		return nil, errors.New("a watermark is text or an image, not both")
+	}
+	if len(normalized.Text) > 200 || strings.ContainsFunc(normalized.Text, unicode.IsControl) {
+		return nil, errors.New("watermark text must be one line of up to 200 bytes")
+	}
+	if normalized.Image != "" && !isSafeName(normalized.Image) {
+		return nil, errors.New("invalid watermark image id")
+	}
+	if normalized.Position == "" {
+		normalized.Position = "bottom-right"
+	}
+	if !watermarkPositions[normalized.Position] {
+		return nil, errors.New("watermark position must be top-left, top-right, bottom-left, bottom-right or center")
+	}
+	if normalized.Opacity == 0 {
+		normalized.Opacity = 0.6
+	}
+	if normalized.Opacity < 0 || normalized.Opacity > 1 {
+		return nil, errors.New("watermark opacity must be between 0 and 1")
+	}
+	if normalized.Size == 0 {
+		normalized.Size = 0.05
+	}
+	if normalized.Size < 0 || normalized.Size > 0.5 {
+		return nil, errors.New("watermark size must be between 0 and 0.5")
+	}
+	return &normalized, nil
+}
+
+// watermarkFor will return the watermark of a video, its own over its
+// tenant's, nil when it goes without
+func (sm *StreamManager) watermarkFor(video VideoRecord) *Watermark {
+	wm := video.Watermark
+	if wm == nil {
+		tenant := sm.tenants.def
+		if configured, ok := sm.tenants.byID[tenantOf(video.Key())]; ok {
+			tenant = configured
+		}
+		wm = tenant.Watermark
+	}
+	if wm == nil || wm.Off {
+		return nil
+	}
+	return wm
+}
+
+// demuxers of the image formats, an image is stored under a .mp4 key and
+// ffmpeg would go by that
+var imageDemuxers = map[string]string{"jpeg": "jpeg_pipe", "png": "png_pipe", "gif": "gif"}
+
+// a watermark ready for ffmpeg, with the local file of its image
+type watermarkFilter struct {
+	*Watermark
+	imagePath    string
+	imageDemuxer string
+}
+
+// watermarkFilter will get wm's image for a video of the tenant, the
+// cleanup removes the copy of a remote one
+func (sm *StreamManager) watermarkFilter(ctx context.Context, video VideoRecord, wm *Watermark) (*watermarkFilter, func(), error) {
+	if wm == nil {
+		return nil, func() {}, nil
+	}
+	if wm.Image == "" {
+		return &watermarkFilter{Watermark: wm}, func() {}, nil
+	}
+	image, ok := sm.tenantImage(video, wm.Image)
+	if !ok {
+		return nil, nil, fmt.Errorf("watermark image %q not found", wm.Image)
+	}
+	path, cleanup, err := sm.localVideoPath(ctx, image.Key())
+	if err != nil {
+		return nil, nil, err
+	}
+	return &watermarkFilter{Watermark: wm, imagePath: path, imageDemuxer: imageDemuxers[image.Format]}, cleanup, nil
+}
+
+// graph will put the watermark over a video height pixels high, after the
+// filters before and ahead of the ones after (a gpu upload). it is for -vf
+func (wf *watermarkFilter) graph(height int, before, after []string) string {
+	if height <= 0 {
+		height = 720
+	}
+	size := max(int(math.Round(float64(height)*wf.Size)), 8)
+	margin := strconv.Itoa(max(size/2, 4))
+	opacity := strconv.FormatFloat(wf.Opacity, 'f', -1, 64)
+
+	// main and own width and height are named differently by the two filters
+	place := func(W, H, w, h string) string {
+		x, y := margin, margin
+		switch wf.Position {
+		case "center":
+			return "x=(" + W + "-" + w + ")/2:y=(" + H + "-" + h + ")/2"
+		case "top-right":
+			x = W + "-" + w + "-" + margin
+		case "bottom-left":
+			y = H + "-" + h + "-" + margin
+		case "bottom-right":
+			x, y = W+"-"+w+"-"+margin, H+"-"+h+"-"+margin
+		}
+		return "x=" + x + ":y=" + y
+	}
+
+	if wf.imagePath == "" {
+		text := "drawtext=text=" + filterValue(wf.Text) + ":expansion=none:fontsize=" + strconv.Itoa(size) +
+			":fontcolor=white@" + opacity + ":shadowcolor=black@" + opacity + ":shadowx=2:shadowy=2:" + place("w", "h", "tw", "th")
+		if WatermarkFont != "" {
+			text += ":fontfile=" + filterValue(WatermarkFont)
+		}
+		filters := append(append(append([]string{}, before...), text), after...)
+		return strings.Join(filters, ",")
+	}
+	main := "null"
+	if len(before) > 0 {
+		main = strings.Join(before, ",")
+	}
+	overlay := strings.Join(append([]string{"overlay=" + place("W", "H", "w", "h")}, after...), ",")
+	return "movie=filename=" + filterValue(wf.imagePath) + ":f=" + wf.imageDemuxer + ",scale=-2:" + strconv.Itoa(size) + ",format=rgba,colorchannelmixer=aa=" + opacity + "[wm];" +
+		"[in]" + main + "[base];[base][wm]" + overlay + "[out]"
+}
+
+// filterValue will escape s as the value of a filter option, once for the
+// option and once more for the graph the filter is in
+func filterValue(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(s)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(s)
+}
+
+// handleWatermarkPreview will show a frame of the video with its watermark,
+// or with the one in the query (text, image, position, opacity, size) to try
+// it before saving. it is made for every request, nothing is kept
+func (sm *StreamManager) handleWatermarkPreview(w http.ResponseWriter, r *http.Request) {
+	fileID := tenantFrom(r).VideoID(r.PathValue("id"))
+	video, ok := sm.metadata.GetVideo(fileID)
+	if !ok || !video.Available() {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if !video.IsVideo() {
+		writeError(w, http.StatusNotFound, "only videos have a watermark")
+		return
+	}
+
+	wm := sm.watermarkFor(video)
+	if params := r.URL.Query(); params.Get("text") != "" || params.Get("image") != "" {
+		opacity, _ := strconv.ParseFloat(params.Get("opacity"), 64)
+		size, _ := strconv.ParseFloat(params.Get("size"), 64)
+		var err error
+		wm, err = normalizeWatermark(&Watermark{Text: params.Get("text"), Image: params.Get("image"),
+			Position: params.Get("position"), Opacity: opacity, Size: size})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if wm == nil {
+		writeError(w, http.StatusNotFound, "video has no watermark")
+		return
+	}
+	if _, err := exec.LookPath(FFmpegPath); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "watermark previews need ffmpeg")
+		return
+	}
+
+	ctx, cancel := renditionContext(r.Context())
+	defer cancel()
+	mark, cleanupMark, err := sm.watermarkFilter(ctx, video, wm)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer cleanupMark()
+	var frame []byte
+	job := &TranscodeJob{ID: newID(), Kind: "watermark", VideoID: fileID, Priority: PriorityViewer, Duration: 1}
+	err = sm.transcodes.Run(ctx, job, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+		defer cancel()
+		source, cleanup, err := sm.localVideoPath(ctx, fileID)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		frame, err = exec.CommandContext(ctx, FFmpegPath, "-hide_banner", "-nostats",
+			"-ss", formatSeconds(previewAt(video)), "-i", source, "-frames:v", "1",
+			"-vf", mark.graph(video.Height, sm.profileFor(video).videoFilters(video), nil),
+			"-q:v", "3", "-f", "mjpeg", "pipe:1").Output()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			lines := strings.Split(strings.TrimSpace(string(exitErr.Stderr)), "\n")
+			return fmt.Errorf("ffmpeg failed: %s", lines[len(lines)-1])
+		}
+		return err
+	})
+	if err != nil {
+		switch {
+		case stillProcessing(r, err):
+			writeProcessing(w, r)
+		case r.Context().Err() != nil:
+		default:
+			log.Println("failed to preview watermark", fileID, err)
+			writeError(w, http.StatusInternalServerError, "failed to preview watermark")
+		}
+		return
+	}
+
+	setCachePolicy(w, r, CacheNoStore, "")
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(frame)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tags that make a video write once, as tag=retention pairs like
+// "legal-hold=8760h,finance=2160h". tenants set theirs with "worm"
+var WORMTags = envString("WORM_TAGS", "")
+
+// ErrWORMLocked is returned for changes to a video in its write once period
+var ErrWORMLocked = errors.New("video is write once locked")
+
+// parseWORMTags will parse WORM_TAGS
+func parseWORMTags(raw string) (map[string]time.Duration, error) {
+	tags := make(map[string]time.Duration)
+	for _, pair := range strings.Split(raw, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		tag, value, _ := strings.Cut(pair, "=")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		retention, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || retention <= 0 || !isSafeName(tag) {
+			return nil, fmt.Errorf("invalid WORM_TAGS entry %q, want tag=duration", pair)
+		}
+		tags[tag] = retention
+	}
+	return tags, nil
+}
+
+// Locked reports whether the video is in its write once period
+func (v VideoRecord) Locked() bool {
+	return v.LockedUntil != nil && time.Now().Before(*v.LockedUntil)
+}
+
+// wormRetention is how long a video is write once, the longest of its
+// tenant's and its tags'
+func (sm *StreamManager) wormRetention(video *VideoRecord) time.Duration {
+	var retention time.Duration
+	if tenant, ok := sm.tenants.byID[tenantOf(video.Key())]; ok {
+		retention = tenant.worm
+	}
+	for _, tag := range video.Tags {
+		retention = max(retention, sm.wormTags[tag])
+	}
+	return retention
+}
+
+// lockWORM will set when a video's write once period ends. it is kept on the
+// record so it only ever grows, later config or tag changes can't shorten it.
+// the metadata store calls it on every write
+func (sm *StreamManager) lockWORM(video *VideoRecord) {
+	retention := sm.wormRetention(video)
+	if retention <= 0 {
+		return
+	}
+	until := video.CreatedAt.Add(retention).UTC()
+	if video.LockedUntil == nil || until.After(*video.LockedUntil) {
+		video.LockedUntil = &until
+	}
+}
+
+// wormLocked reports whether a storage key belongs to a locked video
+func (sm *StreamManager) wormLocked(key string) bool {
+	fileID, ok := strings.CutSuffix(key, ".mp4")
+	if !ok {
+		return false
+	}
+	video, ok := sm.metadata.GetVideo(fileID)
+	return ok && video.Locked()
+}
+
+// WORMStorage will refuse to overwrite or delete the files of locked videos,
+// whichever driver is underneath
+type WORMStorage struct {
+	Storage
+	locked func(key string) bool
+}
+
+// NewWORMStorage will wrap s, locked tells the keys that can't change
+func NewWORMStorage(s Storage, locked func(key string) bool) *WORMStorage {
+	return &WORMStorage{Storage: s, locked: locked}
+}
+
+// Put is allowed for the first copy of a locked video, publishing it
+func (ws *WORMStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if ws.locked(key) {
+		if _, err := ws.Storage.Stat(ctx, key); err == nil {
+			return ErrWORMLocked
+		}
+	}
+	return ws.Storage.Put(ctx, key, r, size)
+}
+
+func (ws *WORMStorage) Delete(ctx context.Context, key string) error {
+	if ws.locked(key) {
+		return ErrWORMLocked
+	}
+	return ws.Storage.Delete(ctx, key)
+}
+
+// Unwrap will return the storage underneath
+func (ws *WORMStorage) Unwrap() Storage {
+	return ws.Storage
+}
+
+// lockedError will write the 409 for a change to a locked video
+func lockedError(w http.ResponseWriter, video VideoRecord) {
+	writeError(w, http.StatusConflict, "video is write once locked until "+video.LockedUntil.Format(time.RFC3339))
+}